@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Audit events
+const (
+	EventSuccess  = "auth_success"
+	EventFailure  = "auth_failure"
+	EventBanned   = "auth_banned"   // a remote address was banned
+	EventRejected = "auth_rejected" // an attempt of a banned address was rejected
+)
+
+// Authentication methods recorded in the audit log
+const (
+	MethodPassword    = "password"
+	MethodCertificate = "certificate"
+)
+
+// ErrBanned is returned for the attempts of a banned remote address
+var ErrBanned = errors.New("too many failed attempts")
+
+// AuditEvent is one line of the audit log
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Method string    `json:"method"`
+	User   string    `json:"user,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	// Ban is the ban started or remaining, in seconds
+	Ban float64 `json:"ban_seconds,omitempty"`
+}
+
+// AuditLog writes the authentication attempts as JSON lines
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditLog creates an audit log writing to w
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// Record writes event, a nil AuditLog records nothing
+func (a *AuditLog) Record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		authLog.Error("Failed to write auth audit log", "error", err)
+	}
+}
+
+// SetAuditLog records the authentication attempts in audit, nil disables it
+func (am *AuthManager) SetAuditLog(audit *AuditLog) {
+	am.audit = audit
+}
+
+// RemoteHost returns the host of a remote address, the throttled unit
+func RemoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// AuthenticateClient verifies the password of the user name for a client
+// connecting from remote. Remote addresses with repeated failures are banned
+// for a while, their attempts fail with ErrBanned without checking the
+// password. Every attempt is recorded in the audit log.
+func (am *AuthManager) AuthenticateClient(name, password, remote string) (bool, error) {
+	host := RemoteHost(remote)
+	if ban := am.throttle.Banned(host); ban > 0 {
+		am.audit.Record(AuditEvent{Event: EventRejected, Method: MethodPassword, User: name, Remote: remote, Ban: ban.Seconds()})
+		return false, fmt.Errorf("%w, retry in %v", ErrBanned, ban.Round(time.Second))
+	}
+
+	valid, err := am.VerifyUser(name, password)
+	if err != nil {
+		return false, err
+	}
+	if valid {
+		am.throttle.Success(host)
+		am.audit.Record(AuditEvent{Event: EventSuccess, Method: MethodPassword, User: name, Remote: remote})
+		return true, nil
+	}
+
+	am.audit.Record(AuditEvent{Event: EventFailure, Method: MethodPassword, User: name, Remote: remote})
+	if ban := am.throttle.Failure(host); ban > 0 {
+		am.audit.Record(AuditEvent{Event: EventBanned, Method: MethodPassword, User: name, Remote: remote, Ban: ban.Seconds()})
+	}
+	return false, nil
+}
+
+// RecordCertificateAuth records a client authenticated as the user name by
+// its TLS certificate
+func (am *AuthManager) RecordCertificateAuth(name, remote string) {
+	am.audit.Record(AuditEvent{Event: EventSuccess, Method: MethodCertificate, User: name, Remote: remote})
+}
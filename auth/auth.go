@@ -2,18 +2,21 @@ package auth
 
 import (
 	"bufio"
-	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
 
-	"golang.org/x/crypto/pbkdf2"
+	"ant-cache/logging"
+
 	"golang.org/x/term"
 )
 
+var authLog = logging.For(logging.Auth)
+
 const (
 	SaltLength = 32
 	KeyLength  = 32
@@ -23,6 +26,19 @@ const (
 type AuthManager struct {
 	passwordFile string
 	enabled      bool
+
+	// Users defined with ACL SETUSER, stored in usersFile
+	usersFile string
+	mu        sync.RWMutex
+	users     map[string]*User
+
+	// Credential of the default user, loaded once from the password file or
+	// set by SetPassword and SetCredential. Guarded by mu.
+	credential *Credential
+
+	// Remote addresses with repeated failures, and the audit log of attempts
+	throttle *Throttle
+	audit    *AuditLog
 }
 
 type PasswordData struct {
@@ -31,10 +47,20 @@ type PasswordData struct {
 }
 
 func NewAuthManager(passwordFile string, enabled bool) *AuthManager {
-	return &AuthManager{
+	am := &AuthManager{
 		passwordFile: passwordFile,
 		enabled:      enabled,
+		usersFile:    usersFileFor(passwordFile),
+		users:        make(map[string]*User),
+		throttle:     NewThrottle(),
+	}
+	if enabled {
+		if err := am.loadUsers(); err != nil {
+			// Users can be defined again, just print the error
+			authLog.Error("Failed to load users", "file", am.usersFile, "error", err)
+		}
 	}
+	return am
 }
 
 func (am *AuthManager) IsEnabled() bool {
@@ -45,6 +71,12 @@ func (am *AuthManager) HasPassword() bool {
 	if !am.enabled {
 		return false
 	}
+	am.mu.RLock()
+	credential := am.credential
+	am.mu.RUnlock()
+	if credential != nil {
+		return true
+	}
 	_, err := os.Stat(am.passwordFile)
 	return err == nil
 }
@@ -54,15 +86,12 @@ func (am *AuthManager) SetPassword(password string) error {
 		return fmt.Errorf("authentication is disabled")
 	}
 
-	// Generate random salt
-	salt := make([]byte, SaltLength)
-	if _, err := rand.Read(salt); err != nil {
-		return fmt.Errorf("failed to generate salt: %v", err)
+	// Generate password hash using PBKDF2 with a random salt
+	credential, err := NewCredential(password)
+	if err != nil {
+		return err
 	}
 
-	// Generate password hash using PBKDF2
-	hash := pbkdf2.Key([]byte(password), salt, Iterations, KeyLength, sha256.New)
-
 	// 保存到文件
 	file, err := os.Create(am.passwordFile)
 	if err != nil {
@@ -71,29 +100,98 @@ func (am *AuthManager) SetPassword(password string) error {
 	defer file.Close()
 
 	// Write salt and hash (hexadecimal format)
-	saltHex := hex.EncodeToString(salt)
-	hashHex := hex.EncodeToString(hash)
+	saltHex := hex.EncodeToString(credential.Salt)
+	hashHex := hex.EncodeToString(credential.Key)
 
 	if _, err := fmt.Fprintf(file, "%s\n%s\n", saltHex, hashHex); err != nil {
 		return fmt.Errorf("failed to write password file: %v", err)
 	}
 
+	am.mu.Lock()
+	am.credential = credential
+	am.mu.Unlock()
+	return nil
+}
+
+// SetSecret sets the password of the default user from a credential, in
+// memory only, or from a plain text password. The password file is only
+// written when a plain text password does not match it, not every time.
+func (am *AuthManager) SetSecret(secret string) error {
+	if IsCredential(secret) {
+		credential, err := ParseCredential(secret)
+		if err != nil {
+			return err
+		}
+		return am.SetCredential(credential)
+	}
+
+	if am.HasPassword() {
+		if valid, err := am.VerifyPassword(secret); err == nil && valid {
+			return nil
+		}
+	}
+	return am.SetPassword(secret)
+}
+
+// SetCredential makes credential the password of the default user, in memory
+// only: the password file is neither read nor written
+func (am *AuthManager) SetCredential(credential *Credential) error {
+	if !am.enabled {
+		return fmt.Errorf("authentication is disabled")
+	}
+	am.mu.Lock()
+	am.credential = credential
+	am.mu.Unlock()
 	return nil
 }
 
+// VerifyPassword checks password against the credential of the default user.
+// The password is derived on every attempt, only the credential is cached.
 func (am *AuthManager) VerifyPassword(password string) (bool, error) {
 	if !am.enabled {
 		return true, nil
 	}
 
+	credential, err := am.passwordCredential()
+	if err != nil {
+		return false, err
+	}
+	// Compared in constant time
+	return credential.Verify(password), nil
+}
+
+// passwordCredential returns the credential of the default user, read from
+// the password file the first time only
+func (am *AuthManager) passwordCredential() (*Credential, error) {
+	am.mu.RLock()
+	credential := am.credential
+	am.mu.RUnlock()
+	if credential != nil {
+		return credential, nil
+	}
+
 	if !am.HasPassword() {
-		return false, fmt.Errorf("no password set")
+		return nil, fmt.Errorf("no password set")
+	}
+	credential, err := am.readPasswordFile()
+	if err != nil {
+		return nil, err
 	}
 
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if am.credential == nil {
+		am.credential = credential
+	}
+	return am.credential, nil
+}
+
+// readPasswordFile reads the salt and the derived key of the password file
+func (am *AuthManager) readPasswordFile() (*Credential, error) {
 	// Read password file
 	file, err := os.Open(am.passwordFile)
 	if err != nil {
-		return false, fmt.Errorf("failed to open password file: %v", err)
+		return nil, fmt.Errorf("failed to open password file: %v", err)
 	}
 	defer file.Close()
 
@@ -101,45 +199,60 @@ func (am *AuthManager) VerifyPassword(password string) (bool, error) {
 
 	// Read salt
 	if !scanner.Scan() {
-		return false, fmt.Errorf("invalid password file format")
+		return nil, fmt.Errorf("invalid password file format")
 	}
 	saltHex := strings.TrimSpace(scanner.Text())
 
 	// Read hash
 	if !scanner.Scan() {
-		return false, fmt.Errorf("invalid password file format")
+		return nil, fmt.Errorf("invalid password file format")
 	}
 	hashHex := strings.TrimSpace(scanner.Text())
 
 	// Decode hexadecimal
 	salt, err := hex.DecodeString(saltHex)
 	if err != nil {
-		return false, fmt.Errorf("invalid salt format: %v", err)
+		return nil, fmt.Errorf("invalid salt format: %v", err)
 	}
 
 	expectedHash, err := hex.DecodeString(hashHex)
 	if err != nil {
-		return false, fmt.Errorf("invalid hash format: %v", err)
+		return nil, fmt.Errorf("invalid hash format: %v", err)
+	}
+	if len(expectedHash) != KeyLength {
+		return nil, fmt.Errorf("invalid hash length %d", len(expectedHash))
 	}
 
-	// Calculate hash of input password
-	actualHash := pbkdf2.Key([]byte(password), salt, Iterations, KeyLength, sha256.New)
+	return &Credential{Iterations: Iterations, Salt: salt, Key: expectedHash}, nil
+}
 
-	// 比较哈希
-	if len(actualHash) != len(expectedHash) {
-		return false, nil
-	}
+func (am *AuthManager) PromptPassword(prompt string) (string, error) {
+	return ReadPassword(prompt)
+}
 
-	for i := range actualHash {
-		if actualHash[i] != expectedHash[i] {
-			return false, nil
+// ReadPassword prompts for a password without echoing it on a terminal, and
+// reads one line of the standard input otherwise
+func ReadPassword(prompt string) (string, error) {
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		// Byte by byte, the lines after the password are left to the caller
+		var line []byte
+		b := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(b)
+			if n == 1 && b[0] != '\n' {
+				line = append(line, b[0])
+				continue
+			}
+			if n == 1 || err == io.EOF && len(line) > 0 {
+				return strings.TrimSuffix(string(line), "\r"), nil
+			}
+			if err == nil {
+				continue
+			}
+			return "", fmt.Errorf("failed to read password: %v", err)
 		}
 	}
 
-	return true, nil
-}
-
-func (am *AuthManager) PromptPassword(prompt string) (string, error) {
 	fmt.Print(prompt)
 
 	// Hide input
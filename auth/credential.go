@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// credentialScheme prefixes the credentials written by Credential.String
+const credentialScheme = "pbkdf2-sha256"
+
+// Credential is a password derived with PBKDF2-SHA256, written as
+// pbkdf2-sha256$iterations$salt$key with the salt and the key in hex.
+// It can be stored in the configuration instead of the password.
+type Credential struct {
+	Iterations int
+	Salt       []byte
+	Key        []byte
+}
+
+// NewCredential derives password with a new random salt
+func NewCredential(password string) (*Credential, error) {
+	salt := make([]byte, SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return &Credential{
+		Iterations: Iterations,
+		Salt:       salt,
+		Key:        deriveKey(password, salt, Iterations, KeyLength),
+	}, nil
+}
+
+// deriveKey derives the key of password with PBKDF2-SHA256, tests replace it
+// to count the derivations or make them cheaper
+var deriveKey = func(password string, salt []byte, iterations, keyLength int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, keyLength, sha256.New)
+}
+
+// IsCredential reports whether s is written like a credential rather than a
+// plain text password
+func IsCredential(s string) bool {
+	return strings.HasPrefix(s, credentialScheme+"$")
+}
+
+// ParseCredential parses a credential written by Credential.String
+func ParseCredential(s string) (*Credential, error) {
+	fields := strings.Split(s, "$")
+	if len(fields) != 4 || fields[0] != credentialScheme {
+		return nil, fmt.Errorf("invalid credential, expected %s$iterations$salt$key", credentialScheme)
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("invalid credential iterations %s", fields[1])
+	}
+	salt, err := hex.DecodeString(fields[2])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("invalid credential salt")
+	}
+	key, err := hex.DecodeString(fields[3])
+	if err != nil || len(key) != KeyLength {
+		return nil, fmt.Errorf("invalid credential key")
+	}
+	return &Credential{Iterations: iterations, Salt: salt, Key: key}, nil
+}
+
+// String writes the credential as pbkdf2-sha256$iterations$salt$key
+func (c *Credential) String() string {
+	return fmt.Sprintf("%s$%d$%s$%s", credentialScheme, c.Iterations,
+		hex.EncodeToString(c.Salt), hex.EncodeToString(c.Key))
+}
+
+// MarshalText writes the credential as String does, for the users file
+func (c *Credential) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText parses a credential written by MarshalText
+func (c *Credential) UnmarshalText(text []byte) error {
+	parsed, err := ParseCredential(string(text))
+	if err != nil {
+		return err
+	}
+	*c = *parsed
+	return nil
+}
+
+// Verify reports whether password derives to the key, compared in constant time
+func (c *Credential) Verify(password string) bool {
+	key := deriveKey(password, c.Salt, c.Iterations, len(c.Key))
+	return subtle.ConstantTimeCompare(key, c.Key) == 1
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxFailures is the number of failed attempts of a remote address before it is banned
+	MaxFailures = 5
+	// BanDuration is the first ban, each failure while banned or after a ban doubles it
+	BanDuration = 30 * time.Second
+	// MaxBanDuration bounds the bans
+	MaxBanDuration = time.Hour
+	// FailureWindow forgets the failures of an address after this long without one
+	FailureWindow = 15 * time.Minute
+
+	// maxThrottled bounds the addresses tracked. Expired ones are pruned
+	// first, then the oldest ones are evicted down to evictThrottled.
+	maxThrottled   = 10000
+	evictThrottled = maxThrottled * 9 / 10
+)
+
+// failureRecord holds the recent failed attempts of one remote address
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+	ban         time.Duration
+}
+
+// Throttle counts the failed authentication attempts per remote address and
+// bans the addresses with too many of them, with exponential backoff
+type Throttle struct {
+	mu      sync.Mutex
+	records map[string]*failureRecord
+	now     func() time.Time
+}
+
+// NewThrottle creates an empty throttle
+func NewThrottle() *Throttle {
+	return &Throttle{
+		records: make(map[string]*failureRecord),
+		now:     time.Now,
+	}
+}
+
+// Banned returns how long remote stays banned, 0 if it is not
+func (t *Throttle) Banned(remote string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := t.records[remote]
+	if r == nil {
+		return 0
+	}
+	if remaining := r.bannedUntil.Sub(t.now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Failure records a failed attempt of remote. Returns the ban it starts, 0 if
+// remote may still try again.
+func (t *Throttle) Failure(remote string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	r := t.records[remote]
+	if r == nil || (now.Sub(r.lastFailure) > FailureWindow && now.After(r.bannedUntil)) {
+		if len(t.records) >= maxThrottled {
+			t.pruneLocked(now)
+		}
+		r = &failureRecord{}
+		t.records[remote] = r
+	}
+	r.failures++
+	r.lastFailure = now
+	if r.failures < MaxFailures {
+		return 0
+	}
+
+	// Each failure once banned doubles the ban
+	if r.ban == 0 {
+		r.ban = BanDuration
+	} else {
+		r.ban = min(2*r.ban, MaxBanDuration)
+	}
+	r.bannedUntil = now.Add(r.ban)
+	return r.ban
+}
+
+// Success forgets the failed attempts of remote
+func (t *Throttle) Success(remote string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.records, remote)
+}
+
+// pruneLocked removes the addresses whose failures and ban expired. If too
+// many are left, those whose last failure is the oldest are removed too.
+func (t *Throttle) pruneLocked(now time.Time) {
+	for remote, r := range t.records {
+		if now.Sub(r.lastFailure) > FailureWindow && now.After(r.bannedUntil) {
+			delete(t.records, remote)
+		}
+	}
+	if len(t.records) < maxThrottled {
+		return
+	}
+
+	remotes := make([]string, 0, len(t.records))
+	for remote := range t.records {
+		remotes = append(remotes, remote)
+	}
+	sort.Slice(remotes, func(i, j int) bool {
+		return t.records[remotes[i]].lastFailure.Before(t.records[remotes[j]].lastFailure)
+	})
+	for _, remote := range remotes[:len(remotes)-evictThrottled] {
+		delete(t.records, remote)
+	}
+}
+
+// FailureDelay is how long a connection is refused AUTH after its failed
+// attempt number n, doubling from 100ms up to 5s
+func FailureDelay(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	delay := 100 * time.Millisecond
+	for i := 1; i < n && delay < 5*time.Second; i++ {
+		delay *= 2
+	}
+	return min(delay, 5*time.Second)
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestThrottle returns a throttle whose clock is read from *now
+func newTestThrottle(now *time.Time) *Throttle {
+	t := NewThrottle()
+	t.now = func() time.Time { return *now }
+	return t
+}
+
+func TestThrottleBan(t *testing.T) {
+	now := time.Unix(1000, 0)
+	th := newTestThrottle(&now)
+
+	for i := 1; i < MaxFailures; i++ {
+		if ban := th.Failure("10.0.0.1"); ban != 0 {
+			t.Fatalf("failure %d started a ban of %v", i, ban)
+		}
+	}
+	if ban := th.Failure("10.0.0.1"); ban != BanDuration {
+		t.Fatalf("failure %d ban = %v, want %v", MaxFailures, ban, BanDuration)
+	}
+	if ban := th.Banned("10.0.0.1"); ban != BanDuration {
+		t.Fatalf("Banned() = %v, want %v", ban, BanDuration)
+	}
+	if ban := th.Banned("10.0.0.2"); ban != 0 {
+		t.Fatalf("Banned() of another address = %v, want 0", ban)
+	}
+
+	// A failure after the ban doubles it
+	now = now.Add(BanDuration)
+	if ban := th.Failure("10.0.0.1"); ban != 2*BanDuration {
+		t.Fatalf("ban after a ban = %v, want %v", ban, 2*BanDuration)
+	}
+
+	// The failures are forgotten after FailureWindow, or on success
+	now = now.Add(2*BanDuration + FailureWindow + time.Second)
+	if ban := th.Failure("10.0.0.1"); ban != 0 {
+		t.Fatalf("ban after FailureWindow = %v, want 0", ban)
+	}
+	th.Success("10.0.0.1")
+	if len(th.records) != 0 {
+		t.Fatalf("records = %d after success, want 0", len(th.records))
+	}
+}
+
+func TestThrottleEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	th := newTestThrottle(&now)
+
+	// A failure of each address every 10ms, none expired
+	for i := 0; i < maxThrottled; i++ {
+		th.Failure(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		now = now.Add(time.Second / 100)
+	}
+	th.Failure("192.168.0.1")
+
+	if len(th.records) > evictThrottled+1 {
+		t.Fatalf("records = %d, want at most %d", len(th.records), evictThrottled+1)
+	}
+	for _, remote := range []string{"192.168.0.1", fmt.Sprintf("10.0.%d.%d", (maxThrottled-1)/256, (maxThrottled-1)%256)} {
+		if _, ok := th.records[remote]; !ok {
+			t.Errorf("the last failure of %s was evicted", remote)
+		}
+	}
+	if _, ok := th.records["10.0.0.0"]; ok {
+		t.Errorf("the oldest failure was kept")
+	}
+
+	// Expired records are pruned before the others are evicted
+	now = now.Add(FailureWindow + time.Minute)
+	for i := 0; len(th.records) < maxThrottled; i++ {
+		th.records[fmt.Sprintf("fresh-%d", i)] = &failureRecord{failures: 1, lastFailure: now}
+	}
+	th.Failure("192.168.0.2")
+	if _, ok := th.records["fresh-0"]; !ok {
+		t.Errorf("a record not expired was evicted while expired ones were left")
+	}
+}
+
+func TestFailureDelay(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{0, 0},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{6, 3200 * time.Millisecond},
+		{7, 5 * time.Second},
+		{1000, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := FailureDelay(tt.n); got != tt.want {
+			t.Errorf("FailureDelay(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
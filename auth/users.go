@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"ant-cache/utils"
+)
+
+// DefaultUser is the user authenticated by the password of auth.dat, it may
+// run every command on every key
+const DefaultUser = "default"
+
+// Command categories a user may be allowed to run
+const (
+	CategoryRead      = "read"
+	CategoryWrite     = "write"
+	CategoryAdmin     = "admin"
+	CategoryDangerous = "dangerous"
+	// CategoryAll allows every command, including the ones without a category
+	CategoryAll = "all"
+)
+
+var categories = map[string]bool{
+	CategoryRead: true, CategoryWrite: true, CategoryAdmin: true, CategoryDangerous: true, CategoryAll: true,
+}
+
+// User is a user defined with ACL SETUSER. A User is never modified once
+// stored, changes store a new one, so it can be used without locking.
+type User struct {
+	Name       string      `json:"name"`
+	Enabled    bool        `json:"enabled"`
+	Password   *Credential `json:"password,omitempty"`
+	Categories []string    `json:"categories"`
+	Keys       []string    `json:"keys"`
+}
+
+// AllowsCategory reports whether the user may run the commands of category,
+// an empty category is only allowed to users with CategoryAll
+func (u *User) AllowsCategory(category string) bool {
+	for _, c := range u.Categories {
+		if c == CategoryAll || (c == category && category != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsKey reports whether key matches one of the key patterns of the user
+func (u *User) AllowsKey(key string) bool {
+	for _, pattern := range u.Keys {
+		if pattern == "*" || utils.MatchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules describes the user with the rules of ACL SETUSER, without the password
+func (u *User) Rules() string {
+	rules := []string{"off"}
+	if u.Enabled {
+		rules[0] = "on"
+	}
+	for _, pattern := range u.Keys {
+		rules = append(rules, "~"+pattern)
+	}
+	for _, c := range u.Categories {
+		rules = append(rules, "+@"+c)
+	}
+	return strings.Join(rules, " ")
+}
+
+// applyRules returns a copy of u modified by rules:
+//
+//	on, off          enable or disable the user
+//	>password        set the password
+//	+@category       allow a category: read, write, admin, dangerous or all
+//	-@category       disallow a category
+//	allcommands      same as +@all
+//	nocommands       disallow every category
+//	~pattern         allow the keys matching a glob pattern
+//	allkeys          same as ~*
+//	resetkeys        disallow every key
+func (u *User) applyRules(rules []string) (*User, error) {
+	updated := *u
+	updated.Categories = append([]string(nil), u.Categories...)
+	updated.Keys = append([]string(nil), u.Keys...)
+
+	for _, rule := range rules {
+		switch {
+		case rule == "on":
+			updated.Enabled = true
+		case rule == "off":
+			updated.Enabled = false
+		case strings.HasPrefix(rule, ">"):
+			credential, err := NewCredential(rule[1:])
+			if err != nil {
+				return nil, err
+			}
+			updated.Password = credential
+		case strings.HasPrefix(rule, "+@"), strings.HasPrefix(rule, "-@"):
+			category := strings.ToLower(rule[2:])
+			if !categories[category] {
+				return nil, fmt.Errorf("unknown command category %s", category)
+			}
+			updated.Categories = removeString(updated.Categories, category)
+			if rule[0] == '+' {
+				updated.Categories = append(updated.Categories, category)
+			}
+		case rule == "allcommands":
+			updated.Categories = []string{CategoryAll}
+		case rule == "nocommands":
+			updated.Categories = nil
+		case strings.HasPrefix(rule, "~") && len(rule) > 1:
+			updated.Keys = append(removeString(updated.Keys, rule[1:]), rule[1:])
+		case rule == "allkeys":
+			updated.Keys = []string{"*"}
+		case rule == "resetkeys":
+			updated.Keys = nil
+		default:
+			return nil, fmt.Errorf("invalid rule %s", rule)
+		}
+	}
+	return &updated, nil
+}
+
+// removeString returns values without s
+func removeString(values []string, s string) []string {
+	kept := values[:0]
+	for _, v := range values {
+		if v != s {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// usersFileFor returns the file storing the users, next to the password file
+func usersFileFor(passwordFile string) string {
+	return filepath.Join(filepath.Dir(passwordFile), "users.dat")
+}
+
+// loadUsers reads the users file, a missing file holds no users
+func (am *AuthManager) loadUsers() error {
+	data, err := os.ReadFile(am.usersFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %v", err)
+	}
+
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("invalid users file: %v", err)
+	}
+	for _, u := range users {
+		am.users[u.Name] = u
+	}
+	return nil
+}
+
+// saveUsersLocked writes all the users to the users file.
+// The caller must hold am.mu.
+func (am *AuthManager) saveUsersLocked() error {
+	users := make([]*User, 0, len(am.users))
+	for _, u := range am.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Replaced atomically, readable by the owner only
+	tempFile := am.usersFile + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write users file: %v", err)
+	}
+	return os.Rename(tempFile, am.usersFile)
+}
+
+// SetUser creates the user name or modifies it with rules, see applyRules.
+// A new user starts disabled, without password, commands nor keys.
+func (am *AuthManager) SetUser(name string, rules []string) error {
+	if !am.enabled {
+		return fmt.Errorf("authentication is disabled")
+	}
+	if name == "" || name == DefaultUser {
+		return fmt.Errorf("the %s user is configured by the password", DefaultUser)
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[name]
+	if !exists {
+		user = &User{Name: name}
+	}
+	updated, err := user.applyRules(rules)
+	if err != nil {
+		return err
+	}
+
+	am.users[name] = updated
+	if err := am.saveUsersLocked(); err != nil {
+		// Keep the stored users and the file in sync
+		if exists {
+			am.users[name] = user
+		} else {
+			delete(am.users, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteUser deletes the user name, returns false if it does not exist
+func (am *AuthManager) DeleteUser(name string) (bool, error) {
+	if name == DefaultUser {
+		return false, fmt.Errorf("the %s user can not be deleted", DefaultUser)
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[name]
+	if !exists {
+		return false, nil
+	}
+	delete(am.users, name)
+	if err := am.saveUsersLocked(); err != nil {
+		am.users[name] = user
+		return false, err
+	}
+	return true, nil
+}
+
+// GetUser returns the user name, nil for DefaultUser which is not restricted.
+// Returns false if the user does not exist or is disabled.
+func (am *AuthManager) GetUser(name string) (*User, bool) {
+	if name == DefaultUser {
+		return nil, true
+	}
+
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[name]
+	if !exists || !user.Enabled {
+		return nil, false
+	}
+	return user, true
+}
+
+// Users returns all the users sorted by name
+func (am *AuthManager) Users() []*User {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	users := make([]*User, 0, len(am.users))
+	for _, u := range am.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// dummyCredential is verified for the unknown users and the users without a
+// password, so that AUTH takes as long for them as for the others
+var dummyCredential = &Credential{Iterations: Iterations, Salt: make([]byte, SaltLength), Key: make([]byte, KeyLength)}
+
+// VerifyUser checks the password of the user name. DefaultUser is verified
+// against the password of auth.dat, a disabled user never authenticates.
+// The password is derived whether the user exists or not, the time taken does
+// not tell which users exist.
+func (am *AuthManager) VerifyUser(name, password string) (bool, error) {
+	if name == DefaultUser {
+		return am.VerifyPassword(password)
+	}
+
+	am.mu.RLock()
+	user, exists := am.users[name]
+	am.mu.RUnlock()
+
+	if !exists || user.Password == nil {
+		dummyCredential.Verify(password)
+		return false, nil
+	}
+	return user.Password.Verify(password) && user.Enabled, nil
+}
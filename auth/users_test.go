@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		want    string
+		wantErr bool
+	}{
+		{"new user", nil, "off", false},
+		{"enabled", []string{"on"}, "on", false},
+		{"disabled again", []string{"on", "off"}, "off", false},
+		{"categories", []string{"+@read", "+@WRITE", "-@read"}, "off +@write", false},
+		{"all commands", []string{"+@read", "allcommands"}, "off +@all", false},
+		{"no commands", []string{"allcommands", "nocommands"}, "off", false},
+		{"keys", []string{"~app:*", "~cache:*", "~app:*"}, "off ~cache:* ~app:*", false},
+		{"all keys", []string{"~app:*", "allkeys"}, "off ~*", false},
+		{"reset keys", []string{"allkeys", "resetkeys"}, "off", false},
+		{"unknown category", []string{"+@unknown"}, "", true},
+		{"empty key pattern", []string{"~"}, "", true},
+		{"unknown rule", []string{"maybe"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := (&User{Name: "app"}).applyRules(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyRules(%v) error = %v, wantErr %v", tt.rules, err, tt.wantErr)
+			}
+			if err == nil && u.Rules() != tt.want {
+				t.Fatalf("applyRules(%v) rules = %q, want %q", tt.rules, u.Rules(), tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRulesDoesNotModifyUser(t *testing.T) {
+	u := &User{Name: "app", Categories: []string{CategoryRead}, Keys: []string{"a", "b"}}
+	if _, err := u.applyRules([]string{"on", ">secret", "-@read", "~c"}); err != nil {
+		t.Fatal(err)
+	}
+	if u.Enabled || u.Password != nil || u.Rules() != "off ~a ~b +@read" {
+		t.Fatalf("applyRules modified the user: %q, password %v", u.Rules(), u.Password)
+	}
+}
+
+func TestVerifyUser(t *testing.T) {
+	dir := t.TempDir()
+	am := NewAuthManager(filepath.Join(dir, "auth.dat"), true)
+	if err := am.SetPassword("root"); err != nil {
+		t.Fatal(err)
+	}
+	for name, rules := range map[string][]string{
+		"app":        {"on", ">secret", "+@read", "~*"},
+		"disabled":   {"off", ">secret"},
+		"nopassword": {"on"},
+	} {
+		if err := am.SetUser(name, rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"app", "secret", true},
+		{"app", "wrong", false},
+		{"app", "", false},
+		{"disabled", "secret", false},
+		{"nopassword", "", false},
+		{"unknown", "secret", false},
+		{DefaultUser, "root", true},
+		{DefaultUser, "secret", false},
+	}
+	check := func(t *testing.T, am *AuthManager) {
+		for _, tt := range tests {
+			if ok, err := am.VerifyUser(tt.user, tt.password); ok != tt.want || err != nil {
+				t.Errorf("VerifyUser(%q, %q) = %v, %v, want %v", tt.user, tt.password, ok, err, tt.want)
+			}
+		}
+	}
+	check(t, am)
+
+	// The users file holds the credentials, never the passwords
+	data, err := os.ReadFile(usersFileFor(filepath.Join(dir, "auth.dat")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") || !strings.Contains(string(data), `"password": "`+credentialScheme+"$") {
+		t.Fatalf("users file = %s, want credentials", data)
+	}
+
+	t.Run("reloaded", func(t *testing.T) {
+		check(t, NewAuthManager(filepath.Join(dir, "auth.dat"), true))
+	})
+}
+
+func TestCredentialText(t *testing.T) {
+	credential, err := NewCredential("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := credential.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed Credential
+	if err := parsed.UnmarshalText(text); err != nil {
+		t.Fatalf("UnmarshalText(%s) error = %v", text, err)
+	}
+	if !parsed.Verify("secret") || parsed.Verify("wrong") {
+		t.Fatal("the parsed credential does not verify like the original")
+	}
+
+	for _, invalid := range []string{"", "secret", credentialScheme + "$0$00$00", credentialScheme + "$1000$zz$00"} {
+		if err := parsed.UnmarshalText([]byte(invalid)); err == nil {
+			t.Errorf("UnmarshalText(%q) accepted an invalid credential", invalid)
+		}
+	}
+}
+
+// countDerivations replaces deriveKey for the test with a cheap derivation
+// and returns the number of derivations made
+func countDerivations(t *testing.T) *int {
+	t.Helper()
+	derive := deriveKey
+	t.Cleanup(func() { deriveKey = derive })
+	count := 0
+	deriveKey = func(password string, salt []byte, iterations, keyLength int) []byte {
+		count++
+		return derive(password, salt, 1, keyLength)
+	}
+	return &count
+}
+
+// TestVerifyUserDerivesForEveryUser checks that unknown, disabled and
+// passwordless users are refused after the same derivation as the others
+func TestVerifyUserDerivesForEveryUser(t *testing.T) {
+	count := countDerivations(t)
+	am := NewAuthManager(filepath.Join(t.TempDir(), "auth.dat"), true)
+	for name, rules := range map[string][]string{
+		"app":        {"on", ">secret"},
+		"disabled":   {"off", ">secret"},
+		"nopassword": {"on"},
+	} {
+		if err := am.SetUser(name, rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"app", "disabled", "nopassword", "unknown"} {
+		*count = 0
+		am.VerifyUser(name, "secret")
+		if *count != 1 {
+			t.Errorf("VerifyUser(%q) derived the password %d times, want 1", name, *count)
+		}
+	}
+}
+
+// TestVerifyPasswordDerivesEveryTime checks that the password file is read
+// once but the password is derived on every attempt, even a repeated one
+func TestVerifyPasswordDerivesEveryTime(t *testing.T) {
+	count := countDerivations(t)
+	path := filepath.Join(t.TempDir(), "auth.dat")
+	if err := NewAuthManager(path, true).SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	am := NewAuthManager(path, true)
+
+	for i, tt := range []struct {
+		password string
+		want     bool
+	}{{"secret", true}, {"secret", true}, {"wrong", false}, {"secret", true}} {
+		*count = 0
+		if ok, err := am.VerifyPassword(tt.password); ok != tt.want || err != nil {
+			t.Fatalf("attempt %d: VerifyPassword(%q) = %v, %v, want %v", i+1, tt.password, ok, err, tt.want)
+		}
+		if *count != 1 {
+			t.Errorf("attempt %d: derived the password %d times, want 1", i+1, *count)
+		}
+		// The credential stays in memory once read
+		os.Remove(path)
+	}
+}
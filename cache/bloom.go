@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bloom filters created by BFAdd on a missing key
+const (
+	DefaultBloomErrorRate = 0.01
+	DefaultBloomCapacity  = 100
+)
+
+// maxBloomBits bounds the size of a single filter (128MB)
+const maxBloomBits = 1 << 30
+
+// maxBloomHashes bounds the hash functions of a filter, enough for error
+// rates down to 2^-64
+const maxBloomHashes = 64
+
+var (
+	// ErrInvalidBloom is returned for an error rate outside (0, 1) or a non-positive capacity
+	ErrInvalidBloom = errors.New("error rate must be between 0 and 1 and capacity positive")
+	// ErrBloomTooLarge is returned when the filter for a capacity and error rate would exceed maxBloomBits
+	ErrBloomTooLarge = errors.New("bloom filter too large, raise the error rate or lower the capacity")
+	// ErrKeyExists is returned when reserving a key that already exists
+	ErrKeyExists = errors.New("key already exists")
+)
+
+// BloomFilter is the value stored for items of type "bloom": a set that may
+// report false positives, at ErrorRate once Capacity items were added, but
+// never false negatives
+type BloomFilter struct {
+	Capacity  int64
+	ErrorRate float64
+	// Items is the number of added items that set at least one bit
+	Items  int64
+	hashes uint32
+	bits   []uint64
+}
+
+// NewBloomFilter creates a filter sized for capacity items at errorRate
+func NewBloomFilter(errorRate float64, capacity int64) (*BloomFilter, error) {
+	// Written so that NaN is rejected too
+	if !(errorRate > 0 && errorRate < 1) || capacity <= 0 {
+		return nil, ErrInvalidBloom
+	}
+	// Optimal size m = -n*ln(p)/ln(2)^2 and hash count k = m/n*ln(2)
+	m := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	if !(m <= maxBloomBits) {
+		return nil, ErrBloomTooLarge
+	}
+	k := math.Min(maxBloomHashes, math.Max(1, math.Round(m/float64(capacity)*math.Ln2)))
+	return &BloomFilter{
+		Capacity:  capacity,
+		ErrorRate: errorRate,
+		hashes:    uint32(k),
+		bits:      make([]uint64, (int64(m)+63)/64),
+	}, nil
+}
+
+// positions calls fn with the bit of each hash function for the item hashed
+// to h1, h2, using double hashing
+func (b *BloomFilter) positions(h1, h2 uint64, fn func(word int, mask uint64) bool) bool {
+	size := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		bit := (h1 + i*h2) % size
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+// addHash adds an item by its hashes and reports whether a bit changed
+func (b *BloomFilter) addHash(h1, h2 uint64) bool {
+	changed := false
+	b.positions(h1, h2, func(word int, mask uint64) bool {
+		if b.bits[word]&mask == 0 {
+			b.bits[word] |= mask
+			changed = true
+		}
+		return true
+	})
+	if changed {
+		b.Items++
+	}
+	return changed
+}
+
+// Add adds item and reports whether it was definitely not present before
+func (b *BloomFilter) Add(item string) bool {
+	return b.addHash(hashItem(item))
+}
+
+// Exists reports whether item may have been added, false means it never was
+func (b *BloomFilter) Exists(item string) bool {
+	h1, h2 := hashItem(item)
+	return b.positions(h1, h2, func(word int, mask uint64) bool {
+		return b.bits[word]&mask != 0
+	})
+}
+
+// String returns the capacity, error rate and item count, as reported for GET
+func (b *BloomFilter) String() string {
+	return fmt.Sprintf("%d %s %d", b.Capacity, strconv.FormatFloat(b.ErrorRate, 'g', -1, 64), b.Items)
+}
+
+// marshalBinary serializes the filter parameters and bits
+func (b *BloomFilter) marshalBinary() []byte {
+	buf := make([]byte, 0, 32+len(b.bits)*8)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(b.Capacity))
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(b.ErrorRate))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(b.Items))
+	buf = binary.BigEndian.AppendUint32(buf, b.hashes)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.bits)))
+	for _, word := range b.bits {
+		buf = binary.BigEndian.AppendUint64(buf, word)
+	}
+	return buf
+}
+
+// unmarshalBloomFilter parses a filter written by marshalBinary
+func unmarshalBloomFilter(data []byte) (*BloomFilter, error) {
+	if len(data) < 32 {
+		return nil, errors.New("invalid bloom filter length")
+	}
+	b := &BloomFilter{
+		Capacity:  int64(binary.BigEndian.Uint64(data[0:])),
+		ErrorRate: math.Float64frombits(binary.BigEndian.Uint64(data[8:])),
+		Items:     int64(binary.BigEndian.Uint64(data[16:])),
+		hashes:    binary.BigEndian.Uint32(data[24:]),
+	}
+	if b.hashes == 0 || b.hashes > maxBloomHashes {
+		return nil, errors.New("invalid bloom filter hash count")
+	}
+	words := int(binary.BigEndian.Uint32(data[28:]))
+	if words == 0 || words > maxBloomBits/64 || len(data) != 32+words*8 {
+		return nil, errors.New("invalid bloom filter length")
+	}
+	b.bits = make([]uint64, words)
+	for i := range b.bits {
+		b.bits[i] = binary.BigEndian.Uint64(data[32+i*8:])
+	}
+	return b, nil
+}
+
+// formatBloomParams formats the parameters of a reserved filter for the ACL
+func formatBloomParams(errorRate float64, capacity int64) string {
+	return strconv.FormatFloat(errorRate, 'g', -1, 64) + ":" + strconv.FormatInt(capacity, 10)
+}
+
+// parseBloomParams parses parameters written by formatBloomParams
+func parseBloomParams(s string) (float64, int64, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid bloom filter parameters: %s", s)
+	}
+	errorRate, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	capacity, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return errorRate, capacity, nil
+}
+
+// formatBloomHashes formats item hashes for the ACL, two per item
+func formatBloomHashes(h1, h2 uint64) []string {
+	return []string{strconv.FormatUint(h1, 16) + ":" + strconv.FormatUint(h2, 16)}
+}
+
+// parseBloomHashes parses item hashes written by formatBloomHashes
+func parseBloomHashes(formatted []string) [][2]uint64 {
+	var hashes [][2]uint64
+	for _, s := range formatted {
+		pair := strings.SplitN(s, ":", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		h1, err1 := strconv.ParseUint(pair[0], 16, 64)
+		h2, err2 := strconv.ParseUint(pair[1], 16, 64)
+		if err1 == nil && err2 == nil {
+			hashes = append(hashes, [2]uint64{h1, h2})
+		}
+	}
+	return hashes
+}
+
+// valueBloom returns the filter held by item, false if item is nil or holds another type
+func (item *CacheItem) valueBloom() (*BloomFilter, bool) {
+	if item == nil {
+		return nil, false
+	}
+	b, ok := item.Value.(*BloomFilter)
+	return b, ok
+}
+
+// getBloomLocked returns the filter stored at key, nil if the key does not exist.
+// The caller must hold the cache lock.
+func (c *Cache) getBloomLocked(key string, now int64) (*BloomFilter, error) {
+	item := c.liveItemLocked(key, now)
+	if item == nil {
+		return nil, nil
+	}
+	b, ok := item.Value.(*BloomFilter)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return b, nil
+}
+
+// BFReserve creates an empty filter at key sized for capacity items at errorRate
+func (c *Cache) BFReserve(key string, errorRate float64, capacity int64, ttl time.Duration) error {
+	b, err := NewBloomFilter(errorRate, capacity)
+	if err != nil {
+		return err
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	if c.liveItemLocked(key, time.Now().UnixNano()) != nil {
+		return ErrKeyExists
+	}
+	c.storeItemLocked(key, &CacheItem{Value: b, Type: "bloom"}, ttl)
+
+	c.logCommand(CMD_BFRESERVE, key, formatBloomParams(errorRate, capacity), ttl)
+	return nil
+}
+
+// BFAdd adds item to the filter at key, creating a default filter if needed.
+// Returns true if the item was definitely not present before.
+func (c *Cache) BFAdd(key, item string, ttl time.Duration) (bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	b, err := c.getBloomLocked(key, time.Now().UnixNano())
+	if err != nil {
+		return false, err
+	}
+	created := b == nil
+	if created {
+		b, _ = NewBloomFilter(DefaultBloomErrorRate, DefaultBloomCapacity)
+		c.storeItemLocked(key, &CacheItem{Value: b, Type: "bloom"}, 0)
+	}
+
+	h1, h2 := hashItem(item)
+	added := b.addHash(h1, h2)
+	c.touchExpirationLocked(c.items[key], ttl)
+	if added {
+		c.touchVersionLocked(c.items[key])
+	}
+
+	if created || added || ttl > 0 {
+		c.logCommand(CMD_BFADD, key, formatBloomHashes(h1, h2), ttl)
+	}
+	return added, nil
+}
+
+// BFExists reports whether item may have been added to the filter at key
+func (c *Cache) BFExists(key, item string) (bool, error) {
+	c.rlock()
+	defer c.runlock()
+
+	b, err := c.getBloomLocked(key, time.Now().UnixNano())
+	if err != nil || b == nil {
+		return false, err
+	}
+	return b.Exists(item), nil
+}
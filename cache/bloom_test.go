@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewBloomFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		errorRate float64
+		capacity  int64
+		err       error
+	}{
+		{"default", DefaultBloomErrorRate, DefaultBloomCapacity, nil},
+		{"tiny error rate", 1e-300, 100, nil},
+		{"smallest error rate", math.SmallestNonzeroFloat64, 1, nil},
+		{"NaN error rate", math.NaN(), 100, ErrInvalidBloom},
+		{"infinite error rate", math.Inf(1), 100, ErrInvalidBloom},
+		{"negative infinite error rate", math.Inf(-1), 100, ErrInvalidBloom},
+		{"zero error rate", 0, 100, ErrInvalidBloom},
+		{"error rate of one", 1, 100, ErrInvalidBloom},
+		{"zero capacity", 0.01, 0, ErrInvalidBloom},
+		{"negative capacity", 0.01, -1, ErrInvalidBloom},
+		{"too large", 0.01, math.MaxInt64, ErrBloomTooLarge},
+		{"too large for the error rate", 1e-300, 1 << 30, ErrBloomTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBloomFilter(tt.errorRate, tt.capacity)
+			if err != tt.err {
+				t.Fatalf("NewBloomFilter(%v, %d) error = %v, want %v", tt.errorRate, tt.capacity, err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if b.hashes < 1 || b.hashes > maxBloomHashes {
+				t.Errorf("hashes = %d, want between 1 and %d", b.hashes, maxBloomHashes)
+			}
+			if bits := len(b.bits) * 64; bits > maxBloomBits {
+				t.Errorf("bits = %d, want at most %d", bits, maxBloomBits)
+			}
+		})
+	}
+}
+
+func TestBFReserveNaN(t *testing.T) {
+	c := New()
+	// BF.RESERVE k nan 100 used to reach makeslice with a NaN size
+	if err := c.BFReserve("k", math.NaN(), 100, 0); err != ErrInvalidBloom {
+		t.Fatalf("BFReserve() error = %v, want %v", err, ErrInvalidBloom)
+	}
+	if ok, err := c.BFExists("k", "item"); ok || err != nil {
+		t.Fatalf("BFExists() = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestBloomFilterMarshal(t *testing.T) {
+	b, err := NewBloomFilter(0.01, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add("item")
+	data := b.marshalBinary()
+
+	loaded, err := unmarshalBloomFilter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.hashes != b.hashes || len(loaded.bits) != len(b.bits) || !loaded.Exists("item") {
+		t.Fatalf("unmarshalBloomFilter() = %+v, want %+v", loaded, b)
+	}
+
+	// A corrupt hash count must not make lookups loop for billions of hashes
+	data[24], data[25], data[26], data[27] = 0xFF, 0xFF, 0xFF, 0xFF
+	if _, err := unmarshalBloomFilter(data); err == nil {
+		t.Fatal("unmarshalBloomFilter() accepted a corrupt hash count")
+	}
+}
@@ -2,10 +2,14 @@ package cache
 
 import (
 	"ant-cache/auth"
+	"ant-cache/logging"
+	"ant-cache/utils"
 	"bytes"
 	"container/heap"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,9 +18,15 @@ type CacheItem struct {
 	Expiration int64
 	index      int    // for heap operations
 	key        string // for deletion operations
-	Type       string // string, array, object
+	Type       string // string, array, object, zset, set, lock, ratelimit, hyperloglog, bloom, stream
+	Version    uint64 // changes on every write of the key, used by WATCH
 }
 
+var cacheLog = logging.For(logging.Cache)
+
+// ErrWrongType is returned when a command is used against a key holding another data type
+var ErrWrongType = errors.New("WRONGTYPE operation against a key holding the wrong kind of value")
+
 // Memory pools for reducing GC pressure
 var (
 	// Buffer pool for string operations
@@ -43,7 +53,7 @@ var (
 
 // BatchOperation represents a batch of cache operations
 type BatchOperation struct {
-	Type  string // SET, GET, DEL
+	Type  string // SET, SETNX, GET, DEL
 	Key   string
 	Value interface{}
 	TTL   time.Duration
@@ -56,11 +66,31 @@ type BatchResult struct {
 	Error   string
 }
 
+// Cache is a view of one logical database. Views of the other databases are
+// returned by Select and share the lock, the persistence and the settings.
 type Cache struct {
+	*database
+	// tx collects the writes of an Atomic block, nil outside of one
+	tx *txLog
+}
+
+// database is a logical database: a keyspace of its own in the shared store
+type database struct {
+	*store
+	index int
 	items map[string]*CacheItem
-	mu    sync.RWMutex
 	// Min heap for expiration times, used to quickly find the earliest expiring items
 	expirationHeap *ExpirationHeap
+	// Clients blocked until one of their keys is written, see blockOn
+	waiters map[string][]*keyWaiter
+	// Clients blocked in BLPop or BRPop, in arrival order, see serveBlockedPopsLocked
+	popWaiters map[string][]*popWaiter
+}
+
+// store holds the cache state shared by all the databases and their Atomic views
+type store struct {
+	mu        sync.RWMutex
+	databases []*database
 	// Persistence manager for data persistence
 	persistence *PersistenceManager
 	// Authentication manager
@@ -71,6 +101,14 @@ type Cache struct {
 	batchWorkers int
 	// Compression configuration
 	compressionConfig CompressionConfig
+	// Last version assigned to a written item
+	version uint64
+	// Last fencing token handed out by Lock, persisted so it never goes back
+	lockToken uint64
+	// Protects the waiters of all the databases
+	waitMu sync.Mutex
+	// Statistics of all the databases, see Stats
+	hits, misses, expiredKeys uint64
 }
 
 // ExpirationHeap implements min heap for managing expiration times
@@ -112,14 +150,15 @@ func (h *ExpirationHeap) Remove(item *CacheItem) {
 	}
 }
 
+// New creates a cache with Databases logical databases and returns a view of database 0
 func New() *Cache {
-	h := &ExpirationHeap{}
-	heap.Init(h)
-	return &Cache{
-		items:             make(map[string]*CacheItem),
-		expirationHeap:    h,
-		compressionConfig: DefaultCompressionConfig(),
+	s := &store{compressionConfig: DefaultCompressionConfig()}
+	for i := 0; i < Databases; i++ {
+		db := &database{store: s, index: i}
+		db.clearLocked()
+		s.databases = append(s.databases, db)
 	}
+	return &Cache{database: s.databases[0]}
 }
 
 // NewWithPersistence create cache with persistence
@@ -130,12 +169,12 @@ func NewWithPersistence(atdPath, aclPath string, atdInterval, aclInterval time.D
 		// Load data when starting
 		if err := cache.persistence.LoadAtd(); err != nil {
 			// Loading data does not affect startup, just print the error
-			fmt.Printf("Failed to load ATD: %v\n", err)
+			persistenceLog.Error("Failed to load ATD snapshot", "file", atdPath, "error", err)
 		}
 		// Load command log
 		if err := cache.persistence.LoadAcl(); err != nil {
 			// Loading command log does not affect startup, just print the error
-			fmt.Printf("Failed to load ACL: %v\n", err)
+			persistenceLog.Error("Failed to load ACL", "file", aclPath, "error", err)
 		}
 		// Start persistence manager
 		cache.persistence.Start()
@@ -159,15 +198,14 @@ func (c *Cache) Close() {
 
 // SetCompressionConfig sets the compression configuration
 func (c *Cache) SetCompressionConfig(config CompressionConfig) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.lock()
+	defer c.unlock()
 	c.compressionConfig = config
 }
 
-func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
+// newValueItem creates the item for a string, array or object value,
+// compressing it when compression is enabled
+func (c *Cache) newValueItem(key string, value interface{}) *CacheItem {
 	// Determine data type
 	var dataType string
 	switch value.(type) {
@@ -183,125 +221,99 @@ func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
 	compressedValue, err := CompressValue(value, dataType, c.compressionConfig)
 	if err != nil {
 		// If compression fails, use the original value
-		fmt.Printf("Compression failed for key %s: %v\n", key, err)
+		cacheLog.Warn("Compression failed, storing the value uncompressed", "key", key, "error", err)
 		compressedValue = value
 	}
 
-	item := &CacheItem{
+	return &CacheItem{
 		Value: compressedValue,
 		key:   key,
 		Type:  dataType,
 	}
+}
 
-	// Only set expiration time when ttl > 0
-	if ttl > 0 {
-		item.Expiration = time.Now().Add(ttl).UnixNano()
-		// Add to expiration heap
-		heap.Push(c.expirationHeap, item)
-	}
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	c.lock()
+	defer c.unlock()
 
-	c.items[key] = item
+	// Replaces the previous item and its expiration heap entry
+	c.storeItemLocked(key, c.newValueItem(key, value), ttl)
 
 	// Removed stats tracking
 
 	// Log the set command to the command log
-	if c.persistence != nil {
-		c.persistence.LogCommand("SET", key, value, ttl)
+	c.logCommand("SET", key, value, ttl)
+
+	if _, ok := value.([]string); ok {
+		c.serveBlockedPopsLocked(key)
 	}
 }
 
 // SetNX sets a key only if it doesn't exist (atomic operation)
 func (c *Cache) SetNX(key string, value interface{}, ttl time.Duration) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.lock()
+	defer c.unlock()
 
 	// Check if key already exists and is not expired
-	if item, exists := c.items[key]; exists {
-		// Check if item is expired
-		if item.Expiration > 0 && time.Now().UnixNano() > item.Expiration {
-			// Item is expired, we can set it
-		} else {
-			// Key exists and is not expired, return false
-			return false
-		}
+	if c.liveItemLocked(key, time.Now().UnixNano()) != nil {
+		// Key exists and is not expired, return false
+		return false
 	}
 
-	// Determine data type
-	var dataType string
-	switch value.(type) {
-	case []string:
-		dataType = "array"
-	case map[string]string:
-		dataType = "object"
-	default:
-		dataType = "string"
-	}
-
-	// Try to compress the value if compression is enabled
-	compressedValue, err := CompressValue(value, dataType, c.compressionConfig)
-	if err != nil {
-		// If compression fails, use the original value
-		fmt.Printf("Compression failed for key %s: %v\n", key, err)
-		compressedValue = value
-	}
-
-	item := &CacheItem{
-		Value: compressedValue,
-		key:   key,
-		Type:  dataType,
-	}
-
-	// Only set expiration time when ttl > 0
-	if ttl > 0 {
-		item.Expiration = time.Now().Add(ttl).UnixNano()
-		// Add to expiration heap
-		heap.Push(c.expirationHeap, item)
-	}
-
-	c.items[key] = item
+	// An expired item is replaced together with its expiration heap entry
+	c.storeItemLocked(key, c.newValueItem(key, value), ttl)
 
 	// Log the set command to the command log
-	if c.persistence != nil {
-		c.persistence.LogCommand("SETNX", key, value, ttl)
+	c.logCommand("SETNX", key, value, ttl)
+
+	if _, ok := value.([]string); ok {
+		c.serveBlockedPopsLocked(key)
 	}
 
 	return true
 }
 
+// Get returns the value of key, the types modified in place are returned as
+// summarized by summaryValue
 func (c *Cache) Get(key string) (interface{}, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.rlock()
+	defer c.runlock()
 
 	item, found := c.items[key]
 	if !found {
-		// stats tracking removed
+		atomic.AddUint64(&c.misses, 1)
 		return nil, false
 	}
 
 	if item.Expiration > 0 && time.Now().UnixNano() > item.Expiration {
-		// stats tracking removed
+		atomic.AddUint64(&c.misses, 1)
 		return nil, false
 	}
+	atomic.AddUint64(&c.hits, 1)
 
 	// Try to decompress the value if it's compressed
 	decompressedValue, _, err := DecompressValue(item.Value)
 	if err != nil {
 		// If decompression fails, return the original value
-		fmt.Printf("Decompression failed for key %s: %v\n", key, err)
-		return item.Value, true
+		cacheLog.Warn("Decompression failed", "key", key, "error", err)
+		return summaryValue(item.Value), true
 	}
 
-	// Removed stats tracking
-	return decompressedValue, true
+	return summaryValue(decompressedValue), true
 }
 
 // GetMultiple gets multiple keys at once
 func (c *Cache) GetMultiple(keys []string) map[string]interface{} {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.rlock()
+	defer c.runlock()
 
 	result := make(map[string]interface{})
 	now := time.Now().UnixNano()
+	hits := 0
+	defer func() {
+		atomic.AddUint64(&c.hits, uint64(hits))
+		atomic.AddUint64(&c.misses, uint64(len(keys)-hits))
+	}()
 
 	for _, key := range keys {
 		if item, found := c.items[key]; found {
@@ -309,15 +321,16 @@ func (c *Cache) GetMultiple(keys []string) map[string]interface{} {
 			if item.Expiration > 0 && now > item.Expiration {
 				continue // Skip expired items
 			}
+			hits++
 
 			// Try to decompress the value if it's compressed
 			decompressedValue, _, err := DecompressValue(item.Value)
 			if err != nil {
 				// If decompression fails, use the original value
-				fmt.Printf("Decompression failed for key %s: %v\n", key, err)
-				result[key] = item.Value
+				cacheLog.Warn("Decompression failed", "key", key, "error", err)
+				result[key] = summaryValue(item.Value)
 			} else {
-				result[key] = decompressedValue
+				result[key] = summaryValue(decompressedValue)
 			}
 		}
 	}
@@ -325,9 +338,115 @@ func (c *Cache) GetMultiple(keys []string) map[string]interface{} {
 	return result
 }
 
+// summaryValue returns what Get and GetAllKeys report for value, built under
+// the lock as the types below are modified in place: the ordered members of
+// sets, the state or count of the other types. Strings, arrays and objects are
+// replaced on write and returned as is.
+func summaryValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case MemberSet:
+		return v.Members()
+	case *SortedSet:
+		return v.Members()
+	case *LockState:
+		return v.Token
+	case *RateLimiter:
+		return v.encode()
+	case *HyperLogLog:
+		return v.Count()
+	case *BloomFilter:
+		return v.String()
+	case *Stream:
+		return v.Len()
+	default:
+		return value
+	}
+}
+
+// MGet returns the values of keys in order, nil for missing or expired keys
+func (c *Cache) MGet(keys []string) []interface{} {
+	found := c.GetMultiple(keys)
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = found[key]
+	}
+	return values
+}
+
+// MSet sets all keys under one lock acquisition and logs them to the ACL as a
+// single batch, so either all or none of them are replayed
+func (c *Cache) MSet(keys []string, values []interface{}, ttl time.Duration) {
+	c.lock()
+	defer c.unlock()
+
+	c.msetLocked(keys, values, ttl, CMD_SET)
+}
+
+// MSetNX sets all keys only if none of them exists, returns false and sets
+// nothing otherwise
+func (c *Cache) MSetNX(keys []string, values []interface{}, ttl time.Duration) bool {
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	for _, key := range keys {
+		if c.liveItemLocked(key, now) != nil {
+			return false
+		}
+	}
+
+	c.msetLocked(keys, values, ttl, CMD_SETNX)
+	return true
+}
+
+// msetLocked stores values at keys and logs them as one ACL batch.
+// The caller must hold the write lock.
+func (c *Cache) msetLocked(keys []string, values []interface{}, ttl time.Duration, cmdType string) {
+	batch := make([]Command, 0, len(keys))
+	for i, key := range keys {
+		c.storeItemLocked(key, c.newValueItem(key, values[i]), ttl)
+		batch = append(batch, Command{Type: cmdType, Key: key, Value: values[i], TTL: ttl})
+	}
+
+	c.logBatch(batch)
+
+	// Arrays may be waited for by BLPOP and BRPOP
+	for i, key := range keys {
+		if _, ok := values[i].([]string); ok {
+			c.serveBlockedPopsLocked(key)
+		}
+	}
+}
+
+// DeleteMultiple deletes keys under one lock acquisition and returns how many
+// existed. The deletions are logged to the ACL as a single batch.
+func (c *Cache) DeleteMultiple(keys []string) int {
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	deleted := 0
+	var batch []Command
+	for _, key := range keys {
+		if _, exists := c.items[key]; !exists {
+			continue
+		}
+		if c.liveItemLocked(key, now) != nil {
+			deleted++
+		}
+		c.removeItemLocked(key)
+		batch = append(batch, Command{Type: CMD_DEL, Key: key, Value: ""})
+	}
+
+	if len(batch) > 0 {
+		c.logBatch(batch)
+	}
+	return deleted
+}
+
 func (c *Cache) Delete(key string) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.lock()
+	defer c.unlock()
 
 	if item, exists := c.items[key]; exists {
 		// If has expiration time, remove from heap
@@ -339,41 +458,116 @@ func (c *Cache) Delete(key string) bool {
 		// Removed stats tracking
 
 		// Log the delete command to the command log
-		if c.persistence != nil {
-			c.persistence.LogCommand("DEL", key, "", 0)
-		}
+		c.logCommand("DEL", key, "", 0)
 		return true
 	}
 	return false
 }
 
+// liveItemLocked returns the item stored at key, nil if it does not exist or
+// has expired. The caller must hold the cache lock.
+func (c *Cache) liveItemLocked(key string, now int64) *CacheItem {
+	item, exists := c.items[key]
+	if !exists {
+		return nil
+	}
+	if item.Expiration > 0 && now > item.Expiration {
+		return nil
+	}
+	return item
+}
+
+// storeItemLocked stores item at key replacing any previous item, and sets its
+// expiration when ttl > 0. The caller must hold the write lock.
+func (c *Cache) storeItemLocked(key string, item *CacheItem, ttl time.Duration) {
+	c.removeItemLocked(key)
+	item.key = key
+	if ttl > 0 {
+		item.Expiration = time.Now().Add(ttl).UnixNano()
+		heap.Push(c.expirationHeap, item)
+	}
+	c.touchVersionLocked(item)
+	c.items[key] = item
+}
+
+// touchVersionLocked gives item a new version after it has been written.
+// The caller must hold the write lock.
+func (c *Cache) touchVersionLocked(item *CacheItem) {
+	c.version++
+	item.Version = c.version
+}
+
+// KeyVersion returns the version of the item stored at key, 0 if the key does
+// not exist or has expired. Any write of the key changes its version.
+func (c *Cache) KeyVersion(key string) uint64 {
+	c.rlock()
+	defer c.runlock()
+
+	item := c.liveItemLocked(key, time.Now().UnixNano())
+	if item == nil {
+		return 0
+	}
+	return item.Version
+}
+
+// touchExpirationLocked moves the expiration of item to now + ttl, nothing is
+// changed when ttl <= 0. The caller must hold the write lock.
+func (c *Cache) touchExpirationLocked(item *CacheItem, ttl time.Duration) {
+	if item == nil || ttl <= 0 {
+		return
+	}
+	expiration := time.Now().Add(ttl).UnixNano()
+	if item.Expiration > 0 && item.index >= 0 {
+		item.Expiration = expiration
+		heap.Fix(c.expirationHeap, item.index)
+		return
+	}
+	item.Expiration = expiration
+	heap.Push(c.expirationHeap, item)
+}
+
+// removeItemLocked deletes key and its expiration heap entry.
+// The caller must hold the write lock.
+func (c *Cache) removeItemLocked(key string) {
+	item, exists := c.items[key]
+	if !exists {
+		return
+	}
+	if item.Expiration > 0 && item.index >= 0 {
+		heap.Remove(c.expirationHeap, item.index)
+	}
+	delete(c.items, key)
+}
+
 // DeleteString method removed - use Delete instead
 
 // DeleteArray method removed - use Delete instead
 
 // DeleteObject method removed - use Delete instead
 
+// Cleanup removes the expired items of all the databases
 func (c *Cache) Cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.lock()
+	defer c.unlock()
 
 	now := time.Now().UnixNano()
 
-	// Only check the top of the heap for expired items, avoid traversing all keys
-	for c.expirationHeap.Len() > 0 {
-		item := (*c.expirationHeap)[0]
-		if item.Expiration > now {
-			// Top item not expired yet, stop checking
-			break
-		}
+	for _, db := range c.databases {
+		// Only check the top of the heap for expired items, avoid traversing all keys
+		for db.expirationHeap.Len() > 0 {
+			item := (*db.expirationHeap)[0]
+			if item.Expiration > now {
+				// Top item not expired yet, stop checking
+				break
+			}
 
-		heap.Pop(c.expirationHeap)
-		delete(c.items, item.key)
+			heap.Pop(db.expirationHeap)
+			delete(db.items, item.key)
+			atomic.AddUint64(&c.expiredKeys, 1)
+		}
 	}
 }
 
-// GetStats method removed
-
 // GetAuthManager obtain the authentication manager
 func (c *Cache) GetAuthManager() *auth.AuthManager {
 	return c.authManager
@@ -381,8 +575,14 @@ func (c *Cache) GetAuthManager() *auth.AuthManager {
 
 // Keys returns all keys matching the pattern (optimized with memory pool)
 func (c *Cache) Keys(pattern string) []string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	return c.KeysByType(pattern, "")
+}
+
+// KeysByType returns all keys matching the glob pattern whose data type is
+// dataType, an empty dataType matches every type
+func (c *Cache) KeysByType(pattern, dataType string) []string {
+	c.rlock()
+	defer c.runlock()
 
 	// Get slice from pool
 	keys := stringSlicePool.Get().([]string)
@@ -397,11 +597,14 @@ func (c *Cache) Keys(pattern string) []string {
 			continue
 		}
 
-		// Simple pattern matching (only supports "*" for all keys)
-		if pattern == "*" {
+		if dataType != "" && item.Type != dataType {
+			continue
+		}
+
+		// Glob pattern matching ("*" matches all keys)
+		if pattern == "*" || utils.MatchPattern(pattern, key) {
 			keys = append(keys, key)
 		}
-		// Could add more pattern matching logic here if needed
 	}
 
 	// Return a copy since we're putting the slice back to pool
@@ -430,6 +633,7 @@ func GetCacheItem() *CacheItem {
 	item.index = 0
 	item.key = ""
 	item.Type = ""
+	item.Version = 0
 	return item
 }
 
@@ -438,78 +642,52 @@ func PutCacheItem(item *CacheItem) {
 	itemPool.Put(item)
 }
 
-// BatchExecute executes a batch of operations atomically
+// BatchExecute executes a batch of operations atomically. The writes are
+// logged to the ACL as a single batch.
 func (c *Cache) BatchExecute(operations []BatchOperation) []BatchResult {
 	results := make([]BatchResult, len(operations))
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	now := time.Now().UnixNano()
-
-	for i, op := range operations {
-		switch op.Type {
-		case "SET":
-			item := GetCacheItem()
-			item.Value = op.Value
-			item.key = op.Key
-			item.Type = "string"
-
-			if op.TTL > 0 {
-				item.Expiration = now + op.TTL.Nanoseconds()
-				heap.Push(c.expirationHeap, item)
-			}
+	c.Atomic(func(tx *Cache) {
+		for i, op := range operations {
+			switch op.Type {
+			case "SET":
+				tx.Set(op.Key, op.Value, op.TTL)
+				results[i] = BatchResult{Success: true}
 
-			// Remove old item if exists
-			if oldItem, exists := c.items[op.Key]; exists {
-				if oldItem.Expiration > 0 {
-					c.expirationHeap.Remove(oldItem)
+			case "SETNX":
+				if tx.SetNX(op.Key, op.Value, op.TTL) {
+					results[i] = BatchResult{Success: true}
+				} else {
+					results[i] = BatchResult{Success: false, Error: "key exists"}
 				}
-				PutCacheItem(oldItem)
-			}
 
-			c.items[op.Key] = item
-			results[i] = BatchResult{Success: true}
-
-		case "GET":
-			if item, exists := c.items[op.Key]; exists {
-				if item.Expiration == 0 || item.Expiration > now {
-					results[i] = BatchResult{Success: true, Value: item.Value}
+			case "GET":
+				if value, found := tx.Get(op.Key); found {
+					results[i] = BatchResult{Success: true, Value: value}
 				} else {
-					// Item expired
-					delete(c.items, op.Key)
-					c.expirationHeap.Remove(item)
-					PutCacheItem(item)
 					results[i] = BatchResult{Success: false, Error: "key not found"}
 				}
-			} else {
-				results[i] = BatchResult{Success: false, Error: "key not found"}
-			}
 
-		case "DEL":
-			if item, exists := c.items[op.Key]; exists {
-				delete(c.items, op.Key)
-				if item.Expiration > 0 {
-					c.expirationHeap.Remove(item)
+			case "DEL":
+				if tx.Delete(op.Key) {
+					results[i] = BatchResult{Success: true}
+				} else {
+					results[i] = BatchResult{Success: false, Error: "key not found"}
 				}
-				PutCacheItem(item)
-				results[i] = BatchResult{Success: true}
-			} else {
-				results[i] = BatchResult{Success: false, Error: "key not found"}
-			}
 
-		default:
-			results[i] = BatchResult{Success: false, Error: "unknown operation"}
+			default:
+				results[i] = BatchResult{Success: false, Error: "unknown operation"}
+			}
 		}
-	}
+	})
 
 	return results
 }
 
 // OptimizedSet uses memory pool for better performance
 func (c *Cache) OptimizedSet(key string, value interface{}, ttl time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.lock()
+	defer c.unlock()
 
 	now := time.Now().UnixNano()
 
@@ -532,13 +710,14 @@ func (c *Cache) OptimizedSet(key string, value interface{}, ttl time.Duration) {
 		PutCacheItem(oldItem)
 	}
 
+	c.touchVersionLocked(item)
 	c.items[key] = item
 }
 
 // GetAllKeys returns all keys with their metadata
 func (c *Cache) GetAllKeys() []map[string]interface{} {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.rlock()
+	defer c.runlock()
 
 	var keys []map[string]interface{}
 	now := time.Now().UnixNano()
@@ -559,13 +738,16 @@ func (c *Cache) GetAllKeys() []map[string]interface{} {
 			}
 		}
 
+		// Collection types are reported as their ordered members
+		value := summaryValue(item.Value)
+
 		// Calculate size
-		size := len(fmt.Sprintf("%v", item.Value))
+		size := len(fmt.Sprintf("%v", value))
 
 		keyInfo := map[string]interface{}{
 			"key":        key,
 			"type":       item.Type,
-			"value":      item.Value,
+			"value":      value,
 			"ttl":        ttl,
 			"expires_at": "",
 			"size":       size,
@@ -583,19 +765,36 @@ func (c *Cache) GetAllKeys() []map[string]interface{} {
 	return keys
 }
 
-// FlushAll removes all keys from the cache
+// FlushAll removes all keys from all the databases, returns how many were removed
 func (c *Cache) FlushAll() int {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.lock()
+	defer c.unlock()
 
-	count := len(c.items)
+	count := 0
+	for _, db := range c.databases {
+		count += len(db.items)
+		db.clearLocked()
+	}
 
-	// Clear all items
-	c.items = make(map[string]*CacheItem)
+	c.logCommand(CMD_FLUSHALL, "", "", 0)
+	return count
+}
 
-	// Reset expiration heap
-	c.expirationHeap = &ExpirationHeap{}
-	heap.Init(c.expirationHeap)
+// FlushDB removes all keys from the database of c, returns how many were removed
+func (c *Cache) FlushDB() int {
+	c.lock()
+	defer c.unlock()
 
+	count := len(c.items)
+	c.clearLocked()
+
+	c.logCommand(CMD_FLUSHDB, "", "", 0)
 	return count
 }
+
+// clearLocked removes all keys of db. The caller must hold the write lock.
+func (db *database) clearLocked() {
+	db.items = make(map[string]*CacheItem)
+	db.expirationHeap = &ExpirationHeap{}
+	heap.Init(db.expirationHeap)
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestGetSummary checks the values returned by Get and MGet for the types
+// modified in place: they are built under the lock and later writes do not
+// change them, GET and MGET format them without the lock
+func TestGetSummary(t *testing.T) {
+	c := New()
+	c.ZAdd("zset", []ZMember{{Member: "b", Score: 2}, {Member: "a", Score: 1}}, 0)
+	c.SAdd("set", []string{"b", "a"}, 0)
+	c.Lock("lock", time.Minute)
+	c.PFAdd("hll", []string{"a"}, 0)
+	c.BFAdd("bloom", "a", 0)
+	c.XAdd("stream", "*", []string{"field", "a"}, 0)
+
+	tests := []struct {
+		key   string
+		write func()
+		want  string
+	}{
+		{"zset", func() { c.ZAdd("zset", []ZMember{{Member: "c", Score: 3}}, 0) }, "[{a 1} {b 2}]"},
+		{"set", func() { c.SAdd("set", []string{"c"}, 0) }, "[a b]"},
+		{"lock", func() { c.Unlock("lock", 1) }, "1"},
+		{"hll", func() { c.PFAdd("hll", []string{"b", "c", "d"}, 0) }, "1"},
+		{"bloom", func() { c.BFAdd("bloom", "b", 0) }, fmt.Sprintf("%d %g 1", DefaultBloomCapacity, DefaultBloomErrorRate)},
+		{"stream", func() { c.XAdd("stream", "*", []string{"field", "b"}, 0) }, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			value, ok := c.Get(tt.key)
+			if !ok {
+				t.Fatalf("Get(%q) found nothing", tt.key)
+			}
+			mget := c.MGet([]string{tt.key})[0]
+			tt.write()
+			for _, v := range []interface{}{value, mget} {
+				if got := fmt.Sprint(v); got != tt.want {
+					t.Errorf("%T after a write = %s, want %s", v, got, tt.want)
+				}
+			}
+		})
+	}
+}
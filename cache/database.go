@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"container/heap"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Databases is the number of logical databases, numbered from 0
+const Databases = 16
+
+// ErrInvalidDB is returned for a database index out of [0, Databases)
+var ErrInvalidDB = errors.New("DB index is out of range")
+
+// Select returns a view of the database index. Inside an Atomic block the view
+// is part of the same block.
+func (c *Cache) Select(index int) (*Cache, error) {
+	if index < 0 || index >= len(c.databases) {
+		return nil, ErrInvalidDB
+	}
+	return &Cache{database: c.databases[index], tx: c.tx}, nil
+}
+
+// Index returns the index of the database viewed by c
+func (c *Cache) Index() int {
+	return c.index
+}
+
+// SwapDB exchanges the keys of the databases a and b. Clients using one of
+// them see the keys of the other at once.
+func (c *Cache) SwapDB(a, b int) error {
+	if a < 0 || a >= len(c.databases) || b < 0 || b >= len(c.databases) {
+		return ErrInvalidDB
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	if a == b {
+		return nil
+	}
+	dbA, dbB := c.databases[a], c.databases[b]
+	dbA.swapLocked(dbB)
+
+	c.logCommand(CMD_SWAPDB, "", strconv.Itoa(a)+" "+strconv.Itoa(b), 0)
+
+	// Blocked clients stay on their database, which may now hold their keys
+	for _, db := range []*database{dbA, dbB} {
+		view := &Cache{database: db, tx: c.tx}
+		for _, key := range view.waitedKeys() {
+			view.serveBlockedPopsLocked(key)
+			view.signalKey(key)
+		}
+	}
+	return nil
+}
+
+// swapLocked exchanges the keys of db and other. The caller must hold the write lock.
+func (db *database) swapLocked(other *database) {
+	db.items, other.items = other.items, db.items
+	db.expirationHeap, other.expirationHeap = other.expirationHeap, db.expirationHeap
+}
+
+// Move moves key to the database index, keeping its expiration. Returns false
+// if key does not exist or already exists in the destination.
+func (c *Cache) Move(key string, index int) (bool, error) {
+	dest, err := c.Select(index)
+	if err != nil {
+		return false, err
+	}
+	if dest.database == c.database {
+		return false, errors.New("source and destination databases are the same")
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	item := c.liveItemLocked(key, now)
+	if item == nil || dest.liveItemLocked(key, now) != nil {
+		return false, nil
+	}
+	c.moveItemLocked(key, dest)
+
+	c.logCommand(CMD_MOVE, key, strconv.Itoa(index), 0)
+
+	dest.serveBlockedPopsLocked(key)
+	dest.signalKey(key)
+	return true, nil
+}
+
+// moveItemLocked moves the item at key to the database of dest, replacing any
+// item stored there. The caller must hold the write lock.
+func (c *Cache) moveItemLocked(key string, dest *Cache) {
+	item := c.items[key]
+	if item == nil {
+		return
+	}
+	expiration := item.Expiration
+	c.removeItemLocked(key)
+
+	item.Expiration = 0
+	dest.storeItemLocked(key, item, 0)
+	if expiration > 0 {
+		item.Expiration = expiration
+		heap.Push(dest.expirationHeap, item)
+	}
+}
+
+// waitedKeys returns the keys clients of the database of c are blocked on
+func (c *Cache) waitedKeys() []string {
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	var keys []string
+	for key := range c.waiters {
+		keys = append(keys, key)
+	}
+	for key := range c.popWaiters {
+		if _, ok := c.waiters[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
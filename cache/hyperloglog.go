@@ -0,0 +1,313 @@
+package cache
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strconv"
+	"time"
+)
+
+const (
+	// hllPrecision is the number of hash bits selecting a register, the
+	// standard error of the estimate is 1.04/sqrt(2^hllPrecision), about 0.81%
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+	// hllMaxRank is the largest register, the rank of the guard bit
+	hllMaxRank = 64 - hllPrecision + 1
+
+	// Encodings of a serialized HyperLogLog
+	hllSparse = 0x00
+	hllDense  = 0x01
+)
+
+// HyperLogLog is the value stored for items of type "hyperloglog": an
+// estimate of the number of distinct elements added to it
+type HyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+// NewHyperLogLog creates an empty HyperLogLog
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{}
+}
+
+// hashItem hashes item into two independent 64-bit values
+func hashItem(item string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(item))
+	var sum [16]byte
+	h.Sum(sum[:0])
+	return mix64(binary.BigEndian.Uint64(sum[:8])), mix64(binary.BigEndian.Uint64(sum[8:]))
+}
+
+// mix64 is the murmur3 finalizer, FNV alone spreads short inputs poorly over the low bits
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// addHash adds an element by its hash and reports whether a register changed
+func (h *HyperLogLog) addHash(hash uint64) bool {
+	index := hash & (hllRegisters - 1)
+	// Position of the first set bit in the remaining bits, the guard bit caps it
+	rank := uint8(bits.TrailingZeros64(hash>>hllPrecision|1<<(64-hllPrecision))) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+		return true
+	}
+	return false
+}
+
+// Add adds element and reports whether the estimate may have changed
+func (h *HyperLogLog) Add(element string) bool {
+	hash, _ := hashItem(element)
+	return h.addHash(hash)
+}
+
+// Merge folds other into h, h then counts the union of both
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Count returns the estimated number of distinct elements
+func (h *HyperLogLog) Count() uint64 {
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	m := float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Linear counting is more accurate while many registers are still empty
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// String returns the estimate, as reported for GET
+func (h *HyperLogLog) String() string {
+	return strconv.FormatUint(h.Count(), 10)
+}
+
+// marshalBinary serializes the registers, only the non-zero registers are
+// written while they are few
+func (h *HyperLogLog) marshalBinary() []byte {
+	used := 0
+	for _, r := range h.registers {
+		if r != 0 {
+			used++
+		}
+	}
+	if used*3 >= hllRegisters {
+		buf := make([]byte, 1+hllRegisters)
+		buf[0] = hllDense
+		copy(buf[1:], h.registers[:])
+		return buf
+	}
+	// Sparse: count, then (index, register) pairs
+	buf := make([]byte, 3, 3+used*3)
+	buf[0] = hllSparse
+	binary.BigEndian.PutUint16(buf[1:], uint16(used))
+	for i, r := range h.registers {
+		if r != 0 {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(i))
+			buf = append(buf, r)
+		}
+	}
+	return buf
+}
+
+// unmarshalHyperLogLog parses registers written by marshalBinary
+func unmarshalHyperLogLog(data []byte) (*HyperLogLog, error) {
+	h := NewHyperLogLog()
+	switch {
+	case len(data) == 1+hllRegisters && data[0] == hllDense:
+		copy(h.registers[:], data[1:])
+		for _, r := range h.registers {
+			if r > hllMaxRank {
+				return nil, errors.New("invalid hyperloglog register")
+			}
+		}
+	case len(data) >= 3 && data[0] == hllSparse:
+		used := int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) != 3+used*3 {
+			return nil, errors.New("invalid hyperloglog length")
+		}
+		for i := 3; i < len(data); i += 3 {
+			index := binary.BigEndian.Uint16(data[i:])
+			if index >= hllRegisters || data[i+2] > hllMaxRank {
+				return nil, errors.New("invalid hyperloglog register")
+			}
+			h.registers[index] = data[i+2]
+		}
+	default:
+		return nil, errors.New("invalid hyperloglog encoding")
+	}
+	return h, nil
+}
+
+// encode formats the registers for the ACL
+func (h *HyperLogLog) encode() string {
+	return base64.StdEncoding.EncodeToString(h.marshalBinary())
+}
+
+// decodeHyperLogLog parses registers written by encode
+func decodeHyperLogLog(s string) (*HyperLogLog, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalHyperLogLog(data)
+}
+
+// formatHashes formats element hashes for the ACL, so that replay does not
+// depend on how the elements themselves are quoted
+func formatHashes(hashes []uint64) []string {
+	formatted := make([]string, len(hashes))
+	for i, hash := range hashes {
+		formatted[i] = strconv.FormatUint(hash, 16)
+	}
+	return formatted
+}
+
+// parseHashes parses element hashes written by formatHashes
+func parseHashes(formatted []string) []uint64 {
+	hashes := make([]uint64, 0, len(formatted))
+	for _, s := range formatted {
+		if hash, err := strconv.ParseUint(s, 16, 64); err == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// valueHyperLogLog returns the HyperLogLog held by item, false if item is nil or holds another type
+func (item *CacheItem) valueHyperLogLog() (*HyperLogLog, bool) {
+	if item == nil {
+		return nil, false
+	}
+	h, ok := item.Value.(*HyperLogLog)
+	return h, ok
+}
+
+// getHyperLogLogLocked returns the HyperLogLog stored at key, nil if the key does not exist.
+// The caller must hold the cache lock.
+func (c *Cache) getHyperLogLogLocked(key string, now int64) (*HyperLogLog, error) {
+	item := c.liveItemLocked(key, now)
+	if item == nil {
+		return nil, nil
+	}
+	h, ok := item.Value.(*HyperLogLog)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return h, nil
+}
+
+// PFAdd adds elements to the HyperLogLog at key, creating it if needed.
+// Returns true if the key was created or its estimate may have changed.
+func (c *Cache) PFAdd(key string, elements []string, ttl time.Duration) (bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	h, err := c.getHyperLogLogLocked(key, time.Now().UnixNano())
+	if err != nil {
+		return false, err
+	}
+	created := h == nil
+	if created {
+		h = NewHyperLogLog()
+		c.storeItemLocked(key, &CacheItem{Value: h, Type: "hyperloglog"}, 0)
+	}
+
+	// Only the elements that changed a register are logged
+	var changed []uint64
+	for _, e := range elements {
+		hash, _ := hashItem(e)
+		if h.addHash(hash) {
+			changed = append(changed, hash)
+		}
+	}
+	c.touchExpirationLocked(c.items[key], ttl)
+	if created || len(changed) > 0 {
+		c.touchVersionLocked(c.items[key])
+	}
+
+	if created || len(changed) > 0 || ttl > 0 {
+		c.logCommand(CMD_PFADD, key, formatHashes(changed), ttl)
+	}
+	return created || len(changed) > 0, nil
+}
+
+// PFCount returns the estimated number of distinct elements added to the
+// HyperLogLogs at keys, counted as their union. Missing keys count as empty.
+func (c *Cache) PFCount(keys ...string) (uint64, error) {
+	c.rlock()
+	defer c.runlock()
+
+	now := time.Now().UnixNano()
+	if len(keys) == 1 {
+		h, err := c.getHyperLogLogLocked(keys[0], now)
+		if err != nil || h == nil {
+			return 0, err
+		}
+		return h.Count(), nil
+	}
+
+	union := NewHyperLogLog()
+	for _, key := range keys {
+		h, err := c.getHyperLogLogLocked(key, now)
+		if err != nil {
+			return 0, err
+		}
+		if h != nil {
+			union.Merge(h)
+		}
+	}
+	return union.Count(), nil
+}
+
+// PFMerge stores at dest the union of dest and the HyperLogLogs at sources
+func (c *Cache) PFMerge(dest string, sources []string) error {
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	union := NewHyperLogLog()
+	for _, key := range append([]string{dest}, sources...) {
+		h, err := c.getHyperLogLogLocked(key, now)
+		if err != nil {
+			return err
+		}
+		if h != nil {
+			union.Merge(h)
+		}
+	}
+
+	// Keep the expiration of an existing destination
+	var ttl time.Duration
+	if item := c.liveItemLocked(dest, now); item != nil && item.Expiration > 0 {
+		ttl = time.Duration(item.Expiration - now)
+	}
+	c.storeItemLocked(dest, &CacheItem{Value: union, Type: "hyperloglog"}, ttl)
+
+	c.logCommand(CMD_PFSTATE, dest, union.encode(), ttl)
+	return nil
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// addRange adds the elements prefix0 to prefix(n-1) to h
+func addRange(h *HyperLogLog, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		h.Add(fmt.Sprintf("%s%d", prefix, i))
+	}
+}
+
+func TestHyperLogLogCount(t *testing.T) {
+	tests := []struct {
+		n int
+		// Relative error allowed, about three standard errors once the
+		// registers fill up
+		tolerance float64
+	}{
+		{0, 0},
+		{1, 0},
+		{10, 0},
+		{100, 0.01},
+		{1000, 0.025},
+		{10000, 0.025},
+		{100000, 0.025},
+		{1000000, 0.025},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.n), func(t *testing.T) {
+			h := NewHyperLogLog()
+			addRange(h, "element", tt.n)
+			got := h.Count()
+			if diff := math.Abs(float64(got) - float64(tt.n)); diff > tt.tolerance*float64(tt.n) {
+				t.Fatalf("Count() = %d, want %d within %.1f%%", got, tt.n, tt.tolerance*100)
+			}
+
+			// Adding the elements again changes nothing
+			for i := 0; i < tt.n && i < 1000; i++ {
+				if h.Add(fmt.Sprintf("element%d", i)) {
+					t.Fatalf("Add(element%d) changed a register the second time", i)
+				}
+			}
+			if again := h.Count(); again != got {
+				t.Fatalf("Count() = %d after adding the elements again, want %d", again, got)
+			}
+		})
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b := NewHyperLogLog(), NewHyperLogLog()
+	addRange(a, "element", 20000)
+	addRange(b, "element", 30000) // Overlaps a on 20000 elements
+
+	a.Merge(b)
+	if got := a.Count(); math.Abs(float64(got)-30000) > 0.025*30000 {
+		t.Fatalf("Count() of the union = %d, want about 30000", got)
+	}
+	if a.Count() != b.Count() {
+		t.Fatalf("the union of b and a subset of b counts %d, b counts %d", a.Count(), b.Count())
+	}
+}
+
+func TestHyperLogLogMarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		encoding byte
+	}{
+		{"empty", 0, hllSparse},
+		{"sparse", 100, hllSparse},
+		{"dense", 100000, hllDense},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHyperLogLog()
+			addRange(h, "element", tt.n)
+			data := h.marshalBinary()
+			if data[0] != tt.encoding {
+				t.Fatalf("encoding = %d, want %d", data[0], tt.encoding)
+			}
+			loaded, err := decodeHyperLogLog(h.encode())
+			if err != nil {
+				t.Fatalf("decodeHyperLogLog() error = %v", err)
+			}
+			if loaded.registers != h.registers {
+				t.Fatal("decoded registers differ from the encoded ones")
+			}
+		})
+	}
+}
+
+func TestUnmarshalHyperLogLogInvalid(t *testing.T) {
+	sparse := func(used uint16, pairs ...[]byte) []byte {
+		data := binary.BigEndian.AppendUint16([]byte{hllSparse}, used)
+		for _, p := range pairs {
+			data = append(data, p...)
+		}
+		return data
+	}
+	dense := make([]byte, 1+hllRegisters)
+	dense[0] = hllDense
+	dense[100] = hllMaxRank + 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown encoding", []byte{0x02, 0, 0}},
+		{"short dense", []byte{hllDense, 1, 2}},
+		{"dense register too large", dense},
+		{"sparse count too large", sparse(2, []byte{0, 1, 1})},
+		{"sparse index out of range", sparse(1, []byte{0xFF, 0xFF, 1})},
+		{"sparse register too large", sparse(1, []byte{0, 1, 0xFF})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := unmarshalHyperLogLog(tt.data); err == nil {
+				t.Fatal("unmarshalHyperLogLog() accepted invalid data")
+			}
+		})
+	}
+}
+
+func TestPFAddPFCount(t *testing.T) {
+	c := New()
+	if changed, err := c.PFAdd("hll", []string{"a", "b", "c"}, 0); !changed || err != nil {
+		t.Fatalf("PFAdd() = %v, %v, want true, nil", changed, err)
+	}
+	if changed, err := c.PFAdd("hll", []string{"a", "b"}, 0); changed || err != nil {
+		t.Fatalf("PFAdd() of elements already added = %v, %v, want false, nil", changed, err)
+	}
+	if changed, err := c.PFAdd("empty", nil, time.Minute); !changed || err != nil {
+		t.Fatalf("PFAdd() without elements = %v, %v, want true, nil", changed, err)
+	}
+	c.Set("string", "value", 0)
+
+	tests := []struct {
+		keys []string
+		want uint64
+		err  error
+	}{
+		{[]string{"hll"}, 3, nil},
+		{[]string{"empty"}, 0, nil},
+		{[]string{"missing"}, 0, nil},
+		{[]string{"hll", "empty", "missing"}, 3, nil},
+		{[]string{"string"}, 0, ErrWrongType},
+		{[]string{"hll", "string"}, 0, ErrWrongType},
+	}
+	for _, tt := range tests {
+		if got, err := c.PFCount(tt.keys...); got != tt.want || err != tt.err {
+			t.Errorf("PFCount(%v) = %d, %v, want %d, %v", tt.keys, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := c.PFAdd("string", []string{"a"}, 0); err != ErrWrongType {
+		t.Errorf("PFAdd() on a string error = %v, want %v", err, ErrWrongType)
+	}
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"time"
+)
+
+// pushList adds values to the head (left) or the tail of list. LPUSH a b
+// leaves b at the head, as if the values were pushed one by one.
+// The result never shares its backing array with list, which readers may still hold.
+func pushList(list []string, values []string, left bool) []string {
+	pushed := make([]string, 0, len(list)+len(values))
+	if !left {
+		pushed = append(pushed, list...)
+		return append(pushed, values...)
+	}
+	for i := len(values) - 1; i >= 0; i-- {
+		pushed = append(pushed, values[i])
+	}
+	return append(pushed, list...)
+}
+
+// popList removes the head (left) or the tail element of a non-empty list
+func popList(list []string, left bool) (string, []string) {
+	if left {
+		return list[0], list[1:]
+	}
+	return list[len(list)-1], list[:len(list)-1]
+}
+
+// getListLocked returns the item and the elements of the array stored at key,
+// nil if the key does not exist. The caller must hold the cache lock.
+func (c *Cache) getListLocked(key string, now int64) (*CacheItem, []string, error) {
+	item := c.liveItemLocked(key, now)
+	if item == nil {
+		return nil, nil, nil
+	}
+	if item.Type != "array" {
+		return nil, nil, ErrWrongType
+	}
+	// Arrays stored with SETS may be compressed, pushed and popped ones are not
+	value, _, err := DecompressValue(item.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, ok := value.([]string)
+	if !ok {
+		return nil, nil, ErrWrongType
+	}
+	return item, list, nil
+}
+
+// push adds values to the array at key, creating it if needed, and serves
+// the clients blocked on it. Returns the length of the array after the push,
+// before blocked clients took their elements.
+func (c *Cache) push(key string, values []string, left bool, ttl time.Duration) (int, error) {
+	c.lock()
+	defer c.unlock()
+
+	item, list, err := c.getListLocked(key, time.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	if item == nil {
+		item = &CacheItem{Type: "array"}
+		c.storeItemLocked(key, item, 0)
+	}
+	list = pushList(list, values, left)
+	item.Value = list
+	c.touchExpirationLocked(item, ttl)
+	c.touchVersionLocked(item)
+
+	cmdType := CMD_RPUSH
+	if left {
+		cmdType = CMD_LPUSH
+	}
+	c.logCommand(cmdType, key, encodeAclArgs(values), ttl)
+
+	c.serveBlockedPopsLocked(key)
+	return len(list), nil
+}
+
+// LPush adds values to the head of the array at key, creating it if needed.
+// Returns the length of the array.
+func (c *Cache) LPush(key string, values []string, ttl time.Duration) (int, error) {
+	return c.push(key, values, true, ttl)
+}
+
+// RPush adds values to the tail of the array at key, creating it if needed.
+// Returns the length of the array.
+func (c *Cache) RPush(key string, values []string, ttl time.Duration) (int, error) {
+	return c.push(key, values, false, ttl)
+}
+
+// popLocked removes the head (left) or tail element of the array at key, false
+// if the key does not exist. The key is deleted with its last element.
+// The caller must hold the write lock.
+func (c *Cache) popLocked(key string, left bool) (string, bool, error) {
+	item, list, err := c.getListLocked(key, time.Now().UnixNano())
+	if err != nil || item == nil || len(list) == 0 {
+		return "", false, err
+	}
+
+	value, rest := popList(list, left)
+	if len(rest) == 0 {
+		c.removeItemLocked(key)
+	} else {
+		item.Value = rest
+		c.touchVersionLocked(item)
+	}
+
+	cmdType := CMD_RPOP
+	if left {
+		cmdType = CMD_LPOP
+	}
+	c.logCommand(cmdType, key, "", 0)
+	return value, true, nil
+}
+
+// LPop removes and returns the head element of the array at key
+func (c *Cache) LPop(key string) (string, bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	return c.popLocked(key, true)
+}
+
+// RPop removes and returns the tail element of the array at key
+func (c *Cache) RPop(key string) (string, bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	return c.popLocked(key, false)
+}
+
+// LLen returns the number of elements of the array at key, 0 if it does not exist
+func (c *Cache) LLen(key string) (int, error) {
+	c.rlock()
+	defer c.runlock()
+
+	_, list, err := c.getListLocked(key, time.Now().UnixNano())
+	return len(list), err
+}
+
+// BLPop pops the head element of the first non-empty array among keys. If
+// they are all empty, it waits for a push to one of them, for up to timeout
+// (0: never waits, BlockForever: no timeout) or until cancel is closed.
+// Clients waiting on the same key are served in the order they arrived.
+// Returns the key the element was popped from, false on timeout.
+func (c *Cache) BLPop(keys []string, timeout time.Duration, cancel <-chan struct{}) (string, string, bool, error) {
+	return c.blockingPop(keys, true, timeout, cancel)
+}
+
+// BRPop is BLPop popping the tail element
+func (c *Cache) BRPop(keys []string, timeout time.Duration, cancel <-chan struct{}) (string, string, bool, error) {
+	return c.blockingPop(keys, false, timeout, cancel)
+}
+
+func (c *Cache) blockingPop(keys []string, left bool, timeout time.Duration, cancel <-chan struct{}) (string, string, bool, error) {
+	c.lock()
+	for _, key := range keys {
+		value, ok, err := c.popLocked(key, left)
+		if err != nil || ok {
+			c.unlock()
+			return key, value, ok, err
+		}
+	}
+	// Writes can not happen while a transaction holds the lock
+	if timeout == 0 || c.tx != nil {
+		c.unlock()
+		return "", "", false, nil
+	}
+	// Queued before unlocking so that no push is missed
+	w := c.addPopWaiter(keys, left)
+	c.unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case e := <-w.popped:
+		return e.key, e.value, true, nil
+	case <-expired:
+	case <-cancel:
+	}
+	if e, ok := c.cancelPopWaiter(w); ok {
+		return e.key, e.value, true, nil
+	}
+	return "", "", false, nil
+}
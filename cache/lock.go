@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"strconv"
+	"time"
+)
+
+// LockState is the value stored for items of type "lock"
+type LockState struct {
+	// Fencing token handed to the owner when the lock was acquired
+	Token uint64
+}
+
+// valueLock returns the lock state held by item, false if item is nil or holds another type
+func (item *CacheItem) valueLock() (*LockState, bool) {
+	if item == nil {
+		return nil, false
+	}
+	state, ok := item.Value.(*LockState)
+	return state, ok
+}
+
+// raiseLockTokenLocked makes sure tokens handed out later are greater than token.
+// The caller must hold the write lock.
+func (c *Cache) raiseLockTokenLocked(token uint64) {
+	if token > c.lockToken {
+		c.lockToken = token
+	}
+}
+
+// Lock acquires the lock at key for ttl and returns its fencing token.
+// Tokens increase monotonically across all locks, including after a restart.
+// If the lock is held, the token is 0 and the remaining TTL of the holder is returned.
+func (c *Cache) Lock(key string, ttl time.Duration) (uint64, time.Duration, error) {
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	if item := c.liveItemLocked(key, now); item != nil {
+		if _, ok := item.Value.(*LockState); !ok {
+			return 0, 0, ErrWrongType
+		}
+		remaining := time.Duration(0)
+		if item.Expiration > 0 {
+			remaining = time.Duration(item.Expiration - now)
+		}
+		return 0, remaining, nil
+	}
+
+	c.lockToken++
+	token := c.lockToken
+	c.storeItemLocked(key, &CacheItem{Value: &LockState{Token: token}, Type: "lock"}, ttl)
+
+	c.logCommand(CMD_LOCK, key, strconv.FormatUint(token, 10), ttl)
+	return token, ttl, nil
+}
+
+// ownedLockLocked returns the item of the lock at key if token owns it.
+// The caller must hold the cache lock.
+func (c *Cache) ownedLockLocked(key string, token uint64) (*CacheItem, error) {
+	item := c.liveItemLocked(key, time.Now().UnixNano())
+	if item == nil {
+		return nil, nil
+	}
+	state, ok := item.Value.(*LockState)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	if state.Token != token {
+		return nil, nil
+	}
+	return item, nil
+}
+
+// Unlock releases the lock at key, only if token is the token of the current owner
+func (c *Cache) Unlock(key string, token uint64) (bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	item, err := c.ownedLockLocked(key, token)
+	if err != nil || item == nil {
+		return false, err
+	}
+	c.removeItemLocked(key)
+
+	c.logCommand(CMD_UNLOCK, key, strconv.FormatUint(token, 10), 0)
+	return true, nil
+}
+
+// Renew extends the lock at key to expire ttl from now, only if token is the
+// token of the current owner
+func (c *Cache) Renew(key string, token uint64, ttl time.Duration) (bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	item, err := c.ownedLockLocked(key, token)
+	if err != nil || item == nil {
+		return false, err
+	}
+	c.touchExpirationLocked(item, ttl)
+	c.touchVersionLocked(item)
+
+	// Logged as a new acquisition with the same token and the new TTL
+	c.logCommand(CMD_LOCK, key, strconv.FormatUint(token, 10), ttl)
+	return true, nil
+}
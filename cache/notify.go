@@ -0,0 +1,187 @@
+package cache
+
+import "time"
+
+// BlockForever makes a blocking read wait until data arrives
+const BlockForever time.Duration = -1
+
+// keyWaiter is a client blocked until one of keys is written
+type keyWaiter struct {
+	keys  []string
+	ready chan struct{}
+}
+
+// addWaiter registers a waiter woken by signalKey on any of keys
+func (c *Cache) addWaiter(keys []string) *keyWaiter {
+	w := &keyWaiter{keys: keys, ready: make(chan struct{}, 1)}
+
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	if c.waiters == nil {
+		c.waiters = make(map[string][]*keyWaiter)
+	}
+	for _, key := range keys {
+		c.waiters[key] = append(c.waiters[key], w)
+	}
+	return w
+}
+
+// removeWaiter unregisters a waiter added by addWaiter
+func (c *Cache) removeWaiter(w *keyWaiter) {
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	for _, key := range w.keys {
+		waiters := c.waiters[key]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(c.waiters, key)
+		} else {
+			c.waiters[key] = waiters
+		}
+	}
+}
+
+// signalKey wakes the clients blocked on key after it was written
+func (c *Cache) signalKey(key string) {
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	for _, w := range c.waiters[key] {
+		select {
+		case w.ready <- struct{}{}:
+		default:
+			// Already woken
+		}
+	}
+}
+
+// blockOn calls try until it reports done, waiting for a write to one of keys
+// between attempts. It gives up after timeout (0: never waits, BlockForever:
+// no timeout) or once cancel is closed. try must take the cache lock itself.
+// Inside a transaction try is called once, since writes can not happen while
+// the transaction holds the lock.
+func (c *Cache) blockOn(keys []string, timeout time.Duration, cancel <-chan struct{}, try func() (bool, error)) error {
+	if timeout == 0 || c.tx != nil {
+		_, err := try()
+		return err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		// Registered before trying so that a write in between is not missed
+		w := c.addWaiter(keys)
+		done, err := try()
+		if err != nil || done {
+			c.removeWaiter(w)
+			return err
+		}
+
+		select {
+		case <-w.ready:
+			c.removeWaiter(w)
+		case <-expired:
+			c.removeWaiter(w)
+			return nil
+		case <-cancel:
+			c.removeWaiter(w)
+			return nil
+		}
+	}
+}
+
+// popWaiter is a client blocked in BLPop or BRPop. Pushes hand their elements
+// directly to the oldest waiter of the key, so waiters are served in FIFO order
+// and an element is never taken by a client that arrived later.
+type popWaiter struct {
+	keys   []string
+	left   bool
+	served bool
+	popped chan poppedElement
+}
+
+// poppedElement is the element handed to a popWaiter and the key it came from
+type poppedElement struct {
+	key   string
+	value string
+}
+
+// addPopWaiter queues a waiter at the end of the queue of each of keys.
+// The caller must hold the write lock, so that no push is missed.
+func (c *Cache) addPopWaiter(keys []string, left bool) *popWaiter {
+	w := &popWaiter{keys: keys, left: left, popped: make(chan poppedElement, 1)}
+
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	if c.popWaiters == nil {
+		c.popWaiters = make(map[string][]*popWaiter)
+	}
+	for _, key := range keys {
+		c.popWaiters[key] = append(c.popWaiters[key], w)
+	}
+	return w
+}
+
+// removePopWaiterLocked removes w from the queues of its keys.
+// The caller must hold waitMu.
+func (c *Cache) removePopWaiterLocked(w *popWaiter) {
+	for _, key := range w.keys {
+		waiters := c.popWaiters[key]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(c.popWaiters, key)
+		} else {
+			c.popWaiters[key] = waiters
+		}
+	}
+}
+
+// cancelPopWaiter gives up waiting, returns the element if one was handed to
+// w in the meantime
+func (c *Cache) cancelPopWaiter(w *popWaiter) (poppedElement, bool) {
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	if w.served {
+		return <-w.popped, true
+	}
+	c.removePopWaiterLocked(w)
+	return poppedElement{}, false
+}
+
+// serveBlockedPopsLocked hands the elements of the list at key to the clients
+// blocked on it, oldest first. The caller must hold the write lock and call it
+// once the write that filled the list was logged, as each pop is logged too.
+func (c *Cache) serveBlockedPopsLocked(key string) {
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	for len(c.popWaiters[key]) > 0 {
+		w := c.popWaiters[key][0]
+		value, ok, err := c.popLocked(key, w.left)
+		if err != nil || !ok {
+			return
+		}
+		c.removePopWaiterLocked(w)
+		w.served = true
+		w.popped <- poppedElement{key: key, value: value}
+	}
+}
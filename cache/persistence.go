@@ -4,17 +4,26 @@ import (
 	"bufio"
 	"compress/gzip"
 	"container/heap"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"ant-cache/logging"
 )
 
+var persistenceLog = logging.For(logging.Persistence)
+
 // PersistenceManager persistence manager
 type PersistenceManager struct {
 	cache          *Cache
@@ -30,6 +39,47 @@ type PersistenceManager struct {
 	commandChan    chan Command
 	aclFileSize    int64
 	maxAclFileSize int64
+
+	// wg counts the goroutines started by Start
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	// sendMu orders the sends on commandChan before Stop closes it
+	sendMu  sync.RWMutex
+	stopped bool
+	// atdIntervalChan and aclIntervalChan pass the intervals set by
+	// SetIntervals to the periodic saves
+	atdIntervalChan chan time.Duration
+	aclIntervalChan chan time.Duration
+
+	// snapshotTime is the time of the last ATD snapshot loaded or saved, the
+	// ACL commands logged before it are already part of the snapshot
+	snapshotTime int64
+	// lastTimestamp is the last timestamp given to a command, see nextTimestamp
+	lastTimestamp int64
+
+	// Statistics, updated atomically so that Stats never waits for a save
+	droppedCommands uint64
+	atdSaves        uint64
+	aclRotations    uint64
+	aclSize         int64
+	lastAtdNanos    int64
+	lastAtdDuration int64
+}
+
+// PersistenceStats describes the state of the persistence, see Stats
+type PersistenceStats struct {
+	// Commands waiting to be written to the ACL, and the queue capacity
+	QueueDepth    int
+	QueueCapacity int
+	// Commands dropped because the queue was full
+	DroppedCommands uint64
+	// Last ATD snapshot, zero before the first one
+	LastAtdTime     time.Time
+	LastAtdDuration time.Duration
+	AtdSaves        uint64
+	// Size of the current ACL file, and the number of times it was rotated
+	AclSize      int64
+	AclRotations uint64
 }
 
 // Command command struct
@@ -39,6 +89,8 @@ type Command struct {
 	Key       string
 	Value     interface{}
 	TTL       time.Duration
+	// DB is the index of the database the command applies to
+	DB int
 }
 
 // Binary format constants for ATD
@@ -49,9 +101,14 @@ const (
 
 // Record types for ATD
 const (
-	RECORD_ITEM  = 0x01
-	RECORD_STATS = 0x02
-	RECORD_END   = 0xFF
+	RECORD_ITEM       = 0x01
+	RECORD_STATS      = 0x02
+	RECORD_LOCK_TOKEN = 0x03
+	// RECORD_SNAPSHOT_TIME is followed by the time the snapshot was taken at
+	RECORD_SNAPSHOT_TIME = 0x04
+	// RECORD_DATABASE is followed by the index of the database of the next items
+	RECORD_DATABASE = 0x05
+	RECORD_END      = 0xFF
 )
 
 // Command types
@@ -65,8 +122,151 @@ const (
 	CMD_DEL    = "DEL"
 	CMD_DELS   = "DELS"
 	CMD_DELX   = "DELX"
+	// Sorted set and set commands log their members with encodeAclArgs
+	CMD_ZADD   = "ZADD"
+	CMD_ZREM   = "ZREM"
+	CMD_SADD   = "SADD"
+	CMD_SREM   = "SREM"
+	CMD_SSTORE = "SSTORE"
+	CMD_BATCH  = "BATCH"
+	CMD_LOCK   = "LOCK"
+	CMD_UNLOCK = "UNLOCK"
+	// CMD_LOCKTOKEN records the last fencing token when compaction drops the lock commands
+	CMD_LOCKTOKEN = "LOCKTOKEN"
+	// CMD_RLSTATE replaces the state of a rate limiter
+	CMD_RLSTATE = "RLSTATE"
+	// CMD_RLREQUEST adds a request to a sliding window, its TTL is the window
+	CMD_RLREQUEST = "RLREQUEST"
+	// CMD_PFADD and CMD_BFADD log the hashes of the added elements, not the elements
+	CMD_PFADD     = "PFADD"
+	CMD_PFSTATE   = "PFSTATE"
+	CMD_BFRESERVE = "BFRESERVE"
+	CMD_BFADD     = "BFADD"
+	// Stream commands log their arguments with encodeAclArgs
+	CMD_XADD     = "XADD"
+	CMD_XGROUP   = "XGROUP"
+	CMD_XDELIVER = "XDELIVER"
+	CMD_XACK     = "XACK"
+	// Array commands, a push logs its elements with encodeAclArgs and a pop
+	// removes one element
+	CMD_LPUSH = "LPUSH"
+	CMD_RPUSH = "RPUSH"
+	CMD_LPOP  = "LPOP"
+	CMD_RPOP  = "RPOP"
+	// Database commands, CMD_FLUSHALL applies to all the databases
+	CMD_FLUSHDB  = "FLUSHDB"
+	CMD_FLUSHALL = "FLUSHALL"
+	CMD_SWAPDB   = "SWAPDB"
+	CMD_MOVE     = "MOVE"
 )
 
+// ATD value types
+const (
+	VALUE_STRING    = 0x01
+	VALUE_ARRAY     = 0x02
+	VALUE_OBJECT    = 0x03
+	VALUE_ZSET      = 0x04
+	VALUE_SET       = 0x05
+	VALUE_LOCK      = 0x06
+	VALUE_RATELIMIT = 0x07
+	VALUE_HLL       = 0x08
+	VALUE_BLOOM     = 0x09
+	VALUE_STREAM    = 0x0A
+)
+
+// isIncrementalCommand reports whether cmdType modifies part of a value instead
+// of replacing it, so every such command must survive ACL compaction
+func isIncrementalCommand(cmdType string) bool {
+	switch cmdType {
+	case CMD_ZADD, CMD_ZREM, CMD_SADD, CMD_SREM, CMD_PFADD, CMD_BFADD,
+		CMD_XADD, CMD_XGROUP, CMD_XDELIVER, CMD_XACK,
+		CMD_LPUSH, CMD_RPUSH, CMD_LPOP, CMD_RPOP, CMD_RLREQUEST:
+		return true
+	}
+	return false
+}
+
+// formatAclValue formats a command value for an ACL line
+func formatAclValue(value interface{}) string {
+	switch v := value.(type) {
+	case []string:
+		return fmt.Sprintf("[%s]", strings.Join(v, " "))
+	case map[string]string:
+		var pairs []string
+		for k, v := range v {
+			pairs = append(pairs, fmt.Sprintf("%s:%s", k, v))
+		}
+		return fmt.Sprintf("map[%s]", strings.Join(pairs, " "))
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// parseAclValue parses a value written by formatAclValue
+func parseAclValue(valueStr string) interface{} {
+	if strings.HasPrefix(valueStr, "[") && strings.HasSuffix(valueStr, "]") {
+		// 数组格式: [apple banana orange]
+		content := strings.Trim(valueStr, "[]")
+		if content != "" {
+			return strings.Fields(content)
+		}
+		return []string{}
+	} else if strings.HasPrefix(valueStr, "map[") && strings.Contains(valueStr, ":") {
+		// 对象格式: map[age:25 name:john]
+		content := strings.TrimPrefix(valueStr, "map[")
+		content = strings.TrimSuffix(content, "]")
+		pairs := strings.Fields(content)
+		obj := make(map[string]string)
+		for _, pair := range pairs {
+			if strings.Contains(pair, ":") {
+				kv := strings.SplitN(pair, ":", 2)
+				if len(kv) == 2 {
+					obj[kv[0]] = kv[1]
+				}
+			}
+		}
+		return obj
+	}
+	// 普通字符串
+	return valueStr
+}
+
+// encodeAclArgs encodes the arguments of a command for the ACL, they may
+// hold any character, spaces and | included
+func encodeAclArgs(args []string) string {
+	data, _ := json.Marshal(args)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// decodeAclArgs decodes arguments written by encodeAclArgs
+func decodeAclArgs(value interface{}) ([]string, error) {
+	data, err := base64.StdEncoding.DecodeString(fmt.Sprintf("%v", value))
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// formatAclLine formats cmd as a single ACL line. A batch is formatted as a
+// header line holding the number of commands followed by one line per command.
+func formatAclLine(cmd Command) string {
+	if batch, ok := cmd.Value.([]Command); ok && cmd.Type == CMD_BATCH {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%d|%s||%d|0\n", cmd.Timestamp, CMD_BATCH, len(batch))
+		for _, c := range batch {
+			c.Timestamp = cmd.Timestamp
+			sb.WriteString(formatAclLine(c))
+		}
+		return sb.String()
+	}
+	return fmt.Sprintf("%d|%s|%s|%s|%d|%d\n",
+		cmd.Timestamp, cmd.Type, cmd.Key, formatAclValue(cmd.Value), cmd.TTL.Nanoseconds(), cmd.DB)
+}
+
 // NewPersistenceManager create persistence manager with async ACL
 func NewPersistenceManager(cache *Cache, atdPath, aclPath string, atdInterval, aclInterval time.Duration) *PersistenceManager {
 	return &PersistenceManager{
@@ -79,6 +279,9 @@ func NewPersistenceManager(cache *Cache, atdPath, aclPath string, atdInterval, a
 		stopChan:       make(chan struct{}),
 		commandChan:    make(chan Command, 50000), // Much larger buffer for async
 		maxAclFileSize: 10 * 1024 * 1024,          // 10MB
+
+		atdIntervalChan: make(chan time.Duration),
+		aclIntervalChan: make(chan time.Duration),
 	}
 }
 
@@ -88,6 +291,7 @@ func (pm *PersistenceManager) Start() {
 		return
 	}
 
+	pm.wg.Add(3)
 	// Start ATD periodic save goroutine
 	go pm.periodicAtd()
 	// Start ACL periodic sync goroutine
@@ -96,56 +300,125 @@ func (pm *PersistenceManager) Start() {
 	go pm.processCommands()
 }
 
-// Stop stop persistence manager
+// Stop writes the queued commands to the ACL, stops the periodic saves and
+// writes a final ATD snapshot. Commands logged once Stop began are not
+// written to the ACL. Stop can be called more than once.
 func (pm *PersistenceManager) Stop() {
 	if !pm.enabled {
 		return
 	}
 
-	close(pm.stopChan)
+	pm.stopOnce.Do(func() {
+		pm.sendMu.Lock()
+		pm.stopped = true
+		close(pm.commandChan)
+		pm.sendMu.Unlock()
+		close(pm.stopChan)
 
-	// wait for all commands to be processed
-	time.Sleep(500 * time.Millisecond)
+		// processCommands returns once the queue is drained
+		pm.wg.Wait()
 
-	close(pm.commandChan)
+		// save one last time
+		if err := pm.SaveAtd(); err != nil {
+			persistenceLog.Error("Failed to save the final ATD snapshot", "error", err)
+		}
+		pm.flushAcl()
+	})
+}
 
-	// save one last time
-	pm.SaveAtd()
-	pm.flushAcl()
+// SetIntervals changes the intervals of the ATD snapshots and of the ACL
+// compactions, the next ones happen one interval from now
+func (pm *PersistenceManager) SetIntervals(atdInterval, aclInterval time.Duration) {
+	if !pm.enabled || atdInterval <= 0 || aclInterval <= 0 {
+		return
+	}
+	select {
+	case pm.atdIntervalChan <- atdInterval:
+	case <-pm.stopChan:
+		return
+	}
+	select {
+	case pm.aclIntervalChan <- aclInterval:
+	case <-pm.stopChan:
+	}
 }
 
-// LogCommand record command
-func (pm *PersistenceManager) LogCommand(cmdType, key string, value interface{}, ttl time.Duration) {
+// nextTimestamp returns the current time, or just after the last returned
+// timestamp if the clock did not move since. Commands logged after a snapshot
+// was taken thus always have a later timestamp than the snapshot.
+func (pm *PersistenceManager) nextTimestamp() int64 {
+	for {
+		last := atomic.LoadInt64(&pm.lastTimestamp)
+		now := time.Now().UnixNano()
+		if now <= last {
+			now = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&pm.lastTimestamp, last, now) {
+			return now
+		}
+	}
+}
+
+// LogCommand records a command applied to the database db
+func (pm *PersistenceManager) LogCommand(db int, cmdType, key string, value interface{}, ttl time.Duration) {
 	if !pm.enabled {
 		return
 	}
 
+	pm.sendMu.RLock()
+	defer pm.sendMu.RUnlock()
+	if pm.stopped {
+		return
+	}
+
 	select {
 	case pm.commandChan <- Command{
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: pm.nextTimestamp(),
 		Type:      cmdType,
 		Key:       key,
 		Value:     value,
 		TTL:       ttl,
+		DB:        db,
 	}:
 	default:
 		// Channel is full, drop command
-		fmt.Printf("Warning: Command channel full, dropping command: %s %s\n", cmdType, key)
+		atomic.AddUint64(&pm.droppedCommands, 1)
+		persistenceLog.Warn("ACL queue full, dropping command", "command", cmdType, "key", key)
 	}
 }
 
-// processCommands process commands
+// LogBatch records commands that must be replayed atomically. The batch is
+// written to the ACL with a single write and skipped on replay if truncated.
+func (pm *PersistenceManager) LogBatch(cmds []Command) {
+	if !pm.enabled || len(cmds) == 0 {
+		return
+	}
+
+	pm.sendMu.RLock()
+	defer pm.sendMu.RUnlock()
+	if pm.stopped {
+		return
+	}
+
+	select {
+	case pm.commandChan <- Command{
+		Timestamp: pm.nextTimestamp(),
+		Type:      CMD_BATCH,
+		Value:     cmds,
+	}:
+	default:
+		// Channel is full, drop the whole batch
+		atomic.AddUint64(&pm.droppedCommands, uint64(len(cmds)))
+		persistenceLog.Warn("ACL queue full, dropping batch", "commands", len(cmds))
+	}
+}
+
+// processCommands writes the queued commands to the ACL until Stop closes
+// the queue
 func (pm *PersistenceManager) processCommands() {
-	for {
-		select {
-		case cmd, ok := <-pm.commandChan:
-			if !ok {
-				return
-			}
-			pm.writeCommandToAcl(cmd)
-		case <-pm.stopChan:
-			return
-		}
+	defer pm.wg.Done()
+	for cmd := range pm.commandChan {
+		pm.writeCommandToAcl(cmd)
 	}
 }
 
@@ -156,7 +429,7 @@ func (pm *PersistenceManager) writeCommandToAcl(cmd Command) {
 
 	dir := filepath.Dir(pm.aclPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		fmt.Printf("Failed to create directory: %v\n", err)
+		persistenceLog.Error("Failed to create ACL directory", "error", err)
 		return
 	}
 
@@ -166,35 +439,25 @@ func (pm *PersistenceManager) writeCommandToAcl(cmd Command) {
 
 	file, err := os.OpenFile(pm.aclPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		fmt.Printf("Failed to open ACL file: %v\n", err)
+		persistenceLog.Error("Failed to open ACL file", "file", pm.aclPath, "error", err)
 		return
 	}
 	defer file.Close()
 
-	// Format command
-	var valueStr string
-	switch v := cmd.Value.(type) {
-	case []string:
-		valueStr = fmt.Sprintf("[%s]", strings.Join(v, " "))
-	case map[string]string:
-		var pairs []string
-		for k, v := range v {
-			pairs = append(pairs, fmt.Sprintf("%s:%s", k, v))
-		}
-		valueStr = fmt.Sprintf("map[%s]", strings.Join(pairs, " "))
-	default:
-		valueStr = fmt.Sprintf("%v", v)
-	}
-
-	line := fmt.Sprintf("%d|%s|%s|%s|%d\n",
-		cmd.Timestamp, cmd.Type, cmd.Key, valueStr, cmd.TTL.Nanoseconds())
+	line := formatAclLine(cmd)
 
 	if _, err := file.WriteString(line); err != nil {
-		fmt.Printf("Failed to write ACL: %v\n", err)
+		persistenceLog.Error("Failed to write ACL", "file", pm.aclPath, "error", err)
 		return
 	}
 
-	pm.aclFileSize += int64(len(line))
+	pm.setAclFileSize(pm.aclFileSize + int64(len(line)))
+}
+
+// setAclFileSize records the size of the current ACL file
+func (pm *PersistenceManager) setAclFileSize(size int64) {
+	pm.aclFileSize = size
+	atomic.StoreInt64(&pm.aclSize, size)
 }
 
 // rotateAclFile rotate acl file
@@ -206,20 +469,19 @@ func (pm *PersistenceManager) rotateAclFile() {
 	newPath := fmt.Sprintf("%s.%s", pm.aclPath, timestamp)
 
 	if err := os.Rename(oldPath, newPath); err != nil {
-		fmt.Printf("Failed to rotate ACL file: %v\n", err)
+		persistenceLog.Error("Failed to rotate ACL file", "file", oldPath, "error", err)
 		return
 	}
 
 	// reset file size
-	pm.aclFileSize = 0
+	pm.setAclFileSize(0)
+	atomic.AddUint64(&pm.aclRotations, 1)
 
-	fmt.Printf("ACL file rotated: %s -> %s\n", oldPath, newPath)
+	persistenceLog.Info("ACL file rotated", "from", oldPath, "to", newPath)
 }
 
 // flushAcl flush acl
 func (pm *PersistenceManager) flushAcl() {
-	// wait for all commands to be processed
-	time.Sleep(100 * time.Millisecond)
 	pm.compactAclFiles()
 }
 
@@ -231,7 +493,7 @@ func (pm *PersistenceManager) compactAclFiles() {
 
 	matches, err := filepath.Glob(pattern)
 	if err != nil {
-		fmt.Printf("Failed to find ACL files: %v\n", err)
+		persistenceLog.Error("Failed to find ACL files", "error", err)
 		return
 	}
 
@@ -242,123 +504,146 @@ func (pm *PersistenceManager) compactAclFiles() {
 		return // Only one file, no need to merge
 	}
 
-	fmt.Printf("Found %d ACL files to compact\n", len(allFiles))
+	persistenceLog.Debug("Compacting ACL files", "files", len(allFiles))
 
 	// Read all commands
-	commands := make(map[string]Command) // key -> latest command
+	var all []Command
 
 	for _, filePath := range allFiles {
 		file, err := os.Open(filePath)
 		if err != nil {
-			fmt.Printf("Failed to open ACL file %s: %v\n", filePath, err)
+			persistenceLog.Error("Failed to open ACL file", "file", filePath, "error", err)
 			continue
 		}
 
 		scanner := bufio.NewScanner(file)
+		lineNum := 0
 		for scanner.Scan() {
+			lineNum++
 			line := strings.TrimSpace(scanner.Text())
 			if line == "" {
 				continue
 			}
 
 			// Parse command line
-			parts := strings.Split(line, "|")
-			if len(parts) != 5 {
+			cmd, err := parseAclLine(line)
+			if err != nil {
 				continue
 			}
 
-			timestamp, _ := strconv.ParseInt(parts[0], 10, 64)
-			cmdType := parts[1]
-			key := parts[2]
-			valueStr := parts[3]
-			ttlNanos, _ := strconv.ParseInt(parts[4], 10, 64)
-
-			// Parse value
-			var value interface{}
-			if strings.HasPrefix(valueStr, "[") && strings.HasSuffix(valueStr, "]") {
-				content := strings.Trim(valueStr, "[]")
-				if content != "" {
-					value = strings.Fields(content)
-				} else {
-					value = []string{}
-				}
-			} else if strings.HasPrefix(valueStr, "map[") && strings.Contains(valueStr, ":") {
-				content := strings.TrimPrefix(valueStr, "map[")
-				content = strings.TrimSuffix(content, "]")
-				pairs := strings.Fields(content)
-				obj := make(map[string]string)
-				for _, pair := range pairs {
-					if strings.Contains(pair, ":") {
-						kv := strings.SplitN(pair, ":", 2)
-						if len(kv) == 2 {
-							obj[kv[0]] = kv[1]
-						}
-					}
-				}
-				value = obj
-			} else {
-				value = valueStr
+			if cmd.Type != CMD_BATCH {
+				all = append(all, cmd)
+				continue
 			}
 
-			cmd := Command{
-				Timestamp: timestamp,
-				Type:      cmdType,
-				Key:       key,
-				Value:     value,
-				TTL:       time.Duration(ttlNanos),
+			// Complete batches are unpacked, the merged file is replaced atomically
+			if batch, ok := readAclBatch(scanner, cmd, &lineNum); ok {
+				all = append(all, batch...)
 			}
+		}
 
-			// Merge strategy: DELETE commands override SET commands, otherwise keep the latest
-			if existingCmd, exists := commands[key]; exists {
-				if cmdType == CMD_DEL || cmdType == CMD_DELS || cmdType == CMD_DELX {
-					// DELETE commands always override SET commands
-					commands[key] = cmd
-				} else if existingCmd.Type == CMD_DEL || existingCmd.Type == CMD_DELS || existingCmd.Type == CMD_DELX {
-					// If there's already a DELETE command, SET commands are ignored
-					continue
-				} else if cmd.Timestamp > existingCmd.Timestamp {
-					// For commands of the same type, keep the latest
-					commands[key] = cmd
-				}
-			} else {
-				commands[key] = cmd
+		file.Close()
+	}
+
+	// Replay in time order, the current file is listed before the rotated ones
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Timestamp < all[j].Timestamp
+	})
+
+	// Merge strategy: a command replacing the whole value drops everything logged
+	// before it for the same key, incremental commands are all kept
+	commands := make(map[int]map[string][]Command) // database -> key -> commands still needed
+	keyCommands := func(db int) map[string][]Command {
+		if commands[db] == nil {
+			commands[db] = make(map[string][]Command)
+		}
+		return commands[db]
+	}
+	// Database commands are all kept, commands moved across databases with
+	// them stay in their bucket and are replayed before them
+	var dbCommands []Command
+	var lockToken uint64
+	var lastTimestamp int64
+	// The commands logged before the last snapshot are skipped on load, the
+	// snapshot holds their keys and the fencing token
+	snapshotTime := atomic.LoadInt64(&pm.snapshotTime)
+	for _, cmd := range all {
+		lastTimestamp = cmd.Timestamp
+		if cmd.Timestamp <= snapshotTime {
+			continue
+		}
+		switch cmd.Type {
+		case CMD_LOCK, CMD_UNLOCK, CMD_LOCKTOKEN:
+			// The highest fencing token must survive even if its lock commands are dropped
+			if token, err := strconv.ParseUint(fmt.Sprintf("%v", cmd.Value), 10, 64); err == nil && token > lockToken {
+				lockToken = token
+			}
+			if cmd.Type == CMD_LOCKTOKEN {
+				continue
 			}
 		}
+		switch cmd.Type {
+		case CMD_FLUSHALL:
+			commands = make(map[int]map[string][]Command)
+			dbCommands = []Command{cmd}
+			continue
+		case CMD_FLUSHDB:
+			delete(commands, cmd.DB)
+			dbCommands = append(dbCommands, cmd)
+			continue
+		case CMD_SWAPDB:
+			var a, b int
+			if _, err := fmt.Sscanf(fmt.Sprintf("%v", cmd.Value), "%d %d", &a, &b); err == nil {
+				commands[a], commands[b] = commands[b], commands[a]
+			}
+			dbCommands = append(dbCommands, cmd)
+			continue
+		case CMD_MOVE:
+			// The destination key did not exist, its commands are not needed
+			if dest, err := strconv.Atoi(fmt.Sprintf("%v", cmd.Value)); err == nil {
+				moved := keyCommands(cmd.DB)[cmd.Key]
+				delete(commands[cmd.DB], cmd.Key)
+				keyCommands(dest)[cmd.Key] = append(moved, cmd)
+			}
+			continue
+		}
+		if isIncrementalCommand(cmd.Type) {
+			keyCommands(cmd.DB)[cmd.Key] = append(keyCommands(cmd.DB)[cmd.Key], cmd)
+		} else {
+			keyCommands(cmd.DB)[cmd.Key] = []Command{cmd}
+		}
+	}
 
-		file.Close()
+	merged := dbCommands
+	for _, keys := range commands {
+		for _, cmds := range keys {
+			merged = append(merged, cmds...)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp < merged[j].Timestamp
+	})
+	if lockToken > 0 {
+		merged = append(merged, Command{
+			Timestamp: lastTimestamp,
+			Type:      CMD_LOCKTOKEN,
+			Value:     strconv.FormatUint(lockToken, 10),
+		})
 	}
 
 	// Create merged file
 	mergedPath := pm.aclPath + ".merged"
 	mergedFile, err := os.Create(mergedPath)
 	if err != nil {
-		fmt.Printf("Failed to create merged file: %v\n", err)
+		persistenceLog.Error("Failed to create compacted ACL file", "error", err)
 		return
 	}
 	defer mergedFile.Close()
 
 	// Write merged commands
-	for _, cmd := range commands {
-		// 格式化命令
-		var valueStr string
-		switch v := cmd.Value.(type) {
-		case []string:
-			valueStr = fmt.Sprintf("[%s]", strings.Join(v, " "))
-		case map[string]string:
-			var pairs []string
-			for k, v := range v {
-				pairs = append(pairs, fmt.Sprintf("%s:%s", k, v))
-			}
-			valueStr = fmt.Sprintf("map[%s]", strings.Join(pairs, " "))
-		default:
-			valueStr = fmt.Sprintf("%v", v)
-		}
-
-		line := fmt.Sprintf("%d|%s|%s|%s|%d\n",
-			cmd.Timestamp, cmd.Type, cmd.Key, valueStr, cmd.TTL.Nanoseconds())
-
-		if _, err := mergedFile.WriteString(line); err != nil {
-			fmt.Printf("Failed to write merged file: %v\n", err)
+	for _, cmd := range merged {
+		if _, err := mergedFile.WriteString(formatAclLine(cmd)); err != nil {
+			persistenceLog.Error("Failed to write compacted ACL file", "error", err)
 			return
 		}
 	}
@@ -366,23 +651,22 @@ func (pm *PersistenceManager) compactAclFiles() {
 	// Delete original files and rename merged file
 	for _, filePath := range matches {
 		if err := os.Remove(filePath); err != nil {
-			fmt.Printf("Failed to remove file %s: %v\n", filePath, err)
+			persistenceLog.Warn("Failed to remove compacted ACL file", "file", filePath, "error", err)
 		}
 	}
 
 	if err := os.Rename(mergedPath, pm.aclPath); err != nil {
-		fmt.Printf("Failed to rename merged file: %v\n", err)
+		persistenceLog.Error("Failed to rename compacted ACL file", "error", err)
 		return
 	}
 
 	// Reset file size
-	pm.aclFileSize = 0
+	pm.setAclFileSize(0)
 	if info, err := os.Stat(pm.aclPath); err == nil {
-		pm.aclFileSize = info.Size()
+		pm.setAclFileSize(info.Size())
 	}
 
-	fmt.Printf("ACL files compacted: %d commands merged into %d commands\n",
-		len(matches), len(commands))
+	persistenceLog.Info("ACL files compacted", "commands", len(all), "merged", len(merged))
 }
 
 // SaveAtd 保存ATD快照（压缩二进制格式）
@@ -393,6 +677,7 @@ func (pm *PersistenceManager) SaveAtd() error {
 	if !pm.enabled {
 		return nil
 	}
+	start := time.Now()
 
 	// 确保目录存在
 	dir := filepath.Dir(pm.atdPath)
@@ -421,26 +706,73 @@ func (pm *PersistenceManager) SaveAtd() error {
 
 	// 写入缓存项
 	pm.cache.mu.RLock()
+	// 快照时间之前记录的ACL命令都已包含在快照中
+	snapshotTime := pm.nextTimestamp()
 	itemCount := 0
-	for key, item := range pm.cache.items {
-		// 检查是否过期
-		if item.Expiration > 0 && time.Now().UnixNano() > item.Expiration {
-			continue // 跳过过期数据
+	for _, db := range pm.cache.databases {
+		if len(db.items) == 0 {
+			continue
 		}
-
-		if err := pm.writeAtdItem(writer, key, item); err != nil {
+		// 之后的数据项属于该数据库
+		if err := writeAtdDatabase(writer, db.index); err != nil {
 			pm.cache.mu.RUnlock()
 			writer.Flush()
 			gzipWriter.Close()
 			file.Close()
-			return fmt.Errorf("failed to write item %s: %v", key, err)
+			return fmt.Errorf("failed to write database %d: %v", db.index, err)
+		}
+		for key, item := range db.items {
+			// 检查是否过期
+			if item.Expiration > 0 && time.Now().UnixNano() > item.Expiration {
+				continue // 跳过过期数据
+			}
+
+			if err := pm.writeAtdItem(writer, key, item); err != nil {
+				pm.cache.mu.RUnlock()
+				writer.Flush()
+				gzipWriter.Close()
+				file.Close()
+				return fmt.Errorf("failed to write item %s: %v", key, err)
+			}
+			itemCount++
 		}
-		itemCount++
 	}
 
 	// stats writing removed
+
+	// 保存fencing token计数器，锁全部过期后也不会回退
+	lockToken := pm.cache.lockToken
 	pm.cache.mu.RUnlock()
 
+	// 记录快照时间，加载时跳过已包含在快照中的ACL命令
+	if err := writer.WriteByte(RECORD_SNAPSHOT_TIME); err != nil {
+		writer.Flush()
+		gzipWriter.Close()
+		file.Close()
+		return fmt.Errorf("failed to write snapshot time: %v", err)
+	}
+	if err := binary.Write(writer, binary.BigEndian, snapshotTime); err != nil {
+		writer.Flush()
+		gzipWriter.Close()
+		file.Close()
+		return fmt.Errorf("failed to write snapshot time: %v", err)
+	}
+
+	if lockToken > 0 {
+		if err := writer.WriteByte(RECORD_LOCK_TOKEN); err != nil {
+			writer.Flush()
+			gzipWriter.Close()
+			file.Close()
+			return fmt.Errorf("failed to write lock token: %v", err)
+		}
+		if err := binary.Write(writer, binary.BigEndian, lockToken); err != nil {
+			writer.Flush()
+			gzipWriter.Close()
+			file.Close()
+			return fmt.Errorf("failed to write lock token: %v", err)
+		}
+	}
+
 	// 写入结束标记
 	if err := pm.writeAtdEndMarker(writer); err != nil {
 		writer.Flush()
@@ -458,9 +790,14 @@ func (pm *PersistenceManager) SaveAtd() error {
 	if err := os.Rename(tempFile, pm.atdPath); err != nil {
 		return fmt.Errorf("failed to rename temp file: %v", err)
 	}
+	// ACL压缩时丢弃快照之前的命令
+	atomic.StoreInt64(&pm.snapshotTime, snapshotTime)
 
 	pm.lastAtdTime = time.Now()
-	fmt.Printf("ATD snapshot saved successfully with %d items at %s\n", itemCount, pm.lastAtdTime.Format("2006-01-02 15:04:05"))
+	atomic.StoreInt64(&pm.lastAtdNanos, pm.lastAtdTime.UnixNano())
+	atomic.StoreInt64(&pm.lastAtdDuration, int64(pm.lastAtdTime.Sub(start)))
+	atomic.AddUint64(&pm.atdSaves, 1)
+	persistenceLog.Info("ATD snapshot saved", "file", pm.atdPath, "items", itemCount, "duration", pm.lastAtdTime.Sub(start))
 	return nil
 }
 
@@ -504,12 +841,13 @@ func (pm *PersistenceManager) LoadAtd() error {
 	defer pm.cache.mu.Unlock()
 
 	// 清空现有数据
-	pm.cache.items = make(map[string]*CacheItem)
-	pm.cache.expirationHeap = &ExpirationHeap{}
-	heap.Init(pm.cache.expirationHeap)
+	for _, db := range pm.cache.databases {
+		db.clearLocked()
+	}
 
-	// 读取记录
+	// 读取记录，没有数据库记录的旧快照只有0号数据库
 	itemCount := 0
+	db := pm.cache.databases[0]
 	for {
 		recordType, err := reader.ReadByte()
 		if err != nil {
@@ -526,17 +864,47 @@ func (pm *PersistenceManager) LoadAtd() error {
 				return fmt.Errorf("failed to read item: %v", err)
 			}
 			if item != nil { // 跳过过期数据
-				pm.cache.items[key] = item
+				if state, ok := item.valueLock(); ok {
+					pm.cache.raiseLockTokenLocked(state.Token)
+				}
+				pm.cache.touchVersionLocked(item)
+				db.items[key] = item
 				if item.Expiration > 0 {
-					heap.Push(pm.cache.expirationHeap, item)
+					heap.Push(db.expirationHeap, item)
 				}
 				itemCount++
 			}
 
+		case RECORD_DATABASE:
+			index, err := readAtdDatabase(reader)
+			if err != nil {
+				return fmt.Errorf("failed to read database: %v", err)
+			}
+			if index < 0 || index >= len(pm.cache.databases) {
+				return fmt.Errorf("database %d out of range", index)
+			}
+			db = pm.cache.databases[index]
+
+		case RECORD_SNAPSHOT_TIME:
+			if err := binary.Read(reader, binary.BigEndian, &pm.snapshotTime); err != nil {
+				return fmt.Errorf("failed to read snapshot time: %v", err)
+			}
+			// 之后记录的命令时间戳必须晚于快照
+			if pm.snapshotTime > pm.lastTimestamp {
+				pm.lastTimestamp = pm.snapshotTime
+			}
+
 		// RECORD_STATS case removed
 
+		case RECORD_LOCK_TOKEN:
+			var lockToken uint64
+			if err := binary.Read(reader, binary.BigEndian, &lockToken); err != nil {
+				return fmt.Errorf("failed to read lock token: %v", err)
+			}
+			pm.cache.raiseLockTokenLocked(lockToken)
+
 		case RECORD_END:
-			fmt.Printf("ATD snapshot loaded successfully with %d items\n", itemCount)
+			persistenceLog.Info("ATD snapshot loaded", "file", pm.atdPath, "items", itemCount)
 			return nil
 
 		default:
@@ -579,66 +947,133 @@ func (pm *PersistenceManager) LoadAcl() error {
 			continue
 		}
 
-		// 解析命令行: timestamp|type|key|value|ttl
-		parts := strings.Split(line, "|")
-		if len(parts) != 5 {
-			fmt.Printf("Warning: Invalid ACL line %d: %s\n", lineNum, line)
+		cmd, err := parseAclLine(line)
+		if err != nil {
+			persistenceLog.Warn("Skipping invalid ACL line", "line", lineNum, "error", err)
 			continue
 		}
 
-		// 解析时间戳（暂时不使用，但保留用于未来扩展）
-		_, err := strconv.ParseInt(parts[0], 10, 64)
-		if err != nil {
-			fmt.Printf("Warning: Invalid timestamp in line %d: %s\n", lineNum, line)
+		// 快照之前记录的命令已经包含在快照中
+		replay := cmd.Timestamp > pm.snapshotTime
+
+		if cmd.Type != CMD_BATCH {
+			if replay {
+				pm.replayCommand(cmd)
+				commandCount++
+			}
 			continue
 		}
 
-		// 解析TTL
-		ttlNanos, err := strconv.ParseInt(parts[4], 10, 64)
-		if err != nil {
-			fmt.Printf("Warning: Invalid TTL in line %d: %s\n", lineNum, line)
+		// 批量命令：只有完整读取的批次才会被执行
+		batch, ok := readAclBatch(scanner, cmd, &lineNum)
+		if !ok {
+			persistenceLog.Warn("Skipping incomplete ACL batch", "line", lineNum)
 			continue
 		}
-		ttl := time.Duration(ttlNanos)
-
-		// 解析值
-		var value interface{}
-		cmdType := parts[1]
-		key := parts[2]
-		valueStr := parts[3]
-
-		// 尝试解析复杂类型
-		if strings.HasPrefix(valueStr, "[") && strings.HasSuffix(valueStr, "]") {
-			// 数组格式: [apple banana orange]
-			content := strings.Trim(valueStr, "[]")
-			if content != "" {
-				value = strings.Fields(content)
-			} else {
-				value = []string{}
-			}
-		} else if strings.HasPrefix(valueStr, "map[") && strings.Contains(valueStr, ":") {
-			// 对象格式: map[age:25 name:john]
-			content := strings.TrimPrefix(valueStr, "map[")
-			content = strings.TrimSuffix(content, "]")
-			pairs := strings.Fields(content)
-			obj := make(map[string]string)
-			for _, pair := range pairs {
-				if strings.Contains(pair, ":") {
-					kv := strings.SplitN(pair, ":", 2)
-					if len(kv) == 2 {
-						obj[kv[0]] = kv[1]
-					}
-				}
-			}
-			value = obj
-		} else {
-			// 普通字符串
-			value = valueStr
+		if !replay {
+			continue
 		}
+		for _, batchCmd := range batch {
+			pm.replayCommand(batchCmd)
+		}
+		commandCount += len(batch)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ACL: %v", err)
+	}
+
+	persistenceLog.Info("ACL loaded", "file", pm.aclPath, "commands", commandCount)
+	return nil
+}
+
+// parseAclLine parses an ACL line: timestamp|type|key|value|ttl|db.
+// Lines written without the database index apply to database 0.
+func parseAclLine(line string) (Command, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) != 5 && len(parts) != 6 {
+		return Command{}, fmt.Errorf("expected 6 fields: %s", line)
+	}
+
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Command{}, fmt.Errorf("invalid timestamp: %s", line)
+	}
+
+	ttlNanos, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil {
+		return Command{}, fmt.Errorf("invalid TTL: %s", line)
+	}
+
+	db := 0
+	if len(parts) == 6 {
+		if db, err = strconv.Atoi(parts[5]); err != nil {
+			return Command{}, fmt.Errorf("invalid database: %s", line)
+		}
+	}
+
+	return Command{
+		Timestamp: timestamp,
+		Type:      parts[1],
+		Key:       parts[2],
+		Value:     parseAclValue(parts[3]),
+		TTL:       time.Duration(ttlNanos),
+		DB:        db,
+	}, nil
+}
+
+// readAclBatch reads the commands announced by a batch header. It returns
+// false when the batch is truncated or contains an invalid line, in which
+// case none of its commands must be applied.
+func readAclBatch(scanner *bufio.Scanner, header Command, lineNum *int) ([]Command, bool) {
+	count, err := strconv.Atoi(fmt.Sprintf("%v", header.Value))
+	if err != nil || count < 0 {
+		return nil, false
+	}
 
-		// 执行命令 - 直接操作缓存，避免死锁
-		switch cmdType {
-		case CMD_SET, CMD_SETS, CMD_SETX:
+	batch := make([]Command, 0, count)
+	for len(batch) < count && scanner.Scan() {
+		*lineNum++
+		cmd, err := parseAclLine(strings.TrimSpace(scanner.Text()))
+		if err != nil || cmd.Type == CMD_BATCH {
+			return nil, false
+		}
+		batch = append(batch, cmd)
+	}
+	return batch, len(batch) == count
+}
+
+// replayCommand applies a logged command directly to the cache items.
+// 直接操作缓存，避免死锁：调用方保证没有并发访问
+func (pm *PersistenceManager) replayCommand(cmd Command) {
+	cmdType := cmd.Type
+	key := cmd.Key
+	value := cmd.Value
+	ttl := cmd.TTL
+
+	db, err := pm.cache.Select(cmd.DB)
+	if err != nil {
+		return
+	}
+
+	switch cmdType {
+	case CMD_SET, CMD_SETS, CMD_SETX:
+		// 确定数据类型
+		var dataType string
+		switch value.(type) {
+		case []string:
+			dataType = "array"
+		case map[string]string:
+			dataType = "object"
+		default:
+			dataType = "string"
+		}
+
+		// Replaces the previous item and its expiration heap entry
+		db.storeItemLocked(key, &CacheItem{Value: value, Type: dataType}, ttl)
+	case CMD_SETNX, CMD_SETSNX, CMD_SETXNX:
+		// NX命令：只在键不存在时设置
+		if _, exists := db.items[key]; !exists {
 			// 确定数据类型
 			var dataType string
 			switch value.(type) {
@@ -650,87 +1085,224 @@ func (pm *PersistenceManager) LoadAcl() error {
 				dataType = "string"
 			}
 
-			item := &CacheItem{
-				Value: value,
-				key:   key,
-				Type:  dataType,
+			db.storeItemLocked(key, &CacheItem{Value: value, Type: dataType}, ttl)
+		}
+	case CMD_DEL:
+		// 删除任意类型的key（DEL命令对所有类型生效）
+		db.removeItemLocked(key)
+	case CMD_DELS:
+		// 删除数组类型的key
+		if item, exists := db.items[key]; exists && item.Type == "array" {
+			// If has expiration time, remove from heap
+			if item.Expiration > 0 && item.index >= 0 {
+				heap.Remove(db.expirationHeap, item.index)
 			}
-			// Only set expiration time when ttl > 0
-			if ttl > 0 {
-				item.Expiration = time.Now().Add(ttl).UnixNano()
-				// Add to expiration heap
-				heap.Push(pm.cache.expirationHeap, item)
+			delete(db.items, key)
+		}
+	case CMD_DELX:
+		// 删除对象类型的key
+		if item, exists := db.items[key]; exists && item.Type == "object" {
+			// If has expiration time, remove from heap
+			if item.Expiration > 0 && item.index >= 0 {
+				heap.Remove(db.expirationHeap, item.index)
 			}
-			pm.cache.items[key] = item
-			// stats tracking removed
-		case CMD_SETNX, CMD_SETSNX, CMD_SETXNX:
-			// NX命令：只在键不存在时设置
-			if _, exists := pm.cache.items[key]; !exists {
-				// 确定数据类型
-				var dataType string
-				switch value.(type) {
-				case []string:
-					dataType = "array"
-				case map[string]string:
-					dataType = "object"
-				default:
-					dataType = "string"
-				}
-
-				item := &CacheItem{
-					Value: value,
-					key:   key,
-					Type:  dataType,
-				}
-				// Only set expiration time when ttl > 0
-				if ttl > 0 {
-					item.Expiration = time.Now().Add(ttl).UnixNano()
-					// Add to expiration heap
-					heap.Push(pm.cache.expirationHeap, item)
-				}
-				pm.cache.items[key] = item
-				// stats tracking removed
+			delete(db.items, key)
+		}
+	case CMD_ZADD:
+		// 有序集合增量添加，成员经过编码
+		members, err := decodeZMembers(value)
+		if err != nil {
+			break
+		}
+		item := db.items[key]
+		zset, ok := item.valueZSet()
+		if !ok {
+			zset = NewSortedSet()
+			item = &CacheItem{Value: zset, Type: "zset"}
+			db.storeItemLocked(key, item, 0)
+		}
+		for _, m := range members {
+			zset.Add(m.Member, m.Score)
+		}
+		db.touchExpirationLocked(item, ttl)
+	case CMD_ZREM:
+		// 有序集合删除成员，成员经过编码
+		members, _ := decodeAclArgs(value)
+		if zset, ok := db.items[key].valueZSet(); ok {
+			for _, m := range members {
+				zset.Remove(m)
 			}
-		case CMD_DEL:
-			// 删除字符串类型的key
-			if item, exists := pm.cache.items[key]; exists && item.Type == "string" {
-				// If has expiration time, remove from heap
-				if item.Expiration > 0 && item.index >= 0 {
-					heap.Remove(pm.cache.expirationHeap, item.index)
-				}
-				delete(pm.cache.items, key)
-				// stats tracking removed
+			if zset.Card() == 0 {
+				db.removeItemLocked(key)
 			}
-		case CMD_DELS:
-			// 删除数组类型的key
-			if item, exists := pm.cache.items[key]; exists && item.Type == "array" {
-				// If has expiration time, remove from heap
-				if item.Expiration > 0 && item.index >= 0 {
-					heap.Remove(pm.cache.expirationHeap, item.index)
-				}
-				delete(pm.cache.items, key)
-				// stats tracking removed
+		}
+	case CMD_SADD:
+		// 集合增量添加，成员经过编码
+		members, err := decodeAclArgs(value)
+		if err != nil {
+			break
+		}
+		item := db.items[key]
+		set, ok := item.valueSet()
+		if !ok {
+			set = NewSet()
+			item = &CacheItem{Value: set, Type: "set"}
+			db.storeItemLocked(key, item, 0)
+		}
+		for _, m := range members {
+			set[m] = struct{}{}
+		}
+		db.touchExpirationLocked(item, ttl)
+	case CMD_SREM:
+		// 集合删除成员，成员经过编码
+		members, _ := decodeAclArgs(value)
+		if set, ok := db.items[key].valueSet(); ok {
+			for _, m := range members {
+				delete(set, m)
+			}
+			if len(set) == 0 {
+				db.removeItemLocked(key)
+			}
+		}
+	case CMD_SSTORE:
+		// 集合运算结果整体替换，成员经过编码
+		members, err := decodeAclArgs(value)
+		if err != nil {
+			break
+		}
+		db.storeItemLocked(key, &CacheItem{Value: NewSet(members...), Type: "set"}, ttl)
+	case CMD_LOCK:
+		// 获取或续期锁，token保持不变
+		if token, err := strconv.ParseUint(fmt.Sprintf("%v", value), 10, 64); err == nil {
+			db.raiseLockTokenLocked(token)
+			db.storeItemLocked(key, &CacheItem{Value: &LockState{Token: token}, Type: "lock"}, ttl)
+		}
+	case CMD_UNLOCK:
+		// 只释放同一token持有的锁
+		if token, err := strconv.ParseUint(fmt.Sprintf("%v", value), 10, 64); err == nil {
+			db.raiseLockTokenLocked(token)
+			if state, ok := db.items[key].valueLock(); ok && state.Token == token {
+				db.removeItemLocked(key)
 			}
-		case CMD_DELX:
-			// 删除对象类型的key
-			if item, exists := pm.cache.items[key]; exists && item.Type == "object" {
-				// If has expiration time, remove from heap
-				if item.Expiration > 0 && item.index >= 0 {
-					heap.Remove(pm.cache.expirationHeap, item.index)
+		}
+	case CMD_LOCKTOKEN:
+		// 压缩后保留的最大fencing token
+		if token, err := strconv.ParseUint(fmt.Sprintf("%v", value), 10, 64); err == nil {
+			db.raiseLockTokenLocked(token)
+		}
+	case CMD_RLSTATE:
+		// 限流器状态整体替换
+		if r, err := decodeRateLimiter(fmt.Sprintf("%v", value)); err == nil {
+			db.storeItemLocked(key, &CacheItem{Value: r, Type: "ratelimit"}, ttl)
+		}
+	case CMD_RLREQUEST:
+		// 滑动窗口增量添加请求，丢弃窗口之外的请求
+		if e, err := parseRateLimitEntry(fmt.Sprintf("%v", value)); err == nil {
+			var log []RateLimitEntry
+			if item, exists := db.items[key]; exists {
+				if r, ok := item.Value.(*RateLimiter); ok && r.Algorithm == RateLimitSlidingWindow {
+					log = r.Log
 				}
-				delete(pm.cache.items, key)
-				// stats tracking removed
 			}
+			r := &RateLimiter{Algorithm: RateLimitSlidingWindow, Log: addToWindow(log, e.Time-int64(ttl), e)}
+			db.storeItemLocked(key, &CacheItem{Value: r, Type: "ratelimit"}, ttl)
+		}
+	case CMD_PFADD:
+		// HyperLogLog按哈希增量添加
+		hashes, _ := value.([]string)
+		item := db.items[key]
+		h, ok := item.valueHyperLogLog()
+		if !ok {
+			h = NewHyperLogLog()
+			item = &CacheItem{Value: h, Type: "hyperloglog"}
+			db.storeItemLocked(key, item, 0)
+		}
+		for _, hash := range parseHashes(hashes) {
+			h.addHash(hash)
+		}
+		db.touchExpirationLocked(item, ttl)
+	case CMD_PFSTATE:
+		// HyperLogLog寄存器整体替换
+		if h, err := decodeHyperLogLog(fmt.Sprintf("%v", value)); err == nil {
+			db.storeItemLocked(key, &CacheItem{Value: h, Type: "hyperloglog"}, ttl)
+		}
+	case CMD_BFRESERVE:
+		// 创建空的布隆过滤器
+		if errorRate, capacity, err := parseBloomParams(fmt.Sprintf("%v", value)); err == nil {
+			if b, err := NewBloomFilter(errorRate, capacity); err == nil {
+				db.storeItemLocked(key, &CacheItem{Value: b, Type: "bloom"}, ttl)
+			}
+		}
+	case CMD_BFADD:
+		// 布隆过滤器按哈希增量添加
+		hashes, _ := value.([]string)
+		item := db.items[key]
+		b, ok := item.valueBloom()
+		if !ok {
+			b, _ = NewBloomFilter(DefaultBloomErrorRate, DefaultBloomCapacity)
+			item = &CacheItem{Value: b, Type: "bloom"}
+			db.storeItemLocked(key, item, 0)
+		}
+		for _, pair := range parseBloomHashes(hashes) {
+			b.addHash(pair[0], pair[1])
+		}
+		db.touchExpirationLocked(item, ttl)
+	case CMD_XADD, CMD_XGROUP, CMD_XDELIVER, CMD_XACK:
+		// 流命令，参数经过编码
+		if args, err := decodeAclArgs(value); err == nil {
+			db.replayStreamCommand(cmdType, key, args, cmd.Timestamp)
+		}
+	case CMD_FLUSHDB:
+		// 清空单个数据库
+		db.clearLocked()
+	case CMD_FLUSHALL:
+		// 清空所有数据库
+		for _, other := range pm.cache.databases {
+			other.clearLocked()
+		}
+	case CMD_SWAPDB:
+		// 交换两个数据库的数据
+		var a, b int
+		if _, err := fmt.Sscanf(fmt.Sprintf("%v", value), "%d %d", &a, &b); err != nil ||
+			a < 0 || a >= len(pm.cache.databases) || b < 0 || b >= len(pm.cache.databases) {
+			break
+		}
+		pm.cache.databases[a].swapLocked(pm.cache.databases[b])
+	case CMD_MOVE:
+		// 移动key到另一个数据库
+		if index, err := strconv.Atoi(fmt.Sprintf("%v", value)); err == nil {
+			if dest, err := pm.cache.Select(index); err == nil && dest.database != db.database {
+				db.moveItemLocked(key, dest)
+			}
+		}
+	case CMD_LPUSH, CMD_RPUSH:
+		// 数组两端增量添加，元素经过编码
+		values, err := decodeAclArgs(value)
+		if err != nil {
+			break
+		}
+		item, list, err := db.getListLocked(key, time.Now().UnixNano())
+		if err != nil {
+			break
+		}
+		if item == nil {
+			item = &CacheItem{Type: "array"}
+			db.storeItemLocked(key, item, 0)
+		}
+		item.Value = pushList(list, values, cmdType == CMD_LPUSH)
+		db.touchExpirationLocked(item, ttl)
+	case CMD_LPOP, CMD_RPOP:
+		// 从数组两端移除一个元素，最后一个元素移除后删除key
+		item, list, err := db.getListLocked(key, time.Now().UnixNano())
+		if err != nil || item == nil || len(list) == 0 {
+			break
+		}
+		if _, rest := popList(list, cmdType == CMD_LPOP); len(rest) > 0 {
+			item.Value = rest
+		} else {
+			db.removeItemLocked(key)
 		}
-		commandCount++
-	}
-
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("failed to read ACL: %v", err)
 	}
-
-	fmt.Printf("ACL loaded successfully with %d commands\n", commandCount)
-	return nil
 }
 
 // writeAtdHeader 写入ATD文件头
@@ -846,6 +1418,30 @@ func (pm *PersistenceManager) readAtdItem(reader *bufio.Reader) (string, *CacheI
 		key:        key,
 	}
 
+	// 根据值类型恢复数据类型
+	switch value.(type) {
+	case []string:
+		item.Type = "array"
+	case map[string]string:
+		item.Type = "object"
+	case *SortedSet:
+		item.Type = "zset"
+	case MemberSet:
+		item.Type = "set"
+	case *LockState:
+		item.Type = "lock"
+	case *RateLimiter:
+		item.Type = "ratelimit"
+	case *HyperLogLog:
+		item.Type = "hyperloglog"
+	case *BloomFilter:
+		item.Type = "bloom"
+	case *Stream:
+		item.Type = "stream"
+	default:
+		item.Type = "string"
+	}
+
 	return key, item, nil
 }
 
@@ -853,7 +1449,7 @@ func (pm *PersistenceManager) readAtdItem(reader *bufio.Reader) (string, *CacheI
 func (pm *PersistenceManager) writeAtdValue(writer *bufio.Writer, value interface{}) error {
 	switch v := value.(type) {
 	case string:
-		if err := writer.WriteByte(0x01); err != nil { // String type
+		if err := writer.WriteByte(VALUE_STRING); err != nil {
 			return err
 		}
 		valueBytes := []byte(v)
@@ -864,7 +1460,7 @@ func (pm *PersistenceManager) writeAtdValue(writer *bufio.Writer, value interfac
 		return err
 
 	case []string:
-		if err := writer.WriteByte(0x02); err != nil { // Array type
+		if err := writer.WriteByte(VALUE_ARRAY); err != nil {
 			return err
 		}
 		if err := binary.Write(writer, binary.BigEndian, uint16(len(v))); err != nil {
@@ -882,7 +1478,7 @@ func (pm *PersistenceManager) writeAtdValue(writer *bufio.Writer, value interfac
 		return nil
 
 	case map[string]string:
-		if err := writer.WriteByte(0x03); err != nil { // Object type
+		if err := writer.WriteByte(VALUE_OBJECT); err != nil {
 			return err
 		}
 		if err := binary.Write(writer, binary.BigEndian, uint16(len(v))); err != nil {
@@ -908,9 +1504,95 @@ func (pm *PersistenceManager) writeAtdValue(writer *bufio.Writer, value interfac
 		}
 		return nil
 
+	case *SortedSet:
+		if err := writer.WriteByte(VALUE_ZSET); err != nil {
+			return err
+		}
+		members := v.Members()
+		if err := binary.Write(writer, binary.BigEndian, uint32(len(members))); err != nil {
+			return err
+		}
+		for _, m := range members {
+			memberBytes := []byte(m.Member)
+			if err := binary.Write(writer, binary.BigEndian, uint16(len(memberBytes))); err != nil {
+				return err
+			}
+			if _, err := writer.Write(memberBytes); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, math.Float64bits(m.Score)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case MemberSet:
+		if err := writer.WriteByte(VALUE_SET); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, uint32(len(v))); err != nil {
+			return err
+		}
+		for m := range v {
+			memberBytes := []byte(m)
+			if err := binary.Write(writer, binary.BigEndian, uint16(len(memberBytes))); err != nil {
+				return err
+			}
+			if _, err := writer.Write(memberBytes); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *LockState:
+		if err := writer.WriteByte(VALUE_LOCK); err != nil {
+			return err
+		}
+		return binary.Write(writer, binary.BigEndian, v.Token)
+
+	case *RateLimiter:
+		if err := writer.WriteByte(VALUE_RATELIMIT); err != nil {
+			return err
+		}
+		algorithm := []byte(v.Algorithm)
+		if err := writer.WriteByte(byte(len(algorithm))); err != nil {
+			return err
+		}
+		if _, err := writer.Write(algorithm); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, math.Float64bits(v.Tokens)); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, v.Updated); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, uint32(len(v.Log))); err != nil {
+			return err
+		}
+		return binary.Write(writer, binary.BigEndian, v.Log)
+
+	case *HyperLogLog:
+		if err := writer.WriteByte(VALUE_HLL); err != nil {
+			return err
+		}
+		return writeAtdBytes(writer, v.marshalBinary())
+
+	case *BloomFilter:
+		if err := writer.WriteByte(VALUE_BLOOM); err != nil {
+			return err
+		}
+		return writeAtdBytes(writer, v.marshalBinary())
+
+	case *Stream:
+		if err := writer.WriteByte(VALUE_STREAM); err != nil {
+			return err
+		}
+		return writeAtdBytes(writer, v.marshalBinary())
+
 	default:
 		// 对于其他类型，转换为字符串
-		if err := writer.WriteByte(0x01); err != nil { // String type
+		if err := writer.WriteByte(VALUE_STRING); err != nil {
 			return err
 		}
 		valueStr := fmt.Sprintf("%v", v)
@@ -931,7 +1613,7 @@ func (pm *PersistenceManager) readAtdValue(reader *bufio.Reader) (interface{}, e
 	}
 
 	switch valueType {
-	case 0x01: // String
+	case VALUE_STRING:
 		var length uint32
 		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
 			return nil, err
@@ -942,7 +1624,7 @@ func (pm *PersistenceManager) readAtdValue(reader *bufio.Reader) (interface{}, e
 		}
 		return string(valueBytes), nil
 
-	case 0x02: // Array
+	case VALUE_ARRAY:
 		var length uint16
 		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
 			return nil, err
@@ -961,7 +1643,7 @@ func (pm *PersistenceManager) readAtdValue(reader *bufio.Reader) (interface{}, e
 		}
 		return array, nil
 
-	case 0x03: // Object
+	case VALUE_OBJECT:
 		var length uint16
 		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
 			return nil, err
@@ -990,11 +1672,150 @@ func (pm *PersistenceManager) readAtdValue(reader *bufio.Reader) (interface{}, e
 		}
 		return object, nil
 
+	case VALUE_ZSET:
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		zset := NewSortedSet()
+		for i := uint32(0); i < length; i++ {
+			var memberLen uint16
+			if err := binary.Read(reader, binary.BigEndian, &memberLen); err != nil {
+				return nil, err
+			}
+			memberBytes := make([]byte, memberLen)
+			if _, err := io.ReadFull(reader, memberBytes); err != nil {
+				return nil, err
+			}
+			var bits uint64
+			if err := binary.Read(reader, binary.BigEndian, &bits); err != nil {
+				return nil, err
+			}
+			zset.Add(string(memberBytes), math.Float64frombits(bits))
+		}
+		return zset, nil
+
+	case VALUE_SET:
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		set := make(MemberSet, length)
+		for i := uint32(0); i < length; i++ {
+			var memberLen uint16
+			if err := binary.Read(reader, binary.BigEndian, &memberLen); err != nil {
+				return nil, err
+			}
+			memberBytes := make([]byte, memberLen)
+			if _, err := io.ReadFull(reader, memberBytes); err != nil {
+				return nil, err
+			}
+			set[string(memberBytes)] = struct{}{}
+		}
+		return set, nil
+
+	case VALUE_LOCK:
+		var token uint64
+		if err := binary.Read(reader, binary.BigEndian, &token); err != nil {
+			return nil, err
+		}
+		return &LockState{Token: token}, nil
+
+	case VALUE_RATELIMIT:
+		algorithmLen, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		algorithm := make([]byte, algorithmLen)
+		if _, err := io.ReadFull(reader, algorithm); err != nil {
+			return nil, err
+		}
+		r := &RateLimiter{Algorithm: string(algorithm)}
+		var bits uint64
+		if err := binary.Read(reader, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		r.Tokens = math.Float64frombits(bits)
+		if err := binary.Read(reader, binary.BigEndian, &r.Updated); err != nil {
+			return nil, err
+		}
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length > 0 {
+			r.Log = make([]RateLimitEntry, length)
+			if err := binary.Read(reader, binary.BigEndian, r.Log); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+
+	case VALUE_HLL:
+		data, err := readAtdBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		return unmarshalHyperLogLog(data)
+
+	case VALUE_BLOOM:
+		data, err := readAtdBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		return unmarshalBloomFilter(data)
+
+	case VALUE_STREAM:
+		data, err := readAtdBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		return unmarshalStream(data)
+
 	default:
 		return nil, fmt.Errorf("unknown value type: %d", valueType)
 	}
 }
 
+// writeAtdDatabase writes the record announcing the database of the next items
+func writeAtdDatabase(writer *bufio.Writer, index int) error {
+	if err := writer.WriteByte(RECORD_DATABASE); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.BigEndian, uint32(index))
+}
+
+// readAtdDatabase reads the index written by writeAtdDatabase, after the record type
+func readAtdDatabase(reader *bufio.Reader) (int, error) {
+	var index uint32
+	if err := binary.Read(reader, binary.BigEndian, &index); err != nil {
+		return 0, err
+	}
+	return int(index), nil
+}
+
+// writeAtdBytes writes a length-prefixed binary value
+func writeAtdBytes(writer *bufio.Writer, data []byte) error {
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+// readAtdBytes reads a value written by writeAtdBytes
+func readAtdBytes(reader *bufio.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 // writeAtdStats method removed
 
 // readAtdStats method removed
@@ -1006,6 +1827,7 @@ func (pm *PersistenceManager) writeAtdEndMarker(writer *bufio.Writer) error {
 
 // periodicAtd 定期保存ATD快照
 func (pm *PersistenceManager) periodicAtd() {
+	defer pm.wg.Done()
 	ticker := time.NewTicker(pm.atdInterval)
 	defer ticker.Stop()
 
@@ -1013,8 +1835,10 @@ func (pm *PersistenceManager) periodicAtd() {
 		select {
 		case <-ticker.C:
 			if err := pm.SaveAtd(); err != nil {
-				fmt.Printf("Failed to save ATD: %v\n", err)
+				persistenceLog.Error("Failed to save ATD snapshot", "error", err)
 			}
+		case interval := <-pm.atdIntervalChan:
+			ticker.Reset(interval)
 		case <-pm.stopChan:
 			return
 		}
@@ -1023,6 +1847,7 @@ func (pm *PersistenceManager) periodicAtd() {
 
 // periodicAcl 定期同步ACL
 func (pm *PersistenceManager) periodicAcl() {
+	defer pm.wg.Done()
 	ticker := time.NewTicker(pm.aclInterval)
 	defer ticker.Stop()
 
@@ -1030,6 +1855,8 @@ func (pm *PersistenceManager) periodicAcl() {
 		select {
 		case <-ticker.C:
 			pm.flushAcl()
+		case interval := <-pm.aclIntervalChan:
+			ticker.Reset(interval)
 		case <-pm.stopChan:
 			return
 		}
@@ -1043,6 +1870,23 @@ func (pm *PersistenceManager) GetLastAtdTime() time.Time {
 	return pm.lastAtdTime
 }
 
+// Stats returns the statistics of the persistence
+func (pm *PersistenceManager) Stats() PersistenceStats {
+	stats := PersistenceStats{
+		QueueDepth:      len(pm.commandChan),
+		QueueCapacity:   cap(pm.commandChan),
+		DroppedCommands: atomic.LoadUint64(&pm.droppedCommands),
+		LastAtdDuration: time.Duration(atomic.LoadInt64(&pm.lastAtdDuration)),
+		AtdSaves:        atomic.LoadUint64(&pm.atdSaves),
+		AclSize:         atomic.LoadInt64(&pm.aclSize),
+		AclRotations:    atomic.LoadUint64(&pm.aclRotations),
+	}
+	if nanos := atomic.LoadInt64(&pm.lastAtdNanos); nanos > 0 {
+		stats.LastAtdTime = time.Unix(0, nanos)
+	}
+	return stats
+}
+
 // IsEnabled 检查是否启用
 func (pm *PersistenceManager) IsEnabled() bool {
 	pm.mutex.RLock()
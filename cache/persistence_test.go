@@ -0,0 +1,293 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompactAclFiles(t *testing.T) {
+	tests := []struct {
+		name         string
+		rotated      []Command
+		current      []Command
+		snapshotTime int64
+		want         []string
+	}{
+		{
+			name:    "a write replaces the commands before it",
+			rotated: []Command{{Timestamp: 1, Type: CMD_SET, Key: "a", Value: "1"}, {Timestamp: 2, Type: CMD_SET, Key: "b", Value: "1"}},
+			current: []Command{{Timestamp: 3, Type: CMD_SET, Key: "a", Value: "2"}},
+			want:    []string{"2 SET b", "3 SET a"},
+		},
+		{
+			name:    "incremental commands are kept in time order",
+			rotated: []Command{{Timestamp: 1, Type: CMD_RPUSH, Key: "l", Value: encodeAclArgs([]string{"a"})}, {Timestamp: 3, Type: CMD_LPOP, Key: "l"}},
+			current: []Command{{Timestamp: 2, Type: CMD_RPUSH, Key: "l", Value: encodeAclArgs([]string{"b"})}},
+			want:    []string{"1 RPUSH l", "2 RPUSH l", "3 LPOP l"},
+		},
+		{
+			name:    "FLUSHALL drops the commands before it",
+			rotated: []Command{{Timestamp: 1, Type: CMD_SET, Key: "a", Value: "1"}, {Timestamp: 2, Type: CMD_FLUSHALL}},
+			current: []Command{{Timestamp: 3, Type: CMD_SET, Key: "b", Value: "1"}},
+			want:    []string{"2 FLUSHALL ", "3 SET b"},
+		},
+		{
+			name: "commands included in the snapshot are dropped",
+			rotated: []Command{
+				{Timestamp: 1, Type: CMD_SET, Key: "a", Value: "1"},
+				{Timestamp: 2, Type: CMD_RPUSH, Key: "l", Value: encodeAclArgs([]string{"a"})},
+			},
+			current: []Command{
+				{Timestamp: 3, Type: CMD_RPUSH, Key: "l", Value: encodeAclArgs([]string{"b"})},
+				{Timestamp: 4, Type: CMD_SET, Key: "b", Value: "1"},
+			},
+			snapshotTime: 2,
+			want:         []string{"3 RPUSH l", "4 SET b"},
+		},
+		{
+			name:         "all the commands are in the snapshot",
+			rotated:      []Command{{Timestamp: 1, Type: CMD_SADD, Key: "s", Value: encodeAclArgs([]string{"a"})}},
+			current:      []Command{{Timestamp: 2, Type: CMD_SADD, Key: "s", Value: encodeAclArgs([]string{"b"})}},
+			snapshotTime: 5,
+			want:         nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aclPath := filepath.Join(t.TempDir(), "cache.acl")
+			writeAcl(t, aclPath+".20240101_000000", tt.rotated)
+			writeAcl(t, aclPath, tt.current)
+			pm := &PersistenceManager{aclPath: aclPath, snapshotTime: tt.snapshotTime}
+
+			pm.compactAclFiles()
+
+			if got := readAcl(t, aclPath); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compacted ACL = %q, want %q", got, tt.want)
+			}
+			if rotated, _ := filepath.Glob(aclPath + ".*"); len(rotated) != 0 {
+				t.Errorf("files left after compaction: %v", rotated)
+			}
+		})
+	}
+}
+
+func writeAcl(t *testing.T, path string, cmds []Command) {
+	t.Helper()
+	var data []byte
+	for _, cmd := range cmds {
+		data = append(data, formatAclLine(cmd)...)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAcl returns the commands of an ACL file as "timestamp type key"
+func readAcl(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var cmds []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		cmd, err := parseAclLine(scanner.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, fmt.Sprintf("%d %s %s", cmd.Timestamp, cmd.Type, cmd.Key))
+	}
+	return cmds
+}
+
+func TestSaveAtdRecordsSnapshotTime(t *testing.T) {
+	dir := t.TempDir()
+	c := NewWithPersistence(filepath.Join(dir, "cache.atd"), filepath.Join(dir, "cache.acl"), time.Hour, time.Hour)
+	defer c.persistence.Stop()
+	c.Set("a", "1", 0)
+
+	before := c.persistence.nextTimestamp()
+	if err := c.persistence.SaveAtd(); err != nil {
+		t.Fatal(err)
+	}
+	// Compaction drops the commands logged before the saved snapshot
+	if got := atomic.LoadInt64(&c.persistence.snapshotTime); got <= before {
+		t.Fatalf("snapshotTime = %d, want after %d", got, before)
+	}
+}
+
+// TestAclReplay restarts from the last snapshot, from an earlier one and from
+// the ACL alone: the commands already in a snapshot must not be replayed on it
+func TestAclReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		// run changes c, calling snapshot once on the way
+		run func(c *Cache, snapshot func())
+		// state describes c without changing it
+		state func(c *Cache) string
+		want  string
+	}{
+		{
+			name: "sorted set members with spaces and |",
+			run: func(c *Cache, snapshot func()) {
+				c.ZAdd("z", []ZMember{{Member: "a b", Score: 1}, {Member: "x|y", Score: 2}}, 0)
+				snapshot()
+				c.ZAdd("z", []ZMember{{Member: " c ", Score: 3}, {Member: "p|q r", Score: 4}}, 0)
+				c.ZIncrBy("z", 10, "a b")
+				c.ZRem("z", []string{"x|y"})
+			},
+			state: func(c *Cache) string {
+				members, _ := c.ZRange("z", 0, -1)
+				var pairs []string
+				for _, m := range members {
+					pairs = append(pairs, fmt.Sprintf("%q:%g", m.Member, m.Score))
+				}
+				return fmt.Sprint(pairs)
+			},
+			want: `[" c ":3 "p|q r":4 "a b":11]`,
+		},
+		{
+			name: "set members with spaces and |",
+			run: func(c *Cache, snapshot func()) {
+				c.SAdd("s", []string{"hello world", "x|y"}, 0)
+				snapshot()
+				c.SAdd("p", []string{"x|y", "a b|c"}, 0)
+				c.SRem("s", []string{"hello world"})
+				c.SCombineStore(SetUnion, "u", []string{"s", "p"})
+			},
+			state: func(c *Cache) string {
+				var sets []string
+				for _, key := range []string{"s", "p", "u"} {
+					members, _ := c.SMembers(key)
+					sets = append(sets, fmt.Sprintf("%s %q", key, members))
+				}
+				return fmt.Sprint(sets)
+			},
+			want: `[s ["x|y"] p ["a b|c" "x|y"] u ["a b|c" "x|y"]]`,
+		},
+		{
+			name: "stream entries and consumer groups",
+			run: func(c *Cache, snapshot func()) {
+				c.XAdd("s", "1-1", []string{"f", "a"}, 0)
+				c.XGroupCreate("s", "g", "0", false)
+				c.XReadGroup("g", "alice", []string{"s"}, []string{">"}, 10, 0, nil)
+				snapshot()
+				c.XAdd("s", "1-2", []string{"f", "b"}, 0)
+				c.XReadGroup("g", "bob", []string{"s"}, []string{">"}, 10, 0, nil)
+				c.XAck("s", "g", []string{"1-1"})
+			},
+			state: func(c *Cache) string {
+				length, _ := c.XLen("s")
+				pending, _ := c.XPending("s", "g")
+				return fmt.Sprintf("len %d, pending %d %v-%v %v", length, pending.Count, pending.Min, pending.Max, pending.Consumers)
+			},
+			want: "len 2, pending 1 1-2-1-2 map[bob:1]",
+		},
+		{
+			name: "list pushes and pops, elements with spaces and |",
+			run: func(c *Cache, snapshot func()) {
+				c.RPush("l", []string{"a", "job 1", "x|y"}, 0)
+				c.LPop("l")
+				snapshot()
+				c.LPush("l", []string{"z"}, 0)
+				c.RPush("l", []string{"job 2|3"}, 0)
+				c.BLPop([]string{"l"}, time.Second, nil)
+				c.RPush("l", []string{"d"}, 0)
+				c.RPop("l")
+			},
+			state: func(c *Cache) string {
+				value, _ := c.Get("l")
+				return fmt.Sprintf("%q", value)
+			},
+			want: `["job 1" "x|y" "job 2|3"]`,
+		},
+		{
+			name: "logical databases",
+			run: func(c *Cache, snapshot func()) {
+				db1, _ := c.Select(1)
+				db1.Set("k", "one", 0)
+				c.Set("k", "zero", 0)
+				snapshot()
+				c.Move("k", 2)
+				c.SwapDB(1, 3)
+				db1.RPush("l", []string{"a"}, 0)
+			},
+			state: func(c *Cache) string {
+				var values []string
+				for i := 0; i < 4; i++ {
+					db, _ := c.Select(i)
+					value, _ := db.Get("k")
+					length, _ := db.LLen("l")
+					values = append(values, fmt.Sprintf("%d:%v/%d", i, value, length))
+				}
+				return fmt.Sprint(values)
+			},
+			want: "[0:<nil>/0 1:<nil>/1 2:zero/0 3:one/0]",
+		},
+		{
+			name: "batches",
+			run: func(c *Cache, snapshot func()) {
+				c.Atomic(func(tx *Cache) {
+					tx.RPush("l", []string{"a"}, 0)
+					tx.XAdd("s", "1-1", []string{"f", "a"}, 0)
+				})
+				snapshot()
+				c.Atomic(func(tx *Cache) {
+					tx.RPush("l", []string{"b"}, 0)
+					tx.XAdd("s", "1-2", []string{"f", "b"}, 0)
+				})
+			},
+			state: func(c *Cache) string {
+				lists, _ := c.LLen("l")
+				streams, _ := c.XLen("s")
+				return fmt.Sprintf("list %d, stream %d", lists, streams)
+			},
+			want: "list 2, stream 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			atd, acl := filepath.Join(dir, "cache.atd"), filepath.Join(dir, "cache.acl")
+			c := NewWithPersistence(atd, acl, time.Hour, time.Hour)
+			snapshot := func() {
+				if err := c.persistence.SaveAtd(); err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(atd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(atd+".earlier", data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.run(c, snapshot)
+			if got := tt.state(c); got != tt.want {
+				t.Fatalf("state = %s, want %s", got, tt.want)
+			}
+			// Stop saves the last snapshot, the ACL keeps every command
+			c.persistence.Stop()
+
+			for _, restart := range []struct{ name, atd string }{
+				{"last snapshot", atd},
+				{"earlier snapshot", atd + ".earlier"},
+				{"ACL only", atd + ".missing"},
+			} {
+				restarted := NewWithPersistence(restart.atd, acl, time.Hour, time.Hour)
+				restarted.persistence.SetEnabled(false)
+				if got := tt.state(restarted); got != tt.want {
+					t.Errorf("%s: state = %s, want %s", restart.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate limiting algorithms
+const (
+	RateLimitTokenBucket   = "tokenbucket"
+	RateLimitSlidingWindow = "slidingwindow"
+	RateLimitGCRA          = "gcra"
+)
+
+var (
+	// ErrCostTooHigh is returned when a request costs more than the limiter can ever allow
+	ErrCostTooHigh = errors.New("cost exceeds the limit, the request can never be allowed")
+	// ErrInvalidRateLimit is returned for non-positive or infinite limits, rates or periods, or a negative cost
+	ErrInvalidRateLimit = errors.New("limits, rates and periods must be positive and finite and cost not negative")
+)
+
+// maxRateLimitTTL bounds how long a limiter state is kept, and the time to
+// wait before retrying, so that they fit in a time.Duration
+const maxRateLimitTTL = 100 * 365 * 24 * time.Hour
+
+// RateLimiter is the value stored for items of type "ratelimit"
+type RateLimiter struct {
+	Algorithm string
+	// Token bucket: tokens left after the last refill
+	Tokens float64
+	// Token bucket: time of the last refill. GCRA: theoretical arrival time.
+	// Unix nanoseconds.
+	Updated int64
+	// Sliding window: the requests inside the window, oldest first
+	Log []RateLimitEntry
+}
+
+// RateLimitEntry is a request counted by a sliding window. The requests of
+// the same nanosecond are counted by a single entry.
+type RateLimitEntry struct {
+	Time int64 // Unix nanoseconds
+	Cost int64
+}
+
+// RateLimitResult is the outcome of a rate limited request
+type RateLimitResult struct {
+	Allowed bool
+	// Requests (or tokens) still available after this one
+	Remaining int64
+	// How long to wait before the request can be allowed, 0 if it was allowed
+	RetryAfter time.Duration
+}
+
+// encode formats the limiter state for the ACL
+func (r *RateLimiter) encode() string {
+	switch r.Algorithm {
+	case RateLimitTokenBucket:
+		return fmt.Sprintf("%s:%s:%d", r.Algorithm, strconv.FormatFloat(r.Tokens, 'g', -1, 64), r.Updated)
+	case RateLimitSlidingWindow:
+		entries := make([]string, len(r.Log))
+		for i, e := range r.Log {
+			entries[i] = e.String()
+		}
+		return r.Algorithm + ":" + strings.Join(entries, ",")
+	default:
+		return fmt.Sprintf("%s:%d", r.Algorithm, r.Updated)
+	}
+}
+
+// String returns the limiter state as written to the ACL
+func (r *RateLimiter) String() string {
+	return r.encode()
+}
+
+// decodeRateLimiter parses a limiter state written by encode
+func decodeRateLimiter(s string) (*RateLimiter, error) {
+	fields := strings.Split(s, ":")
+	r := &RateLimiter{Algorithm: fields[0]}
+	var err error
+	switch {
+	case r.Algorithm == RateLimitTokenBucket && len(fields) == 3:
+		if r.Tokens, err = strconv.ParseFloat(fields[1], 64); err == nil {
+			r.Updated, err = strconv.ParseInt(fields[2], 10, 64)
+		}
+	case r.Algorithm == RateLimitSlidingWindow && len(fields) == 2:
+		if fields[1] != "" {
+			for _, s := range strings.Split(fields[1], ",") {
+				var e RateLimitEntry
+				if e, err = parseRateLimitEntry(s); err != nil {
+					break
+				}
+				r.Log = append(r.Log, e)
+			}
+		}
+	case r.Algorithm == RateLimitGCRA && len(fields) == 2:
+		r.Updated, err = strconv.ParseInt(fields[1], 10, 64)
+	default:
+		err = fmt.Errorf("invalid rate limiter state: %s", s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// String formats the entry as time/cost
+func (e RateLimitEntry) String() string {
+	return strconv.FormatInt(e.Time, 10) + "/" + strconv.FormatInt(e.Cost, 10)
+}
+
+// parseRateLimitEntry parses an entry written by RateLimitEntry.String
+func parseRateLimitEntry(s string) (RateLimitEntry, error) {
+	t, c, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimitEntry{}, fmt.Errorf("invalid sliding window entry: %s", s)
+	}
+	var e RateLimitEntry
+	var err error
+	if e.Time, err = strconv.ParseInt(t, 10, 64); err == nil {
+		e.Cost, err = strconv.ParseInt(c, 10, 64)
+	}
+	return e, err
+}
+
+// addToWindow returns the entries of log after start followed by e, in a new
+// slice. e is merged into the last entry if they have the same time.
+func addToWindow(log []RateLimitEntry, start int64, e RateLimitEntry) []RateLimitEntry {
+	for len(log) > 0 && log[0].Time <= start {
+		log = log[1:]
+	}
+	window := make([]RateLimitEntry, len(log), len(log)+1)
+	copy(window, log)
+	if n := len(window); n > 0 && window[n-1].Time == e.Time {
+		window[n-1].Cost += e.Cost
+		return window
+	}
+	return append(window, e)
+}
+
+// secondsToDuration converts seconds to a duration rounded up, at most maxRateLimitTTL
+func secondsToDuration(seconds float64) time.Duration {
+	d := math.Ceil(seconds * float64(time.Second))
+	if d > float64(maxRateLimitTTL) {
+		return maxRateLimitTTL
+	}
+	return time.Duration(d)
+}
+
+// getRateLimiterLocked returns the limiter stored at key, nil if the key does
+// not exist. The caller must hold the cache lock.
+func (c *Cache) getRateLimiterLocked(key, algorithm string, now int64) (*RateLimiter, error) {
+	item := c.liveItemLocked(key, now)
+	if item == nil {
+		return nil, nil
+	}
+	r, ok := item.Value.(*RateLimiter)
+	if !ok || r.Algorithm != algorithm {
+		return nil, ErrWrongType
+	}
+	return r, nil
+}
+
+// storeRateLimiterLocked stores the limiter at key until it is back to its
+// initial state, the key is removed if it already is.
+// The caller must hold the write lock.
+func (c *Cache) storeRateLimiterLocked(key string, r *RateLimiter, ttl time.Duration) {
+	if ttl <= 0 {
+		if _, exists := c.items[key]; exists {
+			c.removeItemLocked(key)
+			c.logCommand(CMD_DEL, key, "", 0)
+		}
+		return
+	}
+	c.storeItemLocked(key, &CacheItem{Value: r, Type: "ratelimit"}, ttl)
+	c.logCommand(CMD_RLSTATE, key, r.encode(), ttl)
+}
+
+// TokenBucket takes cost tokens from a bucket holding up to capacity tokens
+// and refilled with refillRate tokens per second. A full bucket is not stored.
+func (c *Cache) TokenBucket(key string, capacity int64, refillRate float64, cost int64) (RateLimitResult, error) {
+	// Written so that NaN is rejected too
+	if capacity <= 0 || !(refillRate > 0) || math.IsInf(refillRate, 1) || cost < 0 {
+		return RateLimitResult{}, ErrInvalidRateLimit
+	}
+	if cost > capacity {
+		return RateLimitResult{}, ErrCostTooHigh
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	r, err := c.getRateLimiterLocked(key, RateLimitTokenBucket, now)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if r == nil {
+		r = &RateLimiter{Algorithm: RateLimitTokenBucket, Tokens: float64(capacity), Updated: now}
+	}
+
+	// Refill for the time elapsed since the last request
+	elapsed := time.Duration(now - r.Updated).Seconds()
+	tokens := math.Min(float64(capacity), r.Tokens+elapsed*refillRate)
+
+	if tokens < float64(cost) {
+		wait := (float64(cost) - tokens) / refillRate
+		return RateLimitResult{
+			Remaining:  int64(tokens),
+			RetryAfter: secondsToDuration(wait),
+		}, nil
+	}
+
+	r = &RateLimiter{Algorithm: RateLimitTokenBucket, Tokens: tokens - float64(cost), Updated: now}
+	// A tiny refill rate would overflow the duration, a negative TTL
+	// would remove the key and fill the bucket again
+	full := (float64(capacity) - r.Tokens) / refillRate
+	c.storeRateLimiterLocked(key, r, secondsToDuration(full))
+
+	return RateLimitResult{Allowed: true, Remaining: int64(r.Tokens)}, nil
+}
+
+// SlidingWindow allows at most limit requests (each counting cost times) in
+// any period of length window, keeping the time and cost of every request in
+// the window. Only the request is logged to the ACL, not the whole window.
+func (c *Cache) SlidingWindow(key string, limit int64, window time.Duration, cost int64) (RateLimitResult, error) {
+	if limit <= 0 || window <= 0 || cost < 0 {
+		return RateLimitResult{}, ErrInvalidRateLimit
+	}
+	if cost > limit {
+		return RateLimitResult{}, ErrCostTooHigh
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	r, err := c.getRateLimiterLocked(key, RateLimitSlidingWindow, now)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	// Count the requests still in the window
+	start := now - int64(window)
+	var log []RateLimitEntry
+	var used int64
+	if r != nil {
+		log = r.Log
+	}
+	for len(log) > 0 && log[0].Time <= start {
+		log = log[1:]
+	}
+	for _, e := range log {
+		used += e.Cost
+	}
+
+	if used+cost > limit {
+		// Wait until enough of the oldest requests leave the window
+		excess := used + cost - limit
+		var oldest int64
+		for _, e := range log {
+			if excess -= e.Cost; excess <= 0 {
+				oldest = e.Time
+				break
+			}
+		}
+		return RateLimitResult{
+			Remaining:  limit - used,
+			RetryAfter: time.Duration(oldest + int64(window) - now),
+		}, nil
+	}
+	if cost == 0 {
+		return RateLimitResult{Allowed: true, Remaining: limit - used}, nil
+	}
+
+	entry := RateLimitEntry{Time: now, Cost: cost}
+	r = &RateLimiter{Algorithm: RateLimitSlidingWindow, Log: addToWindow(log, start, entry)}
+	c.storeItemLocked(key, &CacheItem{Value: r, Type: "ratelimit"}, window)
+	c.logCommand(CMD_RLREQUEST, key, entry.String(), window)
+
+	return RateLimitResult{Allowed: true, Remaining: limit - used - cost}, nil
+}
+
+// GCRA allows rate requests per period, with bursts of up to burst requests,
+// using the generic cell rate algorithm. Only one timestamp is stored per key.
+func (c *Cache) GCRA(key string, burst, rate int64, period time.Duration, cost int64) (RateLimitResult, error) {
+	if burst <= 0 || rate <= 0 || period <= 0 || cost < 0 {
+		return RateLimitResult{}, ErrInvalidRateLimit
+	}
+	if cost > burst {
+		return RateLimitResult{}, ErrCostTooHigh
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	r, err := c.getRateLimiterLocked(key, RateLimitGCRA, now)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	// Emission interval between two requests and tolerated burst
+	interval := float64(period) / float64(rate)
+	tolerance := interval * float64(burst)
+
+	tat := now
+	if r != nil && r.Updated > now {
+		tat = r.Updated
+	}
+	newTat := float64(tat) + interval*float64(cost)
+	allowAt := newTat - tolerance
+
+	if float64(now) < allowAt {
+		return RateLimitResult{
+			Remaining:  int64((tolerance - float64(tat-now)) / interval),
+			RetryAfter: time.Duration(math.Ceil(allowAt - float64(now))),
+		}, nil
+	}
+
+	r = &RateLimiter{Algorithm: RateLimitGCRA, Updated: int64(newTat)}
+	c.storeRateLimiterLocked(key, r, time.Duration(r.Updated-now))
+
+	return RateLimitResult{
+		Allowed:   true,
+		Remaining: int64((tolerance - float64(r.Updated-now)) / interval),
+	}, nil
+}
@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRejectsInvalidRates(t *testing.T) {
+	for _, rate := range []float64{0, -1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		c := New()
+		if _, err := c.TokenBucket("k", 10, rate, 1); err != ErrInvalidRateLimit {
+			t.Errorf("TokenBucket(refillRate %v) error = %v, want %v", rate, err, ErrInvalidRateLimit)
+		}
+	}
+}
+
+func TestTokenBucketTinyRate(t *testing.T) {
+	c := New()
+	for i, want := range []RateLimitResult{
+		{Allowed: true, Remaining: 1},
+		{Allowed: true, Remaining: 0},
+		{Allowed: false, Remaining: 0, RetryAfter: maxRateLimitTTL},
+	} {
+		// Refilling takes longer than a time.Duration can hold, the bucket
+		// must not be removed and filled again
+		got, err := c.TokenBucket("k", 2, 1e-300, 1)
+		if err != nil || got != want {
+			t.Fatalf("request %d: TokenBucket() = %+v, %v, want %+v", i+1, got, err, want)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int64
+		costs []int64
+		want  []RateLimitResult
+		log   int
+	}{
+		{
+			name:  "costs add up to the limit",
+			limit: 5,
+			costs: []int64{3, 3, 2, 1},
+			want: []RateLimitResult{
+				{Allowed: true, Remaining: 2},
+				{Allowed: false, Remaining: 2},
+				{Allowed: true, Remaining: 0},
+				{Allowed: false, Remaining: 0},
+			},
+			log: 2,
+		},
+		{
+			name:  "a large cost is one entry",
+			limit: 1 << 40,
+			costs: []int64{1 << 40, 1},
+			want: []RateLimitResult{
+				{Allowed: true, Remaining: 0},
+				{Allowed: false, Remaining: 0},
+			},
+			log: 1,
+		},
+		{
+			name:  "a zero cost only checks",
+			limit: 1,
+			costs: []int64{0, 1, 0},
+			want: []RateLimitResult{
+				{Allowed: true, Remaining: 1},
+				{Allowed: true, Remaining: 0},
+				{Allowed: true, Remaining: 0},
+			},
+			log: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			for i, cost := range tt.costs {
+				got, err := c.SlidingWindow("k", tt.limit, time.Hour, cost)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The wait depends on the clock, only its presence is checked
+				if (got.RetryAfter > 0) == got.Allowed || got.RetryAfter > time.Hour {
+					t.Errorf("request %d: RetryAfter = %v with Allowed %v", i+1, got.RetryAfter, got.Allowed)
+				}
+				got.RetryAfter = 0
+				if got != tt.want[i] {
+					t.Errorf("request %d: SlidingWindow() = %+v, want %+v", i+1, got, tt.want[i])
+				}
+			}
+			if r := limiterAt(c, "k"); r == nil || len(r.Log) > tt.log {
+				t.Errorf("window = %v, want at most %d entries", r, tt.log)
+			}
+		})
+	}
+}
+
+func TestAddToWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		log   []RateLimitEntry
+		start int64
+		entry RateLimitEntry
+		want  []RateLimitEntry
+	}{
+		{"empty", nil, 0, RateLimitEntry{Time: 5, Cost: 1}, []RateLimitEntry{{Time: 5, Cost: 1}}},
+		{
+			name:  "drops the entries before the window",
+			log:   []RateLimitEntry{{Time: 1, Cost: 1}, {Time: 2, Cost: 2}, {Time: 3, Cost: 3}},
+			start: 2,
+			entry: RateLimitEntry{Time: 4, Cost: 4},
+			want:  []RateLimitEntry{{Time: 3, Cost: 3}, {Time: 4, Cost: 4}},
+		},
+		{
+			name:  "merges the entries of the same time",
+			log:   []RateLimitEntry{{Time: 3, Cost: 3}},
+			entry: RateLimitEntry{Time: 3, Cost: 2},
+			want:  []RateLimitEntry{{Time: 3, Cost: 5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := append([]RateLimitEntry(nil), tt.log...)
+			if got := addToWindow(tt.log, tt.start, tt.entry); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("addToWindow() = %v, want %v", got, tt.want)
+			}
+			// The stored window may be read by a copy returned by Get
+			if !reflect.DeepEqual(tt.log, before) {
+				t.Errorf("addToWindow() modified its argument: %v", tt.log)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowPersistence(t *testing.T) {
+	dir := t.TempDir()
+	atd, acl := filepath.Join(dir, "cache.atd"), filepath.Join(dir, "cache.acl")
+	c := NewWithPersistence(atd, acl, time.Hour, time.Hour)
+	c.SlidingWindow("k", 10, time.Hour, 4)
+	c.SlidingWindow("k", 10, time.Hour, 3)
+	c.persistence.Stop()
+
+	// From the ATD snapshot, then from the ACL alone
+	for _, path := range []string{atd, atd + ".missing"} {
+		restarted := NewWithPersistence(path, acl, time.Hour, time.Hour)
+		restarted.persistence.SetEnabled(false)
+		r := limiterAt(restarted, "k")
+		if r == nil {
+			t.Fatalf("%s: no sliding window after a restart", path)
+		}
+		var used int64
+		for _, e := range r.Log {
+			used += e.Cost
+		}
+		if used != 7 {
+			t.Errorf("%s: window = %v, want a cost of 7", path, r.Log)
+		}
+	}
+}
+
+// limiterAt returns the rate limiter stored at key, nil if there is none. Get
+// only returns its state as text.
+func limiterAt(c *Cache, key string) *RateLimiter {
+	c.rlock()
+	defer c.runlock()
+	if item := c.items[key]; item != nil {
+		r, _ := item.Value.(*RateLimiter)
+		return r
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"sort"
+	"time"
+)
+
+// MemberSet is the value stored for items of type "set": unordered unique members
+type MemberSet map[string]struct{}
+
+// NewSet creates a set holding members
+func NewSet(members ...string) MemberSet {
+	s := make(MemberSet, len(members))
+	for _, m := range members {
+		s[m] = struct{}{}
+	}
+	return s
+}
+
+// Members returns the members of the set in sorted order
+func (s MemberSet) Members() []string {
+	members := make([]string, 0, len(s))
+	for m := range s {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Clone returns a copy of the set
+func (s MemberSet) Clone() MemberSet {
+	clone := make(MemberSet, len(s))
+	for m := range s {
+		clone[m] = struct{}{}
+	}
+	return clone
+}
+
+// valueSet returns the set held by item, false if item is nil or holds another type
+func (item *CacheItem) valueSet() (MemberSet, bool) {
+	if item == nil {
+		return nil, false
+	}
+	set, ok := item.Value.(MemberSet)
+	return set, ok
+}
+
+// getSetLocked returns the set stored at key, nil if the key does not exist.
+// The caller must hold the cache lock.
+func (c *Cache) getSetLocked(key string, now int64) (MemberSet, error) {
+	item := c.liveItemLocked(key, now)
+	if item == nil {
+		return nil, nil
+	}
+	set, ok := item.Value.(MemberSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return set, nil
+}
+
+// SAdd adds members to the set at key, creating it if needed.
+// Returns the number of members that were not already present.
+func (c *Cache) SAdd(key string, members []string, ttl time.Duration) (int, error) {
+	c.lock()
+	defer c.unlock()
+
+	set, err := c.getSetLocked(key, time.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	if set == nil {
+		set = NewSet()
+		c.storeItemLocked(key, &CacheItem{Value: set, Type: "set"}, 0)
+	}
+
+	added := 0
+	for _, m := range members {
+		if _, exists := set[m]; !exists {
+			set[m] = struct{}{}
+			added++
+		}
+	}
+	c.touchExpirationLocked(c.items[key], ttl)
+	c.touchVersionLocked(c.items[key])
+
+	c.logCommand(CMD_SADD, key, encodeAclArgs(members), ttl)
+	return added, nil
+}
+
+// SRem removes members from the set at key and returns how many were removed.
+// The key is deleted once the set becomes empty.
+func (c *Cache) SRem(key string, members []string) (int, error) {
+	c.lock()
+	defer c.unlock()
+
+	set, err := c.getSetLocked(key, time.Now().UnixNano())
+	if err != nil || set == nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, m := range members {
+		if _, exists := set[m]; exists {
+			delete(set, m)
+			removed++
+		}
+	}
+	if len(set) == 0 {
+		c.removeItemLocked(key)
+	} else if removed > 0 {
+		c.touchVersionLocked(c.items[key])
+	}
+
+	if removed > 0 {
+		c.logCommand(CMD_SREM, key, encodeAclArgs(members), 0)
+	}
+	return removed, nil
+}
+
+// SIsMember reports whether member belongs to the set at key
+func (c *Cache) SIsMember(key, member string) (bool, error) {
+	c.rlock()
+	defer c.runlock()
+
+	set, err := c.getSetLocked(key, time.Now().UnixNano())
+	if err != nil || set == nil {
+		return false, err
+	}
+	_, exists := set[member]
+	return exists, nil
+}
+
+// SMembers returns the members of the set at key in sorted order
+func (c *Cache) SMembers(key string) ([]string, error) {
+	c.rlock()
+	defer c.runlock()
+
+	set, err := c.getSetLocked(key, time.Now().UnixNano())
+	if err != nil || set == nil {
+		return []string{}, err
+	}
+	return set.Members(), nil
+}
+
+// SCard returns the number of members of the set at key
+func (c *Cache) SCard(key string) (int, error) {
+	c.rlock()
+	defer c.runlock()
+
+	set, err := c.getSetLocked(key, time.Now().UnixNano())
+	if err != nil || set == nil {
+		return 0, err
+	}
+	return len(set), nil
+}
+
+// Set algebra operations
+const (
+	SetInter = "INTER"
+	SetUnion = "UNION"
+	SetDiff  = "DIFF"
+)
+
+// combineSetsLocked applies op to the sets stored at keys. Missing keys are
+// treated as empty sets. The caller must hold the cache lock.
+func (c *Cache) combineSetsLocked(op string, keys []string) (MemberSet, error) {
+	now := time.Now().UnixNano()
+	sets := make([]MemberSet, len(keys))
+	for i, key := range keys {
+		set, err := c.getSetLocked(key, now)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	result := NewSet()
+	if len(sets) == 0 {
+		return result, nil
+	}
+
+	switch op {
+	case SetInter:
+		// Start from the smallest set to keep the work bounded
+		smallest := 0
+		for i, s := range sets {
+			if len(s) < len(sets[smallest]) {
+				smallest = i
+			}
+		}
+		for m := range sets[smallest] {
+			inAll := true
+			for _, s := range sets {
+				if _, exists := s[m]; !exists {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				result[m] = struct{}{}
+			}
+		}
+	case SetUnion:
+		for _, s := range sets {
+			for m := range s {
+				result[m] = struct{}{}
+			}
+		}
+	case SetDiff:
+		for m := range sets[0] {
+			result[m] = struct{}{}
+		}
+		for _, s := range sets[1:] {
+			for m := range s {
+				delete(result, m)
+			}
+		}
+	}
+	return result, nil
+}
+
+// SCombine returns the members of the intersection, union or difference
+// (op is SetInter, SetUnion or SetDiff) of the sets at keys
+func (c *Cache) SCombine(op string, keys []string) ([]string, error) {
+	c.rlock()
+	defer c.runlock()
+
+	result, err := c.combineSetsLocked(op, keys)
+	if err != nil {
+		return nil, err
+	}
+	return result.Members(), nil
+}
+
+// SCombineStore stores the result of SCombine at destination, replacing any
+// previous value, and returns its size. An empty result deletes destination.
+func (c *Cache) SCombineStore(op, destination string, keys []string) (int, error) {
+	c.lock()
+	defer c.unlock()
+
+	result, err := c.combineSetsLocked(op, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(result) == 0 {
+		c.removeItemLocked(destination)
+		c.logCommand(CMD_DEL, destination, "", 0)
+		return 0, nil
+	}
+
+	c.storeItemLocked(destination, &CacheItem{Value: result, Type: "set"}, 0)
+	c.logCommand(CMD_SSTORE, destination, encodeAclArgs(result.Members()), 0)
+	return len(result), nil
+}
@@ -0,0 +1,352 @@
+package cache
+
+import (
+	"math/rand"
+)
+
+const (
+	skipListMaxLevel = 32
+	skipListP        = 0.25
+)
+
+// ZMember is a member of a sorted set together with its score
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// skipListNode is a node of the sorted set skiplist
+type skipListNode struct {
+	member   string
+	score    float64
+	backward *skipListNode
+	level    []skipListLevel
+}
+
+// skipListLevel holds the forward pointer of a node on one level and the
+// number of nodes it skips, which is what makes rank lookups O(log n)
+type skipListLevel struct {
+	forward *skipListNode
+	span    int
+}
+
+// skipList keeps members ordered by (score, member)
+type skipList struct {
+	header *skipListNode
+	tail   *skipListNode
+	length int
+	level  int
+}
+
+func newSkipListNode(level int, score float64, member string) *skipListNode {
+	return &skipListNode{
+		member: member,
+		score:  score,
+		level:  make([]skipListLevel, level),
+	}
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		header: newSkipListNode(skipListMaxLevel, 0, ""),
+		level:  1,
+	}
+}
+
+func randomSkipListLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// less reports whether (score, member) sorts before node
+func (n *skipListNode) less(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds a new node, the caller must make sure member is not present yet
+func (sl *skipList) insert(score float64, member string) *skipListNode {
+	var update [skipListMaxLevel]*skipListNode
+	var rank [skipListMaxLevel]int
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i == sl.level-1 {
+			rank[i] = 0
+		} else {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomSkipListLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = newSkipListNode(level, score, member)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	// Increment span for untouched levels
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+// deleteNode unlinks x using the update vector collected by the caller
+func (sl *skipList) deleteNode(x *skipListNode, update []*skipListNode) {
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// delete removes the node with the given score and member
+func (sl *skipList) delete(score float64, member string) bool {
+	update := make([]*skipListNode, skipListMaxLevel)
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.member == member {
+		sl.deleteNode(x, update)
+		return true
+	}
+	return false
+}
+
+// rank returns the 1-based rank of the element, 0 if it is not found
+func (sl *skipList) rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.less(score, member) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != sl.header && x.score == score && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the given 1-based rank
+func (sl *skipList) byRank(rank int) *skipListNode {
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstInRange returns the first node whose score is inside the range
+func (sl *skipList) firstInRange(r ScoreRange) *skipListNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// ScoreRange describes a score interval used by ZRANGEBYSCORE
+type ScoreRange struct {
+	Min, Max                   float64
+	MinExclusive, MaxExclusive bool
+}
+
+func (r ScoreRange) aboveMin(score float64) bool {
+	if r.MinExclusive {
+		return score > r.Min
+	}
+	return score >= r.Min
+}
+
+func (r ScoreRange) belowMax(score float64) bool {
+	if r.MaxExclusive {
+		return score < r.Max
+	}
+	return score <= r.Max
+}
+
+// SortedSet is the value stored for items of type "zset". Members are kept in
+// a skiplist ordered by score and indexed by a map for O(1) score lookups.
+type SortedSet struct {
+	dict map[string]float64
+	zsl  *skipList
+}
+
+// NewSortedSet creates an empty sorted set
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		dict: make(map[string]float64),
+		zsl:  newSkipList(),
+	}
+}
+
+// Add sets the score of member, returns true if the member is new
+func (z *SortedSet) Add(member string, score float64) bool {
+	if old, exists := z.dict[member]; exists {
+		if old != score {
+			z.zsl.delete(old, member)
+			z.zsl.insert(score, member)
+			z.dict[member] = score
+		}
+		return false
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	return true
+}
+
+// Remove deletes member, returns false if it was not present
+func (z *SortedSet) Remove(member string) bool {
+	score, exists := z.dict[member]
+	if !exists {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	return true
+}
+
+// Score returns the score of member
+func (z *SortedSet) Score(member string) (float64, bool) {
+	score, exists := z.dict[member]
+	return score, exists
+}
+
+// Rank returns the 0-based rank of member in ascending score order
+func (z *SortedSet) Rank(member string) (int, bool) {
+	score, exists := z.dict[member]
+	if !exists {
+		return 0, false
+	}
+	return z.zsl.rank(score, member) - 1, true
+}
+
+// Card returns the number of members
+func (z *SortedSet) Card() int {
+	return z.zsl.length
+}
+
+// Range returns the members between the 0-based ranks start and stop
+// (inclusive). Negative indexes count from the end like in Redis.
+func (z *SortedSet) Range(start, stop int) []ZMember {
+	length := z.zsl.length
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= length {
+		return []ZMember{}
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+
+	result := make([]ZMember, 0, stop-start+1)
+	x := z.zsl.byRank(start + 1)
+	for i := start; i <= stop && x != nil; i++ {
+		result = append(result, ZMember{Member: x.member, Score: x.score})
+		x = x.level[0].forward
+	}
+	return result
+}
+
+// RangeByScore returns the members inside r, skipping offset members and
+// returning at most count of them (count < 0 means no limit)
+func (z *SortedSet) RangeByScore(r ScoreRange, offset, count int) []ZMember {
+	result := []ZMember{}
+	x := z.zsl.firstInRange(r)
+	for ; x != nil && offset > 0; offset-- {
+		x = x.level[0].forward
+	}
+	for x != nil && r.belowMax(x.score) && count != 0 {
+		result = append(result, ZMember{Member: x.member, Score: x.score})
+		x = x.level[0].forward
+		count--
+	}
+	return result
+}
+
+// Members returns all members in ascending score order
+func (z *SortedSet) Members() []ZMember {
+	return z.Range(0, -1)
+}
+
+// Clone returns a deep copy of the sorted set
+func (z *SortedSet) Clone() *SortedSet {
+	clone := NewSortedSet()
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		clone.Add(x.member, x.score)
+	}
+	return clone
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newTestSortedSet returns a sorted set of a:1 b:2 c:2 d:3 e:5
+func newTestSortedSet() *SortedSet {
+	z := NewSortedSet()
+	for _, m := range []ZMember{{"d", 3}, {"b", 2}, {"e", 5}, {"a", 1}, {"c", 2}} {
+		z.Add(m.Member, m.Score)
+	}
+	return z
+}
+
+// memberNames returns the names of members, in order
+func memberNames(members []ZMember) []string {
+	names := []string{}
+	for _, m := range members {
+		names = append(names, m.Member)
+	}
+	return names
+}
+
+func TestSortedSetRange(t *testing.T) {
+	tests := []struct {
+		start, stop int
+		want        []string
+	}{
+		{0, -1, []string{"a", "b", "c", "d", "e"}},
+		{0, 0, []string{"a"}},
+		{1, 2, []string{"b", "c"}},
+		{-2, -1, []string{"d", "e"}},
+		{-100, 1, []string{"a", "b"}},
+		{3, 100, []string{"d", "e"}},
+		{2, 1, []string{}},
+		{5, 10, []string{}},
+		{-1, -2, []string{}},
+	}
+	z := newTestSortedSet()
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d..%d", tt.start, tt.stop), func(t *testing.T) {
+			if got := memberNames(z.Range(tt.start, tt.stop)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Range(%d, %d) = %v, want %v", tt.start, tt.stop, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortedSetRangeByScore(t *testing.T) {
+	tests := []struct {
+		name          string
+		r             ScoreRange
+		offset, count int
+		want          []string
+	}{
+		{"all", ScoreRange{Min: math.Inf(-1), Max: math.Inf(1)}, 0, -1, []string{"a", "b", "c", "d", "e"}},
+		{"inclusive", ScoreRange{Min: 2, Max: 3}, 0, -1, []string{"b", "c", "d"}},
+		{"exclusive min", ScoreRange{Min: 2, Max: 3, MinExclusive: true}, 0, -1, []string{"d"}},
+		{"exclusive max", ScoreRange{Min: 2, Max: 3, MaxExclusive: true}, 0, -1, []string{"b", "c"}},
+		{"between scores", ScoreRange{Min: 3.5, Max: 4.5}, 0, -1, []string{}},
+		{"above all", ScoreRange{Min: 6, Max: 10}, 0, -1, []string{}},
+		{"empty range", ScoreRange{Min: 3, Max: 2}, 0, -1, []string{}},
+		{"offset", ScoreRange{Min: 1, Max: 5}, 2, -1, []string{"c", "d", "e"}},
+		{"offset and count", ScoreRange{Min: 1, Max: 5}, 1, 2, []string{"b", "c"}},
+		{"offset past the range", ScoreRange{Min: 1, Max: 2}, 3, -1, []string{}},
+		{"zero count", ScoreRange{Min: 1, Max: 5}, 0, 0, []string{}},
+	}
+	z := newTestSortedSet()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := memberNames(z.RangeByScore(tt.r, tt.offset, tt.count))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("RangeByScore(%+v, %d, %d) = %v, want %v", tt.r, tt.offset, tt.count, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortedSetAddRemove(t *testing.T) {
+	z := newTestSortedSet()
+	tests := []struct {
+		name   string
+		op     func() bool
+		want   bool
+		result []string
+	}{
+		{"add new member", func() bool { return z.Add("f", 0) }, true, []string{"f", "a", "b", "c", "d", "e"}},
+		{"update score", func() bool { return z.Add("f", 4) }, false, []string{"a", "b", "c", "d", "f", "e"}},
+		{"same score", func() bool { return z.Add("f", 4) }, false, []string{"a", "b", "c", "d", "f", "e"}},
+		{"ties ordered by member", func() bool { return z.Add("a", 2) }, false, []string{"a", "b", "c", "d", "f", "e"}},
+		{"remove member", func() bool { return z.Remove("c") }, true, []string{"a", "b", "d", "f", "e"}},
+		{"remove missing member", func() bool { return z.Remove("c") }, false, []string{"a", "b", "d", "f", "e"}},
+	}
+	for _, tt := range tests {
+		if got := tt.op(); got != tt.want {
+			t.Fatalf("%s: returned %v, want %v", tt.name, got, tt.want)
+		}
+		if got := memberNames(z.Members()); !reflect.DeepEqual(got, tt.result) {
+			t.Fatalf("%s: members = %v, want %v", tt.name, got, tt.result)
+		}
+		for rank, member := range tt.result {
+			if got, ok := z.Rank(member); !ok || got != rank {
+				t.Fatalf("%s: Rank(%s) = %d, %v, want %d", tt.name, member, got, ok, rank)
+			}
+		}
+	}
+}
+
+// TestSortedSetRandom checks the skiplist against a sorted slice, so that the
+// spans used by Rank and Range stay right across the levels
+func TestSortedSetRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	z := NewSortedSet()
+	scores := make(map[string]float64)
+
+	for i := 0; i < 5000; i++ {
+		member := fmt.Sprintf("m%d", rng.Intn(300))
+		if rng.Intn(3) == 0 {
+			_, exists := scores[member]
+			if z.Remove(member) != exists {
+				t.Fatalf("Remove(%s) disagrees with exists = %v", member, exists)
+			}
+			delete(scores, member)
+			continue
+		}
+		score := float64(rng.Intn(50))
+		_, exists := scores[member]
+		if z.Add(member, score) == exists {
+			t.Fatalf("Add(%s) disagrees with exists = %v", member, exists)
+		}
+		scores[member] = score
+	}
+
+	want := make([]ZMember, 0, len(scores))
+	for member, score := range scores {
+		want = append(want, ZMember{Member: member, Score: score})
+	}
+	sort.Slice(want, func(i, j int) bool {
+		if want[i].Score != want[j].Score {
+			return want[i].Score < want[j].Score
+		}
+		return want[i].Member < want[j].Member
+	})
+
+	if z.Card() != len(want) {
+		t.Fatalf("Card() = %d, want %d", z.Card(), len(want))
+	}
+	if got := z.Members(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Members() differ from the sorted members")
+	}
+	for rank, m := range want {
+		if got, ok := z.Rank(m.Member); !ok || got != rank {
+			t.Fatalf("Rank(%s) = %d, %v, want %d", m.Member, got, ok, rank)
+		}
+		if got := z.Range(rank, rank); len(got) != 1 || got[0] != m {
+			t.Fatalf("Range(%d, %d) = %v, want %v", rank, rank, got, m)
+		}
+	}
+	if got := z.Clone().Members(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Clone() members differ from the sorted members")
+	}
+}
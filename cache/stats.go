@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts the keyspace events of all the databases
+type Stats struct {
+	// Keys found and not found by Get and GetMultiple
+	Hits   uint64
+	Misses uint64
+	// Keys removed by Cleanup once expired
+	ExpiredKeys uint64
+}
+
+// KeyspaceStats describes the keys of one database
+type KeyspaceStats struct {
+	DB   int
+	Keys int
+	// Keys with a TTL
+	Expires int
+	// Keys by data type
+	Types map[string]int
+}
+
+// Stats returns the counters of all the databases
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		ExpiredKeys: atomic.LoadUint64(&c.expiredKeys),
+	}
+}
+
+// Keyspace describes the keys of the non-empty databases, expired keys not
+// removed yet excluded
+func (c *Cache) Keyspace() []KeyspaceStats {
+	c.rlock()
+	defer c.runlock()
+
+	now := time.Now().UnixNano()
+	var keyspace []KeyspaceStats
+	for _, db := range c.databases {
+		stats := KeyspaceStats{DB: db.index, Types: make(map[string]int)}
+		for _, item := range db.items {
+			if item.Expiration > 0 && now > item.Expiration {
+				continue
+			}
+			stats.Keys++
+			stats.Types[item.Type]++
+			if item.Expiration > 0 {
+				stats.Expires++
+			}
+		}
+		if stats.Keys > 0 {
+			keyspace = append(keyspace, stats)
+		}
+	}
+	return keyspace
+}
+
+// PersistenceStats returns the statistics of the persistence, false if the
+// cache is not persisted
+func (c *Cache) PersistenceStats() (PersistenceStats, bool) {
+	if c.persistence == nil {
+		return PersistenceStats{}, false
+	}
+	return c.persistence.Stats(), true
+}
+
+// SetPersistenceIntervals changes the intervals of the ATD snapshots and of
+// the ACL compactions, false without persistence
+func (c *Cache) SetPersistenceIntervals(atdInterval, aclInterval time.Duration) bool {
+	if c.persistence == nil {
+		return false
+	}
+	c.persistence.SetIntervals(atdInterval, aclInterval)
+	return true
+}
@@ -0,0 +1,878 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrStreamID is returned for a malformed stream ID
+	ErrStreamID = errors.New("invalid stream ID")
+	// ErrStreamIDTooSmall is returned when XAdd is given an ID not greater than the last one
+	ErrStreamIDTooSmall = errors.New("the ID specified in XADD is equal or smaller than the target stream top item")
+	// ErrNoSuchKey is returned when a command needs an existing key
+	ErrNoSuchKey = errors.New("no such key")
+	// ErrGroupExists is returned when creating a consumer group that already exists
+	ErrGroupExists = errors.New("consumer group name already exists")
+	// ErrNoGroup is returned for a consumer group that does not exist
+	ErrNoGroup = errors.New("no such consumer group")
+)
+
+// StreamID identifies a stream entry: the time it was added in milliseconds
+// and a sequence number for entries added within the same millisecond
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// String formats the ID as "ms-seq"
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Less reports whether id comes before other
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// next returns the smallest ID after id
+func (id StreamID) next() StreamID {
+	if id.Seq == math.MaxUint64 {
+		return StreamID{Ms: id.Ms + 1}
+	}
+	return StreamID{Ms: id.Ms, Seq: id.Seq + 1}
+}
+
+// ParseStreamID parses "ms-seq", or "ms" in which case the sequence is defaultSeq
+func ParseStreamID(s string, defaultSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrStreamID
+	}
+	if !hasSeq {
+		return StreamID{Ms: ms, Seq: defaultSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrStreamID
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// parseRangeID parses a bound of XRANGE: "-" and "+" are the smallest and
+// greatest IDs, a bare "ms" covers the whole millisecond
+func parseRangeID(s string, end bool) (StreamID, error) {
+	switch {
+	case s == "-":
+		return StreamID{}, nil
+	case s == "+":
+		return StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}, nil
+	case end:
+		return ParseStreamID(s, math.MaxUint64)
+	default:
+		return ParseStreamID(s, 0)
+	}
+}
+
+// StreamEntry is an entry of a stream. Fields holds field value pairs, it is
+// nil for a pending entry that was trimmed from the stream.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// StreamRead holds the entries read from one stream
+type StreamRead struct {
+	Key     string
+	Entries []StreamEntry
+}
+
+// PendingEntry is an entry delivered to a consumer of a group and not acknowledged yet
+type PendingEntry struct {
+	ID       StreamID
+	Consumer string
+	// Time of the last delivery in Unix nanoseconds
+	Delivered int64
+	// Number of times the entry was delivered
+	Deliveries int64
+}
+
+// PendingSummary summarizes the pending entries of a consumer group
+type PendingSummary struct {
+	Count     int
+	Min, Max  StreamID
+	Consumers map[string]int
+}
+
+// consumerGroup tracks the deliveries of a stream to a group of consumers.
+// Each entry is delivered to a single consumer of the group.
+type consumerGroup struct {
+	lastDelivered StreamID
+	pending       map[StreamID]*PendingEntry
+}
+
+// Stream is the value stored for items of type "stream": an append-only log
+// of entries ordered by ID, with its consumer groups
+type Stream struct {
+	entries []StreamEntry
+	lastID  StreamID
+	groups  map[string]*consumerGroup
+}
+
+// NewStream creates an empty stream
+func NewStream() *Stream {
+	return &Stream{groups: make(map[string]*consumerGroup)}
+}
+
+// Len returns the number of entries in the stream
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// String returns the number of entries, as reported for GET
+func (s *Stream) String() string {
+	return strconv.Itoa(len(s.entries))
+}
+
+// LastID returns the ID of the last entry ever added
+func (s *Stream) LastID() StreamID {
+	return s.lastID
+}
+
+// search returns the index of the first entry with an ID not less than id
+func (s *Stream) search(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.Less(id)
+	})
+}
+
+// entry returns the entry with id, nil if there is none
+func (s *Stream) entry(id StreamID) *StreamEntry {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return &s.entries[i]
+	}
+	return nil
+}
+
+// nextID returns the ID given to an entry added at now (Unix milliseconds)
+func (s *Stream) nextID(nowMs uint64) StreamID {
+	if nowMs > s.lastID.Ms {
+		return StreamID{Ms: nowMs}
+	}
+	return s.lastID.next()
+}
+
+// add appends an entry and trims the stream to its maxLen newest entries (0: no limit)
+func (s *Stream) add(id StreamID, fields []string, maxLen int64) {
+	s.entries = append(s.entries, StreamEntry{ID: id, Fields: fields})
+	s.lastID = id
+	if maxLen > 0 && int64(len(s.entries)) > maxLen {
+		s.entries = s.entries[int64(len(s.entries))-maxLen:]
+	}
+}
+
+// rangeEntries returns up to count entries (0: all) with IDs between start and end inclusive
+func (s *Stream) rangeEntries(start, end StreamID, count int) []StreamEntry {
+	var entries []StreamEntry
+	for i := s.search(start); i < len(s.entries) && !end.Less(s.entries[i].ID); i++ {
+		if count > 0 && len(entries) == count {
+			break
+		}
+		entries = append(entries, s.entries[i])
+	}
+	return entries
+}
+
+// after returns up to count entries (0: all) with IDs greater than id
+func (s *Stream) after(id StreamID, count int) []StreamEntry {
+	return s.rangeEntries(id.next(), StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}, count)
+}
+
+// deliver records the delivery of ids to consumer at now (Unix nanoseconds)
+func (g *consumerGroup) deliver(consumer string, ids []StreamID, now int64) {
+	for _, id := range ids {
+		p := g.pending[id]
+		if p == nil {
+			p = &PendingEntry{ID: id}
+			g.pending[id] = p
+		}
+		p.Consumer = consumer
+		p.Delivered = now
+		p.Deliveries++
+		if g.lastDelivered.Less(id) {
+			g.lastDelivered = id
+		}
+	}
+}
+
+// sortedPending returns the pending entries ordered by ID
+func (g *consumerGroup) sortedPending() []*PendingEntry {
+	pending := make([]*PendingEntry, 0, len(g.pending))
+	for _, p := range g.pending {
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ID.Less(pending[j].ID)
+	})
+	return pending
+}
+
+// valueStream returns the stream held by item, false if item is nil or holds another type
+func (item *CacheItem) valueStream() (*Stream, bool) {
+	if item == nil {
+		return nil, false
+	}
+	s, ok := item.Value.(*Stream)
+	return s, ok
+}
+
+// getStreamLocked returns the stream stored at key, nil if the key does not exist.
+// The caller must hold the cache lock.
+func (c *Cache) getStreamLocked(key string, now int64) (*Stream, error) {
+	item := c.liveItemLocked(key, now)
+	if item == nil {
+		return nil, nil
+	}
+	s, ok := item.Value.(*Stream)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return s, nil
+}
+
+// getGroupLocked returns the consumer group of the stream at key.
+// The caller must hold the cache lock.
+func (c *Cache) getGroupLocked(key, group string, now int64) (*Stream, *consumerGroup, error) {
+	s, err := c.getStreamLocked(key, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil {
+		return nil, nil, ErrNoGroup
+	}
+	g, ok := s.groups[group]
+	if !ok {
+		return nil, nil, ErrNoGroup
+	}
+	return s, g, nil
+}
+
+// XAdd appends an entry with field value pairs to the stream at key, creating
+// it if needed, and returns its ID. id is "*" to generate a time-ordered ID.
+// With maxLen > 0 only the maxLen newest entries are kept.
+func (c *Cache) XAdd(key, id string, fields []string, maxLen int64) (StreamID, error) {
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return StreamID{}, errors.New("fields must be field value pairs")
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now()
+	s, err := c.getStreamLocked(key, now.UnixNano())
+	if err != nil {
+		return StreamID{}, err
+	}
+	created := s == nil
+	if created {
+		s = NewStream()
+	}
+
+	var entryID StreamID
+	if id == "*" {
+		entryID = s.nextID(uint64(now.UnixMilli()))
+	} else {
+		if entryID, err = ParseStreamID(id, 0); err != nil {
+			return StreamID{}, err
+		}
+		if !s.lastID.Less(entryID) {
+			return StreamID{}, ErrStreamIDTooSmall
+		}
+	}
+
+	if created {
+		c.storeItemLocked(key, &CacheItem{Value: s, Type: "stream"}, 0)
+	}
+	s.add(entryID, fields, maxLen)
+	c.touchVersionLocked(c.items[key])
+
+	args := append([]string{entryID.String(), strconv.FormatInt(maxLen, 10)}, fields...)
+	c.logCommand(CMD_XADD, key, encodeAclArgs(args), 0)
+	c.signalKey(key)
+	return entryID, nil
+}
+
+// XLen returns the number of entries of the stream at key
+func (c *Cache) XLen(key string) (int, error) {
+	c.rlock()
+	defer c.runlock()
+
+	s, err := c.getStreamLocked(key, time.Now().UnixNano())
+	if err != nil || s == nil {
+		return 0, err
+	}
+	return s.Len(), nil
+}
+
+// XRange returns up to count entries (0: all) of the stream at key with IDs
+// between start and end inclusive, "-" and "+" being the first and last IDs
+func (c *Cache) XRange(key, start, end string, count int) ([]StreamEntry, error) {
+	startID, err := parseRangeID(start, false)
+	if err != nil {
+		return nil, err
+	}
+	endID, err := parseRangeID(end, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.rlock()
+	defer c.runlock()
+
+	s, err := c.getStreamLocked(key, time.Now().UnixNano())
+	if err != nil || s == nil {
+		return nil, err
+	}
+	return s.rangeEntries(startID, endID, count), nil
+}
+
+// XRead returns up to count entries (0: all) of each stream at keys with IDs
+// greater than the matching ID in ids, "$" meaning the last ID at the time of
+// the call. If there are none, it waits up to block (0: no wait, BlockForever:
+// no timeout) for entries to be added, or until cancel is closed.
+func (c *Cache) XRead(keys, ids []string, count int, block time.Duration, cancel <-chan struct{}) ([]StreamRead, error) {
+	if len(keys) == 0 || len(keys) != len(ids) {
+		return nil, errors.New("each stream needs an ID")
+	}
+
+	// Resolve "$" once, so that entries added while blocked are returned
+	after := make([]StreamID, len(keys))
+	c.rlock()
+	now := time.Now().UnixNano()
+	for i, id := range ids {
+		var err error
+		if id == "$" {
+			var s *Stream
+			if s, err = c.getStreamLocked(keys[i], now); s != nil {
+				after[i] = s.lastID
+			}
+		} else {
+			after[i], err = ParseStreamID(id, 0)
+		}
+		if err != nil {
+			c.runlock()
+			return nil, err
+		}
+	}
+	c.runlock()
+
+	var result []StreamRead
+	err := c.blockOn(keys, block, cancel, func() (bool, error) {
+		c.rlock()
+		defer c.runlock()
+
+		now := time.Now().UnixNano()
+		for i, key := range keys {
+			s, err := c.getStreamLocked(key, now)
+			if err != nil {
+				return false, err
+			}
+			if s == nil {
+				continue
+			}
+			if entries := s.after(after[i], count); len(entries) > 0 {
+				result = append(result, StreamRead{Key: key, Entries: entries})
+			}
+		}
+		return len(result) > 0, nil
+	})
+	return result, err
+}
+
+// XGroupCreate creates a consumer group of the stream at key that delivers
+// the entries after id, "$" meaning the current last entry. With mkStream an
+// empty stream is created if key does not exist.
+func (c *Cache) XGroupCreate(key, group, id string, mkStream bool) error {
+	c.lock()
+	defer c.unlock()
+
+	s, err := c.getStreamLocked(key, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		if !mkStream {
+			return ErrNoSuchKey
+		}
+		s = NewStream()
+		c.storeItemLocked(key, &CacheItem{Value: s, Type: "stream"}, 0)
+	}
+	if _, exists := s.groups[group]; exists {
+		return ErrGroupExists
+	}
+
+	start := s.lastID
+	if id != "$" {
+		if start, err = ParseStreamID(id, 0); err != nil {
+			return err
+		}
+	}
+	s.groups[group] = &consumerGroup{lastDelivered: start, pending: make(map[StreamID]*PendingEntry)}
+	c.touchVersionLocked(c.items[key])
+
+	c.logCommand(CMD_XGROUP, key, encodeAclArgs([]string{"CREATE", group, start.String()}), 0)
+	return nil
+}
+
+// XGroupDestroy removes a consumer group and its pending entries
+func (c *Cache) XGroupDestroy(key, group string) (bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	s, err := c.getStreamLocked(key, time.Now().UnixNano())
+	if err != nil || s == nil {
+		return false, err
+	}
+	if _, exists := s.groups[group]; !exists {
+		return false, nil
+	}
+	delete(s.groups, group)
+	c.touchVersionLocked(c.items[key])
+
+	c.logCommand(CMD_XGROUP, key, encodeAclArgs([]string{"DESTROY", group}), 0)
+	// Blocked readers of the group get an error
+	c.signalKey(key)
+	return true, nil
+}
+
+// XReadGroup reads the streams at keys as consumer of group. An ID of ">"
+// delivers up to count entries (0: all) never delivered to the group, which
+// stay pending until acknowledged with XAck. Any other ID returns the entries
+// after it still pending for consumer. When all IDs are ">" and there are no
+// new entries, it blocks like XRead.
+func (c *Cache) XReadGroup(group, consumer string, keys, ids []string, count int, block time.Duration, cancel <-chan struct{}) ([]StreamRead, error) {
+	if len(keys) == 0 || len(keys) != len(ids) {
+		return nil, errors.New("each stream needs an ID")
+	}
+	after := make([]StreamID, len(keys))
+	for i, id := range ids {
+		if id == ">" {
+			continue
+		}
+		var err error
+		if after[i], err = ParseStreamID(id, 0); err != nil {
+			return nil, err
+		}
+		// History is returned right away
+		block = 0
+	}
+
+	var result []StreamRead
+	err := c.blockOn(keys, block, cancel, func() (bool, error) {
+		c.lock()
+		defer c.unlock()
+
+		now := time.Now().UnixNano()
+		for i, key := range keys {
+			s, g, err := c.getGroupLocked(key, group, now)
+			if err != nil {
+				return false, err
+			}
+
+			var entries []StreamEntry
+			if ids[i] == ">" {
+				entries = s.after(g.lastDelivered, count)
+				if len(entries) == 0 {
+					continue
+				}
+				delivered := make([]string, 0, len(entries)+2)
+				delivered = append(delivered, group, consumer)
+				deliveredIDs := make([]StreamID, len(entries))
+				for j, e := range entries {
+					deliveredIDs[j] = e.ID
+					delivered = append(delivered, e.ID.String())
+				}
+				g.deliver(consumer, deliveredIDs, now)
+				c.touchVersionLocked(c.items[key])
+				c.logCommand(CMD_XDELIVER, key, encodeAclArgs(delivered), 0)
+			} else {
+				for _, p := range g.sortedPending() {
+					if p.Consumer != consumer || !after[i].Less(p.ID) {
+						continue
+					}
+					if count > 0 && len(entries) == count {
+						break
+					}
+					entry := StreamEntry{ID: p.ID}
+					if e := s.entry(p.ID); e != nil {
+						entry.Fields = e.Fields
+					}
+					entries = append(entries, entry)
+				}
+			}
+			result = append(result, StreamRead{Key: key, Entries: entries})
+		}
+		for _, r := range result {
+			if len(r.Entries) > 0 {
+				return true, nil
+			}
+		}
+		// Nothing new yet, the result is built again on the next attempt
+		result = nil
+		return false, nil
+	})
+	return result, err
+}
+
+// XAck acknowledges entries of a consumer group, they are no longer pending.
+// Returns the number of entries that were pending.
+func (c *Cache) XAck(key, group string, ids []string) (int, error) {
+	parsed := make([]StreamID, len(ids))
+	for i, id := range ids {
+		var err error
+		if parsed[i], err = ParseStreamID(id, 0); err != nil {
+			return 0, err
+		}
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	s, err := c.getStreamLocked(key, time.Now().UnixNano())
+	if err != nil || s == nil {
+		return 0, err
+	}
+	g, ok := s.groups[group]
+	if !ok {
+		return 0, nil
+	}
+
+	acked := []string{group}
+	for _, id := range parsed {
+		if _, pending := g.pending[id]; pending {
+			delete(g.pending, id)
+			acked = append(acked, id.String())
+		}
+	}
+	if len(acked) > 1 {
+		c.touchVersionLocked(c.items[key])
+		c.logCommand(CMD_XACK, key, encodeAclArgs(acked), 0)
+	}
+	return len(acked) - 1, nil
+}
+
+// XPending summarizes the pending entries of a consumer group
+func (c *Cache) XPending(key, group string) (PendingSummary, error) {
+	c.rlock()
+	defer c.runlock()
+
+	_, g, err := c.getGroupLocked(key, group, time.Now().UnixNano())
+	if err != nil {
+		return PendingSummary{}, err
+	}
+	summary := PendingSummary{Count: len(g.pending), Consumers: make(map[string]int)}
+	for i, p := range g.sortedPending() {
+		if i == 0 {
+			summary.Min = p.ID
+		}
+		summary.Max = p.ID
+		summary.Consumers[p.Consumer]++
+	}
+	return summary, nil
+}
+
+// XPendingRange returns up to count pending entries of a consumer group with
+// IDs between start and end inclusive, only those of consumer if it is not empty
+func (c *Cache) XPendingRange(key, group, start, end string, count int, consumer string) ([]PendingEntry, error) {
+	startID, err := parseRangeID(start, false)
+	if err != nil {
+		return nil, err
+	}
+	endID, err := parseRangeID(end, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.rlock()
+	defer c.runlock()
+
+	_, g, err := c.getGroupLocked(key, group, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	var pending []PendingEntry
+	for _, p := range g.sortedPending() {
+		if p.ID.Less(startID) || endID.Less(p.ID) || (consumer != "" && p.Consumer != consumer) {
+			continue
+		}
+		if count > 0 && len(pending) == count {
+			break
+		}
+		pending = append(pending, *p)
+	}
+	return pending, nil
+}
+
+// XAutoClaim redelivers to consumer up to count entries of a consumer group,
+// starting at start, that are pending for at least minIdle: entries whose
+// consumer crashed before acknowledging them. Pending entries trimmed from
+// the stream are dropped. Returns the claimed entries and the ID to start the
+// next call from, "0-0" once all the pending entries were scanned.
+func (c *Cache) XAutoClaim(key, group, consumer string, minIdle time.Duration, start string, count int) (StreamID, []StreamEntry, error) {
+	startID, err := parseRangeID(start, false)
+	if err != nil {
+		return StreamID{}, nil, err
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	s, g, err := c.getGroupLocked(key, group, now)
+	if err != nil {
+		return StreamID{}, nil, err
+	}
+
+	var next StreamID
+	var claimed []StreamEntry
+	var claimedIDs []StreamID
+	dropped := []string{group}
+	for _, p := range g.sortedPending() {
+		if p.ID.Less(startID) || time.Duration(now-p.Delivered) < minIdle {
+			continue
+		}
+		if count > 0 && len(claimed) == count {
+			next = p.ID
+			break
+		}
+		e := s.entry(p.ID)
+		if e == nil {
+			delete(g.pending, p.ID)
+			dropped = append(dropped, p.ID.String())
+			continue
+		}
+		claimed = append(claimed, *e)
+		claimedIDs = append(claimedIDs, p.ID)
+	}
+
+	if len(claimedIDs) > 0 {
+		g.deliver(consumer, claimedIDs, now)
+		delivered := []string{group, consumer}
+		for _, id := range claimedIDs {
+			delivered = append(delivered, id.String())
+		}
+		c.logCommand(CMD_XDELIVER, key, encodeAclArgs(delivered), 0)
+	}
+	if len(dropped) > 1 {
+		c.logCommand(CMD_XACK, key, encodeAclArgs(dropped), 0)
+	}
+	if len(claimedIDs) > 0 || len(dropped) > 1 {
+		c.touchVersionLocked(c.items[key])
+	}
+	return next, claimed, nil
+}
+
+// replayStreamCommand applies a stream command logged in the ACL at timestamp.
+// The caller must hold the write lock.
+func (c *Cache) replayStreamCommand(cmdType, key string, args []string, timestamp int64) {
+	item := c.items[key]
+	s, ok := item.valueStream()
+	if !ok {
+		s = NewStream()
+		item = &CacheItem{Value: s, Type: "stream"}
+		c.storeItemLocked(key, item, 0)
+	}
+
+	switch cmdType {
+	case CMD_XADD:
+		if len(args) < 2 {
+			return
+		}
+		id, err := ParseStreamID(args[0], 0)
+		if err != nil {
+			return
+		}
+		maxLen, _ := strconv.ParseInt(args[1], 10, 64)
+		s.add(id, args[2:], maxLen)
+
+	case CMD_XGROUP:
+		if len(args) == 3 && args[0] == "CREATE" {
+			if start, err := ParseStreamID(args[2], 0); err == nil {
+				s.groups[args[1]] = &consumerGroup{lastDelivered: start, pending: make(map[StreamID]*PendingEntry)}
+			}
+		} else if len(args) == 2 && args[0] == "DESTROY" {
+			delete(s.groups, args[1])
+		}
+
+	case CMD_XDELIVER:
+		if len(args) < 2 || s.groups[args[0]] == nil {
+			return
+		}
+		s.groups[args[0]].deliver(args[1], parseStreamIDs(args[2:]), timestamp)
+
+	case CMD_XACK:
+		if len(args) < 1 || s.groups[args[0]] == nil {
+			return
+		}
+		for _, id := range parseStreamIDs(args[1:]) {
+			delete(s.groups[args[0]].pending, id)
+		}
+	}
+}
+
+// parseStreamIDs parses the valid IDs of ids
+func parseStreamIDs(ids []string) []StreamID {
+	parsed := make([]StreamID, 0, len(ids))
+	for _, s := range ids {
+		if id, err := ParseStreamID(s, 0); err == nil {
+			parsed = append(parsed, id)
+		}
+	}
+	return parsed
+}
+
+// marshalBinary serializes the entries and the consumer groups of the stream
+func (s *Stream) marshalBinary() []byte {
+	var buf []byte
+	appendID := func(id StreamID) {
+		buf = binary.BigEndian.AppendUint64(buf, id.Ms)
+		buf = binary.BigEndian.AppendUint64(buf, id.Seq)
+	}
+	appendString := func(str string) {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(str)))
+		buf = append(buf, str...)
+	}
+
+	appendID(s.lastID)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s.entries)))
+	for _, e := range s.entries {
+		appendID(e.ID)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(e.Fields)))
+		for _, f := range e.Fields {
+			appendString(f)
+		}
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s.groups)))
+	for name, g := range s.groups {
+		appendString(name)
+		appendID(g.lastDelivered)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(g.pending)))
+		for _, p := range g.pending {
+			appendID(p.ID)
+			appendString(p.Consumer)
+			buf = binary.BigEndian.AppendUint64(buf, uint64(p.Delivered))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(p.Deliveries))
+		}
+	}
+	return buf
+}
+
+// unmarshalStream parses a stream written by marshalBinary
+func unmarshalStream(data []byte) (*Stream, error) {
+	errShort := errors.New("invalid stream length")
+	pos := 0
+	readUint := func(size int) (uint64, error) {
+		if len(data)-pos < size {
+			return 0, errShort
+		}
+		var v uint64
+		if size == 4 {
+			v = uint64(binary.BigEndian.Uint32(data[pos:]))
+		} else {
+			v = binary.BigEndian.Uint64(data[pos:])
+		}
+		pos += size
+		return v, nil
+	}
+	readID := func() (StreamID, error) {
+		ms, err := readUint(8)
+		if err != nil {
+			return StreamID{}, err
+		}
+		seq, err := readUint(8)
+		return StreamID{Ms: ms, Seq: seq}, err
+	}
+	readString := func() (string, error) {
+		n, err := readUint(4)
+		if err != nil || uint64(len(data)-pos) < n {
+			return "", errShort
+		}
+		str := string(data[pos : pos+int(n)])
+		pos += int(n)
+		return str, nil
+	}
+
+	s := NewStream()
+	var err error
+	if s.lastID, err = readID(); err != nil {
+		return nil, err
+	}
+	entries, err := readUint(4)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < entries; i++ {
+		e := StreamEntry{}
+		if e.ID, err = readID(); err != nil {
+			return nil, err
+		}
+		fields, err := readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		e.Fields = make([]string, fields)
+		for j := range e.Fields {
+			if e.Fields[j], err = readString(); err != nil {
+				return nil, err
+			}
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	groups, err := readUint(4)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		g := &consumerGroup{pending: make(map[StreamID]*PendingEntry)}
+		if g.lastDelivered, err = readID(); err != nil {
+			return nil, err
+		}
+		pending, err := readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < pending; j++ {
+			p := &PendingEntry{}
+			if p.ID, err = readID(); err != nil {
+				return nil, err
+			}
+			if p.Consumer, err = readString(); err != nil {
+				return nil, err
+			}
+			delivered, err := readUint(8)
+			if err != nil {
+				return nil, err
+			}
+			deliveries, err := readUint(8)
+			if err != nil {
+				return nil, err
+			}
+			p.Delivered, p.Deliveries = int64(delivered), int64(deliveries)
+			g.pending[p.ID] = p
+		}
+		s.groups[name] = g
+	}
+	return s, nil
+}
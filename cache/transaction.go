@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"time"
+)
+
+// txLog collects the commands written inside an Atomic block
+type txLog struct {
+	cmds []Command
+}
+
+// Atomic runs fn with exclusive access to the cache. Every operation done
+// through tx is applied under a single acquisition of the write lock, and the
+// writes are logged to the ACL as one batch, so they are either all replayed
+// or not at all. tx must not be used after fn returns.
+// Calling Atomic on a tx view runs fn inside the enclosing block.
+func (c *Cache) Atomic(fn func(tx *Cache)) {
+	if c.tx != nil {
+		fn(c)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tx := &Cache{database: c.database, tx: &txLog{}}
+	fn(tx)
+
+	// Logged before unlocking so batches reach the ACL in execution order
+	if c.persistence != nil {
+		c.persistence.LogBatch(tx.tx.cmds)
+	}
+}
+
+// lock takes the write lock, already held inside an Atomic block
+func (c *Cache) lock() {
+	if c.tx == nil {
+		c.mu.Lock()
+	}
+}
+
+func (c *Cache) unlock() {
+	if c.tx == nil {
+		c.mu.Unlock()
+	}
+}
+
+// rlock takes the read lock, the write lock is already held inside an Atomic block
+func (c *Cache) rlock() {
+	if c.tx == nil {
+		c.mu.RLock()
+	}
+}
+
+func (c *Cache) runlock() {
+	if c.tx == nil {
+		c.mu.RUnlock()
+	}
+}
+
+// logCommand logs a write to the ACL, or defers it to the batch of the
+// enclosing Atomic block
+func (c *Cache) logCommand(cmdType, key string, value interface{}, ttl time.Duration) {
+	if c.tx != nil {
+		c.tx.cmds = append(c.tx.cmds, Command{Type: cmdType, Key: key, Value: value, TTL: ttl, DB: c.index})
+		return
+	}
+	if c.persistence != nil {
+		c.persistence.LogCommand(c.index, cmdType, key, value, ttl)
+	}
+}
+
+// logBatch logs writes that must be replayed together
+func (c *Cache) logBatch(cmds []Command) {
+	for i := range cmds {
+		cmds[i].DB = c.index
+	}
+	if c.tx != nil {
+		c.tx.cmds = append(c.tx.cmds, cmds...)
+		return
+	}
+	if c.persistence != nil {
+		c.persistence.LogBatch(cmds)
+	}
+}
@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrNaNScore is returned for a NaN score, such as the result of adding -inf
+// to +inf with ZINCRBY
+var ErrNaNScore = errors.New("resulting score is not a number (NaN)")
+
+// valueZSet returns the sorted set held by item, false if item is nil or holds another type
+func (item *CacheItem) valueZSet() (*SortedSet, bool) {
+	if item == nil {
+		return nil, false
+	}
+	zset, ok := item.Value.(*SortedSet)
+	return zset, ok
+}
+
+// getZSetLocked returns the sorted set stored at key, nil if the key does not
+// exist. The caller must hold the cache lock.
+func (c *Cache) getZSetLocked(key string, now int64) (*SortedSet, error) {
+	item := c.liveItemLocked(key, now)
+	if item == nil {
+		return nil, nil
+	}
+	zset, ok := item.Value.(*SortedSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return zset, nil
+}
+
+// encodeZMembers encodes members for the ACL as score member pairs, see
+// encodeAclArgs
+func encodeZMembers(members []ZMember) string {
+	args := make([]string, 0, 2*len(members))
+	for _, m := range members {
+		args = append(args, strconv.FormatFloat(m.Score, 'g', -1, 64), m.Member)
+	}
+	return encodeAclArgs(args)
+}
+
+// decodeZMembers decodes members written by encodeZMembers
+func decodeZMembers(value interface{}) ([]ZMember, error) {
+	args, err := decodeAclArgs(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(args)%2 != 0 {
+		return nil, errors.New("expected score member pairs")
+	}
+	members := make([]ZMember, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(args[i], 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, fmt.Errorf("invalid score %q", args[i])
+		}
+		members = append(members, ZMember{Member: args[i+1], Score: score})
+	}
+	return members, nil
+}
+
+// ZAdd adds members to the sorted set at key, creating it if needed.
+// Returns the number of newly added members.
+func (c *Cache) ZAdd(key string, members []ZMember, ttl time.Duration) (int, error) {
+	for _, m := range members {
+		if math.IsNaN(m.Score) {
+			return 0, ErrNaNScore
+		}
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	zset, err := c.getZSetLocked(key, now)
+	if err != nil {
+		return 0, err
+	}
+	if zset == nil {
+		zset = NewSortedSet()
+		c.storeItemLocked(key, &CacheItem{Value: zset, key: key, Type: "zset"}, 0)
+	}
+
+	added := 0
+	for _, m := range members {
+		if zset.Add(m.Member, m.Score) {
+			added++
+		}
+	}
+	c.touchExpirationLocked(c.items[key], ttl)
+	c.touchVersionLocked(c.items[key])
+
+	c.logCommand(CMD_ZADD, key, encodeZMembers(members), ttl)
+	return added, nil
+}
+
+// ZIncrBy increments the score of member by delta and returns the new score
+func (c *Cache) ZIncrBy(key string, delta float64, member string) (float64, error) {
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	zset, err := c.getZSetLocked(key, now)
+	if err != nil {
+		return 0, err
+	}
+
+	// The sorted set is created once the new score is known to be valid
+	var score float64
+	if zset != nil {
+		score, _ = zset.Score(member)
+	}
+	score += delta
+	if math.IsNaN(score) {
+		return 0, ErrNaNScore
+	}
+	if zset == nil {
+		zset = NewSortedSet()
+		c.storeItemLocked(key, &CacheItem{Value: zset, key: key, Type: "zset"}, 0)
+	}
+	zset.Add(member, score)
+	c.touchVersionLocked(c.items[key])
+
+	// Log the resulting score so replaying the log is idempotent
+	c.logCommand(CMD_ZADD, key, encodeZMembers([]ZMember{{Member: member, Score: score}}), 0)
+	return score, nil
+}
+
+// ZRem removes members from the sorted set at key and returns how many were removed.
+// The key is deleted once the sorted set becomes empty.
+func (c *Cache) ZRem(key string, members []string) (int, error) {
+	c.lock()
+	defer c.unlock()
+
+	zset, err := c.getZSetLocked(key, time.Now().UnixNano())
+	if err != nil || zset == nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, m := range members {
+		if zset.Remove(m) {
+			removed++
+		}
+	}
+	if zset.Card() == 0 {
+		c.removeItemLocked(key)
+	} else if removed > 0 {
+		c.touchVersionLocked(c.items[key])
+	}
+
+	if removed > 0 {
+		c.logCommand(CMD_ZREM, key, encodeAclArgs(members), 0)
+	}
+	return removed, nil
+}
+
+// ZScore returns the score of member in the sorted set at key
+func (c *Cache) ZScore(key, member string) (float64, bool, error) {
+	c.rlock()
+	defer c.runlock()
+
+	zset, err := c.getZSetLocked(key, time.Now().UnixNano())
+	if err != nil || zset == nil {
+		return 0, false, err
+	}
+	score, exists := zset.Score(member)
+	return score, exists, nil
+}
+
+// ZRank returns the 0-based rank of member ordered by ascending score
+func (c *Cache) ZRank(key, member string) (int, bool, error) {
+	c.rlock()
+	defer c.runlock()
+
+	zset, err := c.getZSetLocked(key, time.Now().UnixNano())
+	if err != nil || zset == nil {
+		return 0, false, err
+	}
+	rank, exists := zset.Rank(member)
+	return rank, exists, nil
+}
+
+// ZCard returns the number of members in the sorted set at key
+func (c *Cache) ZCard(key string) (int, error) {
+	c.rlock()
+	defer c.runlock()
+
+	zset, err := c.getZSetLocked(key, time.Now().UnixNano())
+	if err != nil || zset == nil {
+		return 0, err
+	}
+	return zset.Card(), nil
+}
+
+// ZRange returns the members with ranks between start and stop (inclusive)
+func (c *Cache) ZRange(key string, start, stop int) ([]ZMember, error) {
+	c.rlock()
+	defer c.runlock()
+
+	zset, err := c.getZSetLocked(key, time.Now().UnixNano())
+	if err != nil || zset == nil {
+		return []ZMember{}, err
+	}
+	return zset.Range(start, stop), nil
+}
+
+// ZRangeByScore returns the members with scores inside r
+func (c *Cache) ZRangeByScore(key string, r ScoreRange, offset, count int) ([]ZMember, error) {
+	c.rlock()
+	defer c.runlock()
+
+	zset, err := c.getZSetLocked(key, time.Now().UnixNano())
+	if err != nil || zset == nil {
+		return []ZMember{}, err
+	}
+	return zset.RangeByScore(r, offset, count), nil
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"math"
+	"testing"
+)
+
+func TestZIncrBy(t *testing.T) {
+	tests := []struct {
+		name  string
+		start []ZMember
+		delta float64
+		want  float64
+		err   error
+	}{
+		{"new key", nil, 2.5, 2.5, nil},
+		{"existing member", []ZMember{{Member: "m", Score: 1}}, 2, 3, nil},
+		{"to infinity", []ZMember{{Member: "m", Score: 1}}, math.Inf(1), math.Inf(1), nil},
+		{"infinity minus infinity", []ZMember{{Member: "m", Score: math.Inf(1)}}, math.Inf(-1), 0, ErrNaNScore},
+		{"NaN increment", nil, math.NaN(), 0, ErrNaNScore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			if tt.start != nil {
+				if _, err := c.ZAdd("z", tt.start, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := c.ZIncrBy("z", tt.delta, "m")
+			if err != tt.err || (err == nil && got != tt.want) {
+				t.Fatalf("ZIncrBy() = %v, %v, want %v, %v", got, err, tt.want, tt.err)
+			}
+			if err == nil {
+				return
+			}
+			// A rejected increment leaves the sorted set as it was
+			score, exists, _ := c.ZScore("z", "m")
+			if tt.start == nil && exists {
+				t.Errorf("ZIncrBy() created the member with score %v", score)
+			}
+			if tt.start != nil && score != tt.start[0].Score {
+				t.Errorf("score = %v after a rejected increment, want %v", score, tt.start[0].Score)
+			}
+			if _, found := c.Get("z"); found != (tt.start != nil) {
+				t.Errorf("key exists = %v after a rejected increment", found)
+			}
+		})
+	}
+}
+
+func TestZAddRejectsNaN(t *testing.T) {
+	c := New()
+	members := []ZMember{{Member: "a", Score: 1}, {Member: "b", Score: math.NaN()}}
+	if _, err := c.ZAdd("z", members, 0); err != ErrNaNScore {
+		t.Fatalf("ZAdd() error = %v, want %v", err, ErrNaNScore)
+	}
+	if _, found := c.Get("z"); found {
+		t.Fatal("ZAdd() stored a sorted set with a NaN score")
+	}
+}
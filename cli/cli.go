@@ -12,19 +12,21 @@ import (
 	"time"
 )
 
-func StartInteractiveCLI(cache *cache.Cache, host string, port string, configPassword string) {
+func StartInteractiveCLI(cache *cache.Cache, host string, port string) {
 	// Check if authentication is required
-	if configPassword != "" {
-		fmt.Print("Password: ")
-		reader := bufio.NewReader(os.Stdin)
-		password, err := reader.ReadString('\n')
+	if authManager := cache.GetAuthManager(); authManager != nil && authManager.IsEnabled() {
+		password, err := authManager.PromptPassword("Password: ")
 		if err != nil {
 			fmt.Printf("Error reading password: %v\n", err)
 			os.Exit(1)
 		}
-		password = strings.TrimSpace(password)
 
-		if password != configPassword {
+		valid, err := authManager.VerifyPassword(password)
+		if err != nil {
+			fmt.Printf("Authentication error: %v\n", err)
+			os.Exit(1)
+		}
+		if !valid {
 			fmt.Println("Authentication failed: invalid password")
 			os.Exit(1)
 		}
@@ -59,7 +61,8 @@ func StartInteractiveCLI(cache *cache.Cache, host string, port string, configPas
 		}
 
 		switch strings.ToUpper(parts[0]) {
-		case "SET", "SETS", "SETX", "SETNX", "SETSNX", "SETXNX", "GET", "DEL", "KEYS", "FLUSHALL":
+		case "SET", "SETS", "SETX", "SETNX", "SETSNX", "SETXNX", "GET", "DEL", "KEYS", "FLUSHALL",
+			"MGET", "MSET", "MSETNX", "MDEL":
 			handleCacheCommand(cache, parts)
 			fmt.Print("> ")
 		case "AUTH":
@@ -79,8 +82,9 @@ func handleCacheCommand(cache *cache.Cache, parts []string) {
 	ttl := time.Duration(0)
 	var filteredParts []string
 
-	// DEL, GET, KEYS and FLUSHALL commands don't support TTL parameter
-	if cmd == "DEL" || cmd == "GET" || cmd == "KEYS" || cmd == "FLUSHALL" {
+	// DEL, GET, KEYS, FLUSHALL and multi-key commands don't support TTL parameter
+	if cmd == "DEL" || cmd == "GET" || cmd == "KEYS" || cmd == "FLUSHALL" ||
+		cmd == "MGET" || cmd == "MSET" || cmd == "MSETNX" || cmd == "MDEL" {
 		filteredParts = parts
 	} else {
 		// Handle TTL parameter - only support after key
@@ -205,33 +209,60 @@ func handleCacheCommand(cache *cache.Cache, parts []string) {
 		if !exists {
 			fmt.Println("NOT_FOUND")
 		} else {
-			// Format output based on data type
-			switch v := value.(type) {
-			case string:
-				// String: return as-is
-				fmt.Println(v)
-			case []string:
-				// Array: return as space-separated values in brackets
-				fmt.Printf("[%s]\n", strings.Join(v, " "))
-			case map[string]string:
-				// Object: return as JSON string
-				jsonBytes, err := json.Marshal(v)
-				if err != nil {
-					fmt.Printf("ERROR serializing object: %v\n", err)
-				} else {
-					fmt.Println(string(jsonBytes))
-				}
-			default:
-				// Fallback for other types
-				fmt.Println(value)
+			printValue(value)
+		}
+
+	case "MGET":
+		if len(filteredParts) < 2 {
+			fmt.Println("ERROR: MGET requires at least one key")
+			return
+		}
+		for i, value := range cache.MGet(filteredParts[1:]) {
+			fmt.Printf("%d) ", i+1)
+			if value == nil {
+				fmt.Println("NOT_FOUND")
+			} else {
+				printValue(value)
 			}
 		}
 
+	case "MSET", "MSETNX":
+		if len(filteredParts) < 3 || (len(filteredParts)-1)%2 != 0 {
+			fmt.Printf("ERROR: %s requires key value pairs\n", cmd)
+			return
+		}
+		var keys []string
+		var values []interface{}
+		for i := 1; i < len(filteredParts); i += 2 {
+			keys = append(keys, filteredParts[i])
+			values = append(values, filteredParts[i+1])
+		}
+		if cmd == "MSET" {
+			cache.MSet(keys, values, 0)
+			fmt.Println("OK")
+		} else if cache.MSetNX(keys, values, 0) {
+			fmt.Println("OK")
+		} else {
+			fmt.Println("NOT_SET")
+		}
+
+	case "MDEL":
+		if len(filteredParts) < 2 {
+			fmt.Println("ERROR: MDEL requires at least one key")
+			return
+		}
+		fmt.Println(cache.DeleteMultiple(filteredParts[1:]))
+
 	case "DEL":
 		if len(filteredParts) < 2 {
 			fmt.Println("ERROR: DEL requires key")
 			return
 		}
+		if len(filteredParts) > 2 {
+			// Multiple keys are deleted atomically
+			fmt.Println(cache.DeleteMultiple(filteredParts[1:]))
+			return
+		}
 		key := filteredParts[1]
 		deleted := cache.Delete(key)
 		if deleted {
@@ -261,6 +292,29 @@ func handleCacheCommand(cache *cache.Cache, parts []string) {
 	}
 }
 
+// printValue prints a value based on its data type
+func printValue(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		// String: return as-is
+		fmt.Println(v)
+	case []string:
+		// Array: return as space-separated values in brackets
+		fmt.Printf("[%s]\n", strings.Join(v, " "))
+	case map[string]string:
+		// Object: return as JSON string
+		jsonBytes, err := json.Marshal(v)
+		if err != nil {
+			fmt.Printf("ERROR serializing object: %v\n", err)
+		} else {
+			fmt.Println(string(jsonBytes))
+		}
+	default:
+		// Fallback for other types
+		fmt.Println(value)
+	}
+}
+
 func handleAuthCommand(cache *cache.Cache, parts []string) {
 	authManager := cache.GetAuthManager()
 	if authManager == nil || !authManager.IsEnabled() {
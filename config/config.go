@@ -2,20 +2,32 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"strings"
 	"time"
+
+	"ant-cache/logging"
 )
 
 type Config struct {
 	Server struct {
-		Host string `json:"host"`
-		Port string `json:"port"`
+		Host            string `json:"host"`
+		Port            string `json:"port"`
+		ShutdownTimeout string `json:"shutdown_timeout"` // Wait for the commands in flight on shutdown
 	} `json:"server"`
 	Auth struct {
-		Password string `json:"password"`
+		Password     string `json:"password"`      // Plain text password or pbkdf2-sha256 credential
+		PasswordEnv  string `json:"password_env"`  // Environment variable holding the password
+		PasswordFile string `json:"password_file"` // File holding the password
+		AuditLog     string `json:"audit_log"`     // JSON lines of the AUTH attempts
 	} `json:"auth"`
 	Persistence struct {
+		AtdFile     string `json:"atd_file"` // Empty disables persistence
 		AtdInterval string `json:"atd_interval"`
+		AclFile     string `json:"acl_file"` // Empty disables persistence
 		AclInterval string `json:"acl_interval"`
 	} `json:"persistence"`
 	Compression struct {
@@ -25,6 +37,35 @@ type Config struct {
 		MinSize     int    `json:"min_size"`     // 最小压缩大小（字节）
 		StringsOnly bool   `json:"strings_only"` // 是否只压缩字符串
 	} `json:"compression"`
+	Metrics struct {
+		Enabled bool   `json:"enabled"`
+		Host    string `json:"host"`
+		Port    string `json:"port"`
+	} `json:"metrics"`
+	Slowlog struct {
+		Threshold string `json:"threshold"` // Commands slower than this are logged, negative disables
+		MaxLen    int    `json:"max_len"`   // Entries kept
+	} `json:"slowlog"`
+	TLS struct {
+		Enabled           bool   `json:"enabled"`
+		CertFile          string `json:"cert_file"`
+		KeyFile           string `json:"key_file"`
+		CAFile            string `json:"ca_file"`             // CA verifying client certificates
+		MinVersion        string `json:"min_version"`         // "1.2" or "1.3"
+		RequireClientCert bool   `json:"require_client_cert"` // Mutual TLS
+		ClientCertAuth    bool   `json:"client_cert_auth"`    // Authenticate the user named by the certificate CN
+	} `json:"tls"`
+	Logging struct {
+		Level      string            `json:"level"`       // "debug", "info", "warn" or "error"
+		Format     string            `json:"format"`      // "text" or "json"
+		File       string            `json:"file"`        // Empty logs to the standard error
+		MaxSizeMB  int               `json:"max_size_mb"` // Rotate the file at this size, 0 never
+		MaxBackups int               `json:"max_backups"` // Rotated files kept
+		Subsystems map[string]string `json:"subsystems"`  // Level of some subsystems, by name
+	} `json:"logging"`
+
+	// sources are the sources of the settings not set by default, by path
+	sources map[string]string
 }
 
 // GetAtdInterval returns the ATD interval as time.Duration
@@ -53,76 +94,157 @@ func (c *Config) GetAclInterval() time.Duration {
 	return duration
 }
 
-func LoadConfig(filename string) (*Config, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// GetShutdownTimeout returns the shutdown timeout as time.Duration
+func (c *Config) GetShutdownTimeout() time.Duration {
+	if c.Server.ShutdownTimeout == "" {
+		return 10 * time.Second
 	}
-	defer file.Close()
-
-	config := &Config{}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(config)
+	duration, err := time.ParseDuration(c.Server.ShutdownTimeout)
 	if err != nil {
-		return nil, err
+		// If parsing fails, return the default value
+		return 10 * time.Second
 	}
+	return duration
+}
 
-	// Set default values
-	if config.Server.Host == "" {
-		config.Server.Host = "localhost"
-	}
-	if config.Server.Port == "" {
-		config.Server.Port = "8890"
+// GetSlowlogThreshold returns the slow log threshold as time.Duration
+func (c *Config) GetSlowlogThreshold() time.Duration {
+	if c.Slowlog.Threshold == "" {
+		return 10 * time.Millisecond
 	}
-	if config.Persistence.AtdInterval == "" {
-		config.Persistence.AtdInterval = "1h"
-	}
-	if config.Persistence.AclInterval == "" {
-		config.Persistence.AclInterval = "1s"
+	duration, err := time.ParseDuration(c.Slowlog.Threshold)
+	if err != nil {
+		// If parsing fails, return the default value
+		return 10 * time.Millisecond
 	}
-	// Set default compression values
-	if config.Compression.Type == "" {
-		config.Compression.Type = "gzip"
+	return duration
+}
+
+// LoggingOptions returns the options of logging.Setup
+func (c *Config) LoggingOptions() logging.Options {
+	return logging.Options{
+		Level:      c.Logging.Level,
+		Format:     c.Logging.Format,
+		File:       c.Logging.File,
+		MaxSize:    int64(c.Logging.MaxSizeMB) * 1024 * 1024,
+		MaxBackups: c.Logging.MaxBackups,
+		Subsystems: c.Logging.Subsystems,
 	}
-	if config.Compression.Level == "" {
-		config.Compression.Level = "default"
+}
+
+// AuthSecret returns the password or credential of the default user, read
+// from password_file or password_env when set, or else password. Empty
+// disables authentication.
+func (c *Config) AuthSecret() (string, error) {
+	switch {
+	case c.Auth.PasswordFile != "":
+		data, err := os.ReadFile(c.Auth.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %v", err)
+		}
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return "", fmt.Errorf("password file %s is empty", c.Auth.PasswordFile)
+		}
+		return secret, nil
+	case c.Auth.PasswordEnv != "":
+		secret := strings.TrimSpace(os.Getenv(c.Auth.PasswordEnv))
+		if secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", c.Auth.PasswordEnv)
+		}
+		return secret, nil
+	default:
+		return c.Auth.Password, nil
 	}
-	if config.Compression.MinSize == 0 {
-		config.Compression.MinSize = 1024 // 默认1KB
+}
+
+// AuthSecretSource describes where AuthSecret reads the secret from
+func (c *Config) AuthSecretSource() string {
+	switch {
+	case c.Auth.PasswordFile != "":
+		return "file " + c.Auth.PasswordFile
+	case c.Auth.PasswordEnv != "":
+		return "environment variable " + c.Auth.PasswordEnv
+	case c.Auth.Password != "":
+		return "config"
+	default:
+		return ""
 	}
+}
 
-	return config, nil
+// LoadConfig loads the configuration of the file filename over the defaults,
+// with the overrides of the ANTCACHE_* environment variables, see Load
+func LoadConfig(filename string) (*Config, error) {
+	return Load(filename, nil)
 }
 
-// SaveConfig saves the configuration to a file
+// SaveConfig saves the settings changed by CONFIG SET to the JSON file
+// filename. The other settings of the file are kept as they are, the values
+// of the environment and the flags are not written. A plain text
+// auth.password is written as its credential, and the file is replaced with
+// mode 0600 as it may hold credentials.
 func (c *Config) SaveConfig(filename string) error {
-	data, err := json.MarshalIndent(c, "", "  ")
-	if err != nil {
+	sections := make(map[string]map[string]json.RawMessage)
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &sections); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+
+	for _, f := range fields {
+		if c.Source(f.path) != SourceConfigSet {
+			continue
+		}
+		value, err := json.Marshal(f.value(c).Interface())
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.path, err)
+		}
+		section, name, _ := strings.Cut(f.path, ".")
+		if sections[section] == nil {
+			sections[section] = make(map[string]json.RawMessage)
+		}
+		sections[section][name] = value
+	}
+	if err := protectPassword(sections["auth"]); err != nil {
 		return err
 	}
-	return os.WriteFile(filename, data, 0644)
+	return writeFile(filename, marshalSections(sections))
 }
 
 // DefaultConfig returns a default configuration
 func DefaultConfig() *Config {
 	return &Config{
 		Server: struct {
-			Host string `json:"host"`
-			Port string `json:"port"`
+			Host            string `json:"host"`
+			Port            string `json:"port"`
+			ShutdownTimeout string `json:"shutdown_timeout"`
 		}{
-			Host: "localhost",
-			Port: "8890",
+			Host:            "localhost",
+			Port:            "8890",
+			ShutdownTimeout: "10s",
 		},
 		Auth: struct {
-			Password string `json:"password"`
+			Password     string `json:"password"`
+			PasswordEnv  string `json:"password_env"`
+			PasswordFile string `json:"password_file"`
+			AuditLog     string `json:"audit_log"`
 		}{
 			Password: "",
+			AuditLog: "auth_audit.log",
 		},
 		Persistence: struct {
+			AtdFile     string `json:"atd_file"`
 			AtdInterval string `json:"atd_interval"`
+			AclFile     string `json:"acl_file"`
 			AclInterval string `json:"acl_interval"`
 		}{
+			AtdFile:     "cache.atd",
 			AtdInterval: "1h",
+			AclFile:     "cache.acl",
 			AclInterval: "1s",
 		},
 		Compression: struct {
@@ -138,5 +260,46 @@ func DefaultConfig() *Config {
 			MinSize:     1024,  // 默认1KB以上的值才压缩
 			StringsOnly: false, // 默认压缩所有类型
 		},
+		Metrics: struct {
+			Enabled bool   `json:"enabled"`
+			Host    string `json:"host"`
+			Port    string `json:"port"`
+		}{
+			Enabled: false,
+			Host:    "localhost",
+			Port:    "9190",
+		},
+		Slowlog: struct {
+			Threshold string `json:"threshold"`
+			MaxLen    int    `json:"max_len"`
+		}{
+			Threshold: "10ms",
+			MaxLen:    128,
+		},
+		TLS: struct {
+			Enabled           bool   `json:"enabled"`
+			CertFile          string `json:"cert_file"`
+			KeyFile           string `json:"key_file"`
+			CAFile            string `json:"ca_file"`
+			MinVersion        string `json:"min_version"`
+			RequireClientCert bool   `json:"require_client_cert"`
+			ClientCertAuth    bool   `json:"client_cert_auth"`
+		}{
+			Enabled:    false,
+			MinVersion: "1.2",
+		},
+		Logging: struct {
+			Level      string            `json:"level"`
+			Format     string            `json:"format"`
+			File       string            `json:"file"`
+			MaxSizeMB  int               `json:"max_size_mb"`
+			MaxBackups int               `json:"max_backups"`
+			Subsystems map[string]string `json:"subsystems"`
+		}{
+			Level:      "info",
+			Format:     "text",
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
 	}
 }
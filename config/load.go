@@ -0,0 +1,347 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables overriding the settings, as
+// ANTCACHE_SERVER_PORT for server.port
+const EnvPrefix = "ANTCACHE_"
+
+// Sources of the settings, the file and env sources are followed by the file
+// name and the environment variable
+const (
+	SourceDefault   = "default"
+	SourceFile      = "file"
+	SourceEnv       = "env"
+	SourceFlag      = "flag"
+	SourceConfigSet = "CONFIG SET"
+)
+
+// Setting is a value of the configuration, named by its path in the JSON file
+type Setting struct {
+	Path   string // As server.port
+	Value  string
+	Source string // Where the value comes from, as "env ANTCACHE_SERVER_PORT"
+}
+
+// Errors lists the invalid settings of a configuration, each error starting
+// with the path of its setting
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// errorList returns errs as Errors, nil if empty
+func errorList(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return Errors(errs)
+}
+
+// field is a setting of Config, with the indexes of its struct field
+type field struct {
+	path  string
+	index []int
+}
+
+// fields are the settings of Config in the order of its sections
+var fields = func() []field {
+	var fields []field
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		section := t.Field(i)
+		if !section.IsExported() {
+			continue
+		}
+		for j := 0; j < section.Type.NumField(); j++ {
+			f := section.Type.Field(j)
+			fields = append(fields, field{
+				path:  jsonName(section) + "." + jsonName(f),
+				index: []int{i, j},
+			})
+		}
+	}
+	return fields
+}()
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
+
+func lookupField(path string) (field, bool) {
+	for _, f := range fields {
+		if f.path == path {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// EnvName returns the environment variable overriding the setting path
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// Load builds the configuration from its layers, each one overriding the
+// previous ones: the defaults, the JSON file filename, the ANTCACHE_*
+// environment variables, then flags, the values of the command line flags
+// by setting path. The configuration is validated, the error names every
+// invalid setting by its path.
+func Load(filename string, flags map[string]string) (*Config, error) {
+	c := DefaultConfig()
+	if err := c.loadFile(filename); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		path, ok := envPath(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting", name))
+			continue
+		}
+		if err := c.Set(path, value, SourceEnv+" "+name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	paths := make([]string, 0, len(flags))
+	for path := range flags {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := c.Set(path, flags[path], SourceFlag); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errorList(errs)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// envPath returns the setting overridden by the environment variable name
+func envPath(name string) (string, bool) {
+	for _, f := range fields {
+		if EnvName(f.path) == name {
+			return f.path, true
+		}
+	}
+	return "", false
+}
+
+// loadFile overrides the settings present in the JSON file filename. Unknown
+// sections and fields are rejected.
+func (c *Config) loadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := position(data, syntaxErr.Offset)
+			return fmt.Errorf("%s:%d:%d: %v", filename, line, column, err)
+		}
+		return fmt.Errorf("%s: expected an object of sections", filename)
+	}
+
+	var errs []error
+	for _, section := range sortedKeys(sections) {
+		if !isSection(section) {
+			errs = append(errs, fmt.Errorf("%s: unknown section", section))
+			continue
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(sections[section], &values); err != nil {
+			errs = append(errs, fmt.Errorf("%s: expected an object", section))
+			continue
+		}
+		for _, name := range sortedKeys(values) {
+			path := section + "." + name
+			f, ok := lookupField(path)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown field", path))
+				continue
+			}
+			v := f.value(c)
+			next := reflect.New(v.Type())
+			if err := json.Unmarshal(values[name], next.Interface()); err != nil {
+				errs = append(errs, fmt.Errorf("%s: expected %s", path, describeKind(v.Type())))
+				continue
+			}
+			v.Set(next.Elem())
+			c.setSource(path, SourceFile+" "+filename)
+		}
+	}
+	return errorList(errs)
+}
+
+// isSection reports whether section is a section of Config
+func isSection(section string) bool {
+	for _, f := range fields {
+		if strings.HasPrefix(f.path, section+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// position returns the line and column of the byte read last at offset in
+// data, counted from 1
+func position(data []byte, offset int64) (int, int) {
+	before := data[:min(int(offset), len(data))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n') - 1
+	return line, max(column, 1)
+}
+
+func describeKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int:
+		return "an integer"
+	case reflect.Map:
+		return "an object of strings"
+	default:
+		return "a string"
+	}
+}
+
+func (f field) value(c *Config) reflect.Value {
+	return reflect.ValueOf(c).Elem().FieldByIndex(f.index)
+}
+
+// Value returns the value of the setting path, "" if it does not exist.
+// logging.subsystems is formatted as name=level pairs separated by commas.
+func (c *Config) Value(path string) string {
+	f, ok := lookupField(path)
+	if !ok {
+		return ""
+	}
+	v := f.value(c)
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Map:
+		pairs := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			pairs = append(pairs, key.String()+"="+v.MapIndex(key).String())
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return v.String()
+	}
+}
+
+// Set parses value into the setting path, as formatted by Value, and records
+// source as its source. The value is not validated.
+func (c *Config) Set(path, value, source string) error {
+	f, ok := lookupField(path)
+	if !ok {
+		return fmt.Errorf("%s: unknown setting", path)
+	}
+	v := f.value(c)
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false (from %s)", path, value, source)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer (from %s)", path, value, source)
+		}
+		v.SetInt(int64(n))
+	case reflect.Map:
+		pairs := make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			key, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s: %q is not name=value (from %s)", path, pair, source)
+			}
+			pairs[key] = val
+		}
+		v.Set(reflect.ValueOf(pairs))
+	default:
+		v.SetString(value)
+	}
+	c.setSource(path, source)
+	return nil
+}
+
+// setSource records the source of the setting path. The sources are copied,
+// they may be shared with copies of c.
+func (c *Config) setSource(path, source string) {
+	sources := make(map[string]string, len(c.sources)+1)
+	for p, s := range c.sources {
+		sources[p] = s
+	}
+	sources[path] = source
+	c.sources = sources
+}
+
+// Source returns where the value of the setting path comes from
+func (c *Config) Source(path string) string {
+	if source, ok := c.sources[path]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// Settings returns every setting with its value and its source, in the order
+// of the JSON file. Passwords are not redacted.
+func (c *Config) Settings() []Setting {
+	settings := make([]Setting, 0, len(fields))
+	for _, f := range fields {
+		settings = append(settings, Setting{Path: f.path, Value: c.Value(f.path), Source: c.Source(f.path)})
+	}
+	return settings
+}
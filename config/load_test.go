@@ -0,0 +1,214 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes data to a configuration file and returns its path
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLayers(t *testing.T) {
+	file := `{
+		"server": {"host": "0.0.0.0", "port": "9000"},
+		"persistence": {"atd_file": "file.atd", "acl_interval": "10s"},
+		"compression": {"enabled": true},
+		"logging": {"subsystems": {"auth": "debug"}}
+	}`
+	tests := []struct {
+		name       string
+		env        map[string]string
+		flags      map[string]string
+		path       string
+		want       string
+		wantSource string
+	}{
+		{name: "default", path: "slowlog.max_len", want: "128", wantSource: SourceDefault},
+		{name: "file", path: "persistence.atd_file", want: "file.atd", wantSource: "file"},
+		{name: "file boolean", path: "compression.enabled", want: "true", wantSource: "file"},
+		{name: "file map", path: "logging.subsystems", want: "auth=debug", wantSource: "file"},
+		{
+			name: "environment over file",
+			env:  map[string]string{"ANTCACHE_SERVER_PORT": "9100"},
+			path: "server.port", want: "9100", wantSource: "env ANTCACHE_SERVER_PORT",
+		},
+		{
+			name: "environment over default",
+			env:  map[string]string{"ANTCACHE_SLOWLOG_MAX_LEN": "64"},
+			path: "slowlog.max_len", want: "64", wantSource: "env ANTCACHE_SLOWLOG_MAX_LEN",
+		},
+		{
+			name: "environment map replaces the file map",
+			env:  map[string]string{"ANTCACHE_LOGGING_SUBSYSTEMS": "tcpserver=warn, cache=error"},
+			path: "logging.subsystems", want: "cache=error,tcpserver=warn", wantSource: "env ANTCACHE_LOGGING_SUBSYSTEMS",
+		},
+		{
+			name:  "flag over environment",
+			env:   map[string]string{"ANTCACHE_SERVER_HOST": "10.0.0.1"},
+			flags: map[string]string{"server.host": "127.0.0.1"},
+			path:  "server.host", want: "127.0.0.1", wantSource: SourceFlag,
+		},
+		{
+			name:  "flag over file",
+			flags: map[string]string{"compression.enabled": "false"},
+			path:  "compression.enabled", want: "false", wantSource: SourceFlag,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, file)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := Load(path, tt.flags)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if got := cfg.Value(tt.path); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.path, got, tt.want)
+			}
+			wantSource := tt.wantSource
+			if wantSource == "file" {
+				wantSource = SourceFile + " " + path
+			}
+			if got := cfg.Source(tt.path); got != wantSource {
+				t.Errorf("source of %s = %q, want %q", tt.path, got, wantSource)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags map[string]string
+		// Each error expected, in order
+		want []string
+	}{
+		{
+			name: "syntax error",
+			file: "{\n  \"server\": {\"port\": 9000,}\n}",
+			want: []string{":2:27: invalid character '}'"},
+		},
+		{
+			name: "not an object",
+			file: `[1, 2]`,
+			want: []string{"expected an object of sections"},
+		},
+		{
+			name: "unknown section and field",
+			file: `{"servr": {}, "server": {"prot": "1"}}`,
+			want: []string{"server.prot: unknown field", "servr: unknown section"},
+		},
+		{
+			name: "wrong types",
+			file: `{"server": {"port": 9000}, "slowlog": {"max_len": "32"}, "tls": {"enabled": 1}}`,
+			want: []string{"server.port: expected a string", "slowlog.max_len: expected an integer", "tls.enabled: expected true or false"},
+		},
+		{
+			name: "section not an object",
+			file: `{"server": "localhost"}`,
+			want: []string{"server: expected an object"},
+		},
+		{
+			name: "unknown environment variable",
+			file: `{}`,
+			env:  map[string]string{"ANTCACHE_SERVER_PROT": "1"},
+			want: []string{"ANTCACHE_SERVER_PROT: unknown setting"},
+		},
+		{
+			name:  "invalid environment and flag values",
+			file:  `{}`,
+			env:   map[string]string{"ANTCACHE_SLOWLOG_MAX_LEN": "many"},
+			flags: map[string]string{"compression.enabled": "yes", "logging.subsystems": "auth"},
+			want: []string{
+				`slowlog.max_len: "many" is not an integer (from env ANTCACHE_SLOWLOG_MAX_LEN)`,
+				`compression.enabled: "yes" is not true or false (from flag)`,
+				`logging.subsystems: "auth" is not name=value (from flag)`,
+			},
+		},
+		{
+			name: "invalid values",
+			file: `{"server": {"port": "99999"}, "persistence": {"atd_interval": "1m"}}`,
+			env:  map[string]string{"ANTCACHE_LOGGING_LEVEL": "verbose"},
+			want: []string{
+				`server.port: "99999" is not a port number (from file`,
+				"persistence.atd_interval: 1m is less than the minimum 5m0s (from file",
+				`logging.level: "verbose" is not debug, info, warn or error (from env ANTCACHE_LOGGING_LEVEL)`,
+			},
+		},
+		{
+			name:  "TLS files required",
+			file:  `{"tls": {"enabled": true, "require_client_cert": true}}`,
+			flags: map[string]string{"tls.cert_file": "server.crt"},
+			want: []string{
+				"tls.key_file: is required with tls.enabled",
+				"tls.ca_file: is required to verify client certificates",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.file)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load(path, tt.flags)
+			if err == nil {
+				t.Fatal("Load() accepted an invalid configuration")
+			}
+			var errs Errors
+			if len(tt.want) > 1 && !errors.As(err, &errs) {
+				t.Fatalf("Load() error = %v, want a list of errors", err)
+			}
+			// The errors appear in the order of the expected ones
+			rest := err.Error()
+			for _, want := range tt.want {
+				i := strings.Index(rest, want)
+				if i < 0 {
+					t.Fatalf("Load() error = %v, want %q after the previous errors", err, want)
+				}
+				rest = rest[i+len(want):]
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing.json"), nil)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Load() error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestSetValueRoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, s := range cfg.Settings() {
+		next := DefaultConfig()
+		if err := next.Set(s.Path, s.Value, SourceFlag); err != nil {
+			t.Errorf("Set(%s, %q) error = %v", s.Path, s.Value, err)
+			continue
+		}
+		if got := next.Value(s.Path); got != s.Value {
+			t.Errorf("Value(%s) = %q after Set(%q)", s.Path, got, s.Value)
+		}
+		if next.Source(s.Path) != SourceFlag || cfg.Source(s.Path) != SourceDefault {
+			t.Errorf("source of %s = %q, default config %q", s.Path, next.Source(s.Path), cfg.Source(s.Path))
+		}
+	}
+	if err := cfg.Set("server.prot", "1", SourceFlag); err == nil {
+		t.Error("Set() accepted an unknown setting")
+	}
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ant-cache/auth"
+)
+
+// protectPassword replaces a plain text password of the auth section by its
+// credential
+func protectPassword(section map[string]json.RawMessage) error {
+	var password string
+	if err := json.Unmarshal(section["password"], &password); err != nil || password == "" || auth.IsCredential(password) {
+		return nil
+	}
+	credential, err := auth.NewCredential(password)
+	if err != nil {
+		return fmt.Errorf("auth.password: %v", err)
+	}
+	section["password"], err = json.Marshal(credential.String())
+	return err
+}
+
+// marshalSections formats the sections as an indented JSON object, the
+// settings in the order of Config
+func marshalSections(sections map[string]map[string]json.RawMessage) []byte {
+	var compact bytes.Buffer
+	compact.WriteByte('{')
+	current := ""
+	for _, f := range fields {
+		section, name, _ := strings.Cut(f.path, ".")
+		value, ok := sections[section][name]
+		if !ok {
+			continue
+		}
+		switch {
+		case section == current:
+			compact.WriteByte(',')
+		case current != "":
+			compact.WriteString("},")
+			fallthrough
+		default:
+			fmt.Fprintf(&compact, "%q:{", section)
+			current = section
+		}
+		fmt.Fprintf(&compact, "%q:%s", name, value)
+	}
+	if current != "" {
+		compact.WriteByte('}')
+	}
+	compact.WriteByte('}')
+
+	var indented bytes.Buffer
+	// The values are valid JSON, read from the file or marshaled
+	json.Indent(&indented, compact.Bytes(), "", "  ")
+	indented.WriteByte('\n')
+	return indented.Bytes()
+}
+
+// writeFile replaces filename with data through a temporary file, created
+// with mode 0600, renamed over it
+func writeFile(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
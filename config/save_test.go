@@ -0,0 +1,83 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ant-cache/auth"
+)
+
+func TestSaveConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"server": {"port": "9000"}, "auth": {"password": "secret"}, "slowlog": {"max_len": 32}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ANTCACHE_SERVER_HOST", "0.0.0.0")
+	t.Setenv("ANTCACHE_SERVER_PORT", "9100")
+	cfg, err := Load(path, map[string]string{"persistence.atd_interval": "2h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Set("slowlog.max_len", "64", SourceConfigSet); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Set("logging.level", "debug", SourceConfigSet); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SaveConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode = %o, want 600", mode)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(written), "secret") {
+		t.Errorf("the plain text password was written:\n%s", written)
+	}
+
+	// Restored by t.Setenv at the end of the test
+	os.Unsetenv("ANTCACHE_SERVER_HOST")
+	os.Unsetenv("ANTCACHE_SERVER_PORT")
+	loaded, err := Load(path, nil)
+	if err != nil {
+		t.Fatalf("Load() of the rewritten file: %v\n%s", err, written)
+	}
+	tests := []struct {
+		path   string
+		value  string
+		source string
+	}{
+		// Kept from the file, not the environment
+		{"server.port", "9000", SourceFile + " " + path},
+		{"server.host", "localhost", SourceDefault},
+		// Set by a flag, not written
+		{"persistence.atd_interval", "1h", SourceDefault},
+		// Set by CONFIG SET
+		{"slowlog.max_len", "64", SourceFile + " " + path},
+		{"logging.level", "debug", SourceFile + " " + path},
+	}
+	for _, tt := range tests {
+		if value, source := loaded.Value(tt.path), loaded.Source(tt.path); value != tt.value || source != tt.source {
+			t.Errorf("%s = %q from %s, want %q from %s", tt.path, value, source, tt.value, tt.source)
+		}
+	}
+
+	credential, err := auth.ParseCredential(loaded.Auth.Password)
+	if err != nil {
+		t.Fatalf("auth.password: %v", err)
+	}
+	if !credential.Verify("secret") {
+		t.Error("auth.password is not the credential of the password")
+	}
+}
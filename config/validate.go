@@ -0,0 +1,137 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ant-cache/logging"
+)
+
+// Limits of the persistence intervals
+const (
+	MinAtdInterval = 5 * time.Minute
+	MaxAtdInterval = 30 * 24 * time.Hour
+	MinAclInterval = time.Second
+	MaxAclInterval = time.Minute
+)
+
+// Validate checks the values of the settings. The error names every invalid
+// setting by its path, followed by its source unless it is the default.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(path string, err error) {
+		if err == nil {
+			return
+		}
+		if source := c.Source(path); source != SourceDefault {
+			err = fmt.Errorf("%v (from %s)", err, source)
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", path, err))
+	}
+
+	check("server.port", checkPort(c.Server.Port))
+	check("server.shutdown_timeout", checkDuration(c.Server.ShutdownTimeout, 0, 0))
+
+	check("persistence.atd_interval", checkDuration(c.Persistence.AtdInterval, MinAtdInterval, MaxAtdInterval))
+	check("persistence.acl_interval", checkDuration(c.Persistence.AclInterval, MinAclInterval, MaxAclInterval))
+
+	check("compression.type", checkChoice(c.Compression.Type, "gzip", "zlib"))
+	check("compression.level", checkChoice(c.Compression.Level, "default", "best_speed", "best_compression"))
+	check("compression.min_size", checkMin(c.Compression.MinSize, 0))
+
+	if c.Metrics.Enabled {
+		check("metrics.port", checkPort(c.Metrics.Port))
+	}
+
+	if _, err := time.ParseDuration(c.Slowlog.Threshold); err != nil {
+		check("slowlog.threshold", fmt.Errorf("%q is not a duration", c.Slowlog.Threshold))
+	}
+	check("slowlog.max_len", checkMin(c.Slowlog.MaxLen, 1))
+
+	check("tls.min_version", checkChoice(c.TLS.MinVersion, "1.2", "1.3"))
+	if c.TLS.Enabled {
+		if c.TLS.CertFile == "" {
+			check("tls.cert_file", errors.New("is required with tls.enabled"))
+		}
+		if c.TLS.KeyFile == "" {
+			check("tls.key_file", errors.New("is required with tls.enabled"))
+		}
+		if (c.TLS.RequireClientCert || c.TLS.ClientCertAuth) && c.TLS.CAFile == "" {
+			check("tls.ca_file", errors.New("is required to verify client certificates"))
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		check("logging.level", fmt.Errorf("%q is not debug, info, warn or error", c.Logging.Level))
+	}
+	check("logging.format", checkChoice(c.Logging.Format, "text", "json"))
+	check("logging.max_size_mb", checkMin(c.Logging.MaxSizeMB, 0))
+	check("logging.max_backups", checkMin(c.Logging.MaxBackups, 0))
+	for _, name := range sortedNames(c.Logging.Subsystems) {
+		switch name {
+		case logging.Main, logging.Cache, logging.Persistence, logging.TCPServer, logging.Auth:
+		default:
+			check("logging.subsystems", fmt.Errorf("unknown subsystem %q, use main, cache, persistence, tcpserver or auth", name))
+			continue
+		}
+		if level := c.Logging.Subsystems[name]; level == "" {
+			check("logging.subsystems", fmt.Errorf("%s: the level is empty", name))
+		} else if _, err := logging.ParseLevel(level); err != nil {
+			check("logging.subsystems", fmt.Errorf("%s: %q is not debug, info, warn or error", name, level))
+		}
+	}
+	return errorList(errs)
+}
+
+// checkDuration checks that value is a duration of at least min, and at most
+// max unless max is 0
+func checkDuration(value string, min, max time.Duration) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration, such as 30s or 5m", value)
+	}
+	if d < min {
+		return fmt.Errorf("%s is less than the minimum %v", value, min)
+	}
+	if max > 0 && d > max {
+		return fmt.Errorf("%s is more than the maximum %v", value, max)
+	}
+	return nil
+}
+
+func checkPort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("%q is not a port number", value)
+	}
+	return nil
+}
+
+func checkChoice(value string, choices ...string) error {
+	for _, choice := range choices {
+		if value == choice {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not one of %s", value, strings.Join(choices, ", "))
+}
+
+func checkMin(value, min int) error {
+	if value < min {
+		return fmt.Errorf("%d is less than the minimum %d", value, min)
+	}
+	return nil
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
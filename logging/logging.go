@@ -0,0 +1,183 @@
+// Package logging provides the leveled loggers of the subsystems, built on
+// log/slog. Loggers are created once per package with For and follow the
+// configuration applied later by Setup.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Subsystems with their own logger and level
+const (
+	Main        = "main"
+	Cache       = "cache"
+	Persistence = "persistence"
+	TCPServer   = "tcpserver"
+	Auth        = "auth"
+)
+
+// Options configures the loggers
+type Options struct {
+	// Level is debug, info, warn or error, "" for info
+	Level string
+	// Format is text or json, "" for text
+	Format string
+	// File receives the logs instead of the standard error when set
+	File string
+	// MaxSize rotates File once it reaches this many bytes, 0 never
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int
+	// Subsystems overrides Level for some subsystems
+	Subsystems map[string]string
+}
+
+var (
+	// base writes the records of every subsystem
+	base atomic.Pointer[slog.Handler]
+
+	mu sync.Mutex
+	// levels holds the level of each subsystem created with For
+	levels = make(map[string]*slog.LevelVar)
+	// defaultLevel and overrides are the levels set by Setup
+	defaultLevel = slog.LevelInfo
+	overrides    = make(map[string]slog.Level)
+	// output is the log file opened by Setup, closed by the next Setup
+	output io.Closer
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	base.Store(&h)
+}
+
+// For returns the logger of a subsystem
+func For(subsystem string) *slog.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	level, ok := levels[subsystem]
+	if !ok {
+		level = new(slog.LevelVar)
+		level.Set(levelOf(subsystem))
+		levels[subsystem] = level
+	}
+	return slog.New(&handler{subsystem: subsystem, level: level})
+}
+
+// levelOf returns the level set for subsystem, mu must be held
+func levelOf(subsystem string) slog.Level {
+	if level, ok := overrides[subsystem]; ok {
+		return level
+	}
+	return defaultLevel
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level %s, use debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// Setup applies options to the loggers of every subsystem, and makes the
+// log package and slog.Default write through them as the main subsystem
+func Setup(options Options) error {
+	level, err := ParseLevel(options.Level)
+	if err != nil {
+		return err
+	}
+	subsystems := make(map[string]slog.Level)
+	for name, s := range options.Subsystems {
+		if subsystems[name], err = ParseLevel(s); err != nil {
+			return fmt.Errorf("subsystem %s: %v", name, err)
+		}
+	}
+
+	var w io.Writer = os.Stderr
+	var file io.Closer
+	if options.File != "" {
+		f, err := OpenRotatingFile(options.File, options.MaxSize, options.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w, file = f, f
+	}
+
+	// Levels are checked per subsystem, the handler writes everything it gets
+	handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch strings.ToLower(options.Format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, handlerOptions)
+	case "json":
+		h = slog.NewJSONHandler(w, handlerOptions)
+	default:
+		if file != nil {
+			file.Close()
+		}
+		return fmt.Errorf("invalid log format %s, use text or json", options.Format)
+	}
+
+	mu.Lock()
+	defaultLevel = level
+	overrides = subsystems
+	for name, level := range levels {
+		level.Set(levelOf(name))
+	}
+	previous := output
+	output = file
+	base.Store(&h)
+	mu.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	slog.SetDefault(For(Main))
+	return nil
+}
+
+// handler filters the records of a subsystem by its level and writes them
+// with the base handler, tagged with the subsystem
+type handler struct {
+	subsystem string
+	level     *slog.LevelVar
+	// with replays WithAttrs and WithGroup on the base handler
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	next := (*base.Load()).WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, with := range h.with {
+		next = with(next)
+	}
+	return next.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	withs := append(append([]func(slog.Handler) slog.Handler(nil), h.with...), with)
+	return &handler{subsystem: h.subsystem, level: h.level, with: withs}
+}
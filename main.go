@@ -6,59 +6,126 @@ import (
 	"ant-cache/cleaner"
 	"ant-cache/cli"
 	"ant-cache/config"
+	"ant-cache/logging"
 	"ant-cache/tcpserver"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
-// handleQueryConfig handles the query configuration command
-func handleQueryConfig(configFile string) {
-	cfg, err := config.LoadConfig(configFile)
+var mainLog = logging.For(logging.Main)
+
+// server is implemented by both TCP servers
+type server interface {
+	SetTLS(m *tcpserver.TLSManager)
+	SetRuntimeConfig(rc *tcpserver.RuntimeConfig)
+	Start(host, port string) error
+	Shutdown(ctx context.Context) error
+	MetricsHandler() http.Handler
+}
+
+// fatal logs msg as an error and exits
+func fatal(msg string, args ...any) {
+	mainLog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// flagSettings are the settings overridden by the command line flags, by flag
+var flagSettings = map[string]string{
+	"host":         "server.host",
+	"port":         "server.port",
+	"atd":          "persistence.atd_file",
+	"acl":          "persistence.acl_file",
+	"atd-interval": "persistence.atd_interval",
+	"acl-interval": "persistence.acl_interval",
+}
+
+// handleQueryConfig prints the effective configuration, each setting with
+// where its value comes from
+func handleQueryConfig(configFile string, flags map[string]string) {
+	cfg, err := config.Load(configFile, flags)
 	if err != nil {
-		log.Fatalf("Failed to load config file '%s': %v\nPlease ensure the config file exists and is valid JSON.", configFile, err)
+		fatal("Invalid configuration", "file", configFile, "error", err)
 	}
 
 	fmt.Printf("=== Ant-Cache Configuration ===\n")
 	fmt.Printf("Config File: %s\n", configFile)
-	fmt.Printf("\n[Server]\n")
-	fmt.Printf("Host: %s\n", cfg.Server.Host)
-	fmt.Printf("Port: %s\n", cfg.Server.Port)
-
-	fmt.Printf("\n[Persistence]\n")
-	fmt.Printf("ATD Interval: %s\n", cfg.Persistence.AtdInterval)
-	fmt.Printf("ACL Interval: %s\n", cfg.Persistence.AclInterval)
-
-	fmt.Printf("\n[Authentication]\n")
-	if cfg.Auth.Password != "" {
-		fmt.Printf("Enabled: true\n")
-		fmt.Printf("Password: %s\n", cfg.Auth.Password)
-	} else {
-		fmt.Printf("Enabled: false\n")
-		fmt.Printf("Password: (not set)\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	section := ""
+	for _, s := range cfg.Settings() {
+		if name, _, _ := strings.Cut(s.Path, "."); name != section {
+			section = name
+			fmt.Fprintf(w, "\n[%s]\n", section)
+		}
+		value := s.Value
+		switch {
+		case s.Path == "auth.password" && value != "":
+			// The password itself is never printed
+			value = "(redacted)"
+		case value == "":
+			value = `""`
+		}
+		fmt.Fprintf(w, "%s\t%s\t(%s)\n", s.Path, value, s.Source)
+	}
+	w.Flush()
+}
+
+// handleHashPassword reads a password and prints its pbkdf2-sha256 credential,
+// which can be configured instead of the password
+func handleHashPassword() {
+	password, err := auth.ReadPassword("Password: ")
+	if err != nil {
+		fatal("Failed to read password", "error", err)
+	}
+	if password == "" {
+		fatal("Password can not be empty")
+	}
+	credential, err := auth.NewCredential(password)
+	if err != nil {
+		fatal("Failed to hash password", "error", err)
 	}
+	fmt.Println(credential)
 }
 
 func main() {
 	// Parse command line arguments
 	cliMode := flag.Bool("cli", false, "Run in interactive CLI mode")
-	host := flag.String("host", "localhost", "Server host")
-	port := flag.String("port", "8890", "Server port")
+	hashPassword := flag.Bool("hash-password", false, "Read a password and print its credential for the auth.password setting")
+	// The flags of flagSettings override the configuration when set
+	flag.String("host", "localhost", "Server host")
+	flag.String("port", "8890", "Server port")
 	configFile := flag.String("config", "", "Configuration file path (default: config.json in current directory)")
-	atdFile := flag.String("atd", "", "ATD file path (empty to disable)")
-	aclFile := flag.String("acl", "", "ACL file path (empty to disable)")
-	atdInterval := flag.Duration("atd-interval", 1*time.Hour, "ATD save interval (min 5m, max 30d)")
-	aclInterval := flag.Duration("acl-interval", 1*time.Second, "ACL sync interval (min 1s, max 1m)")
+	flag.String("atd", "cache.atd", "ATD file path (empty to disable)")
+	flag.String("acl", "cache.acl", "ACL file path (empty to disable)")
+	flag.Duration("atd-interval", 1*time.Hour, "ATD save interval (min 5m, max 30d)")
+	flag.Duration("acl-interval", 1*time.Second, "ACL sync interval (min 1s, max 1m)")
 
 	queryConfig := flag.Bool("query", false, "Query current configuration")
 	serverType := flag.String("server", "single-goroutine", "Server type: 'single-goroutine' or 'pooled-goroutine' (default: single-goroutine)")
 	maxWorkers := flag.Int("workers", 200, "Number of worker goroutines for pooled server (default: 200)")
 	flag.Parse()
 
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if path, ok := flagSettings[f.Name]; ok {
+			flags[path] = f.Value.String()
+		}
+	})
+
+	if *hashPassword {
+		handleHashPassword()
+		return
+	}
+
 	// Determine config file path
 	var configPath string
 	if *configFile != "" {
@@ -71,72 +138,71 @@ func main() {
 
 	// Handle query command
 	if *queryConfig {
-		handleQueryConfig(configPath)
+		handleQueryConfig(configPath, flags)
 		return
 	}
 
-	// Load configuration - required
-	cfg, err := config.LoadConfig(configPath)
-	if err != nil {
+	// Load configuration - required. The defaults are overridden by the file,
+	// the ANTCACHE_* environment variables and the flags.
+	cfg, err := config.Load(configPath, flags)
+	if errors.Is(err, fs.ErrNotExist) {
 		if *configFile != "" {
-			log.Fatalf("Failed to load specified config file '%s': %v\nPlease ensure the config file exists and is valid JSON.", configPath, err)
+			fatal("Failed to load specified config file, please ensure it exists", "file", configPath, "error", err)
 		} else {
-			log.Fatalf("Failed to load default config file '%s': %v\nPlease ensure config.json exists in the current directory or specify a config file with -config flag.", configPath, err)
+			fatal("Failed to load default config file, please ensure config.json exists in the current directory or specify a config file with -config flag", "file", configPath, "error", err)
 		}
+	} else if err != nil {
+		fatal("Invalid configuration", "file", configPath, "error", err)
 	}
-	log.Printf("Loaded configuration from: %s", configPath)
+	if err := logging.Setup(cfg.LoggingOptions()); err != nil {
+		fatal("Failed to setup logging", "error", err)
+	}
+	mainLog.Info("Loaded configuration", "file", configPath)
 
 	// Setup authentication based on config
 	var authManager *auth.AuthManager
-	if cfg.Auth.Password != "" {
+	secret, err := cfg.AuthSecret()
+	if err != nil {
+		fatal("Failed to load the password", "error", err)
+	}
+	if secret != "" {
 		// Authentication enabled if password is configured
 		authManager = auth.NewAuthManager("auth.dat", true)
-		if err := authManager.SetPassword(cfg.Auth.Password); err != nil {
-			log.Printf("Failed to set password from config: %v", err)
+		if !auth.IsCredential(secret) {
+			mainLog.Warn("The password is configured in plain text, consider a credential printed by -hash-password")
+		}
+		if err := authManager.SetSecret(secret); err != nil {
+			fatal("Failed to set password", "source", cfg.AuthSecretSource(), "error", err)
+		}
+		mainLog.Info("Authentication enabled", "source", cfg.AuthSecretSource())
+		auditFile, err := os.OpenFile(cfg.Auth.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			mainLog.Error("Failed to open auth audit log", "file", cfg.Auth.AuditLog, "error", err)
 		} else {
-			log.Printf("Authentication enabled with password from config")
+			authManager.SetAuditLog(auth.NewAuditLog(auditFile))
+			mainLog.Info("Auth audit log opened", "file", cfg.Auth.AuditLog)
 		}
 	} else {
 		// No authentication if no password configured
 		authManager = auth.NewAuthManager("", false)
-		log.Printf("Authentication disabled (no password configured)")
+		mainLog.Info("Authentication disabled, no password configured")
 	}
 
-	// Setup persistence with fixed paths
-	atdPath := "cache.atd"
-	aclPath := "cache.acl"
-
-	// Parse intervals from config
-	atdIntervalDuration, err := time.ParseDuration(cfg.Persistence.AtdInterval)
-	if err != nil {
-		log.Printf("Invalid ATD interval: %s, using default 1h", cfg.Persistence.AtdInterval)
-		atdIntervalDuration = 1 * time.Hour
-	}
-	aclIntervalDuration, err := time.ParseDuration(cfg.Persistence.AclInterval)
-	if err != nil {
-		log.Printf("Invalid ACL interval: %s, using default 1s", cfg.Persistence.AclInterval)
-		aclIntervalDuration = 1 * time.Second
-	}
+	// Setup persistence, validated by config.Load
+	atdPath := cfg.Persistence.AtdFile
+	aclPath := cfg.Persistence.AclFile
+	atdIntervalDuration := cfg.GetAtdInterval()
+	aclIntervalDuration := cfg.GetAclInterval()
 
-	// Override with command line arguments if provided
-	if *atdFile != "" {
-		atdPath = *atdFile
-	}
-	if *aclFile != "" {
-		aclPath = *aclFile
-	}
-	if *atdInterval != 1*time.Hour {
-		atdIntervalDuration = *atdInterval
-	}
-	if *aclInterval != 1*time.Second {
-		aclIntervalDuration = *aclInterval
+	// Create cache with persistence, disabled by an empty file path
+	if atdPath == "" || aclPath == "" {
+		mainLog.Warn("Creating cache with persistence disabled, an ATD or ACL file path is empty")
+	} else {
+		mainLog.Info("Creating cache with persistence enabled",
+			"atd_file", atdPath, "acl_file", aclPath,
+			"atd_interval", atdIntervalDuration, "acl_interval", aclIntervalDuration)
 	}
 
-	// Create cache with persistence (always enabled)
-	log.Printf("Creating cache with persistence enabled")
-	log.Printf("ATD file: %s, ACL file: %s", atdPath, aclPath)
-	log.Printf("ATD interval: %v, ACL interval: %v", atdIntervalDuration, aclIntervalDuration)
-
 	// Create compression config from configuration
 	compressionConfig := cache.CompressionConfig{
 		Enabled:     cfg.Compression.Enabled,
@@ -145,10 +211,10 @@ func main() {
 	}
 
 	if cfg.Compression.Enabled {
-		log.Printf("Compression enabled: min_size=%d, strings_only=%v",
-			cfg.Compression.MinSize, cfg.Compression.StringsOnly)
+		mainLog.Info("Compression enabled",
+			"min_size", cfg.Compression.MinSize, "strings_only", cfg.Compression.StringsOnly)
 	} else {
-		log.Printf("Compression disabled")
+		mainLog.Info("Compression disabled")
 	}
 
 	var cacheInstance *cache.Cache
@@ -161,57 +227,152 @@ func main() {
 	// Apply compression config
 	cacheInstance.SetCompressionConfig(compressionConfig)
 
-	// If configuration file loaded successfully, use config values
-	if cfg != nil {
-		*host = cfg.Server.Host
-		*port = cfg.Server.Port
-
-		// Start cleaner with default interval
-		go cleaner.Start(cacheInstance)
-	}
-	// Setup graceful shutdown
-	setupGracefulShutdown(cacheInstance)
+	// Start cleaner with default interval
+	go cleaner.Start(cacheInstance)
 
 	if *cliMode {
-		cli.StartInteractiveCLI(cacheInstance, cfg.Server.Host, cfg.Server.Port, cfg.Auth.Password)
+		setupGracefulShutdown(cacheInstance, nil, nil, nil)
+		cli.StartInteractiveCLI(cacheInstance, cfg.Server.Host, cfg.Server.Port)
 		// Call Close in CLI mode to save data
 		cacheInstance.Close()
 		os.Exit(0)
 	}
 
+	// Setup TLS, the certificates are reloaded on SIGHUP with the configuration
+	var tlsManager *tcpserver.TLSManager
+	if cfg.TLS.Enabled {
+		tlsManager, err = tcpserver.NewTLSManager(tcpserver.TLSOptions{
+			CertFile:          cfg.TLS.CertFile,
+			KeyFile:           cfg.TLS.KeyFile,
+			CAFile:            cfg.TLS.CAFile,
+			MinVersion:        cfg.TLS.MinVersion,
+			RequireClientCert: cfg.TLS.RequireClientCert,
+			ClientCertAuth:    cfg.TLS.ClientCertAuth,
+		})
+		if err != nil {
+			fatal("Failed to setup TLS", "error", err)
+		}
+		mainLog.Info("TLS enabled",
+			"min_version", cfg.TLS.MinVersion, "require_client_cert", cfg.TLS.RequireClientCert)
+	}
+
+	tcpserver.SetSlowLog(cfg.GetSlowlogThreshold(), cfg.Slowlog.MaxLen)
+
 	// Start TCP server
-	log.Printf("Starting %s TCP cache server on %s:%s", *serverType, cfg.Server.Host, cfg.Server.Port)
+	mainLog.Info("Starting TCP cache server", "server", *serverType, "address", cfg.Server.Host+":"+cfg.Server.Port)
 
+	var srv server
 	switch *serverType {
 	case "single-goroutine":
 		// Single-threaded listener with one goroutine per connection (direct cache memory access)
-		fmt.Println("Starting single-goroutine server...")
-		singleServer := tcpserver.NewSingleGoroutineServer(cacheInstance)
-		if err := singleServer.Start(cfg.Server.Host, cfg.Server.Port); err != nil {
-			log.Fatal(err)
-		}
+		srv = tcpserver.NewSingleGoroutineServer(cacheInstance)
 
 	case "pooled-goroutine":
 		// Single-threaded listener with goroutine pool (direct cache memory access)
-		fmt.Printf("Starting pooled-goroutine server (%d workers)...\n", *maxWorkers)
-		pooledServer := tcpserver.NewPooledGoroutineServer(cacheInstance, *maxWorkers)
-		if err := pooledServer.Start(cfg.Server.Host, cfg.Server.Port); err != nil {
-			log.Fatal(err)
-		}
+		srv = tcpserver.NewPooledGoroutineServer(cacheInstance, *maxWorkers)
 
 	default:
-		log.Fatalf("Unknown server type: %s. Available types: single-goroutine, pooled-goroutine", *serverType)
+		fatal("Unknown server type, available types: single-goroutine, pooled-goroutine", "server", *serverType)
+	}
+
+	// CONFIG changes the configuration loaded from configPath, which SIGHUP reloads
+	runtimeConfig := tcpserver.NewRuntimeConfig(configPath, flags, cfg, cacheInstance)
+	srv.SetTLS(tlsManager)
+	srv.SetRuntimeConfig(runtimeConfig)
+	metrics := startMetrics(cfg, srv.MetricsHandler())
+	setupReload(runtimeConfig, tlsManager)
+	setupGracefulShutdown(cacheInstance, srv, metrics, runtimeConfig)
+	if err := srv.Start(cfg.Server.Host, cfg.Server.Port); err != nil {
+		fatal("Server stopped", "error", err)
 	}
+	// Start returns once the shutdown stopped the listener, the shutdown
+	// exits the process when the data is saved
+	select {}
 }
 
-func setupGracefulShutdown(cacheInstance *cache.Cache) {
-	sigChan := make(chan os.Signal, 1)
+// startMetrics serves the Prometheus metrics on their own HTTP listener, if
+// enabled. The server returned is nil if disabled.
+func startMetrics(cfg *config.Config, handler http.Handler) *http.Server {
+	if !cfg.Metrics.Enabled {
+		return nil
+	}
+	addr := cfg.Metrics.Host + ":" + cfg.Metrics.Port
+	metrics := &http.Server{Addr: addr, Handler: handler}
+	mainLog.Info("Serving metrics", "url", "http://"+addr+"/metrics")
+	go func() {
+		if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			mainLog.Error("Metrics listener stopped", "error", err)
+		}
+	}()
+	return metrics
+}
+
+// setupGracefulShutdown shuts down on SIGINT or SIGTERM: srv, nil in CLI
+// mode, stops accepting connections and waits up to the shutdown timeout of
+// rc for the commands in flight, and so does the metrics listener if not nil.
+// Then the cache writes the queued ACL commands and a final ATD snapshot, and
+// the process exits. A second signal exits at once.
+func setupGracefulShutdown(cacheInstance *cache.Cache, srv server, metrics *http.Server, rc *tcpserver.RuntimeConfig) {
+	sigChan := make(chan os.Signal, 2)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigChan
-		log.Println("Received shutdown signal, saving data and shutting down...")
+		mainLog.Info("Received shutdown signal, saving data and shutting down")
+		go func() {
+			<-sigChan
+			mainLog.Warn("Received a second shutdown signal, exiting without saving")
+			os.Exit(1)
+		}()
+
+		if srv != nil {
+			cfg := rc.Config()
+			timeout := cfg.GetShutdownTimeout()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := srv.Shutdown(ctx); err != nil {
+				mainLog.Warn("Connections closed with commands in flight", "timeout", timeout, "error", err)
+			}
+			if metrics != nil {
+				if err := metrics.Shutdown(ctx); err != nil {
+					mainLog.Warn("Metrics listener closed with requests in flight", "error", err)
+				}
+			}
+			cancel()
+		}
 		cacheInstance.Close()
+		mainLog.Info("Shutdown complete")
 		os.Exit(0)
 	}()
 }
+
+// setupReload reloads the configuration file and the TLS certificates, if
+// tlsManager is not nil, on SIGHUP. The settings requiring a restart are
+// reported and keep their value. Connections already established keep the
+// certificates they were opened with.
+func setupReload(rc *tcpserver.RuntimeConfig, tlsManager *tcpserver.TLSManager) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			report, err := rc.Reload()
+			if err != nil {
+				mainLog.Error("Failed to reload the configuration, keeping the current one", "error", err)
+			} else {
+				mainLog.Info("Configuration reloaded", "applied", report.Applied)
+				if len(report.Restart) > 0 {
+					mainLog.Warn("Settings changed in the configuration file require a restart", "settings", report.Restart)
+				}
+			}
+
+			if tlsManager == nil {
+				continue
+			}
+			if err := tlsManager.Reload(); err != nil {
+				mainLog.Error("Failed to reload TLS certificates, keeping the current ones", "error", err)
+			} else {
+				mainLog.Info("TLS certificates reloaded")
+			}
+		}
+	}()
+}
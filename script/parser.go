@@ -0,0 +1,352 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Expressions
+type (
+	constExpr struct {
+		value interface{}
+	}
+	varExpr struct {
+		name string
+		pos  int
+	}
+	indexExpr struct {
+		target, index expr
+		pos           int
+	}
+	callExpr struct {
+		name string
+		args []expr
+		pos  int
+	}
+	unaryExpr struct {
+		op      string
+		operand expr
+		pos     int
+	}
+	binaryExpr struct {
+		op          string
+		left, right expr
+		pos         int
+	}
+)
+
+type expr interface{}
+
+// Statements
+type (
+	assignStmt struct {
+		name    string
+		value   expr
+		declare bool
+		pos     int
+	}
+	ifStmt struct {
+		conds     []expr
+		blocks    [][]stmt
+		elseBlock []stmt
+	}
+	whileStmt struct {
+		cond expr
+		body []stmt
+	}
+	returnStmt struct {
+		value expr
+	}
+	exprStmt struct {
+		value expr
+	}
+)
+
+type stmt interface{}
+
+// binaryPrecedence gives the precedence of the binary operators, higher binds tighter
+var binaryPrecedence = map[string]int{
+	"or":  1,
+	"and": 2,
+	"==":  3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"..": 4,
+	"+":  5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// parser is a recursive descent parser over the tokens of a script
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses the statements of a script
+func parse(tokens []token) ([]stmt, error) {
+	p := &parser{tokens: tokens}
+	var body []stmt
+	for p.peek().kind != tokEOF {
+		s, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	return body, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the operator or keyword text
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokOp || t.kind == tokKeyword) && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.is(text) {
+		return p.errorf("expected %q", text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("%s at end of script", fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%s at %d near %q", fmt.Sprintf(format, args...), t.pos, t.text)
+}
+
+func (p *parser) parseStmt() (stmt, error) {
+	t := p.peek()
+	switch {
+	case p.is("let"):
+		p.next()
+		name := p.next()
+		if name.kind != tokIdent {
+			return nil, p.errorf("expected variable name")
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		return &assignStmt{name: name.text, value: value, declare: true, pos: name.pos}, nil
+
+	case p.is("if"):
+		p.next()
+		s := &ifStmt{}
+		for {
+			cond, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			block, err := p.parseBlock()
+			if err != nil {
+				return nil, err
+			}
+			s.conds = append(s.conds, cond)
+			s.blocks = append(s.blocks, block)
+			if !p.is("elif") {
+				break
+			}
+			p.next()
+		}
+		if p.is("else") {
+			p.next()
+			block, err := p.parseBlock()
+			if err != nil {
+				return nil, err
+			}
+			s.elseBlock = block
+		}
+		return s, nil
+
+	case p.is("while"):
+		p.next()
+		cond, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+		return &whileStmt{cond: cond, body: body}, nil
+
+	case p.is("return"):
+		p.next()
+		// A bare return ends the script with nil
+		if p.peek().kind == tokEOF || p.is("}") {
+			return &returnStmt{value: &constExpr{}}, nil
+		}
+		value, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		return &returnStmt{value: value}, nil
+
+	case t.kind == tokIdent && p.tokens[p.pos+1].kind == tokOp && p.tokens[p.pos+1].text == "=":
+		p.next()
+		p.next()
+		value, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		return &assignStmt{name: t.text, value: value, pos: t.pos}, nil
+	}
+
+	value, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	return &exprStmt{value: value}, nil
+}
+
+func (p *parser) parseBlock() ([]stmt, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var block []stmt
+	for !p.is("}") {
+		if p.peek().kind == tokEOF {
+			return nil, p.errorf("expected %q", "}")
+		}
+		s, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, s)
+	}
+	p.next()
+	return block, nil
+}
+
+// parseExpr parses binary operators of precedence above minPrec (precedence climbing)
+func (p *parser) parseExpr(minPrec int) (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := binaryPrecedence[t.text]
+		if !ok || (t.kind != tokOp && t.kind != tokKeyword) || prec <= minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseExpr(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: t.text, left: left, right: right, pos: t.pos}
+	}
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.is("-") || p.is("not") {
+		t := p.next()
+		// Unary operators bind tighter than every binary operator
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: t.text, operand: operand, pos: t.pos}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (expr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("[") {
+		t := p.next()
+		index, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		e = &indexExpr{target: e, index: index, pos: t.pos}
+	}
+	return e, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return &constExpr{value: n}, nil
+
+	case tokString:
+		p.next()
+		return &constExpr{value: t.text}, nil
+
+	case tokKeyword:
+		switch t.text {
+		case "nil":
+			p.next()
+			return &constExpr{}, nil
+		case "true", "false":
+			p.next()
+			return &constExpr{value: t.text == "true"}, nil
+		}
+
+	case tokIdent:
+		p.next()
+		if !p.is("(") {
+			return &varExpr{name: t.text, pos: t.pos}, nil
+		}
+		p.next()
+		call := &callExpr{name: t.text, pos: t.pos}
+		for !p.is(")") {
+			if len(call.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		p.next()
+		return call, nil
+
+	case tokOp:
+		if t.text == "(" {
+			p.next()
+			e, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		}
+	}
+	return nil, p.errorf("unexpected token")
+}
@@ -0,0 +1,582 @@
+// Package script implements a small deterministic scripting language used by
+// EVAL to run a sequence of cache commands atomically on the server.
+//
+// A script is a list of statements:
+//
+//	let name = expr                 declare a variable
+//	name = expr                     assign a declared variable
+//	if expr { ... } elif expr { ... } else { ... }
+//	while expr { ... }
+//	return expr
+//	expr                            evaluate an expression, e.g. a call
+//
+// Values are nil, booleans, numbers, strings and lists. KEYS and ARGV hold the
+// keys and arguments given to EVAL, indexed from 1. Commands are run with
+// call("CMD", args...), which stops the script on an error reply, or
+// pcall("CMD", args...), which returns the error reply as a string.
+// There is no access to time, randomness or anything outside the cache.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits bounds the work a script may do while it holds the cache lock
+type Limits struct {
+	MaxSteps int
+	Timeout  time.Duration
+	// MaxStringLen bounds the length in bytes of a string built with ..
+	MaxStringLen int
+	// MaxMemory bounds the total bytes of the strings built and the command
+	// replies read by the script
+	MaxMemory int
+}
+
+// DefaultLimits are the limits used by EVAL
+var DefaultLimits = Limits{
+	MaxSteps:     100000,
+	Timeout:      500 * time.Millisecond,
+	MaxStringLen: 8 << 20,
+	MaxMemory:    64 << 20,
+}
+
+var (
+	// ErrStepLimit is returned when a script evaluates too many steps
+	ErrStepLimit = errors.New("script exceeded the step limit")
+	// ErrTimeout is returned when a script runs longer than its timeout
+	ErrTimeout = errors.New("script exceeded the time limit")
+	// ErrStringLimit is returned when a script builds a string longer than MaxStringLen
+	ErrStringLimit = errors.New("script exceeded the string length limit")
+	// ErrMemoryLimit is returned when a script allocates more than MaxMemory
+	ErrMemoryLimit = errors.New("script exceeded the memory limit")
+)
+
+// CallFunc executes a cache command and returns its protocol reply
+type CallFunc func(args []string) string
+
+// Script is a parsed script, safe to run several times
+type Script struct {
+	body []stmt
+}
+
+// Compile parses src
+func Compile(src string) (*Script, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parse(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{body: body}, nil
+}
+
+// Run runs the script and returns the value of its return statement, nil if
+// it has none. Commands already executed are not undone when Run fails.
+func (s *Script) Run(keys, argv []string, call CallFunc, limits Limits) (interface{}, error) {
+	in := &interpreter{
+		vars: map[string]interface{}{
+			"KEYS": toList(keys),
+			"ARGV": toList(argv),
+		},
+		call:     call,
+		limits:   limits,
+		deadline: time.Now().Add(limits.Timeout),
+	}
+	returned, value, err := in.execBlock(s.body)
+	if err != nil || !returned {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Format formats a script result as a protocol reply
+func Format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL\n"
+	case []interface{}:
+		if len(v) == 0 {
+			return "EMPTY\n"
+		}
+		var sb strings.Builder
+		for _, elem := range v {
+			sb.WriteString(Format(elem))
+		}
+		return sb.String()
+	default:
+		return toString(v) + "\n"
+	}
+}
+
+// interpreter holds the state of one run of a script
+type interpreter struct {
+	vars     map[string]interface{}
+	call     CallFunc
+	limits   Limits
+	deadline time.Time
+	steps    int
+	// allocated counts the bytes accounted by alloc
+	allocated int
+}
+
+// step counts one evaluation step and enforces the limits
+func (in *interpreter) step() error {
+	in.steps++
+	if in.limits.MaxSteps > 0 && in.steps > in.limits.MaxSteps {
+		return ErrStepLimit
+	}
+	// Reading the clock on every step would dominate small scripts
+	if in.steps%256 == 0 {
+		return in.checkDeadline()
+	}
+	return nil
+}
+
+// checkDeadline enforces the timeout. It is also checked by the operations
+// that may take long within a single step, commands and concatenations.
+func (in *interpreter) checkDeadline() error {
+	if in.limits.Timeout > 0 && time.Now().After(in.deadline) {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// alloc accounts for n bytes of strings or lists built by the script
+func (in *interpreter) alloc(n int) error {
+	in.allocated += n
+	if in.limits.MaxMemory > 0 && in.allocated > in.limits.MaxMemory {
+		return ErrMemoryLimit
+	}
+	return nil
+}
+
+// concat joins the values as strings. The length is checked before the
+// string is built, so that s = s .. s can not double it past the limits.
+func (in *interpreter) concat(left, right interface{}) (interface{}, error) {
+	if err := in.checkDeadline(); err != nil {
+		return nil, err
+	}
+	l, r := toString(left), toString(right)
+	if in.limits.MaxStringLen > 0 && len(l)+len(r) > in.limits.MaxStringLen {
+		return nil, ErrStringLimit
+	}
+	if err := in.alloc(len(l) + len(r)); err != nil {
+		return nil, err
+	}
+	return l + r, nil
+}
+
+// execBlock executes statements, returned is true once a return statement ran
+func (in *interpreter) execBlock(block []stmt) (returned bool, value interface{}, err error) {
+	for _, s := range block {
+		if err := in.step(); err != nil {
+			return false, nil, err
+		}
+		switch s := s.(type) {
+		case *assignStmt:
+			if _, exists := in.vars[s.name]; !exists && !s.declare {
+				return false, nil, fmt.Errorf("assignment to undeclared variable %s at %d", s.name, s.pos)
+			}
+			v, err := in.eval(s.value)
+			if err != nil {
+				return false, nil, err
+			}
+			in.vars[s.name] = v
+
+		case *ifStmt:
+			ran := false
+			for i, cond := range s.conds {
+				v, err := in.eval(cond)
+				if err != nil {
+					return false, nil, err
+				}
+				if truthy(v) {
+					ran = true
+					if returned, value, err = in.execBlock(s.blocks[i]); err != nil || returned {
+						return returned, value, err
+					}
+					break
+				}
+			}
+			if !ran && s.elseBlock != nil {
+				if returned, value, err = in.execBlock(s.elseBlock); err != nil || returned {
+					return returned, value, err
+				}
+			}
+
+		case *whileStmt:
+			for {
+				v, err := in.eval(s.cond)
+				if err != nil {
+					return false, nil, err
+				}
+				if !truthy(v) {
+					break
+				}
+				if returned, value, err = in.execBlock(s.body); err != nil || returned {
+					return returned, value, err
+				}
+			}
+
+		case *returnStmt:
+			v, err := in.eval(s.value)
+			return err == nil, v, err
+
+		case *exprStmt:
+			if _, err := in.eval(s.value); err != nil {
+				return false, nil, err
+			}
+		}
+	}
+	return false, nil, nil
+}
+
+func (in *interpreter) eval(e expr) (interface{}, error) {
+	if err := in.step(); err != nil {
+		return nil, err
+	}
+	switch e := e.(type) {
+	case *constExpr:
+		return e.value, nil
+
+	case *varExpr:
+		v, exists := in.vars[e.name]
+		if !exists {
+			return nil, fmt.Errorf("undeclared variable %s at %d", e.name, e.pos)
+		}
+		return v, nil
+
+	case *indexExpr:
+		target, err := in.eval(e.target)
+		if err != nil {
+			return nil, err
+		}
+		index, err := in.eval(e.index)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := target.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("only lists can be indexed at %d", e.pos)
+		}
+		n, ok := toNumber(index)
+		if !ok || n != math.Trunc(n) {
+			return nil, fmt.Errorf("list index must be an integer at %d", e.pos)
+		}
+		// Lists are indexed from 1, out of range reads give nil
+		if n < 1 || int(n) > len(list) {
+			return nil, nil
+		}
+		return list[int(n)-1], nil
+
+	case *callExpr:
+		args := make([]interface{}, len(e.args))
+		for i, a := range e.args {
+			v, err := in.eval(a)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		return in.callBuiltin(e, args)
+
+	case *unaryExpr:
+		v, err := in.eval(e.operand)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "not" {
+			return !truthy(v), nil
+		}
+		n, ok := toNumber(v)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %s at %d", typeName(v), e.pos)
+		}
+		return -n, nil
+
+	case *binaryExpr:
+		left, err := in.eval(e.left)
+		if err != nil {
+			return nil, err
+		}
+		// and/or short-circuit and return one of their operands
+		switch e.op {
+		case "and":
+			if !truthy(left) {
+				return left, nil
+			}
+			return in.eval(e.right)
+		case "or":
+			if truthy(left) {
+				return left, nil
+			}
+			return in.eval(e.right)
+		}
+		right, err := in.eval(e.right)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == ".." {
+			return in.concat(left, right)
+		}
+		return binaryOp(e, left, right)
+	}
+	return nil, fmt.Errorf("invalid expression")
+}
+
+func (in *interpreter) callBuiltin(e *callExpr, args []interface{}) (interface{}, error) {
+	switch e.name {
+	case "call", "pcall":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s requires a command at %d", e.name, e.pos)
+		}
+		parts := make([]string, len(args))
+		for i, a := range args {
+			if _, isList := a.([]interface{}); isList || a == nil {
+				return nil, fmt.Errorf("%s arguments must be strings or numbers at %d", e.name, e.pos)
+			}
+			parts[i] = toString(a)
+		}
+		if err := in.checkDeadline(); err != nil {
+			return nil, err
+		}
+		reply := in.call(parts)
+		// Replies of several lines become lists
+		if err := in.alloc(len(reply)); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(reply, "ERROR") {
+			if e.name == "call" {
+				return nil, fmt.Errorf("%s: %s", parts[0], strings.TrimSpace(strings.TrimPrefix(reply, "ERROR")))
+			}
+			return strings.TrimSuffix(reply, "\n"), nil
+		}
+		return parseReply(reply), nil
+
+	case "tonumber":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("tonumber requires one argument at %d", e.pos)
+		}
+		if n, ok := toNumber(args[0]); ok {
+			return n, nil
+		}
+		return nil, nil
+
+	case "tostring":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("tostring requires one argument at %d", e.pos)
+		}
+		str := toString(args[0])
+		if _, isList := args[0].([]interface{}); isList {
+			if err := in.alloc(len(str)); err != nil {
+				return nil, err
+			}
+		}
+		return str, nil
+
+	case "len":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("len requires one argument at %d", e.pos)
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("len of %s at %d", typeName(args[0]), e.pos)
+
+	default:
+		return nil, fmt.Errorf("unknown function %s at %d", e.name, e.pos)
+	}
+}
+
+func binaryOp(e *binaryExpr, left, right interface{}) (interface{}, error) {
+	switch e.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		cmp, err := compare(left, right)
+		if err != nil {
+			return nil, fmt.Errorf("%v at %d", err, e.pos)
+		}
+		switch e.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	}
+
+	// Arithmetic, numeric strings are converted to numbers
+	a, ok1 := toNumber(left)
+	b, ok2 := toNumber(right)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("arithmetic on %s and %s at %d", typeName(left), typeName(right), e.pos)
+	}
+	switch e.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero at %d", e.pos)
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero at %d", e.pos)
+		}
+		return math.Mod(a, b), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s at %d", e.op, e.pos)
+}
+
+// parseReply converts a command reply to a script value: NULL is nil and a
+// reply of several lines is a list
+func parseReply(reply string) interface{} {
+	lines := strings.Split(strings.TrimSuffix(reply, "\n"), "\n")
+	if len(lines) == 1 {
+		return replyLine(lines[0])
+	}
+	list := make([]interface{}, len(lines))
+	for i, line := range lines {
+		list[i] = replyLine(line)
+	}
+	return list
+}
+
+func replyLine(line string) interface{} {
+	if line == "NULL" {
+		return nil
+	}
+	return line
+}
+
+func toList(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		list[i] = v
+	}
+	return list
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(n) {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			parts[i] = toString(elem)
+		}
+		return strings.Join(parts, " ")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// equal compares values, a number equals a string holding the same number
+func equal(a, b interface{}) bool {
+	if na, ok := a.(float64); ok {
+		nb, ok := toNumber(b)
+		return ok && na == nb
+	}
+	if nb, ok := b.(float64); ok {
+		na, ok := toNumber(a)
+		return ok && na == nb
+	}
+	switch a := a.(type) {
+	case []interface{}:
+		return false
+	default:
+		_, bIsList := b.([]interface{})
+		return !bIsList && a == b
+	}
+}
+
+// compare orders numbers (numeric strings included) numerically and other
+// strings lexicographically
+func compare(a, b interface{}) (int, error) {
+	na, ok1 := toNumber(a)
+	nb, ok2 := toNumber(b)
+	if ok1 && ok2 {
+		switch {
+		case na < nb:
+			return -1, nil
+		case na > nb:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	sa, ok1 := a.(string)
+	sb, ok2 := b.(string)
+	if ok1 && ok2 {
+		return strings.Compare(sa, sb), nil
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", typeName(a), typeName(b))
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	}
+	return "unknown"
+}
@@ -0,0 +1,257 @@
+package script
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		limits Limits
+		reply  string
+		err    error
+	}{
+		{
+			name:   "step limit",
+			src:    "while true { }",
+			limits: Limits{MaxSteps: 1000},
+			err:    ErrStepLimit,
+		},
+		{
+			name:   "timeout",
+			src:    "while true { }",
+			limits: Limits{Timeout: time.Millisecond},
+			err:    ErrTimeout,
+		},
+		{
+			name:   "doubling a string",
+			src:    "let s = 'x'; while true { s = s .. s }",
+			limits: DefaultLimits,
+			err:    ErrStringLimit,
+		},
+		{
+			name:   "string within the limit",
+			src:    "let s = 'x'; let i = 0; while i < 10 { s = s .. s; i = i + 1 } return len(s)",
+			limits: Limits{MaxStringLen: 1024},
+		},
+		{
+			name:   "string over the limit",
+			src:    "let s = 'x'; let i = 0; while i < 11 { s = s .. s; i = i + 1 } return len(s)",
+			limits: Limits{MaxStringLen: 1024},
+			err:    ErrStringLimit,
+		},
+		{
+			name:   "total allocation",
+			src:    "let s = ''; while true { s = ARGV[1] .. 'x' }",
+			limits: Limits{MaxStringLen: 1 << 20, MaxMemory: 1 << 20},
+			err:    ErrMemoryLimit,
+		},
+		{
+			name:   "command replies",
+			src:    "while true { call('LRANGE', 'list') }",
+			limits: Limits{MaxMemory: 1 << 20},
+			reply:  strings.Repeat("element\n", 1000),
+			err:    ErrMemoryLimit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			call := func(args []string) string { return tt.reply }
+			_, err = s.Run(nil, []string{strings.Repeat("a", 1000)}, call, tt.limits)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRunChecksDeadlineOnCall(t *testing.T) {
+	s, err := Compile("call('SLOW') call('SLOW') call('SLOW')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	slow := func(args []string) string {
+		calls++
+		time.Sleep(20 * time.Millisecond)
+		return "OK\n"
+	}
+	// Far fewer than 256 steps, the deadline is checked before each command
+	if _, err := s.Run(nil, nil, slow, Limits{Timeout: 10 * time.Millisecond}); err != ErrTimeout {
+		t.Fatalf("Run() error = %v, want %v", err, ErrTimeout)
+	}
+	if calls != 1 {
+		t.Fatalf("commands run = %d, want 1", calls)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"unterminated string", "return 'abc", "unterminated string at 7"},
+		{"unexpected character", "return 1 & 2", "unexpected character '&' at 9"},
+		{"invalid number", "return 1.2.3", `invalid number "1.2.3" at 7`},
+		{"let without name", "let = 1", "expected variable name"},
+		{"let keyword", "let if = 1", "expected variable name"},
+		{"let without value", "let x 1", `expected "="`},
+		{"missing block", "if true return 1", `expected "{"`},
+		{"unclosed block", "while true { call('GET', 'k')", `expected "}" at end of script`},
+		{"unclosed parenthesis", "return (1 + 2", `expected ")" at end of script`},
+		{"unclosed index", "return KEYS[1", `expected "]"`},
+		{"missing comma", "call('GET' 'k')", `expected ","`},
+		{"missing operand", "return 1 +", "unexpected token at end of script"},
+		{"stray operator", "return * 2", `unexpected token at 7 near "*"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Compile(%q) error = %v, want %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		// Formatted result, or the error expected
+		want string
+		err  string
+	}{
+		// Values and operators
+		{name: "no return", src: "let x = 1", want: "NULL\n"},
+		{name: "bare return", src: "return", want: "NULL\n"},
+		{name: "precedence", src: "return 1 + 2 * 3 - 4 / 2", want: "5\n"},
+		{name: "parentheses", src: "return (1 + 2) * 3", want: "9\n"},
+		{name: "unary minus", src: "return -2 * 3", want: "-6\n"},
+		{name: "modulo", src: "return 7 % 3", want: "1\n"},
+		{name: "fraction", src: "return 1 / 4", want: "0.25\n"},
+		{name: "numeric strings", src: "return '2' * ARGV[1]", want: "6\n"},
+		{name: "concat binds looser than +", src: "return 'a' .. 1 + 2", want: "a3\n"},
+		{name: "concat numbers", src: "return 1..2", want: "12\n"},
+		{name: "escapes", src: `return "a\tb\"c"`, want: "a\tb\"c\n"},
+		{name: "comments", src: "# first\nreturn 1 # second", want: "1\n"},
+		{name: "booleans", src: "return not nil", want: "1\n"},
+		{name: "and returns an operand", src: "return 1 and 'x'", want: "x\n"},
+		{name: "or returns an operand", src: "return nil or 'y'", want: "y\n"},
+		{name: "number equals string", src: "return 1 == '1.0'", want: "1\n"},
+		{name: "strings compared", src: "return 'b' > 'a'", want: "1\n"},
+		{name: "numbers compared numerically", src: "return '10' > '9'", want: "1\n"},
+		{name: "list is not equal to itself", src: "return KEYS == KEYS", want: "0\n"},
+
+		// Statements
+		{name: "if", src: "if 1 > 2 { return 'a' } elif 2 > 1 { return 'b' } else { return 'c' }", want: "b\n"},
+		{name: "else", src: "if false { return 'a' } else { return 'c' }", want: "c\n"},
+		{name: "while", src: "let i = 0 let sum = 0 while i < 5 { i = i + 1 sum = sum + i } return sum", want: "15\n"},
+		{name: "return from a loop", src: "let i = 0 while true { i = i + 1 if i == 3 { return i } }", want: "3\n"},
+		{name: "assignment in a block", src: "let x = 1 if true { x = 2 } return x", want: "2\n"},
+
+		// KEYS, ARGV and lists
+		{name: "keys", src: "return KEYS[2]", want: "k2\n"},
+		{name: "index out of range", src: "return KEYS[3]", want: "NULL\n"},
+		{name: "index zero", src: "return ARGV[0]", want: "NULL\n"},
+		{name: "list", src: "return KEYS", want: "k1\nk2\n"},
+		{name: "len", src: "return len(KEYS) + len('abc')", want: "5\n"},
+		{name: "tostring of a list", src: "return tostring(KEYS)", want: "k1 k2\n"},
+		{name: "tonumber", src: "return tonumber(' 42 ') + 1", want: "43\n"},
+		{name: "tonumber of text", src: "return tonumber('abc')", want: "NULL\n"},
+
+		// Commands
+		{name: "call", src: "return call('GET', KEYS[1])", want: "value\n"},
+		{name: "call with numbers", src: "return call('ECHO', 1.5, true)", want: "ECHO 1.5 1\n"},
+		{name: "call reply of several lines", src: "let l = call('LRANGE', 'list') return l[2]", want: "b\n"},
+		{name: "call NULL reply", src: "return call('GET', 'missing') == nil", want: "1\n"},
+		{name: "call error", src: "call('FAIL') return 1", err: "FAIL: wrong type"},
+		{name: "pcall error", src: "return pcall('FAIL')", want: "ERROR wrong type\n"},
+		{name: "short circuit", src: "return false and call('FAIL')", want: "0\n"},
+
+		// Runtime errors
+		{name: "undeclared variable", src: "return x", err: "undeclared variable x at 7"},
+		{name: "assignment to undeclared variable", src: "x = 1", err: "assignment to undeclared variable x at 0"},
+		{name: "arithmetic on text", src: "return 'a' + 1", err: "arithmetic on string and number at 11"},
+		{name: "division by zero", src: "return 1 / 0", err: "division by zero"},
+		{name: "modulo by zero", src: "return 1 % 0", err: "division by zero"},
+		{name: "negate text", src: "return -'a'", err: "cannot negate string"},
+		{name: "index a string", src: "return 'abc'[1]", err: "only lists can be indexed"},
+		{name: "fractional index", src: "return KEYS[1.5]", err: "list index must be an integer"},
+		{name: "compare mixed", src: "return KEYS < 1", err: "cannot compare list with number"},
+		{name: "call without command", src: "call()", err: "call requires a command"},
+		{name: "call with a list", src: "call('GET', KEYS)", err: "call arguments must be strings or numbers"},
+		{name: "call with nil", src: "call('GET', nil)", err: "call arguments must be strings or numbers"},
+		{name: "unknown function", src: "print(1)", err: "unknown function print"},
+		{name: "len of a number", src: "return len(1)", err: "len of number"},
+		{name: "wrong argument count", src: "return tostring()", err: "tostring requires one argument"},
+	}
+	replies := map[string]string{
+		"GET k1": "value\n",
+		"GET":    "NULL\n",
+		"LRANGE": "a\nb\nc\n",
+		"FAIL":   "ERROR wrong type\n",
+	}
+	// Other commands reply with their arguments
+	call := func(args []string) string {
+		if reply, ok := replies[strings.Join(args, " ")]; ok {
+			return reply
+		}
+		if reply, ok := replies[args[0]]; ok {
+			return reply
+		}
+		return strings.Join(args, " ") + "\n"
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile(tt.src)
+			if err != nil {
+				t.Fatalf("Compile(%q) error = %v", tt.src, err)
+			}
+			value, err := s.Run([]string{"k1", "k2"}, []string{"3"}, call, DefaultLimits)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Run(%q) error = %v, want %q", tt.src, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run(%q) error = %v", tt.src, err)
+			}
+			if got := Format(value); got != tt.want {
+				t.Fatalf("Run(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "NULL\n"},
+		{true, "1\n"},
+		{false, "0\n"},
+		{float64(42), "42\n"},
+		{-0.5, "-0.5\n"},
+		{1e21, "1000000000000000000000\n"},
+		{"text", "text\n"},
+		{[]interface{}{}, "EMPTY\n"},
+		{[]interface{}{"a", nil, float64(1)}, "a\nNULL\n1\n"},
+	}
+	for _, tt := range tests {
+		if got := Format(tt.value); got != tt.want {
+			t.Errorf("Format(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ant-cache/auth"
+)
+
+// commandCategories maps the commands to the category a user must be allowed
+// to run them. Commands missing here are only allowed to users with +@all.
+var commandCategories = map[string]string{
+	// Reads
+	"GET": auth.CategoryRead, "MGET": auth.CategoryRead, "WATCH": auth.CategoryRead,
+	"EVAL": auth.CategoryRead, "ZSCORE": auth.CategoryRead, "ZCARD": auth.CategoryRead,
+	"ZRANK": auth.CategoryRead, "ZRANGE": auth.CategoryRead, "ZRANGEBYSCORE": auth.CategoryRead,
+	"SISMEMBER": auth.CategoryRead, "SMEMBERS": auth.CategoryRead, "SCARD": auth.CategoryRead,
+	"SINTER": auth.CategoryRead, "SUNION": auth.CategoryRead, "SDIFF": auth.CategoryRead,
+	"PFCOUNT": auth.CategoryRead, "BF.EXISTS": auth.CategoryRead, "XLEN": auth.CategoryRead,
+	"XRANGE": auth.CategoryRead, "XREAD": auth.CategoryRead, "XPENDING": auth.CategoryRead,
+	"LLEN": auth.CategoryRead,
+
+	// Writes
+	"SET": auth.CategoryWrite, "SETS": auth.CategoryWrite, "SETX": auth.CategoryWrite,
+	"SETNX": auth.CategoryWrite, "SETSNX": auth.CategoryWrite, "SETXNX": auth.CategoryWrite,
+	"DEL": auth.CategoryWrite, "MSET": auth.CategoryWrite, "MSETNX": auth.CategoryWrite,
+	"MDEL": auth.CategoryWrite, "MOVE": auth.CategoryWrite, "ZADD": auth.CategoryWrite,
+	"ZREM": auth.CategoryWrite, "ZINCRBY": auth.CategoryWrite, "SADD": auth.CategoryWrite,
+	"SREM": auth.CategoryWrite, "SINTERSTORE": auth.CategoryWrite, "SUNIONSTORE": auth.CategoryWrite,
+	"SDIFFSTORE": auth.CategoryWrite, "PFADD": auth.CategoryWrite, "PFMERGE": auth.CategoryWrite,
+	"BF.RESERVE": auth.CategoryWrite, "BF.ADD": auth.CategoryWrite, "XADD": auth.CategoryWrite,
+	"XGROUP": auth.CategoryWrite, "XREADGROUP": auth.CategoryWrite, "XACK": auth.CategoryWrite,
+	"XAUTOCLAIM": auth.CategoryWrite, "LPUSH": auth.CategoryWrite, "RPUSH": auth.CategoryWrite,
+	"LPOP": auth.CategoryWrite, "RPOP": auth.CategoryWrite, "BLPOP": auth.CategoryWrite,
+	"BRPOP": auth.CategoryWrite, "LOCK": auth.CategoryWrite, "UNLOCK": auth.CategoryWrite,
+	"RENEW": auth.CategoryWrite, "RL.TOKENBUCKET": auth.CategoryWrite,
+	"RL.SLIDINGWINDOW": auth.CategoryWrite, "RL.GCRA": auth.CategoryWrite,
+
+	// Commands scanning or removing whole databases
+	"KEYS": auth.CategoryDangerous, "FLUSHALL": auth.CategoryDangerous,
+	"FLUSHDB": auth.CategoryDangerous, "SWAPDB": auth.CategoryDangerous,
+
+	"ACL": auth.CategoryAdmin, "INFO": auth.CategoryAdmin, "STATS": auth.CategoryAdmin,
+	"SLOWLOG": auth.CategoryAdmin, "CLIENT": auth.CategoryAdmin, "MONITOR": auth.CategoryAdmin,
+	"CONFIG": auth.CategoryAdmin,
+}
+
+// commandKeys returns the key arguments of a command, after its TTL was removed
+func commandKeys(cmd string, parts []string) []string {
+	switch cmd {
+	case "KEYS", "FLUSHALL", "FLUSHDB", "SWAPDB", "ACL", "INFO", "STATS", "SLOWLOG", "CLIENT", "MONITOR", "CONFIG":
+		return nil
+	case "MGET", "DEL", "MDEL", "WATCH", "SINTER", "SUNION", "SDIFF",
+		"SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE", "PFCOUNT", "PFMERGE":
+		return parts[1:]
+	case "MSET", "MSETNX":
+		var keys []string
+		for i := 1; i < len(parts); i += 2 {
+			keys = append(keys, parts[i])
+		}
+		return keys
+	case "BLPOP", "BRPOP":
+		if len(parts) < 3 {
+			return nil
+		}
+		return parts[1 : len(parts)-1]
+	case "XREAD", "XREADGROUP":
+		for i, part := range parts {
+			if strings.ToUpper(part) == "STREAMS" {
+				streams := parts[i+1:]
+				return streams[:len(streams)/2]
+			}
+		}
+		return nil
+	case "XGROUP":
+		if len(parts) < 3 {
+			return nil
+		}
+		return parts[2:3]
+	case "EVAL":
+		// Only the declared keys, the commands called by the script are checked too
+		if len(parts) < 3 {
+			return nil
+		}
+		numKeys, err := strconv.Atoi(parts[2])
+		if err != nil || numKeys < 0 || numKeys > len(parts)-3 {
+			return nil
+		}
+		return parts[3 : 3+numKeys]
+	default:
+		if len(parts) < 2 {
+			return nil
+		}
+		return parts[1:2]
+	}
+}
+
+// checkPermission returns the error reply if user may not run the command or
+// access its keys, an empty string otherwise. A nil user is not restricted.
+func checkPermission(user *auth.User, cmd string, parts []string) string {
+	if user == nil {
+		return ""
+	}
+	if !user.AllowsCategory(commandCategories[cmd]) {
+		return fmt.Sprintf("ERROR user %s has no permission to run %s\n", user.Name, cmd)
+	}
+	for _, key := range commandKeys(cmd, parts) {
+		if !user.AllowsKey(key) {
+			return fmt.Sprintf("ERROR user %s has no permission to access key %s\n", user.Name, key)
+		}
+	}
+	return ""
+}
+
+// handleACLCommand executes the ACL subcommands, shared by both servers.
+// WHOAMI is allowed to every user, the others need the admin category.
+func handleACLCommand(authManager *auth.AuthManager, parts []string, sess *session, user *auth.User) string {
+	if len(parts) < 2 {
+		return "ERROR ACL requires a subcommand: SETUSER, DELUSER, LIST or WHOAMI\n"
+	}
+	sub := strings.ToUpper(parts[1])
+	if sub == "WHOAMI" {
+		if len(parts) != 2 {
+			return "ERROR ACL WHOAMI takes no arguments\n"
+		}
+		return sess.userName() + "\n"
+	}
+	if errMsg := checkPermission(user, "ACL", parts); errMsg != "" {
+		return errMsg
+	}
+	if authManager == nil || !authManager.IsEnabled() {
+		return "ERROR authentication is disabled\n"
+	}
+
+	switch sub {
+	case "SETUSER":
+		// ACL SETUSER username [rule ...]
+		if len(parts) < 3 {
+			return "ERROR ACL SETUSER requires a username\n"
+		}
+		if err := authManager.SetUser(parts[2], parts[3:]); err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return "OK\n"
+
+	case "DELUSER":
+		// ACL DELUSER username [username ...]
+		if len(parts) < 3 {
+			return "ERROR ACL DELUSER requires at least one username\n"
+		}
+		deleted := 0
+		for _, name := range parts[2:] {
+			ok, err := authManager.DeleteUser(name)
+			if err != nil {
+				return fmt.Sprintf("ERROR %v\n", err)
+			}
+			if ok {
+				deleted++
+			}
+		}
+		return fmt.Sprintf("%d\n", deleted)
+
+	case "LIST":
+		if len(parts) != 2 {
+			return "ERROR ACL LIST takes no arguments\n"
+		}
+		// One line per user with its rules, the default user first
+		var sb strings.Builder
+		sb.WriteString("user " + auth.DefaultUser + " on ~* +@all\n")
+		for _, u := range authManager.Users() {
+			fmt.Fprintf(&sb, "user %s %s\n", quoteReplyField(u.Name), u.Rules())
+		}
+		return sb.String()
+
+	default:
+		return fmt.Sprintf("ERROR unknown ACL subcommand %s\n", parts[1])
+	}
+}
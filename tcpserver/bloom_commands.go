@@ -0,0 +1,61 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"ant-cache/cache"
+)
+
+// handleBloomCommand executes the Bloom filter commands, shared by both servers
+func handleBloomCommand(c *cache.Cache, cmd string, parts []string, ttl time.Duration) string {
+	switch cmd {
+	case "BF.RESERVE":
+		// BF.RESERVE key error_rate capacity
+		if len(parts) != 4 {
+			return "ERROR BF.RESERVE requires key, error_rate and capacity\n"
+		}
+		errorRate, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return "ERROR error_rate must be a number\n"
+		}
+		capacity, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return "ERROR capacity must be an integer\n"
+		}
+		if err := c.BFReserve(parts[1], errorRate, capacity, ttl); err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return "OK\n"
+
+	case "BF.ADD":
+		if len(parts) != 3 {
+			return "ERROR BF.ADD requires key and item\n"
+		}
+		added, err := c.BFAdd(parts[1], parts[2], ttl)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if added {
+			return "1\n"
+		}
+		return "0\n"
+
+	case "BF.EXISTS":
+		if len(parts) != 3 {
+			return "ERROR BF.EXISTS requires key and item\n"
+		}
+		exists, err := c.BFExists(parts[1], parts[2])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if exists {
+			return "1\n"
+		}
+		return "0\n"
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
@@ -0,0 +1,269 @@
+package tcpserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+)
+
+// nextClientID numbers the connections of both servers, from 1
+var nextClientID atomic.Uint64
+
+// clientState is the state of a session shown by CLIENT LIST, copied from
+// the session so that other connections can read it
+type clientState struct {
+	name          string
+	user          string
+	authenticated bool
+	db            int
+	lastCmd       string
+	lastActive    time.Time
+}
+
+// newClientConn creates the connection of sess, read through reader and
+// written through writer
+func newClientConn(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer, sess *session) *clientConn {
+	now := time.Now()
+	return &clientConn{
+		conn:    conn,
+		reader:  reader,
+		writer:  writer,
+		id:      nextClientID.Add(1),
+		addr:    conn.RemoteAddr().String(),
+		created: now,
+		state:   clientState{user: sess.userName(), authenticated: sess.authenticated, lastActive: now},
+	}
+}
+
+// update copies the state of sess after the command cmd, nil-safe
+func (cc *clientConn) update(c *cache.Cache, cmd string, sess *session) {
+	if cc == nil {
+		return
+	}
+	authManager := c.GetAuthManager()
+	db := sess.dbIndex()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.state.user = sess.userName()
+	cc.state.authenticated = sess.authenticated || authManager == nil || !authManager.IsEnabled()
+	cc.state.db = db
+	cc.state.lastCmd = cmd
+	cc.state.lastActive = time.Now()
+}
+
+// snapshot returns a copy of the session state
+func (cc *clientConn) snapshot() clientState {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.state
+}
+
+// kill closes the connection. A connection killing itself is closed by
+// serveConnection once the reply is sent.
+func (cc *clientConn) kill(self bool) {
+	cc.closing.Store(true)
+	if !self {
+		cc.conn.Close()
+	}
+}
+
+// clientRegistry holds the live connections of a server, for CLIENT LIST and KILL
+type clientRegistry struct {
+	mu      sync.RWMutex
+	clients map[uint64]*clientConn
+	// closed is set by shutdown, the connections added later close at once
+	closed bool
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[uint64]*clientConn)}
+}
+
+func (r *clientRegistry) add(cc *clientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[cc.id] = cc
+	if r.closed {
+		cc.shutdown()
+	}
+}
+
+func (r *clientRegistry) remove(cc *clientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, cc.id)
+}
+
+// shutdown marks the registry closed and returns its connections
+func (r *clientRegistry) shutdown() []*clientConn {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return r.list()
+}
+
+// list returns the connections sorted by id
+func (r *clientRegistry) list() []*clientConn {
+	r.mu.RLock()
+	clients := make([]*clientConn, 0, len(r.clients))
+	for _, cc := range r.clients {
+		clients = append(clients, cc)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// clientFilter selects the connections killed by CLIENT KILL, zero fields
+// match every connection
+type clientFilter struct {
+	id   uint64
+	addr string
+	user string
+}
+
+func (f clientFilter) match(cc *clientConn, state clientState) bool {
+	return (f.id == 0 || cc.id == f.id) &&
+		(f.addr == "" || cc.addr == f.addr) &&
+		(f.user == "" || state.authenticated && state.user == f.user)
+}
+
+// parseClientFilter parses the filters of CLIENT KILL: ID id, ADDR ip:port
+// and USER username, or a single address
+func parseClientFilter(args []string) (clientFilter, error) {
+	var f clientFilter
+	if len(args) == 1 {
+		f.addr = args[0]
+		return f, nil
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return f, fmt.Errorf("CLIENT KILL requires ID id, ADDR ip:port or USER username filters")
+	}
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "ID":
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || id == 0 {
+				return f, fmt.Errorf("invalid client id %s", value)
+			}
+			f.id = id
+		case "ADDR":
+			f.addr = value
+		case "USER":
+			f.user = value
+		default:
+			return f, fmt.Errorf("unknown CLIENT KILL filter %s", args[i])
+		}
+	}
+	return f, nil
+}
+
+// handleClientCommand handles CLIENT ID, SETNAME, GETNAME, LIST and KILL.
+// ID, SETNAME and GETNAME apply to the connection itself and are allowed to
+// every user, LIST and KILL require the admin category.
+func handleClientCommand(parts []string, sess *session, user *auth.User) string {
+	if len(parts) < 2 {
+		return "ERROR CLIENT requires a subcommand: ID, SETNAME, GETNAME, LIST or KILL\n"
+	}
+	cc := sess.client
+
+	switch sub := strings.ToUpper(parts[1]); sub {
+	case "ID":
+		if len(parts) != 2 {
+			return "ERROR CLIENT ID takes no arguments\n"
+		}
+		if cc == nil {
+			return "ERROR no client connection\n"
+		}
+		return fmt.Sprintf("%d\n", cc.id)
+
+	case "SETNAME":
+		if len(parts) != 3 {
+			return "ERROR CLIENT SETNAME requires a name\n"
+		}
+		if strings.ContainsAny(parts[2], " \t\r\n") {
+			return "ERROR client names can not contain spaces\n"
+		}
+		if cc == nil {
+			return "ERROR no client connection\n"
+		}
+		cc.mu.Lock()
+		cc.state.name = parts[2]
+		cc.mu.Unlock()
+		return "OK\n"
+
+	case "GETNAME":
+		if len(parts) != 2 {
+			return "ERROR CLIENT GETNAME takes no arguments\n"
+		}
+		if cc == nil || cc.snapshot().name == "" {
+			return "NULL\n"
+		}
+		return cc.snapshot().name + "\n"
+
+	case "LIST", "KILL":
+		if errMsg := checkPermission(user, "CLIENT", parts); errMsg != "" {
+			return errMsg
+		}
+		if sess.server == nil {
+			return "ERROR no server\n"
+		}
+		clients := sess.server.clients().list()
+
+		if sub == "LIST" {
+			if len(parts) != 2 {
+				return "ERROR CLIENT LIST takes no arguments\n"
+			}
+			// One line per connection, as field=value pairs
+			now := time.Now()
+			var sb strings.Builder
+			for _, client := range clients {
+				state := client.snapshot()
+				userName := ""
+				if state.authenticated {
+					userName = state.user
+				}
+				fmt.Fprintf(&sb, "id=%d addr=%s name=%s user=%s auth=%d db=%d age=%d idle=%d cmd=%s in=%d out=%d\n",
+					client.id, client.addr, state.name, userName, boolToInt(state.authenticated), state.db,
+					int64(now.Sub(client.created).Seconds()), int64(now.Sub(state.lastActive).Seconds()),
+					strings.ToLower(state.lastCmd), client.bytesIn.Load(), client.bytesOut.Load())
+			}
+			return sb.String()
+		}
+
+		filter, err := parseClientFilter(parts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		killed := 0
+		for _, client := range clients {
+			if filter.match(client, client.snapshot()) {
+				client.kill(client == cc)
+				killed++
+			}
+		}
+		return fmt.Sprintf("%d\n", killed)
+
+	default:
+		return fmt.Sprintf("ERROR unknown CLIENT subcommand %s\n", parts[1])
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,266 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+	"ant-cache/utils"
+)
+
+// executeCommand executes a data command against c and returns its response.
+// It is shared by both servers and by BATCH, which passes an Atomic view of the cache.
+// client is the connection blocking commands watch while they wait, nil for
+// commands queued in a batch or called from a script, which never block.
+// user restricts the commands and keys allowed, nil allows everything.
+func executeCommand(c *cache.Cache, parts []string, client *clientConn, user *auth.User) string {
+	cmd := strings.ToUpper(parts[0])
+
+	// Parse TTL
+	ttl, filteredParts, err := parseTTLFromParts(parts)
+	if err != nil {
+		return fmt.Sprintf("ERROR %v\n", err)
+	}
+
+	if errMsg := checkPermission(user, cmd, filteredParts); errMsg != "" {
+		return errMsg
+	}
+
+	switch cmd {
+	case "SET":
+		if len(filteredParts) < 3 {
+			return "ERROR SET requires key and value\n"
+		}
+		key := filteredParts[1]
+		value := strings.Join(filteredParts[2:], " ")
+
+		// Direct memory operation
+		c.Set(key, value, ttl)
+		return "OK\n"
+
+	case "SETS":
+		// SET String array - simple space-separated values
+		if len(filteredParts) < 3 {
+			return "ERROR SETS requires key and at least one array element\n"
+		}
+		key := filteredParts[1]
+		// All remaining parts become array elements
+		array := filteredParts[2:]
+
+		// Direct memory operation
+		c.Set(key, array, ttl)
+		return "OK\n"
+
+	case "SETX":
+		// SET eXtended object - key-value pairs
+		if len(filteredParts) < 4 {
+			return "ERROR SETX requires key and at least one key-value pair\n"
+		}
+		if (len(filteredParts)-2)%2 != 0 {
+			return "ERROR SETX requires even number of arguments for key-value pairs\n"
+		}
+
+		key := filteredParts[1]
+		// Convert pairs to map: a b c d -> {a: b, c: d}
+		object := make(map[string]string)
+		for i := 2; i < len(filteredParts); i += 2 {
+			object[filteredParts[i]] = filteredParts[i+1]
+		}
+
+		// Direct memory operation
+		c.Set(key, object, ttl)
+		return "OK\n"
+
+	case "SETNX":
+		if len(filteredParts) < 3 {
+			return "ERROR SETNX requires key and value\n"
+		}
+		key := filteredParts[1]
+		value := strings.Join(filteredParts[2:], " ")
+
+		// Direct memory operation
+		ok := c.SetNX(key, value, ttl)
+		if ok {
+			return "OK\n"
+		}
+		return "NOT_SET\n"
+
+	case "SETSNX":
+		if len(filteredParts) < 3 {
+			return "ERROR SETSNX requires key and at least one array element\n"
+		}
+		key := filteredParts[1]
+		array := filteredParts[2:]
+
+		// Direct memory operation
+		ok := c.SetNX(key, array, ttl)
+		if ok {
+			return "OK\n"
+		}
+		return "NOT_SET\n"
+
+	case "SETXNX":
+		if len(filteredParts) < 4 {
+			return "ERROR SETXNX requires key and at least one key-value pair\n"
+		}
+		if (len(filteredParts)-2)%2 != 0 {
+			return "ERROR SETXNX requires even number of arguments for key-value pairs\n"
+		}
+
+		key := filteredParts[1]
+		object := make(map[string]string)
+		for i := 2; i < len(filteredParts); i += 2 {
+			object[filteredParts[i]] = filteredParts[i+1]
+		}
+
+		// Direct memory operation
+		ok := c.SetNX(key, object, ttl)
+		if ok {
+			return "OK\n"
+		}
+		return "NOT_SET\n"
+
+	case "GET":
+		if len(filteredParts) < 2 {
+			return "ERROR GET requires key\n"
+		}
+		key := filteredParts[1]
+
+		// Direct memory operation
+		value, exists := c.Get(key)
+		if !exists {
+			return "NULL\n"
+		}
+
+		// Format output based on data type
+		return formatValue(value)
+
+	case "DEL":
+		if len(filteredParts) < 2 {
+			return "ERROR DEL requires key\n"
+		}
+		if len(filteredParts) > 2 {
+			// Multiple keys are deleted atomically, returns the number deleted
+			return handleMultiKeyCommand(c, "MDEL", filteredParts)
+		}
+		key := filteredParts[1]
+
+		// Direct memory operation
+		deleted := c.Delete(key)
+		if deleted {
+			return "OK\n"
+		}
+		return "NOT_FOUND\n"
+
+	case "KEYS":
+		// KEYS [pattern] [TYPE type]
+		pattern := "*"
+		if len(filteredParts) > 1 {
+			pattern = filteredParts[1]
+		}
+		dataType := ""
+		if len(filteredParts) == 4 && strings.ToUpper(filteredParts[2]) == "TYPE" {
+			dataType = strings.ToLower(filteredParts[3])
+		} else if len(filteredParts) > 2 {
+			return "ERROR KEYS syntax: KEYS [pattern] [TYPE type]\n"
+		}
+
+		// Direct memory operation
+		keys := c.KeysByType(pattern, dataType)
+		if len(keys) == 0 {
+			return "EMPTY\n"
+		}
+		return strings.Join(keys, " ") + "\n"
+
+	case "FLUSHALL":
+		// Direct memory operation
+		c.FlushAll()
+		return "OK\n"
+
+	case "FLUSHDB", "SWAPDB", "MOVE":
+		// Logical databases
+		return handleDatabaseCommand(c, cmd, filteredParts)
+
+	case "MGET", "MSET", "MSETNX", "MDEL":
+		// Multi-key operations
+		return handleMultiKeyCommand(c, cmd, filteredParts)
+
+	case "ZADD", "ZREM", "ZSCORE", "ZINCRBY", "ZCARD", "ZRANK", "ZRANGE", "ZRANGEBYSCORE":
+		// Sorted set operations
+		return handleZSetCommand(c, cmd, filteredParts, ttl)
+
+	case "SADD", "SREM", "SISMEMBER", "SMEMBERS", "SCARD",
+		"SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+		// Unordered set operations
+		return handleSetCommand(c, cmd, filteredParts, ttl)
+
+	case "PFADD", "PFCOUNT", "PFMERGE":
+		// HyperLogLog distinct counters
+		return handleHyperLogLogCommand(c, cmd, filteredParts, ttl)
+
+	case "BF.RESERVE", "BF.ADD", "BF.EXISTS":
+		// Bloom filters
+		return handleBloomCommand(c, cmd, filteredParts, ttl)
+
+	case "XADD", "XLEN", "XRANGE", "XREAD", "XGROUP", "XREADGROUP", "XACK", "XPENDING", "XAUTOCLAIM":
+		// Streams and consumer groups, reads may block
+		return handleStreamCommand(c, cmd, filteredParts, client)
+
+	case "LPUSH", "RPUSH", "LPOP", "RPOP", "LLEN", "BLPOP", "BRPOP":
+		// Arrays used as queues, pops may block
+		return handleListCommand(c, cmd, filteredParts, ttl, client)
+
+	case "LOCK", "UNLOCK", "RENEW":
+		// Distributed locks with fencing tokens
+		return handleLockCommand(c, cmd, filteredParts)
+
+	case "RL.TOKENBUCKET", "RL.SLIDINGWINDOW", "RL.GCRA":
+		// Rate limiters, the state expires on its own
+		return handleRateLimitCommand(c, cmd, filteredParts)
+
+	case "EVAL":
+		// Scripts run atomically against the cache
+		return handleEvalCommand(c, filteredParts, user)
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
+
+// noTTLCommands are the commands that don't support TTL
+var noTTLCommands = map[string]bool{
+	"DEL": true, "GET": true, "KEYS": true, "FLUSHALL": true,
+	"FLUSHDB": true, "SWAPDB": true, "MOVE": true,
+	"MGET": true, "MSET": true, "MSETNX": true, "MDEL": true, "EVAL": true,
+	"LOCK": true, "UNLOCK": true, "RENEW": true,
+	"RL.TOKENBUCKET": true, "RL.SLIDINGWINDOW": true, "RL.GCRA": true,
+	"PFCOUNT": true, "PFMERGE": true, "BF.EXISTS": true,
+	"XADD": true, "XLEN": true, "XRANGE": true, "XREAD": true, "XGROUP": true,
+	"XREADGROUP": true, "XACK": true, "XPENDING": true, "XAUTOCLAIM": true,
+}
+
+// parseTTLFromParts parses TTL from command parts
+func parseTTLFromParts(parts []string) (time.Duration, []string, error) {
+	cmd := strings.ToUpper(parts[0])
+	ttl := time.Duration(0)
+
+	if noTTLCommands[cmd] {
+		return ttl, parts, nil
+	}
+
+	// Handle TTL parameter: COMMAND key -t TTL_VALUE [other_params...]
+	if len(parts) >= 4 && parts[2] == "-t" {
+		ttlValue, err := utils.ParseTTL(parts[3])
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid ttl value: %v", err)
+		}
+		ttl = ttlValue
+		// Remove -t and TTL value
+		filteredParts := append([]string{parts[0], parts[1]}, parts[4:]...)
+		return ttl, filteredParts, nil
+	}
+
+	return ttl, parts, nil
+}
@@ -0,0 +1,221 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ant-cache/logging"
+)
+
+var serverLog = logging.For(logging.TCPServer)
+
+const (
+	// readTimeout closes connections idle for longer than this
+	readTimeout = 30 * time.Second
+	// maxLineSize is the longest command line accepted (1MB)
+	maxLineSize = 1024 * 1024
+)
+
+var errLineTooLong = errors.New("command line too long")
+
+// serveConnection reads command lines from conn and writes back the responses
+// of process. Pipelined commands are answered in order, and the responses of
+// all the complete lines already received are coalesced into a single write,
+// sent before a command blocks. sess.client is set so that blocking commands can watch the connection, and
+// registered in the clients of the server while the connection lasts.
+func serveConnection(conn net.Conn, sess *session, process func(line string) string, totalRequests, totalResponses *uint64) {
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	writer := bufio.NewWriterSize(conn, 64*1024)
+	sess.client = newClientConn(conn, reader, writer, sess)
+	if sess.server != nil {
+		clients := sess.server.clients()
+		clients.add(sess.client)
+		defer clients.remove(sess.client)
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		// The server is shutting down, see clientConn.shutdown
+		if sess.client.closing.Load() {
+			writer.Flush()
+			return
+		}
+
+		line, err := readLine(reader)
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err != io.EOF && !sess.client.closing.Load() {
+				serverLog.Debug("Connection read error", "client", conn.RemoteAddr().String(), "error", err)
+			}
+			writer.Flush()
+			return
+		}
+
+		if len(line) > 0 {
+			atomic.AddUint64(totalRequests, 1)
+			sess.client.bytesIn.Add(uint64(len(line)) + 1)
+
+			response := process(string(line))
+			writer.WriteString(response)
+
+			sess.client.bytesOut.Add(uint64(len(response)))
+			atomic.AddUint64(totalResponses, 1)
+		}
+
+		// Flush once no other complete command is waiting to be processed
+		killed := sess.client.closing.Load()
+		if killed || sess.monitor != nil || err == io.EOF || !hasBufferedLine(reader) {
+			if err := writer.Flush(); err != nil {
+				if !killed {
+					serverLog.Debug("Failed to write response", "client", conn.RemoteAddr().String(), "error", err)
+				}
+				return
+			}
+		}
+		// A connection killed by CLIENT KILL closes once its reply is sent
+		if killed || err == io.EOF {
+			return
+		}
+		// After MONITOR the connection only receives the commands of the others
+		if sess.monitor != nil {
+			streamMonitor(sess.client, writer, sess.monitor)
+			return
+		}
+	}
+}
+
+// clientConn is the connection of a session, watched by blocking commands
+// and listed by CLIENT LIST
+type clientConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// Time spent blocked since the last takeWaited
+	waited time.Duration
+
+	id      uint64
+	addr    string
+	created time.Time
+	// Bytes of the command lines received and of the responses sent
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	// closing is set by CLIENT KILL and by the shutdown of the server
+	closing atomic.Bool
+
+	// State of the session, updated after each command
+	mu    sync.Mutex
+	state clientState
+}
+
+// watchClose returns a channel closed if the client disconnects before stop
+// is called. Commands the client sends meanwhile stay buffered for after the
+// blocking command. A nil clientConn is never closed.
+func (cc *clientConn) watchClose() (<-chan struct{}, func()) {
+	if cc == nil {
+		return nil, func() {}
+	}
+
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	var stopped atomic.Bool
+	start := time.Now()
+	go func() {
+		defer close(done)
+		for {
+			// No idle timeout while blocked, serveConnection sets it again before the next read
+			cc.conn.SetReadDeadline(time.Time{})
+			if stopped.Load() {
+				return
+			}
+			_, err := cc.reader.Peek(1)
+			var netErr net.Error
+			if err == nil || stopped.Load() {
+				return
+			}
+			if !(errors.As(err, &netErr) && netErr.Timeout()) {
+				close(closed)
+				return
+			}
+			// Interrupted by the shutdown of the server, the command goes on
+		}
+	}()
+
+	stop := func() {
+		// Interrupt the peek, the reader keeps working after a timeout
+		stopped.Store(true)
+		cc.conn.SetReadDeadline(time.Now())
+		<-done
+		cc.waited += time.Since(start)
+	}
+	return closed, stop
+}
+
+// takeWaited returns the time spent blocked since the last call
+func (cc *clientConn) takeWaited() time.Duration {
+	if cc == nil {
+		return 0
+	}
+	waited := cc.waited
+	cc.waited = 0
+	return waited
+}
+
+// watchIfBlocking watches the client while a command blocks for up to
+// timeout, so that it stops waiting if the client disconnects. The replies of
+// the commands pipelined before are sent first, not held until it returns.
+func watchIfBlocking(client *clientConn, timeout time.Duration) (<-chan struct{}, func()) {
+	if timeout == 0 {
+		return nil, func() {}
+	}
+	client.flush()
+	return client.watchClose()
+}
+
+// flush sends the replies buffered for the client, a nil clientConn has none.
+// A write error is reported by the next flush of serveConnection.
+func (cc *clientConn) flush() {
+	if cc != nil && cc.writer != nil {
+		cc.writer.Flush()
+	}
+}
+
+// readLine reads one line without its trailing "\r\n" or "\n". The last line
+// before EOF is returned together with io.EOF.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineSize {
+			return nil, errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			line = append(line, chunk...)
+			continue
+		}
+		if line == nil {
+			// Copy since the slice is only valid until the next read
+			line = make([]byte, 0, len(chunk))
+		}
+		line = append(line, chunk...)
+		if err != nil {
+			return line, err
+		}
+		line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+		return line, nil
+	}
+}
+
+// hasBufferedLine reports whether a complete line is already buffered
+func hasBufferedLine(reader *bufio.Reader) bool {
+	n := reader.Buffered()
+	if n == 0 {
+		return false
+	}
+	buffered, _ := reader.Peek(n)
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
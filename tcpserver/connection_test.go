@@ -0,0 +1,50 @@
+package tcpserver
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestPipelinedRepliesBeforeBlocking checks that the replies of the commands
+// pipelined before a blocking command are sent while it waits
+func TestPipelinedRepliesBeforeBlocking(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	sess := &session{}
+	release := make(chan struct{})
+	process := func(line string) string {
+		if line == "BLOCK" {
+			_, stop := watchIfBlocking(sess.client, time.Minute)
+			defer stop()
+			<-release
+			return "UNBLOCKED\n"
+		}
+		return line + "\n"
+	}
+	var requests, responses uint64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveConnection(server, sess, process, &requests, &responses)
+	}()
+
+	if _, err := client.Write([]byte("A\nB\nBLOCK\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"A\n", "B\n"} {
+		if reply, err := reader.ReadString('\n'); reply != want || err != nil {
+			t.Fatalf("reply while blocked = %q, %v, want %q", reply, err, want)
+		}
+	}
+
+	close(release)
+	if reply, err := reader.ReadString('\n'); reply != "UNBLOCKED\n" || err != nil {
+		t.Fatalf("reply of the blocking command = %q, %v", reply, err)
+	}
+	client.Close()
+	<-done
+}
@@ -0,0 +1,55 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+
+	"ant-cache/cache"
+)
+
+// handleDatabaseCommand executes the commands acting on whole logical
+// databases, shared by both servers. SELECT is handled by the session.
+func handleDatabaseCommand(c *cache.Cache, cmd string, parts []string) string {
+	switch cmd {
+	case "FLUSHDB":
+		if len(parts) != 1 {
+			return "ERROR FLUSHDB takes no arguments\n"
+		}
+		c.FlushDB()
+		return "OK\n"
+
+	case "SWAPDB":
+		if len(parts) != 3 {
+			return "ERROR SWAPDB requires two database indexes\n"
+		}
+		a, errA := strconv.Atoi(parts[1])
+		b, errB := strconv.Atoi(parts[2])
+		if errA != nil || errB != nil {
+			return "ERROR database index must be an integer\n"
+		}
+		if err := c.SwapDB(a, b); err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return "OK\n"
+
+	case "MOVE":
+		if len(parts) != 3 {
+			return "ERROR MOVE requires key and database index\n"
+		}
+		index, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return "ERROR database index must be an integer\n"
+		}
+		moved, err := c.Move(parts[1], index)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if moved {
+			return "1\n"
+		}
+		return "0\n"
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
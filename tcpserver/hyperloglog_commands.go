@@ -0,0 +1,48 @@
+package tcpserver
+
+import (
+	"fmt"
+	"time"
+
+	"ant-cache/cache"
+)
+
+// handleHyperLogLogCommand executes the HyperLogLog commands, shared by both servers
+func handleHyperLogLogCommand(c *cache.Cache, cmd string, parts []string, ttl time.Duration) string {
+	switch cmd {
+	case "PFADD":
+		if len(parts) < 2 {
+			return "ERROR PFADD requires key\n"
+		}
+		changed, err := c.PFAdd(parts[1], parts[2:], ttl)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if changed {
+			return "1\n"
+		}
+		return "0\n"
+
+	case "PFCOUNT":
+		if len(parts) < 2 {
+			return "ERROR PFCOUNT requires at least one key\n"
+		}
+		count, err := c.PFCount(parts[1:]...)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", count)
+
+	case "PFMERGE":
+		if len(parts) < 2 {
+			return "ERROR PFMERGE requires destination key\n"
+		}
+		if err := c.PFMerge(parts[1], parts[2:]); err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return "OK\n"
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
@@ -0,0 +1,216 @@
+package tcpserver
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+)
+
+// Version is the version of the server reported by INFO
+var Version = "1.2.0"
+
+// startTime is the start of the process, for the uptime reported by INFO
+var startTime = time.Now()
+
+// infoSections are the sections of INFO, in the order they are written
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "keyspace", "pool"}
+
+// sessionServer is the server of a session, implemented by both servers
+type sessionServer interface {
+	// GetStats returns the connection counters of the server
+	GetStats() map[string]interface{}
+	// poolStats returns the statistics of the goroutine pool, nil without one
+	poolStats() map[string]interface{}
+	// clients returns the live connections of the server
+	clients() *clientRegistry
+	// runtimeConfig returns the configuration changed by CONFIG, nil without one
+	runtimeConfig() *RuntimeConfig
+}
+
+// handleInfoCommand handles INFO [section ...] and STATS, which replies the
+// stats section. Every line is field:value, each section starting with
+// "# Section".
+func handleInfoCommand(c *cache.Cache, cmd string, parts []string, sess *session, user *auth.User) string {
+	if errMsg := checkPermission(user, cmd, parts); errMsg != "" {
+		return errMsg
+	}
+
+	sections := infoSections
+	if cmd == "STATS" {
+		if len(parts) != 1 {
+			return "ERROR STATS takes no arguments\n"
+		}
+		sections = []string{"stats"}
+	} else if len(parts) > 1 {
+		sections = nil
+		for _, name := range parts[1:] {
+			name = strings.ToLower(name)
+			if name == "all" || name == "everything" {
+				sections = infoSections
+				break
+			}
+			if !isInfoSection(name) {
+				return fmt.Sprintf("ERROR unknown INFO section %s\n", name)
+			}
+			sections = append(sections, name)
+		}
+	}
+
+	var sb strings.Builder
+	for _, name := range sections {
+		writeInfoSection(&sb, name, c, sess.server)
+	}
+	return sb.String()
+}
+
+func isInfoSection(name string) bool {
+	for _, section := range infoSections {
+		if section == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeInfoSection writes one section, server is nil for a session without one
+func writeInfoSection(sb *strings.Builder, name string, c *cache.Cache, server sessionServer) {
+	field := func(name string, value interface{}) {
+		fmt.Fprintf(sb, "%s:%v\n", name, value)
+	}
+	uptime := time.Since(startTime)
+
+	switch name {
+	case "server":
+		sb.WriteString("# Server\n")
+		field("version", Version)
+		field("go_version", runtime.Version())
+		field("os", runtime.GOOS)
+		field("arch", runtime.GOARCH)
+		field("process_id", os.Getpid())
+		mode := "single-goroutine"
+		if server != nil && server.poolStats() != nil {
+			mode = "pooled-goroutine"
+		}
+		field("server_mode", mode)
+		field("uptime_in_seconds", int64(uptime.Seconds()))
+		field("uptime_in_days", int64(uptime.Hours()/24))
+
+	case "clients":
+		sb.WriteString("# Clients\n")
+		if server == nil {
+			return
+		}
+		stats := server.GetStats()
+		field("connected_clients", stats["active_connections"])
+		field("total_connections_received", stats["total_connections"])
+		if rejected, ok := stats["rejected_tasks"]; ok {
+			field("rejected_connections", rejected)
+		}
+		field("monitors", commandMonitors.count.Load())
+
+	case "memory":
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		sb.WriteString("# Memory\n")
+		field("used_memory", mem.HeapAlloc)
+		field("used_memory_human", formatBytes(mem.HeapAlloc))
+		field("used_memory_sys", mem.Sys)
+		field("heap_objects", mem.HeapObjects)
+		field("gc_runs", mem.NumGC)
+		field("goroutines", runtime.NumGoroutine())
+
+	case "persistence":
+		sb.WriteString("# Persistence\n")
+		ps, ok := c.PersistenceStats()
+		if !ok {
+			field("persistence_enabled", 0)
+			return
+		}
+		field("persistence_enabled", 1)
+		field("acl_queue_depth", ps.QueueDepth)
+		field("acl_queue_capacity", ps.QueueCapacity)
+		field("acl_dropped_commands", ps.DroppedCommands)
+		field("acl_size", ps.AclSize)
+		field("acl_rotations", ps.AclRotations)
+		field("atd_saves", ps.AtdSaves)
+		lastSave := int64(0)
+		if !ps.LastAtdTime.IsZero() {
+			lastSave = ps.LastAtdTime.Unix()
+		}
+		field("atd_last_save_time", lastSave)
+		field("atd_last_save_duration_ms", ps.LastAtdDuration.Milliseconds())
+
+	case "stats":
+		stats := c.Stats()
+		total := commandMetrics.total()
+		sb.WriteString("# Stats\n")
+		field("total_commands_processed", total)
+		field("instantaneous_ops_per_sec", commandMetrics.opsPerSec())
+		field("average_ops_per_sec", fmt.Sprintf("%.2f", float64(total)/uptime.Seconds()))
+		field("keyspace_hits", stats.Hits)
+		field("keyspace_misses", stats.Misses)
+		hitRate := 0.0
+		if lookups := stats.Hits + stats.Misses; lookups > 0 {
+			hitRate = float64(stats.Hits) / float64(lookups)
+		}
+		field("keyspace_hit_rate", fmt.Sprintf("%.4f", hitRate))
+		field("expired_keys", stats.ExpiredKeys)
+		if server != nil {
+			serverStats := server.GetStats()
+			field("total_requests", serverStats["total_requests"])
+			field("total_responses", serverStats["total_responses"])
+		}
+
+	case "keyspace":
+		// db0:keys=3,expires=1,array=1,string=2
+		sb.WriteString("# Keyspace\n")
+		for _, db := range c.Keyspace() {
+			types := make([]string, 0, len(db.Types))
+			for t := range db.Types {
+				types = append(types, t)
+			}
+			sort.Strings(types)
+			fmt.Fprintf(sb, "db%d:keys=%d,expires=%d", db.DB, db.Keys, db.Expires)
+			for _, t := range types {
+				fmt.Fprintf(sb, ",%s=%d", t, db.Types[t])
+			}
+			sb.WriteString("\n")
+		}
+
+	case "pool":
+		sb.WriteString("# Pool\n")
+		if server == nil {
+			return
+		}
+		stats := server.poolStats()
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field(name, stats[name])
+		}
+	}
+}
+
+// formatBytes formats n bytes with a binary unit, as 1.50M
+func formatBytes(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", value, units[unit])
+}
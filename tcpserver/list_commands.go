@@ -0,0 +1,88 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"ant-cache/cache"
+)
+
+// handleListCommand executes the commands pushing to and popping from array
+// values, shared by both servers
+func handleListCommand(c *cache.Cache, cmd string, parts []string, ttl time.Duration, client *clientConn) string {
+	switch cmd {
+	case "LPUSH", "RPUSH":
+		if len(parts) < 3 {
+			return fmt.Sprintf("ERROR %s requires key and at least one element\n", cmd)
+		}
+		push := c.RPush
+		if cmd == "LPUSH" {
+			push = c.LPush
+		}
+		length, err := push(parts[1], parts[2:], ttl)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", length)
+
+	case "LPOP", "RPOP":
+		if len(parts) != 2 {
+			return fmt.Sprintf("ERROR %s requires key\n", cmd)
+		}
+		pop := c.RPop
+		if cmd == "LPOP" {
+			pop = c.LPop
+		}
+		value, ok, err := pop(parts[1])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if !ok {
+			return "NULL\n"
+		}
+		return value + "\n"
+
+	case "LLEN":
+		if len(parts) != 2 {
+			return "ERROR LLEN requires key\n"
+		}
+		length, err := c.LLen(parts[1])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", length)
+
+	case "BLPOP", "BRPOP":
+		// BLPOP key [key ...] timeout, the timeout is in seconds and 0 waits forever
+		if len(parts) < 3 {
+			return fmt.Sprintf("ERROR %s requires at least one key and a timeout\n", cmd)
+		}
+		seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+		if err != nil || seconds < 0 {
+			return "ERROR timeout must be a non-negative number of seconds\n"
+		}
+		timeout := cache.BlockForever
+		if seconds > 0 {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+
+		closed, stop := watchIfBlocking(client, timeout)
+		defer stop()
+		pop := c.BRPop
+		if cmd == "BLPOP" {
+			pop = c.BLPop
+		}
+		key, value, ok, err := pop(parts[1:len(parts)-1], timeout, closed)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if !ok {
+			return "NULL\n"
+		}
+		return quoteReplyField(key) + " " + value + "\n"
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
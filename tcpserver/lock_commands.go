@@ -0,0 +1,88 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"ant-cache/cache"
+	"ant-cache/utils"
+)
+
+// handleLockCommand executes the distributed lock commands, shared by both servers
+func handleLockCommand(c *cache.Cache, cmd string, parts []string) string {
+	switch cmd {
+	case "LOCK":
+		// LOCK key ttl
+		if len(parts) != 3 {
+			return "ERROR LOCK requires key and ttl\n"
+		}
+		ttl, err := parseLockTTL(parts[2])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		token, remaining, err := c.Lock(parts[1], ttl)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if token == 0 {
+			return fmt.Sprintf("LOCKED %d\n", remaining.Milliseconds())
+		}
+		return fmt.Sprintf("%d %d\n", token, remaining.Milliseconds())
+
+	case "UNLOCK":
+		// UNLOCK key token
+		if len(parts) != 3 {
+			return "ERROR UNLOCK requires key and token\n"
+		}
+		token, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return "ERROR token must be a positive integer\n"
+		}
+		released, err := c.Unlock(parts[1], token)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if !released {
+			return "NOT_OWNER\n"
+		}
+		return "OK\n"
+
+	case "RENEW":
+		// RENEW key token ttl
+		if len(parts) != 4 {
+			return "ERROR RENEW requires key, token and ttl\n"
+		}
+		token, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return "ERROR token must be a positive integer\n"
+		}
+		ttl, err := parseLockTTL(parts[3])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		renewed, err := c.Renew(parts[1], token, ttl)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if !renewed {
+			return "NOT_OWNER\n"
+		}
+		return "OK\n"
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
+
+// parseLockTTL parses the TTL of a lock, locks must always expire
+func parseLockTTL(s string) (time.Duration, error) {
+	ttl, err := utils.ParseTTL(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl value: %v", err)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("lock ttl must be positive")
+	}
+	return ttl, nil
+}
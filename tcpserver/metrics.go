@@ -0,0 +1,233 @@
+package tcpserver
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ant-cache/cache"
+)
+
+// latencyBuckets are the upper bounds of the command latency histogram, in seconds
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// sessionCommands are the commands handled by processCommand itself
+var sessionCommands = map[string]bool{
+	"AUTH": true, "SELECT": true, "BATCH": true, "MULTI": true, "END": true,
+	"EXEC": true, "DISCARD": true, "UNWATCH": true,
+}
+
+// commandStat counts the calls of one command and their latency
+type commandStat struct {
+	calls   uint64
+	nanos   uint64
+	buckets []uint64 // calls per latency bucket, not cumulative
+}
+
+// commandStats holds the statistics of every command, shared by both servers
+type commandStats struct {
+	mu    sync.RWMutex
+	stats map[string]*commandStat
+
+	calls atomic.Uint64
+	// Calls of the current second and of the one before, for the
+	// instantaneous ops per second
+	second   atomic.Int64
+	current  atomic.Uint64
+	previous atomic.Uint64
+}
+
+var commandMetrics = &commandStats{stats: make(map[string]*commandStat)}
+
+// record counts a call of cmd which took elapsed. Unknown commands are
+// counted together so that clients can not create series at will.
+func (s *commandStats) record(cmd string, elapsed time.Duration) {
+	if commandCategories[cmd] == "" && !sessionCommands[cmd] {
+		cmd = "UNKNOWN"
+	}
+
+	s.mu.RLock()
+	stat := s.stats[cmd]
+	s.mu.RUnlock()
+	if stat == nil {
+		s.mu.Lock()
+		if stat = s.stats[cmd]; stat == nil {
+			stat = &commandStat{buckets: make([]uint64, len(latencyBuckets)+1)}
+			s.stats[cmd] = stat
+		}
+		s.mu.Unlock()
+	}
+
+	bucket := sort.SearchFloat64s(latencyBuckets, elapsed.Seconds())
+	atomic.AddUint64(&stat.buckets[bucket], 1)
+	atomic.AddUint64(&stat.nanos, uint64(elapsed))
+	atomic.AddUint64(&stat.calls, 1)
+
+	s.calls.Add(1)
+	now := time.Now().Unix()
+	if second := s.second.Load(); second != now && s.second.CompareAndSwap(second, now) {
+		last := s.current.Swap(0)
+		if second != now-1 {
+			last = 0
+		}
+		s.previous.Store(last)
+	}
+	s.current.Add(1)
+}
+
+// total returns the number of commands processed
+func (s *commandStats) total() uint64 {
+	return s.calls.Load()
+}
+
+// opsPerSec returns the number of commands processed in the last full second
+func (s *commandStats) opsPerSec() uint64 {
+	now := time.Now().Unix()
+	switch s.second.Load() {
+	case now:
+		return s.previous.Load()
+	case now - 1:
+		return s.current.Load()
+	}
+	return 0
+}
+
+// commands returns the names of the commands called so far, sorted
+func (s *commandStats) commands() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.stats))
+	for name := range s.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *commandStats) get(cmd string) *commandStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stats[cmd]
+}
+
+// metricsWriter writes metrics in the Prometheus text format
+type metricsWriter struct {
+	sb strings.Builder
+}
+
+// metric starts the metric name with its help and type
+func (w *metricsWriter) metric(name, typ, help string) {
+	w.sb.WriteString("# HELP " + name + " " + help + "\n")
+	w.sb.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes one value of name, labels are name and value pairs
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.sb.WriteString(name)
+	if len(labels) > 0 {
+		w.sb.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.sb.WriteByte(',')
+			}
+			w.sb.WriteString(labels[i] + "=" + strconv.Quote(labels[i+1]))
+		}
+		w.sb.WriteByte('}')
+	}
+	w.sb.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// single writes a metric without labels
+func (w *metricsWriter) single(name, typ, help string, value float64) {
+	w.metric(name, typ, help)
+	w.sample(name, value)
+}
+
+// writeCacheMetrics writes the metrics of the keyspace, the persistence and the commands
+func writeCacheMetrics(w *metricsWriter, c *cache.Cache) {
+	stats := c.Stats()
+	w.single("ant_cache_keyspace_hits_total", "counter", "Keys found by GET and MGET.", float64(stats.Hits))
+	w.single("ant_cache_keyspace_misses_total", "counter", "Keys not found by GET and MGET.", float64(stats.Misses))
+	w.single("ant_cache_expired_keys_total", "counter", "Keys removed once expired.", float64(stats.ExpiredKeys))
+	// The cache has no memory limit, keys only leave it when deleted or expired
+	w.single("ant_cache_evicted_keys_total", "counter", "Keys evicted to free memory.", 0)
+
+	keyspace := c.Keyspace()
+	w.metric("ant_cache_keys", "gauge", "Keys by database and data type.")
+	for _, db := range keyspace {
+		types := make([]string, 0, len(db.Types))
+		for t := range db.Types {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			w.sample("ant_cache_keys", float64(db.Types[t]), "db", strconv.Itoa(db.DB), "type", t)
+		}
+	}
+	w.metric("ant_cache_keys_with_ttl", "gauge", "Keys with a TTL by database.")
+	for _, db := range keyspace {
+		w.sample("ant_cache_keys_with_ttl", float64(db.Expires), "db", strconv.Itoa(db.DB))
+	}
+
+	if ps, ok := c.PersistenceStats(); ok {
+		w.single("ant_cache_acl_queue_depth", "gauge", "Commands waiting to be written to the ACL.", float64(ps.QueueDepth))
+		w.single("ant_cache_acl_queue_capacity", "gauge", "Capacity of the ACL queue.", float64(ps.QueueCapacity))
+		w.single("ant_cache_acl_dropped_commands_total", "counter", "Commands not logged to the ACL because its queue was full.", float64(ps.DroppedCommands))
+		w.single("ant_cache_acl_size_bytes", "gauge", "Size of the current ACL file.", float64(ps.AclSize))
+		w.single("ant_cache_acl_rotations_total", "counter", "ACL file rotations.", float64(ps.AclRotations))
+		w.single("ant_cache_atd_saves_total", "counter", "ATD snapshots saved.", float64(ps.AtdSaves))
+		w.single("ant_cache_atd_last_save_duration_seconds", "gauge", "Duration of the last ATD snapshot.", ps.LastAtdDuration.Seconds())
+		lastSave := 0.0
+		if !ps.LastAtdTime.IsZero() {
+			lastSave = float64(ps.LastAtdTime.UnixNano()) / 1e9
+		}
+		w.single("ant_cache_atd_last_save_timestamp_seconds", "gauge", "Time of the last ATD snapshot, 0 before the first one.", lastSave)
+	}
+
+	commands := commandMetrics.commands()
+	w.metric("ant_cache_commands_total", "counter", "Commands processed by command name.")
+	for _, cmd := range commands {
+		w.sample("ant_cache_commands_total", float64(atomic.LoadUint64(&commandMetrics.get(cmd).calls)), "command", cmd)
+	}
+	w.metric("ant_cache_command_duration_seconds", "histogram", "Command latency by command name, blocking commands include their wait.")
+	for _, cmd := range commands {
+		stat := commandMetrics.get(cmd)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&stat.buckets[i])
+			w.sample("ant_cache_command_duration_seconds_bucket", float64(cumulative), "command", cmd, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		cumulative += atomic.LoadUint64(&stat.buckets[len(latencyBuckets)])
+		w.sample("ant_cache_command_duration_seconds_bucket", float64(cumulative), "command", cmd, "le", "+Inf")
+		w.sample("ant_cache_command_duration_seconds_sum", float64(atomic.LoadUint64(&stat.nanos))/1e9, "command", cmd)
+		w.sample("ant_cache_command_duration_seconds_count", float64(cumulative), "command", cmd)
+	}
+
+	w.single("ant_cache_slowlog_length", "gauge", "Entries in the slow log.", float64(commandSlowLog.len()))
+	w.single("ant_cache_slowlog_recorded_total", "counter", "Commands recorded in the slow log.", float64(commandSlowLog.recorded.Load()))
+}
+
+// writeConnectionMetrics writes the connection counters shared by both servers
+func writeConnectionMetrics(w *metricsWriter, total, active, requests, responses *uint64) {
+	w.single("ant_cache_connections_total", "counter", "Connections accepted.", float64(atomic.LoadUint64(total)))
+	w.single("ant_cache_connections_active", "gauge", "Connections open.", float64(atomic.LoadUint64(active)))
+	w.single("ant_cache_requests_total", "counter", "Command lines received.", float64(atomic.LoadUint64(requests)))
+	w.single("ant_cache_responses_total", "counter", "Responses sent.", float64(atomic.LoadUint64(responses)))
+}
+
+// metricsHandler serves the metrics written by write on /metrics
+func metricsHandler(write func(w *metricsWriter)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		var w metricsWriter
+		write(&w)
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		rw.Write([]byte(w.sb.String()))
+	})
+	return mux
+}
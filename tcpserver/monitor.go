@@ -0,0 +1,133 @@
+package tcpserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// monitorBuffer is the number of lines a monitor may lag behind before it is dropped
+	monitorBuffer = 1024
+	// monitorWriteTimeout drops a monitor whose client stopped reading
+	monitorWriteTimeout = 10 * time.Second
+)
+
+// monitor is a connection receiving the commands of every client
+type monitor struct {
+	lines   chan string
+	dropped chan struct{}
+	once    sync.Once
+}
+
+// drop stops the monitor, its client being too slow
+func (m *monitor) drop() {
+	m.once.Do(func() { close(m.dropped) })
+}
+
+// monitorHub fans out the processed commands to the monitors. Publishing
+// never blocks, a monitor whose buffer is full is dropped.
+type monitorHub struct {
+	mu       sync.RWMutex
+	monitors map[*monitor]struct{}
+	// count lets publish return at once without monitors
+	count atomic.Int32
+}
+
+var commandMonitors = &monitorHub{monitors: make(map[*monitor]struct{})}
+
+func (h *monitorHub) subscribe() *monitor {
+	m := &monitor{lines: make(chan string, monitorBuffer), dropped: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.monitors[m] = struct{}{}
+	h.count.Add(1)
+	return m
+}
+
+func (h *monitorHub) unsubscribe(m *monitor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.monitors[m]; ok {
+		delete(h.monitors, m)
+		h.count.Add(-1)
+	}
+}
+
+// active reports whether a monitor is connected
+func (h *monitorHub) active() bool {
+	return h.count.Load() > 0
+}
+
+// publish sends the command parts run by client on the database db to the
+// monitors, as: time [db address] arguments. Passwords are redacted.
+func (h *monitorHub) publish(parts []string, db int, client string) {
+	if !h.active() {
+		return
+	}
+	if client == "" {
+		client = "-"
+	}
+	now := time.Now()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d.%06d [%d %s]", now.Unix(), now.Nanosecond()/1000, db, client)
+	for _, arg := range redactArgs(parts) {
+		sb.WriteString(" " + quoteReplyField(arg))
+	}
+	sb.WriteString("\n")
+	line := sb.String()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for m := range h.monitors {
+		select {
+		case m.lines <- line:
+		default:
+			m.drop()
+		}
+	}
+}
+
+// streamMonitor writes the lines of m to the connection until the client
+// disconnects, the connection is killed or the monitor is dropped. What the
+// client sends meanwhile is discarded.
+func streamMonitor(cc *clientConn, writer *bufio.Writer, m *monitor) {
+	defer commandMonitors.unsubscribe(m)
+
+	closed := make(chan struct{})
+	cc.conn.SetReadDeadline(time.Time{})
+	if cc.closing.Load() {
+		return
+	}
+	go func() {
+		io.Copy(io.Discard, cc.reader)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case line := <-m.lines:
+			writer.WriteString(line)
+			// Coalesce the lines already waiting into one write
+			for n := len(m.lines); n > 0; n-- {
+				writer.WriteString(<-m.lines)
+			}
+			cc.bytesOut.Add(uint64(writer.Buffered()))
+			cc.conn.SetWriteDeadline(time.Now().Add(monitorWriteTimeout))
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		case <-m.dropped:
+			cc.conn.SetWriteDeadline(time.Now().Add(monitorWriteTimeout))
+			writer.WriteString("ERROR monitor dropped, the client did not keep up\n")
+			writer.Flush()
+			return
+		case <-closed:
+			return
+		}
+	}
+}
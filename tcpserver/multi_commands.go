@@ -0,0 +1,84 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"ant-cache/cache"
+)
+
+// handleMultiKeyCommand executes the multi-key commands, shared by both servers.
+// Each command is applied under a single cache lock acquisition.
+func handleMultiKeyCommand(c *cache.Cache, cmd string, parts []string) string {
+	switch cmd {
+	case "MGET":
+		// One response line per requested key, in request order
+		if len(parts) < 2 {
+			return "ERROR MGET requires at least one key\n"
+		}
+		var sb strings.Builder
+		for _, value := range c.MGet(parts[1:]) {
+			if value == nil {
+				sb.WriteString("NULL\n")
+				continue
+			}
+			sb.WriteString(formatValue(value))
+		}
+		return sb.String()
+
+	case "MSET", "MSETNX":
+		if len(parts) < 3 || (len(parts)-1)%2 != 0 {
+			return fmt.Sprintf("ERROR %s requires key value pairs\n", cmd)
+		}
+		keys := make([]string, 0, (len(parts)-1)/2)
+		values := make([]interface{}, 0, (len(parts)-1)/2)
+		for i := 1; i < len(parts); i += 2 {
+			keys = append(keys, parts[i])
+			values = append(values, parts[i+1])
+		}
+		if cmd == "MSET" {
+			c.MSet(keys, values, 0)
+			return "OK\n"
+		}
+		if c.MSetNX(keys, values, 0) {
+			return "OK\n"
+		}
+		return "NOT_SET\n"
+
+	case "MDEL":
+		if len(parts) < 2 {
+			return "ERROR MDEL requires at least one key\n"
+		}
+		return fmt.Sprintf("%d\n", c.DeleteMultiple(parts[1:]))
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
+
+// formatValue formats a value returned by Get for GET and MGET based on its
+// data type
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		// String: return as-is
+		return fmt.Sprintf("%s\n", v)
+	case []string:
+		// Array: return as space-separated values in brackets
+		return fmt.Sprintf("[%s]\n", strings.Join(v, " "))
+	case map[string]string:
+		// Object: return as JSON string
+		jsonBytes, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("ERROR serializing object: %v\n", err)
+		}
+		return fmt.Sprintf("%s\n", string(jsonBytes))
+	case []cache.ZMember:
+		// Sorted set: return members with scores in brackets
+		return fmt.Sprintf("[%s]\n", strings.TrimSuffix(formatZMembers(v, true), "\n"))
+	default:
+		// Fallback for other types
+		return fmt.Sprintf("%v\n", value)
+	}
+}
@@ -1,17 +1,16 @@
 package tcpserver
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"ant-cache/cache"
-	"ant-cache/utils"
 )
 
 // ConnectionTask represents a connection handling task for the goroutine pool
@@ -35,6 +34,8 @@ type GoroutinePool struct {
 	completedTasks int64
 	rejectedTasks  int64
 	avgTaskTime    int64 // nanoseconds
+	scaleUps       int64
+	scaleDowns     int64
 
 	// Dynamic scaling
 	lastScaleTime  time.Time
@@ -134,10 +135,11 @@ func (gp *GoroutinePool) handleConnectionTask(task *ConnectionTask) {
 	defer func() {
 		task.conn.Close()
 		atomic.AddUint64(&task.server.activeConnections, ^uint64(0)) // Decrement
+		task.server.handlers.Done()
 	}()
 
 	// Set connection options for better performance
-	if tcpConn, ok := task.conn.(*net.TCPConn); ok {
+	if tcpConn := tcpConn(task.conn); tcpConn != nil {
 		tcpConn.SetNoDelay(true)
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
@@ -152,40 +154,16 @@ func (gp *GoroutinePool) handleConnectionTask(task *ConnectionTask) {
 
 // handleTextConnectionTask handles text protocol connection task
 func (gp *GoroutinePool) handleTextConnectionTask(task *ConnectionTask) {
-	scanner := bufio.NewScanner(task.conn)
-	authenticated := false
-
-	// Use larger buffer for better performance
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024) // 1MB max token size
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
-
-		atomic.AddUint64(&task.server.totalRequests, 1)
-
-		// Reset read deadline
-		task.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-
-		// Process command directly in this pooled goroutine (direct memory access)
-		response := task.server.processCommandDirect(line, &authenticated)
-
-		// Send response
-		_, err := task.conn.Write([]byte(response))
-		if err != nil {
-			fmt.Printf("Failed to write response: %v\n", err)
-			return
-		}
-
-		atomic.AddUint64(&task.server.totalResponses, 1)
-	}
-
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("Connection read error: %v\n", err)
+	sess, err := newSession(task.server.cache, task.conn, task.server.tls)
+	if err != nil {
+		serverLog.Warn("Connection error", "client", task.conn.RemoteAddr().String(), "error", err)
+		return
 	}
+	sess.server = task.server
+	serveConnection(task.conn, sess, func(line string) string {
+		// Process command directly in this pooled goroutine (direct memory access)
+		return processCommand(task.server.cache, line, sess)
+	}, &task.server.totalRequests, &task.server.totalResponses)
 }
 
 // SubmitTask submits a connection task to the pool with dynamic scaling
@@ -249,7 +227,8 @@ func (gp *GoroutinePool) scaleUp() {
 	}
 
 	gp.workerCount += newWorkers
-	fmt.Printf("Scaled up pool to %d workers\n", gp.workerCount)
+	atomic.AddInt64(&gp.scaleUps, 1)
+	serverLog.Info("Scaled up pool", "workers", gp.workerCount)
 }
 
 // scaleDown removes workers from the pool
@@ -269,7 +248,8 @@ func (gp *GoroutinePool) scaleDown() {
 	}
 
 	gp.workerCount -= removeWorkers
-	fmt.Printf("Scaled down pool to %d workers\n", gp.workerCount)
+	atomic.AddInt64(&gp.scaleDowns, 1)
+	serverLog.Info("Scaled down pool", "workers", gp.workerCount)
 }
 
 func min(a, b int) int {
@@ -296,6 +276,8 @@ func (gp *GoroutinePool) GetPoolStats() map[string]interface{} {
 		"rejected_tasks":   atomic.LoadInt64(&gp.rejectedTasks),
 		"avg_task_time_ns": atomic.LoadInt64(&gp.avgTaskTime),
 		"avg_task_time_ms": float64(atomic.LoadInt64(&gp.avgTaskTime)) / 1e6,
+		"scale_ups":        atomic.LoadInt64(&gp.scaleUps),
+		"scale_downs":      atomic.LoadInt64(&gp.scaleDowns),
 	}
 }
 
@@ -317,11 +299,25 @@ func (gp *GoroutinePool) GetStats() map[string]interface{} {
 // PooledGoroutineServer implements single-threaded listener with pooled goroutine processing
 // Pooled goroutines directly operate on cache memory
 type PooledGoroutineServer struct {
-	cache    *cache.Cache
+	cache *cache.Cache
+	pool  *GoroutinePool
+
+	// mu guards listener and stopped, Shutdown may run before or during Start
+	mu       sync.Mutex
 	listener net.Listener
-	pool     *GoroutinePool
-	running  bool
-	stopChan chan struct{}
+	stopped  bool
+	// acceptDone is closed when the accept loop of Start returns
+	acceptDone chan struct{}
+	// handlers counts the connections queued or being served
+	handlers sync.WaitGroup
+
+	// TLS of the listener, nil for plain TCP
+	tls *TLSManager
+	// config is changed by CONFIG, nil without a configuration file
+	config *RuntimeConfig
+
+	// Live connections, for CLIENT LIST and KILL
+	registry *clientRegistry
 
 	// Statistics
 	totalConnections  uint64
@@ -334,33 +330,52 @@ type PooledGoroutineServer struct {
 // NewPooledGoroutineServer creates a new pooled goroutine server
 func NewPooledGoroutineServer(cache *cache.Cache, poolSize int) *PooledGoroutineServer {
 	return &PooledGoroutineServer{
-		cache:    cache,
-		pool:     NewGoroutinePool(poolSize),
-		stopChan: make(chan struct{}),
+		cache:      cache,
+		registry:   newClientRegistry(),
+		pool:       NewGoroutinePool(poolSize),
+		acceptDone: make(chan struct{}),
 	}
 }
 
-// Start starts the pooled goroutine server
+// SetTLS makes Start serve TLS connections, it must be called before Start
+func (s *PooledGoroutineServer) SetTLS(m *TLSManager) {
+	s.tls = m
+}
+
+// SetRuntimeConfig enables CONFIG, it must be called before Start
+func (s *PooledGoroutineServer) SetRuntimeConfig(rc *RuntimeConfig) {
+	s.config = rc
+}
+
+// Start starts the pooled goroutine server, it returns nil once Shutdown
+// stopped the listener
 func (s *PooledGoroutineServer) Start(host, port string) error {
-	listener, err := net.Listen("tcp", host+":"+port)
+	listener, err := s.tls.listen(host + ":" + port)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
 	s.listener = listener
-	s.running = true
-
 	// Start the goroutine pool
 	s.pool.Start()
+	s.mu.Unlock()
+	defer close(s.acceptDone)
 
-	fmt.Printf("Pooled-goroutine server started on %s:%s with %d workers\n", host, port, s.pool.workerCount)
+	serverLog.Info("Pooled-goroutine server started", "address", host+":"+port, "workers", s.pool.workerCount, "tls", s.tls != nil)
 
 	// Single-threaded accept loop
-	for s.running {
-		conn, err := s.listener.Accept()
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			if s.running {
-				fmt.Printf("Accept error: %v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
 			}
+			serverLog.Error("Accept error", "error", err)
 			continue
 		}
 
@@ -373,265 +388,94 @@ func (s *PooledGoroutineServer) Start(host, port string) error {
 			server: s,
 		}
 
+		s.handlers.Add(1)
 		if !s.pool.SubmitTask(task) {
 			// Pool is full, reject the connection
 			atomic.AddUint64(&s.rejectedTasks, 1)
 			atomic.AddUint64(&s.activeConnections, ^uint64(0)) // Decrement
+			s.handlers.Done()
 			conn.Close()
-			fmt.Printf("Connection rejected: pool is full\n")
+			serverLog.Warn("Connection rejected, the pool is full", "client", conn.RemoteAddr().String())
 		}
 	}
-
-	return nil
 }
 
-// processCommandDirect processes command with direct cache memory access (same as single goroutine)
-func (s *PooledGoroutineServer) processCommandDirect(command string, authenticated *bool) string {
-	parts := utils.ParseCommandWithQuotes(command)
-	if len(parts) < 1 {
-		return "ERROR invalid command format\n"
-	}
-
-	cmd := strings.ToUpper(parts[0])
-
-	// Handle AUTH command
-	if cmd == "AUTH" {
-		return s.handleAuth(parts, authenticated)
-	}
-
-	// Check authentication
-	authManager := s.cache.GetAuthManager()
-	if authManager != nil && authManager.IsEnabled() && !*authenticated {
-		return "ERROR authentication required\n"
-	}
-
-	// Parse TTL
-	ttl, filteredParts, err := s.parseTTLFromParts(parts)
-	if err != nil {
-		return fmt.Sprintf("ERROR %v\n", err)
-	}
-
-	// Direct cache memory operations (no network overhead, no additional task queues)
-	switch cmd {
-	case "SET":
-		if len(filteredParts) < 3 {
-			return "ERROR SET requires key and value\n"
-		}
-		key := filteredParts[1]
-		value := strings.Join(filteredParts[2:], " ")
-
-		// Direct memory operation
-		s.cache.Set(key, value, ttl)
-		return "OK\n"
-
-	case "SETS":
-		// SET String array - simple space-separated values
-		if len(filteredParts) < 3 {
-			return "ERROR SETS requires key and at least one array element\n"
-		}
-		key := filteredParts[1]
-		// All remaining parts become array elements
-		array := filteredParts[2:]
-
-		// Direct memory operation
-		s.cache.Set(key, array, ttl)
-		return "OK\n"
-
-	case "SETX":
-		// SET eXtended object - key-value pairs
-		if len(filteredParts) < 4 {
-			return "ERROR SETX requires key and at least one key-value pair\n"
-		}
-		if (len(filteredParts)-2)%2 != 0 {
-			return "ERROR SETX requires even number of arguments for key-value pairs\n"
-		}
-
-		key := filteredParts[1]
-		// Convert pairs to map: a b c d -> {a: b, c: d}
-		object := make(map[string]string)
-		for i := 2; i < len(filteredParts); i += 2 {
-			object[filteredParts[i]] = filteredParts[i+1]
-		}
-
-		// Direct memory operation
-		s.cache.Set(key, object, ttl)
-		return "OK\n"
-
-	case "SETNX":
-		if len(filteredParts) < 3 {
-			return "ERROR SETNX requires key and value\n"
-		}
-		key := filteredParts[1]
-		value := strings.Join(filteredParts[2:], " ")
-
-		// Direct memory operation
-		ok := s.cache.SetNX(key, value, ttl)
-		if ok {
-			return "OK\n"
-		}
-		return "NOT_SET\n"
-
-	case "SETSNX":
-		if len(filteredParts) < 3 {
-			return "ERROR SETSNX requires key and at least one array element\n"
-		}
-		key := filteredParts[1]
-		array := filteredParts[2:]
-
-		// Direct memory operation
-		ok := s.cache.SetNX(key, array, ttl)
-		if ok {
-			return "OK\n"
-		}
-		return "NOT_SET\n"
-
-	case "SETXNX":
-		if len(filteredParts) < 4 {
-			return "ERROR SETXNX requires key and at least one key-value pair\n"
-		}
-		if (len(filteredParts)-2)%2 != 0 {
-			return "ERROR SETXNX requires even number of arguments for key-value pairs\n"
-		}
-
-		key := filteredParts[1]
-		object := make(map[string]string)
-		for i := 2; i < len(filteredParts); i += 2 {
-			object[filteredParts[i]] = filteredParts[i+1]
-		}
-
-		// Direct memory operation
-		ok := s.cache.SetNX(key, object, ttl)
-		if ok {
-			return "OK\n"
-		}
-		return "NOT_SET\n"
-
-	case "GET":
-		if len(filteredParts) < 2 {
-			return "ERROR GET requires key\n"
-		}
-		key := filteredParts[1]
-
-		// Direct memory operation
-		value, exists := s.cache.Get(key)
-		if !exists {
-			return "NULL\n"
-		}
-
-		// Format output based on data type
-		switch v := value.(type) {
-		case string:
-			// String: return as-is
-			return fmt.Sprintf("%s\n", v)
-		case []string:
-			// Array: return as space-separated values in brackets
-			return fmt.Sprintf("[%s]\n", strings.Join(v, " "))
-		case map[string]string:
-			// Object: return as JSON string
-			jsonBytes, err := json.Marshal(v)
-			if err != nil {
-				return fmt.Sprintf("ERROR serializing object: %v\n", err)
-			}
-			return fmt.Sprintf("%s\n", string(jsonBytes))
-		default:
-			// Fallback for other types
-			return fmt.Sprintf("%v\n", value)
-		}
-
-	case "DEL":
-		if len(filteredParts) < 2 {
-			return "ERROR DEL requires key\n"
-		}
-		key := filteredParts[1]
-
-		// Direct memory operation
-		deleted := s.cache.Delete(key)
-		if deleted {
-			return "OK\n"
-		}
-		return "NOT_FOUND\n"
-
-	case "KEYS":
-		pattern := "*"
-		if len(filteredParts) > 1 {
-			pattern = filteredParts[1]
-		}
-
-		// Direct memory operation
-		keys := s.cache.Keys(pattern)
-		if len(keys) == 0 {
-			return "EMPTY\n"
-		}
-		return strings.Join(keys, " ") + "\n"
-
-	case "FLUSHALL":
-		// Direct memory operation
-		s.cache.FlushAll()
-		return "OK\n"
-
-	default:
-		return "ERROR unknown command\n"
-	}
+// Shutdown stops accepting connections, then closes each connection once its
+// command in flight is answered and stops the pool. The connections still
+// open when ctx ends are closed and ctx.Err() is returned.
+func (s *PooledGoroutineServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	listener := s.listener
+	s.mu.Unlock()
+
+	if listener == nil {
+		// Start did not run, nor the pool
+		return nil
+	}
+	listener.Close()
+	<-s.acceptDone
+
+	// The queued connections are served by the pool and close at once
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	err := drainConnections(ctx, s.registry, done)
+	s.pool.Stop()
+	return err
 }
 
-// handleAuth handles authentication (same as single goroutine)
-func (s *PooledGoroutineServer) handleAuth(parts []string, authenticated *bool) string {
-	if len(parts) != 2 {
-		return "ERROR AUTH requires password\n"
-	}
-
-	password := parts[1]
-	authManager := s.cache.GetAuthManager()
-
-	if authManager != nil && authManager.IsEnabled() {
-		valid, err := authManager.VerifyPassword(password)
-		if err != nil {
-			return fmt.Sprintf("ERROR authentication error: %v\n", err)
-		} else if valid {
-			*authenticated = true
-			return "OK authenticated\n"
-		} else {
-			return "ERROR invalid password\n"
-		}
-	} else {
-		*authenticated = true
-		return "OK no authentication required\n"
-	}
+// Stop stops the server, waiting up to DefaultShutdownTimeout for the
+// commands in flight
+func (s *PooledGoroutineServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	s.Shutdown(ctx)
 }
 
-// parseTTLFromParts parses TTL from command parts (same as single goroutine)
-func (s *PooledGoroutineServer) parseTTLFromParts(parts []string) (time.Duration, []string, error) {
-	cmd := strings.ToUpper(parts[0])
-	ttl := time.Duration(0)
-
-	// Commands that don't support TTL
-	if cmd == "DEL" || cmd == "GET" || cmd == "KEYS" || cmd == "FLUSHALL" {
-		return ttl, parts, nil
-	}
+// MetricsHandler returns the handler serving the metrics of the server, its
+// pool and its cache on /metrics, in the Prometheus text format
+func (s *PooledGoroutineServer) MetricsHandler() http.Handler {
+	return metricsHandler(func(w *metricsWriter) {
+		writeConnectionMetrics(w, &s.totalConnections, &s.activeConnections, &s.totalRequests, &s.totalResponses)
+		w.single("ant_cache_connections_rejected_total", "counter", "Connections rejected because the pool was full.", float64(atomic.LoadUint64(&s.rejectedTasks)))
+
+		gp := s.pool
+		gp.mu.RLock()
+		workers := gp.workerCount
+		gp.mu.RUnlock()
+		w.single("ant_cache_pool_workers", "gauge", "Workers of the pool.", float64(workers))
+		w.single("ant_cache_pool_active_workers", "gauge", "Workers serving a connection.", float64(atomic.LoadInt64(&gp.activeWorkers)))
+		w.single("ant_cache_pool_queue_length", "gauge", "Connections waiting for a worker.", float64(len(gp.taskChan)))
+		w.single("ant_cache_pool_tasks_total", "counter", "Connections submitted to the pool.", float64(atomic.LoadInt64(&gp.totalTasks)))
+		w.single("ant_cache_pool_avg_task_seconds", "gauge", "Average time a worker serves a connection.", float64(atomic.LoadInt64(&gp.avgTaskTime))/1e9)
+		w.metric("ant_cache_pool_scale_events_total", "counter", "Pool resizes by direction.")
+		w.sample("ant_cache_pool_scale_events_total", float64(atomic.LoadInt64(&gp.scaleUps)), "direction", "up")
+		w.sample("ant_cache_pool_scale_events_total", float64(atomic.LoadInt64(&gp.scaleDowns)), "direction", "down")
+
+		writeCacheMetrics(w, s.cache)
+	})
+}
 
-	// Handle TTL parameter: COMMAND key -t TTL_VALUE [other_params...]
-	if len(parts) >= 4 && parts[2] == "-t" {
-		ttlValue, err := utils.ParseTTL(parts[3])
-		if err != nil {
-			return 0, nil, fmt.Errorf("invalid ttl value: %v", err)
-		}
-		ttl = ttlValue
-		// Remove -t and TTL value
-		filteredParts := append([]string{parts[0], parts[1]}, parts[4:]...)
-		return ttl, filteredParts, nil
-	}
+// poolStats returns the statistics of the goroutine pool
+func (s *PooledGoroutineServer) poolStats() map[string]interface{} {
+	return s.pool.GetPoolStats()
+}
 
-	return ttl, parts, nil
+// clients returns the live connections of the server
+func (s *PooledGoroutineServer) clients() *clientRegistry {
+	return s.registry
 }
 
-// Stop stops the server
-func (s *PooledGoroutineServer) Stop() {
-	s.running = false
-	if s.listener != nil {
-		s.listener.Close()
-	}
-	s.pool.Stop()
-	close(s.stopChan)
+// runtimeConfig returns the configuration changed by CONFIG
+func (s *PooledGoroutineServer) runtimeConfig() *RuntimeConfig {
+	return s.config
 }
 
 // GetStats returns server statistics
@@ -0,0 +1,120 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"ant-cache/cache"
+	"ant-cache/utils"
+)
+
+// handleRateLimitCommand executes the rate limiter commands, shared by both servers.
+// Every command replies "<allowed 1|0> <remaining> <retry_after_ms>".
+func handleRateLimitCommand(c *cache.Cache, cmd string, parts []string) string {
+	var result cache.RateLimitResult
+
+	switch cmd {
+	case "RL.TOKENBUCKET":
+		// RL.TOKENBUCKET key capacity refill_rate [cost]
+		if len(parts) != 4 && len(parts) != 5 {
+			return "ERROR RL.TOKENBUCKET requires key, capacity, refill_rate and optional cost\n"
+		}
+		capacity, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return "ERROR capacity must be an integer\n"
+		}
+		refillRate, err := strconv.ParseFloat(parts[3], 64)
+		if err != nil {
+			return "ERROR refill_rate must be a number\n"
+		}
+		cost, errMsg := parseRateLimitCost(parts, 4)
+		if errMsg != "" {
+			return errMsg
+		}
+		result, err = c.TokenBucket(parts[1], capacity, refillRate, cost)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+
+	case "RL.SLIDINGWINDOW":
+		// RL.SLIDINGWINDOW key limit window [cost]
+		if len(parts) != 4 && len(parts) != 5 {
+			return "ERROR RL.SLIDINGWINDOW requires key, limit, window and optional cost\n"
+		}
+		limit, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return "ERROR limit must be an integer\n"
+		}
+		window, errMsg := parseRateLimitPeriod(parts[3])
+		if errMsg != "" {
+			return errMsg
+		}
+		cost, errMsg := parseRateLimitCost(parts, 4)
+		if errMsg != "" {
+			return errMsg
+		}
+		result, err = c.SlidingWindow(parts[1], limit, window, cost)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+
+	case "RL.GCRA":
+		// RL.GCRA key burst rate period [cost]
+		if len(parts) != 5 && len(parts) != 6 {
+			return "ERROR RL.GCRA requires key, burst, rate, period and optional cost\n"
+		}
+		burst, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return "ERROR burst must be an integer\n"
+		}
+		rate, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return "ERROR rate must be an integer\n"
+		}
+		period, errMsg := parseRateLimitPeriod(parts[4])
+		if errMsg != "" {
+			return errMsg
+		}
+		cost, errMsg := parseRateLimitCost(parts, 5)
+		if errMsg != "" {
+			return errMsg
+		}
+		result, err = c.GCRA(parts[1], burst, rate, period, cost)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+
+	default:
+		return "ERROR unknown command\n"
+	}
+
+	allowed := 0
+	if result.Allowed {
+		allowed = 1
+	}
+	// Round the wait up so that retrying after it is never too early
+	retryAfter := (result.RetryAfter + time.Millisecond - 1) / time.Millisecond
+	return fmt.Sprintf("%d %d %d\n", allowed, result.Remaining, retryAfter)
+}
+
+// parseRateLimitCost returns the optional cost at parts[i], 1 if it is missing
+func parseRateLimitCost(parts []string, i int) (int64, string) {
+	if len(parts) <= i {
+		return 1, ""
+	}
+	cost, err := strconv.ParseInt(parts[i], 10, 64)
+	if err != nil {
+		return 0, "ERROR cost must be an integer\n"
+	}
+	return cost, ""
+}
+
+// parseRateLimitPeriod parses a window or period, in seconds or with a unit like the TTLs
+func parseRateLimitPeriod(s string) (time.Duration, string) {
+	period, err := utils.ParseTTL(s)
+	if err != nil {
+		return 0, fmt.Sprintf("ERROR invalid period value: %v\n", err)
+	}
+	return period, ""
+}
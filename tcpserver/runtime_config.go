@@ -0,0 +1,305 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+	"ant-cache/config"
+	"ant-cache/logging"
+	"ant-cache/utils"
+)
+
+// RuntimeConfig is the configuration of a running server, read and changed by
+// CONFIG GET, SET and REWRITE, and loaded again by Reload. Parameters are
+// named by their path in the JSON file, as slowlog.max_len.
+type RuntimeConfig struct {
+	mu    sync.Mutex
+	path  string
+	flags map[string]string
+	// cfg is the configuration in effect, except the parameters requiring a
+	// restart, which are in effect as in started
+	cfg     *config.Config
+	started config.Config
+	cache   *cache.Cache
+}
+
+// NewRuntimeConfig returns the runtime configuration of c, cfg being loaded
+// by config.Load from the file path and the flags
+func NewRuntimeConfig(path string, flags map[string]string, cfg *config.Config, c *cache.Cache) *RuntimeConfig {
+	current := *cfg
+	return &RuntimeConfig{path: path, flags: flags, cfg: &current, started: *cfg, cache: c}
+}
+
+// Config returns a copy of the current configuration
+func (rc *RuntimeConfig) Config() config.Config {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return *rc.cfg
+}
+
+// ConfigReload reports the parameters changed by Reload
+type ConfigReload struct {
+	// Applied lists the parameters applied at once
+	Applied []string
+	// Restart lists the parameters whose new value is used after a restart
+	Restart []string
+}
+
+// Reload loads the configuration again, from its file, the environment and
+// the flags, and applies the parameters that changed. Nothing is applied if
+// the configuration is invalid or a change fails.
+func (rc *RuntimeConfig) Reload() (ConfigReload, error) {
+	var report ConfigReload
+	next, err := config.Load(rc.path, rc.flags)
+	if err != nil {
+		return report, fmt.Errorf("failed to load %s: %v", rc.path, err)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, s := range next.Settings() {
+		if _, ok := runtimeParams[s.Path]; !ok {
+			if rc.started.Value(s.Path) != s.Value {
+				report.Restart = append(report.Restart, s.Path)
+			}
+		} else if rc.cfg.Value(s.Path) != s.Value {
+			report.Applied = append(report.Applied, s.Path)
+		}
+	}
+	if err := rc.apply(rc.cfg, next, report.Applied); err != nil {
+		return ConfigReload{}, err
+	}
+	rc.cfg = next
+	return report, nil
+}
+
+// get returns the parameters matching the glob pattern with their values,
+// sorted by name. Passwords are redacted.
+func (rc *RuntimeConfig) get(pattern string) []config.Setting {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var settings []config.Setting
+	for _, s := range rc.cfg.Settings() {
+		if !utils.MatchPattern(strings.ToLower(pattern), s.Path) {
+			continue
+		}
+		if s.Path == "auth.password" && s.Value != "" {
+			s.Value = "(redacted)"
+		}
+		settings = append(settings, s)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Path < settings[j].Path })
+	return settings
+}
+
+// set changes the parameter name to value and applies it
+func (rc *RuntimeConfig) set(name, value string) error {
+	name = strings.ToLower(name)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if name == "auth.password" {
+		if rc.cfg.Auth.PasswordFile != "" || rc.cfg.Auth.PasswordEnv != "" {
+			return errors.New("auth.password is not used while auth.password_file or auth.password_env is set")
+		}
+		// A plain text password is stored as its credential, so that
+		// CONFIG REWRITE does not write it to the file
+		if value != "" && !auth.IsCredential(value) {
+			credential, err := auth.NewCredential(value)
+			if err != nil {
+				return err
+			}
+			value = credential.String()
+		}
+	}
+
+	next := *rc.cfg
+	if err := next.Set(name, value, config.SourceConfigSet); err != nil {
+		return err
+	}
+	if _, ok := runtimeParams[name]; !ok {
+		return fmt.Errorf("%s can not be changed at runtime, change it in %s and restart", name, rc.path)
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	if err := rc.apply(rc.cfg, &next, []string{name}); err != nil {
+		return err
+	}
+	rc.cfg = &next
+	serverLog.Info("Configuration changed", "parameter", name)
+	return nil
+}
+
+// rewrite saves the parameters changed by CONFIG SET to the configuration file
+func (rc *RuntimeConfig) rewrite() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if err := rc.cfg.SaveConfig(rc.path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", rc.path, err)
+	}
+	return nil
+}
+
+// apply makes the server use next for the sections of the changed
+// parameters, once per section. If a section fails, the sections already
+// applied are applied again from current.
+func (rc *RuntimeConfig) apply(current, next *config.Config, changed []string) error {
+	var applied []applyFunc
+	sections := make(map[string]bool)
+	for _, name := range changed {
+		section, _, _ := strings.Cut(name, ".")
+		if sections[section] {
+			continue
+		}
+		sections[section] = true
+		apply := runtimeParams[name]
+		if err := apply(rc, next); err != nil {
+			for _, done := range applied {
+				done(rc, current)
+			}
+			return fmt.Errorf("failed to apply %s: %v", section, err)
+		}
+		applied = append(applied, apply)
+	}
+	return nil
+}
+
+// applyFunc makes the server use the section of a parameter in cfg
+type applyFunc func(rc *RuntimeConfig, cfg *config.Config) error
+
+// runtimeParams are the parameters applied at runtime, with their applyFunc.
+// The others are only used at startup.
+var runtimeParams = map[string]applyFunc{
+	"server.shutdown_timeout": applyOnUse,
+
+	"auth.password":      applyAuth,
+	"auth.password_env":  applyAuth,
+	"auth.password_file": applyAuth,
+
+	"persistence.atd_interval": applyPersistence,
+	"persistence.acl_interval": applyPersistence,
+
+	"compression.enabled":      applyCompression,
+	"compression.min_size":     applyCompression,
+	"compression.strings_only": applyCompression,
+
+	"slowlog.threshold": applySlowlog,
+	"slowlog.max_len":   applySlowlog,
+
+	"logging.level":       applyLogging,
+	"logging.format":      applyLogging,
+	"logging.file":        applyLogging,
+	"logging.max_size_mb": applyLogging,
+	"logging.max_backups": applyLogging,
+	"logging.subsystems":  applyLogging,
+}
+
+// applyOnUse applies the parameters read from Config when they are used
+func applyOnUse(*RuntimeConfig, *config.Config) error {
+	return nil
+}
+
+// applyAuth sets the password of the default user. Authentication can not be
+// enabled or disabled at runtime.
+func applyAuth(rc *RuntimeConfig, cfg *config.Config) error {
+	secret, err := cfg.AuthSecret()
+	if err != nil {
+		return err
+	}
+	authManager := rc.cache.GetAuthManager()
+	enabled := authManager != nil && authManager.IsEnabled()
+	switch {
+	case secret == "" && enabled:
+		return errors.New("disabling authentication requires a restart")
+	case secret != "" && !enabled:
+		return errors.New("enabling authentication requires a restart")
+	case secret == "":
+		return nil
+	}
+	return authManager.SetSecret(secret)
+}
+
+func applyPersistence(rc *RuntimeConfig, cfg *config.Config) error {
+	if !rc.cache.SetPersistenceIntervals(cfg.GetAtdInterval(), cfg.GetAclInterval()) {
+		return errors.New("persistence is disabled")
+	}
+	return nil
+}
+
+func applyCompression(rc *RuntimeConfig, cfg *config.Config) error {
+	rc.cache.SetCompressionConfig(cache.CompressionConfig{
+		Enabled:     cfg.Compression.Enabled,
+		MinSize:     cfg.Compression.MinSize,
+		StringsOnly: cfg.Compression.StringsOnly,
+	})
+	return nil
+}
+
+func applySlowlog(_ *RuntimeConfig, cfg *config.Config) error {
+	SetSlowLog(cfg.GetSlowlogThreshold(), cfg.Slowlog.MaxLen)
+	return nil
+}
+
+func applyLogging(_ *RuntimeConfig, cfg *config.Config) error {
+	return logging.Setup(cfg.LoggingOptions())
+}
+
+// handleConfigCommand handles CONFIG GET pattern, CONFIG SET parameter value
+// and CONFIG REWRITE
+func handleConfigCommand(parts []string, sess *session, user *auth.User) string {
+	if errMsg := checkPermission(user, "CONFIG", parts); errMsg != "" {
+		return errMsg
+	}
+	if len(parts) < 2 {
+		return "ERROR CONFIG requires a subcommand: GET, SET or REWRITE\n"
+	}
+	var rc *RuntimeConfig
+	if sess.server != nil {
+		rc = sess.server.runtimeConfig()
+	}
+	if rc == nil {
+		return "ERROR CONFIG is not available without a configuration file\n"
+	}
+
+	switch strings.ToUpper(parts[1]) {
+	case "GET":
+		if len(parts) != 3 {
+			return "ERROR CONFIG GET requires a pattern\n"
+		}
+		settings := rc.get(parts[2])
+		if len(settings) == 0 {
+			return "EMPTY\n"
+		}
+		var sb strings.Builder
+		for _, s := range settings {
+			sb.WriteString(s.Path + " " + quoteReplyField(s.Value) + "\n")
+		}
+		return sb.String()
+
+	case "SET":
+		if len(parts) != 4 {
+			return "ERROR CONFIG SET requires a parameter and a value\n"
+		}
+		if err := rc.set(parts[2], parts[3]); err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return "OK\n"
+
+	case "REWRITE":
+		if len(parts) != 2 {
+			return "ERROR CONFIG REWRITE takes no arguments\n"
+		}
+		if err := rc.rewrite(); err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return "OK\n"
+
+	default:
+		return fmt.Sprintf("ERROR unknown CONFIG subcommand %s\n", parts[1])
+	}
+}
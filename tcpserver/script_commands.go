@@ -0,0 +1,46 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+	"ant-cache/script"
+)
+
+// handleEvalCommand runs a script atomically: every command it calls runs under
+// one cache lock, and the resulting writes are logged to the ACL as one batch.
+// The commands called are checked against the permissions of user.
+func handleEvalCommand(c *cache.Cache, parts []string, user *auth.User) string {
+	// EVAL script numkeys [key ...] [arg ...]
+	if len(parts) < 3 {
+		return "ERROR EVAL requires script and numkeys\n"
+	}
+	numKeys, err := strconv.Atoi(parts[2])
+	if err != nil || numKeys < 0 || numKeys > len(parts)-3 {
+		return "ERROR numkeys must be between 0 and the number of arguments\n"
+	}
+	keys := parts[3 : 3+numKeys]
+	argv := parts[3+numKeys:]
+
+	s, err := script.Compile(parts[1])
+	if err != nil {
+		return fmt.Sprintf("ERROR script: %v\n", err)
+	}
+
+	var result interface{}
+	c.Atomic(func(tx *cache.Cache) {
+		result, err = s.Run(keys, argv, func(args []string) string {
+			if strings.ToUpper(args[0]) == "EVAL" {
+				return "ERROR EVAL can not be called from a script\n"
+			}
+			return executeCommand(tx, args, nil, user)
+		}, script.DefaultLimits)
+	})
+	if err != nil {
+		return fmt.Sprintf("ERROR script: %v\n", err)
+	}
+	return script.Format(result)
+}
@@ -0,0 +1,337 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+	"ant-cache/utils"
+)
+
+// maxBatchCommands bounds the number of commands queued by one BATCH block
+const maxBatchCommands = 10000
+
+// batchEnds maps the commands ending a block to the command starting it.
+// MULTI/EXEC behave like BATCH/END.
+var batchEnds = map[string]string{
+	"END":  "BATCH",
+	"EXEC": "MULTI",
+}
+
+// session holds the per-connection protocol state
+type session struct {
+	authenticated bool
+	// User authenticated with AUTH username password, empty for the default user
+	user string
+	// Failed AUTH attempts of the connection, each one refuses AUTH longer.
+	// AUTH is refused without checking the password until authRetryAt.
+	authFailures int
+	authRetryAt  time.Time
+
+	// Commands queued between BATCH and END, or MULTI and EXEC
+	inBatch    bool
+	batchStart string
+	batch      [][]string
+
+	// Versions of the keys watched by WATCH, checked when the block runs
+	watched map[string]uint64
+
+	// Connection of the session, set by serveConnection
+	client *clientConn
+
+	// Database selected with SELECT, nil until then for database 0
+	db *cache.Cache
+
+	// Server of the connection, described by INFO and CLIENT LIST
+	server sessionServer
+
+	// Set by MONITOR, the connection then streams the commands of the others
+	monitor *monitor
+}
+
+// processCommand processes one command line of a connection, shared by both servers
+func processCommand(c *cache.Cache, command string, sess *session) string {
+	parts := utils.ParseCommandWithQuotes(command)
+	if len(parts) < 1 {
+		return "ERROR invalid command format\n"
+	}
+
+	cmd := strings.ToUpper(parts[0])
+	start, db := time.Now(), sess.dbIndex()
+	defer func() {
+		elapsed := time.Since(start)
+		commandMetrics.record(cmd, elapsed)
+		// The slow log leaves out the time blocking commands waited
+		commandSlowLog.record(parts, elapsed-sess.client.takeWaited(), sess.remoteAddr())
+		sess.client.update(c, cmd, sess)
+		if sess.monitor == nil {
+			commandMonitors.publish(parts, db, sess.remoteAddr())
+		}
+	}()
+
+	// Handle AUTH command
+	if cmd == "AUTH" {
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR AUTH is not allowed inside %s\n", sess.batchStart)
+		}
+		return handleAuth(c, parts, sess)
+	}
+
+	// Check authentication
+	authManager := c.GetAuthManager()
+	if authManager != nil && authManager.IsEnabled() && !sess.authenticated {
+		return "ERROR authentication required\n"
+	}
+
+	// Permissions are looked up on every command, so ACL changes apply at once
+	user, ok := sess.currentUser(authManager)
+	if !ok {
+		sess.authenticated = false
+		sess.user = ""
+		return "ERROR user was deleted or disabled, authenticate again\n"
+	}
+
+	// Commands run against the selected database
+	if sess.db != nil {
+		c = sess.db
+	}
+
+	switch cmd {
+	case "SELECT":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR SELECT is not allowed inside %s\n", sess.batchStart)
+		}
+		if len(parts) != 2 {
+			return "ERROR SELECT requires a database index\n"
+		}
+		index, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return "ERROR database index must be an integer\n"
+		}
+		db, err := c.Select(index)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		sess.db = db
+		// Watched versions belong to the previous database
+		sess.watched = nil
+		return "OK\n"
+
+	case "BATCH", "MULTI":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR %s calls can not be nested\n", cmd)
+		}
+		sess.inBatch = true
+		sess.batchStart = cmd
+		sess.batch = nil
+		return "OK\n"
+
+	case "END", "EXEC":
+		if !sess.inBatch || sess.batchStart != batchEnds[cmd] {
+			return fmt.Sprintf("ERROR %s without %s\n", cmd, batchEnds[cmd])
+		}
+		return executeBatch(c, sess, user)
+
+	case "DISCARD":
+		if !sess.inBatch {
+			return "ERROR DISCARD without MULTI\n"
+		}
+		sess.inBatch = false
+		sess.batch = nil
+		sess.watched = nil
+		return "OK\n"
+
+	case "ACL":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR ACL is not allowed inside %s\n", sess.batchStart)
+		}
+		return handleACLCommand(authManager, parts, sess, user)
+
+	case "INFO", "STATS":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR %s is not allowed inside %s\n", cmd, sess.batchStart)
+		}
+		return handleInfoCommand(c, cmd, parts, sess, user)
+
+	case "CLIENT":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR CLIENT is not allowed inside %s\n", sess.batchStart)
+		}
+		return handleClientCommand(parts, sess, user)
+
+	case "MONITOR":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR MONITOR is not allowed inside %s\n", sess.batchStart)
+		}
+		if len(parts) != 1 {
+			return "ERROR MONITOR takes no arguments\n"
+		}
+		if errMsg := checkPermission(user, cmd, parts); errMsg != "" {
+			return errMsg
+		}
+		if sess.client == nil {
+			return "ERROR MONITOR requires a client connection\n"
+		}
+		sess.monitor = commandMonitors.subscribe()
+		return "OK\n"
+
+	case "SLOWLOG":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR SLOWLOG is not allowed inside %s\n", sess.batchStart)
+		}
+		return handleSlowLogCommand(parts, user)
+
+	case "CONFIG":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR CONFIG is not allowed inside %s\n", sess.batchStart)
+		}
+		return handleConfigCommand(parts, sess, user)
+
+	case "WATCH":
+		if sess.inBatch {
+			return fmt.Sprintf("ERROR WATCH inside %s is not allowed\n", sess.batchStart)
+		}
+		if len(parts) < 2 {
+			return "ERROR WATCH requires at least one key\n"
+		}
+		if errMsg := checkPermission(user, cmd, parts); errMsg != "" {
+			return errMsg
+		}
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+		}
+		for _, key := range parts[1:] {
+			// Keep the version seen by the first WATCH of a key
+			if _, exists := sess.watched[key]; !exists {
+				sess.watched[key] = c.KeyVersion(key)
+			}
+		}
+		return "OK\n"
+
+	case "UNWATCH":
+		sess.watched = nil
+		return "OK\n"
+	}
+
+	if sess.inBatch {
+		if len(sess.batch) >= maxBatchCommands {
+			return fmt.Sprintf("ERROR %s is limited to %d commands\n", sess.batchStart, maxBatchCommands)
+		}
+		sess.batch = append(sess.batch, parts)
+		return "QUEUED\n"
+	}
+
+	return executeCommand(c, parts, sess.client, user)
+}
+
+// executeBatch runs the queued commands atomically and returns their
+// responses in order. The writes are logged to the ACL as a single batch.
+// Nothing runs and NULL is returned if a watched key changed since WATCH.
+func executeBatch(c *cache.Cache, sess *session, user *auth.User) string {
+	batch, watched := sess.batch, sess.watched
+	sess.inBatch = false
+	sess.batch = nil
+	sess.watched = nil
+
+	var sb strings.Builder
+	aborted := false
+	c.Atomic(func(tx *cache.Cache) {
+		for key, version := range watched {
+			if tx.KeyVersion(key) != version {
+				aborted = true
+				return
+			}
+		}
+		for _, parts := range batch {
+			sb.WriteString(executeCommand(tx, parts, nil, user))
+		}
+	})
+	if aborted {
+		return "NULL\n"
+	}
+	return sb.String()
+}
+
+// handleAuth handles authentication: AUTH password authenticates the default
+// user, AUTH username password a user created with ACL SETUSER
+func handleAuth(c *cache.Cache, parts []string, sess *session) string {
+	if len(parts) != 2 && len(parts) != 3 {
+		return "ERROR AUTH requires [username] password\n"
+	}
+
+	username, password := auth.DefaultUser, parts[len(parts)-1]
+	if len(parts) == 3 {
+		username = parts[1]
+	}
+	authManager := c.GetAuthManager()
+
+	if authManager != nil && authManager.IsEnabled() {
+		// Refused rather than delayed, so that the connection does not hold
+		// its goroutine, a worker of the pooled server
+		if wait := time.Until(sess.authRetryAt); wait > 0 {
+			return fmt.Sprintf("ERROR %v, retry in %v\n", auth.ErrBanned, wait.Round(time.Millisecond))
+		}
+		valid, err := authManager.AuthenticateClient(username, password, sess.remoteAddr())
+		if errors.Is(err, auth.ErrBanned) {
+			return fmt.Sprintf("ERROR %v\n", err)
+		} else if err != nil {
+			return fmt.Sprintf("ERROR authentication error: %v\n", err)
+		} else if valid {
+			sess.authenticated = true
+			sess.authFailures = 0
+			sess.user = ""
+			if username != auth.DefaultUser {
+				sess.user = username
+			}
+			return "OK authenticated\n"
+		}
+
+		sess.authFailures++
+		sess.authRetryAt = time.Now().Add(auth.FailureDelay(sess.authFailures))
+		if len(parts) == 3 {
+			return "ERROR invalid username or password\n"
+		} else {
+			return "ERROR invalid password\n"
+		}
+	} else {
+		sess.authenticated = true
+		return "OK no authentication required\n"
+	}
+}
+
+// currentUser returns the permissions of the session user, nil for the
+// default user. Returns false if the user was deleted or disabled since AUTH.
+func (sess *session) currentUser(authManager *auth.AuthManager) (*auth.User, bool) {
+	if sess.user == "" || authManager == nil {
+		return nil, true
+	}
+	return authManager.GetUser(sess.user)
+}
+
+// remoteAddr returns the address of the client, empty without a connection
+func (sess *session) remoteAddr() string {
+	if sess.client == nil {
+		return ""
+	}
+	return sess.client.conn.RemoteAddr().String()
+}
+
+// dbIndex returns the index of the selected database
+func (sess *session) dbIndex() int {
+	if sess.db == nil {
+		return 0
+	}
+	return sess.db.Index()
+}
+
+// userName returns the name of the session user, as replied by ACL WHOAMI
+func (sess *session) userName() string {
+	if sess.user == "" {
+		return auth.DefaultUser
+	}
+	return sess.user
+}
@@ -0,0 +1,51 @@
+package tcpserver
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestHandleAuthFailureDelay(t *testing.T) {
+	authManager := auth.NewAuthManager(filepath.Join(t.TempDir(), "auth.dat"), true)
+	// A credential of a single iteration, deriving the password takes far
+	// less than the delay even under the race detector
+	salt := []byte("salt")
+	cheap := &auth.Credential{Iterations: 1, Salt: salt, Key: pbkdf2.Key([]byte("secret"), salt, 1, auth.KeyLength, sha256.New)}
+	if err := authManager.SetCredential(cheap); err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewWithPersistenceAndAuth("", "", 0, 0, authManager)
+	sess := &session{}
+
+	// The failure is answered at once, the next attempt must wait
+	start := time.Now()
+	if reply := handleAuth(c, []string{"AUTH", "wrong"}, sess); reply != "ERROR invalid password\n" {
+		t.Fatalf("AUTH wrong = %q", reply)
+	}
+	if elapsed := time.Since(start); elapsed >= auth.FailureDelay(sess.authFailures) {
+		t.Fatalf("failed AUTH took %v, the reply must not wait", elapsed)
+	}
+	if reply := handleAuth(c, []string{"AUTH", "secret"}, sess); !strings.HasPrefix(reply, "ERROR too many failed attempts, retry in ") {
+		t.Fatalf("AUTH during the delay = %q", reply)
+	}
+	if sess.authenticated {
+		t.Fatal("AUTH during the delay authenticated the session")
+	}
+
+	// Once the delay ends, without waiting for it in the test
+	sess.authRetryAt = time.Now()
+	if reply := handleAuth(c, []string{"AUTH", "secret"}, sess); reply != "OK authenticated\n" {
+		t.Fatalf("AUTH after the delay = %q", reply)
+	}
+	if sess.authFailures != 0 {
+		t.Fatalf("authFailures = %d after AUTH succeeded, want 0", sess.authFailures)
+	}
+}
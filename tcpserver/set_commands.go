@@ -0,0 +1,108 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"ant-cache/cache"
+)
+
+// setAlgebraOps maps the set algebra commands to their cache operation
+var setAlgebraOps = map[string]string{
+	"SINTER":      cache.SetInter,
+	"SUNION":      cache.SetUnion,
+	"SDIFF":       cache.SetDiff,
+	"SINTERSTORE": cache.SetInter,
+	"SUNIONSTORE": cache.SetUnion,
+	"SDIFFSTORE":  cache.SetDiff,
+}
+
+// handleSetCommand executes the unordered set commands, shared by both servers
+func handleSetCommand(c *cache.Cache, cmd string, parts []string, ttl time.Duration) string {
+	switch cmd {
+	case "SADD":
+		if len(parts) < 3 {
+			return "ERROR SADD requires key and at least one member\n"
+		}
+		added, err := c.SAdd(parts[1], parts[2:], ttl)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", added)
+
+	case "SREM":
+		if len(parts) < 3 {
+			return "ERROR SREM requires key and at least one member\n"
+		}
+		removed, err := c.SRem(parts[1], parts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", removed)
+
+	case "SISMEMBER":
+		if len(parts) != 3 {
+			return "ERROR SISMEMBER requires key and member\n"
+		}
+		exists, err := c.SIsMember(parts[1], parts[2])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if exists {
+			return "1\n"
+		}
+		return "0\n"
+
+	case "SMEMBERS":
+		if len(parts) != 2 {
+			return "ERROR SMEMBERS requires key\n"
+		}
+		members, err := c.SMembers(parts[1])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return formatMembers(members)
+
+	case "SCARD":
+		if len(parts) != 2 {
+			return "ERROR SCARD requires key\n"
+		}
+		count, err := c.SCard(parts[1])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", count)
+
+	case "SINTER", "SUNION", "SDIFF":
+		if len(parts) < 2 {
+			return fmt.Sprintf("ERROR %s requires at least one key\n", cmd)
+		}
+		members, err := c.SCombine(setAlgebraOps[cmd], parts[1:])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return formatMembers(members)
+
+	case "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+		if len(parts) < 3 {
+			return fmt.Sprintf("ERROR %s requires destination and at least one key\n", cmd)
+		}
+		count, err := c.SCombineStore(setAlgebraOps[cmd], parts[1], parts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", count)
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
+
+// formatMembers formats members as a space-separated line, EMPTY if there are none
+func formatMembers(members []string) string {
+	if len(members) == 0 {
+		return "EMPTY\n"
+	}
+	return strings.Join(members, " ") + "\n"
+}
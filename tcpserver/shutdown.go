@@ -0,0 +1,42 @@
+package tcpserver
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultShutdownTimeout bounds the wait of Stop for the commands in flight
+const DefaultShutdownTimeout = 10 * time.Second
+
+// shutdown makes the connection close once the command in flight, if any, is
+// answered. An idle connection closes at once.
+func (cc *clientConn) shutdown() {
+	cc.closing.Store(true)
+	// Interrupt the read of an idle connection, serveConnection checks
+	// closing again after setting its own deadline
+	cc.conn.SetReadDeadline(time.Now())
+}
+
+// drainConnections shuts down the connections of registry and waits until
+// done is closed, once every connection handler returned. The connections
+// still open when ctx ends are closed, interrupting their commands, and
+// ctx.Err() is returned.
+func drainConnections(ctx context.Context, registry *clientRegistry, done <-chan struct{}) error {
+	for _, cc := range registry.shutdown() {
+		cc.shutdown()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	clients := registry.list()
+	serverLog.Warn("Shutdown deadline reached, closing the remaining connections", "connections", len(clients))
+	for _, cc := range clients {
+		cc.kill(false)
+	}
+	<-done
+	return ctx.Err()
+}
@@ -1,25 +1,39 @@
 package tcpserver
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"ant-cache/cache"
-	"ant-cache/utils"
 )
 
 // SingleGoroutineServer implements single-threaded listener with one goroutine per connection
 // Each connection gets its own goroutine that directly operates on cache memory
 type SingleGoroutineServer struct {
-	cache    *cache.Cache
+	cache *cache.Cache
+
+	// mu guards listener and stopped, Shutdown may run before or during Start
+	mu       sync.Mutex
 	listener net.Listener
-	running  bool
-	stopChan chan struct{}
+	stopped  bool
+	// acceptDone is closed when the accept loop of Start returns
+	acceptDone chan struct{}
+	// handlers counts the connections being served
+	handlers sync.WaitGroup
+
+	// TLS of the listener, nil for plain TCP
+	tls *TLSManager
+	// config is changed by CONFIG, nil without a configuration file
+	config *RuntimeConfig
+
+	// Live connections, for CLIENT LIST and KILL
+	registry *clientRegistry
 
 	// Statistics
 	totalConnections  uint64
@@ -31,29 +45,49 @@ type SingleGoroutineServer struct {
 // NewSingleGoroutineServer creates a new single goroutine server
 func NewSingleGoroutineServer(cache *cache.Cache) *SingleGoroutineServer {
 	return &SingleGoroutineServer{
-		cache:    cache,
-		stopChan: make(chan struct{}),
+		cache:      cache,
+		registry:   newClientRegistry(),
+		acceptDone: make(chan struct{}),
 	}
 }
 
-// Start starts the single goroutine server
+// SetTLS makes Start serve TLS connections, it must be called before Start
+func (s *SingleGoroutineServer) SetTLS(m *TLSManager) {
+	s.tls = m
+}
+
+// SetRuntimeConfig enables CONFIG, it must be called before Start
+func (s *SingleGoroutineServer) SetRuntimeConfig(rc *RuntimeConfig) {
+	s.config = rc
+}
+
+// Start starts the single goroutine server, it returns nil once Shutdown
+// stopped the listener
 func (s *SingleGoroutineServer) Start(host, port string) error {
-	listener, err := net.Listen("tcp", host+":"+port)
+	listener, err := s.tls.listen(host + ":" + port)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
 	s.listener = listener
-	s.running = true
+	s.mu.Unlock()
+	defer close(s.acceptDone)
 
-	fmt.Printf("Single-goroutine server started on %s:%s\n", host, port)
+	serverLog.Info("Single-goroutine server started", "address", host+":"+port, "tls", s.tls != nil)
 
 	// Single-threaded accept loop
-	for s.running {
-		conn, err := s.listener.Accept()
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			if s.running {
-				fmt.Printf("Accept error: %v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
 			}
+			serverLog.Error("Accept error", "error", err)
 			continue
 		}
 
@@ -62,10 +96,12 @@ func (s *SingleGoroutineServer) Start(host, port string) error {
 
 		// Create a new goroutine for each connection
 		// This goroutine directly operates on cache memory
-		go s.handleConnection(conn)
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handleConnection(conn)
+		}()
 	}
-
-	return nil
 }
 
 // handleConnection handles a single connection with direct cache memory operations
@@ -76,7 +112,7 @@ func (s *SingleGoroutineServer) handleConnection(conn net.Conn) {
 	}()
 
 	// Set connection options for better performance
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
+	if tcpConn := tcpConn(conn); tcpConn != nil {
 		tcpConn.SetNoDelay(true)
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
@@ -91,288 +127,74 @@ func (s *SingleGoroutineServer) handleConnection(conn net.Conn) {
 
 // handleTextConnection handles text protocol connection
 func (s *SingleGoroutineServer) handleTextConnection(conn net.Conn) {
-	scanner := bufio.NewScanner(conn)
-	authenticated := false
-
-	// Use larger buffer for better performance
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024) // 1MB max token size
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
-
-		atomic.AddUint64(&s.totalRequests, 1)
-
-		// Reset read deadline
-		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-
-		// Process command directly in this goroutine (direct memory access)
-		response := s.processCommandDirect(line, &authenticated)
-
-		// Send response
-		_, err := conn.Write([]byte(response))
-		if err != nil {
-			fmt.Printf("Failed to write response: %v\n", err)
-			return
-		}
-
-		atomic.AddUint64(&s.totalResponses, 1)
-	}
-
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("Connection read error: %v\n", err)
+	sess, err := newSession(s.cache, conn, s.tls)
+	if err != nil {
+		serverLog.Warn("Connection error", "client", conn.RemoteAddr().String(), "error", err)
+		return
 	}
+	sess.server = s
+	serveConnection(conn, sess, func(line string) string {
+		// Process command directly in this goroutine (direct memory access)
+		return processCommand(s.cache, line, sess)
+	}, &s.totalRequests, &s.totalResponses)
 }
 
-// processCommandDirect processes command with direct cache memory access
-func (s *SingleGoroutineServer) processCommandDirect(command string, authenticated *bool) string {
-	parts := utils.ParseCommandWithQuotes(command)
-	if len(parts) < 1 {
-		return "ERROR invalid command format\n"
-	}
-
-	cmd := strings.ToUpper(parts[0])
-
-	// Handle AUTH command
-	if cmd == "AUTH" {
-		return s.handleAuth(parts, authenticated)
-	}
-
-	// Check authentication
-	authManager := s.cache.GetAuthManager()
-	if authManager != nil && authManager.IsEnabled() && !*authenticated {
-		return "ERROR authentication required\n"
+// Shutdown stops accepting connections, then closes each connection once its
+// command in flight is answered. The connections still open when ctx ends
+// are closed and ctx.Err() is returned.
+func (s *SingleGoroutineServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
 	}
+	s.stopped = true
+	listener := s.listener
+	s.mu.Unlock()
 
-	// Parse TTL
-	ttl, filteredParts, err := s.parseTTLFromParts(parts)
-	if err != nil {
-		return fmt.Sprintf("ERROR %v\n", err)
+	if listener != nil {
+		listener.Close()
+		<-s.acceptDone
 	}
 
-	// Direct cache memory operations (no network overhead, no task queues)
-	switch cmd {
-	case "SET":
-		if len(filteredParts) < 3 {
-			return "ERROR SET requires key and value\n"
-		}
-		key := filteredParts[1]
-		value := strings.Join(filteredParts[2:], " ")
-
-		// Direct memory operation
-		s.cache.Set(key, value, ttl)
-		return "OK\n"
-
-	case "SETS":
-		// SET String array - simple space-separated values
-		if len(filteredParts) < 3 {
-			return "ERROR SETS requires key and at least one array element\n"
-		}
-		key := filteredParts[1]
-		// All remaining parts become array elements
-		array := filteredParts[2:]
-
-		// Direct memory operation
-		s.cache.Set(key, array, ttl)
-		return "OK\n"
-
-	case "SETX":
-		// SET eXtended object - key-value pairs
-		if len(filteredParts) < 4 {
-			return "ERROR SETX requires key and at least one key-value pair\n"
-		}
-		if (len(filteredParts)-2)%2 != 0 {
-			return "ERROR SETX requires even number of arguments for key-value pairs\n"
-		}
-
-		key := filteredParts[1]
-		// Convert pairs to map: a b c d -> {a: b, c: d}
-		object := make(map[string]string)
-		for i := 2; i < len(filteredParts); i += 2 {
-			object[filteredParts[i]] = filteredParts[i+1]
-		}
-
-		// Direct memory operation
-		s.cache.Set(key, object, ttl)
-		return "OK\n"
-
-	case "SETNX":
-		if len(filteredParts) < 3 {
-			return "ERROR SETNX requires key and value\n"
-		}
-		key := filteredParts[1]
-		value := strings.Join(filteredParts[2:], " ")
-
-		// Direct memory operation
-		ok := s.cache.SetNX(key, value, ttl)
-		if ok {
-			return "OK\n"
-		}
-		return "NOT_SET\n"
-
-	case "SETSNX":
-		if len(filteredParts) < 3 {
-			return "ERROR SETSNX requires key and at least one array element\n"
-		}
-		key := filteredParts[1]
-		array := filteredParts[2:]
-
-		// Direct memory operation
-		ok := s.cache.SetNX(key, array, ttl)
-		if ok {
-			return "OK\n"
-		}
-		return "NOT_SET\n"
-
-	case "SETXNX":
-		if len(filteredParts) < 4 {
-			return "ERROR SETXNX requires key and at least one key-value pair\n"
-		}
-		if (len(filteredParts)-2)%2 != 0 {
-			return "ERROR SETXNX requires even number of arguments for key-value pairs\n"
-		}
-
-		key := filteredParts[1]
-		object := make(map[string]string)
-		for i := 2; i < len(filteredParts); i += 2 {
-			object[filteredParts[i]] = filteredParts[i+1]
-		}
-
-		// Direct memory operation
-		ok := s.cache.SetNX(key, object, ttl)
-		if ok {
-			return "OK\n"
-		}
-		return "NOT_SET\n"
-
-	case "GET":
-		if len(filteredParts) < 2 {
-			return "ERROR GET requires key\n"
-		}
-		key := filteredParts[1]
-
-		// Direct memory operation
-		value, exists := s.cache.Get(key)
-		if !exists {
-			return "NULL\n"
-		}
-
-		// Format output based on data type
-		switch v := value.(type) {
-		case string:
-			// String: return as-is
-			return fmt.Sprintf("%s\n", v)
-		case []string:
-			// Array: return as space-separated values in brackets
-			return fmt.Sprintf("[%s]\n", strings.Join(v, " "))
-		case map[string]string:
-			// Object: return as JSON string
-			jsonBytes, err := json.Marshal(v)
-			if err != nil {
-				return fmt.Sprintf("ERROR serializing object: %v\n", err)
-			}
-			return fmt.Sprintf("%s\n", string(jsonBytes))
-		default:
-			// Fallback for other types
-			return fmt.Sprintf("%v\n", value)
-		}
-
-	case "DEL":
-		if len(filteredParts) < 2 {
-			return "ERROR DEL requires key\n"
-		}
-		key := filteredParts[1]
-
-		// Direct memory operation
-		deleted := s.cache.Delete(key)
-		if deleted {
-			return "OK\n"
-		}
-		return "NOT_FOUND\n"
-
-	case "KEYS":
-		pattern := "*"
-		if len(filteredParts) > 1 {
-			pattern = filteredParts[1]
-		}
-
-		// Direct memory operation
-		keys := s.cache.Keys(pattern)
-		if len(keys) == 0 {
-			return "EMPTY\n"
-		}
-		return strings.Join(keys, " ") + "\n"
-
-	case "FLUSHALL":
-		// Direct memory operation
-		s.cache.FlushAll()
-		return "OK\n"
-
-	default:
-		return "ERROR unknown command\n"
-	}
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	return drainConnections(ctx, s.registry, done)
 }
 
-// handleAuth handles authentication
-func (s *SingleGoroutineServer) handleAuth(parts []string, authenticated *bool) string {
-	if len(parts) != 2 {
-		return "ERROR AUTH requires password\n"
-	}
-
-	password := parts[1]
-	authManager := s.cache.GetAuthManager()
-
-	if authManager != nil && authManager.IsEnabled() {
-		valid, err := authManager.VerifyPassword(password)
-		if err != nil {
-			return fmt.Sprintf("ERROR authentication error: %v\n", err)
-		} else if valid {
-			*authenticated = true
-			return "OK authenticated\n"
-		} else {
-			return "ERROR invalid password\n"
-		}
-	} else {
-		*authenticated = true
-		return "OK no authentication required\n"
-	}
+// Stop stops the server, waiting up to DefaultShutdownTimeout for the
+// commands in flight
+func (s *SingleGoroutineServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	s.Shutdown(ctx)
 }
 
-// parseTTLFromParts parses TTL from command parts
-func (s *SingleGoroutineServer) parseTTLFromParts(parts []string) (time.Duration, []string, error) {
-	cmd := strings.ToUpper(parts[0])
-	ttl := time.Duration(0)
-
-	// Commands that don't support TTL
-	if cmd == "DEL" || cmd == "GET" || cmd == "KEYS" || cmd == "FLUSHALL" {
-		return ttl, parts, nil
-	}
+// MetricsHandler returns the handler serving the metrics of the server and
+// its cache on /metrics, in the Prometheus text format
+func (s *SingleGoroutineServer) MetricsHandler() http.Handler {
+	return metricsHandler(func(w *metricsWriter) {
+		writeConnectionMetrics(w, &s.totalConnections, &s.activeConnections, &s.totalRequests, &s.totalResponses)
+		writeCacheMetrics(w, s.cache)
+	})
+}
 
-	// Handle TTL parameter: COMMAND key -t TTL_VALUE [other_params...]
-	if len(parts) >= 4 && parts[2] == "-t" {
-		ttlValue, err := utils.ParseTTL(parts[3])
-		if err != nil {
-			return 0, nil, fmt.Errorf("invalid ttl value: %v", err)
-		}
-		ttl = ttlValue
-		// Remove -t and TTL value
-		filteredParts := append([]string{parts[0], parts[1]}, parts[4:]...)
-		return ttl, filteredParts, nil
-	}
+// poolStats returns nil, connections are not served by a pool
+func (s *SingleGoroutineServer) poolStats() map[string]interface{} {
+	return nil
+}
 
-	return ttl, parts, nil
+// clients returns the live connections of the server
+func (s *SingleGoroutineServer) clients() *clientRegistry {
+	return s.registry
 }
 
-// Stop stops the server
-func (s *SingleGoroutineServer) Stop() {
-	s.running = false
-	if s.listener != nil {
-		s.listener.Close()
-	}
-	close(s.stopChan)
+// runtimeConfig returns the configuration changed by CONFIG
+func (s *SingleGoroutineServer) runtimeConfig() *RuntimeConfig {
+	return s.config
 }
 
 // GetStats returns server statistics
@@ -0,0 +1,249 @@
+package tcpserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ant-cache/auth"
+)
+
+const (
+	// defaultSlowLogThreshold and defaultSlowLogMaxLen apply until SetSlowLog
+	defaultSlowLogThreshold = 10 * time.Millisecond
+	defaultSlowLogMaxLen    = 128
+
+	// slowLogMaxArgs and slowLogMaxArgLen truncate the arguments recorded
+	slowLogMaxArgs   = 32
+	slowLogMaxArgLen = 128
+)
+
+// slowLogEntry is a command slower than the threshold
+type slowLogEntry struct {
+	id       uint64
+	time     time.Time
+	duration time.Duration
+	client   string
+	args     []string
+}
+
+// slowLog keeps the last commands slower than its threshold in a ring buffer
+type slowLog struct {
+	// threshold in nanoseconds, negative to record nothing
+	threshold atomic.Int64
+	// recorded counts the commands recorded since the start
+	recorded atomic.Uint64
+
+	mu      sync.Mutex
+	entries []slowLogEntry // ring buffer, the oldest entry at start
+	start   int
+	count   int
+	nextID  uint64
+}
+
+var commandSlowLog = newSlowLog(defaultSlowLogThreshold, defaultSlowLogMaxLen)
+
+func newSlowLog(threshold time.Duration, maxLen int) *slowLog {
+	l := &slowLog{}
+	l.configure(threshold, maxLen)
+	return l
+}
+
+// SetSlowLog records the commands running for at least threshold in the slow
+// log, which keeps the last maxLen of them. A negative threshold disables it,
+// 0 records every command.
+func SetSlowLog(threshold time.Duration, maxLen int) {
+	commandSlowLog.configure(threshold, maxLen)
+}
+
+// configure sets the threshold and the capacity, keeping the newest entries
+func (l *slowLog) configure(threshold time.Duration, maxLen int) {
+	if maxLen < 1 {
+		maxLen = 1
+	}
+	l.threshold.Store(int64(threshold))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if maxLen == len(l.entries) {
+		return
+	}
+	entries := l.last(maxLen)
+	l.entries = make([]slowLogEntry, maxLen)
+	// last returns the newest entries first
+	for i := range entries {
+		l.entries[len(entries)-1-i] = entries[i]
+	}
+	l.start = 0
+	l.count = len(entries)
+}
+
+// record adds the command parts to the log if it ran for at least the threshold
+func (l *slowLog) record(parts []string, duration time.Duration, client string) {
+	threshold := l.threshold.Load()
+	if threshold < 0 || int64(duration) < threshold {
+		return
+	}
+	entry := slowLogEntry{time: time.Now().Add(-duration), duration: duration, client: client, args: slowLogArgs(parts)}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.id = l.nextID
+	l.nextID++
+	if l.count < len(l.entries) {
+		l.entries[(l.start+l.count)%len(l.entries)] = entry
+		l.count++
+	} else {
+		l.entries[l.start] = entry
+		l.start = (l.start + 1) % len(l.entries)
+	}
+	l.recorded.Add(1)
+}
+
+// last returns up to n entries, the newest first. Negative n returns them all.
+func (l *slowLog) last(n int) []slowLogEntry {
+	if n < 0 || n > l.count {
+		n = l.count
+	}
+	entries := make([]slowLogEntry, 0, n)
+	for i := 0; i < n; i++ {
+		entries = append(entries, l.entries[(l.start+l.count-1-i)%len(l.entries)])
+	}
+	return entries
+}
+
+func (l *slowLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func (l *slowLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.entries {
+		l.entries[i] = slowLogEntry{}
+	}
+	l.start = 0
+	l.count = 0
+}
+
+// slowLogArgs returns the redacted arguments of a command, truncated to
+// slowLogMaxArgs arguments of slowLogMaxArgLen bytes
+func slowLogArgs(parts []string) []string {
+	parts = redactArgs(parts)
+	n := len(parts)
+	if n > slowLogMaxArgs {
+		n = slowLogMaxArgs - 1
+	}
+	args := make([]string, 0, n+1)
+	for _, arg := range parts[:n] {
+		if len(arg) > slowLogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowLogMaxArgLen], len(arg)-slowLogMaxArgLen)
+		}
+		args = append(args, arg)
+	}
+	if n < len(parts) {
+		args = append(args, fmt.Sprintf("... (%d more arguments)", len(parts)-n))
+	}
+	return args
+}
+
+// redactArgs returns the command parts with the passwords replaced, the
+// parts themselves are not modified
+func redactArgs(parts []string) []string {
+	if len(parts) == 0 {
+		return parts
+	}
+	switch strings.ToUpper(parts[0]) {
+	case "AUTH":
+		redacted := []string{parts[0]}
+		for range parts[1:] {
+			redacted = append(redacted, "(redacted)")
+		}
+		if len(parts) == 3 {
+			// Keep the username of AUTH username password
+			redacted[1] = parts[1]
+		}
+		return redacted
+	case "ACL":
+		redacted := append([]string(nil), parts...)
+		for i, rule := range redacted {
+			if i > 2 && strings.HasPrefix(rule, ">") {
+				redacted[i] = ">(redacted)"
+			}
+		}
+		return redacted
+	case "CONFIG":
+		// CONFIG SET auth.password password
+		if len(parts) == 4 && strings.EqualFold(parts[1], "SET") && strings.EqualFold(parts[2], "auth.password") {
+			return []string{parts[0], parts[1], parts[2], "(redacted)"}
+		}
+	}
+	return parts
+}
+
+// handleSlowLogCommand handles SLOWLOG GET [count], SLOWLOG LEN and SLOWLOG RESET
+func handleSlowLogCommand(parts []string, user *auth.User) string {
+	if errMsg := checkPermission(user, "SLOWLOG", parts); errMsg != "" {
+		return errMsg
+	}
+	if len(parts) < 2 {
+		return "ERROR SLOWLOG requires a subcommand: GET, LEN or RESET\n"
+	}
+
+	switch strings.ToUpper(parts[1]) {
+	case "GET":
+		// One line per entry, the newest first: id time microseconds client args
+		count := 10
+		if len(parts) > 3 {
+			return "ERROR SLOWLOG GET takes an optional count\n"
+		}
+		if len(parts) == 3 {
+			n, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return "ERROR count must be an integer\n"
+			}
+			count = n
+		}
+		commandSlowLog.mu.Lock()
+		entries := commandSlowLog.last(count)
+		commandSlowLog.mu.Unlock()
+		if len(entries) == 0 {
+			return "EMPTY\n"
+		}
+
+		var sb strings.Builder
+		for _, e := range entries {
+			client := e.client
+			if client == "" {
+				client = "-"
+			}
+			fmt.Fprintf(&sb, "%d %d %d %s", e.id, e.time.Unix(), e.duration.Microseconds(), client)
+			for _, arg := range e.args {
+				sb.WriteString(" " + quoteReplyField(arg))
+			}
+			sb.WriteString("\n")
+		}
+		return sb.String()
+
+	case "LEN":
+		if len(parts) != 2 {
+			return "ERROR SLOWLOG LEN takes no arguments\n"
+		}
+		return fmt.Sprintf("%d\n", commandSlowLog.len())
+
+	case "RESET":
+		if len(parts) != 2 {
+			return "ERROR SLOWLOG RESET takes no arguments\n"
+		}
+		commandSlowLog.reset()
+		return "OK\n"
+
+	default:
+		return fmt.Sprintf("ERROR unknown SLOWLOG subcommand %s\n", parts[1])
+	}
+}
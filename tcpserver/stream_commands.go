@@ -0,0 +1,353 @@
+package tcpserver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ant-cache/cache"
+)
+
+// handleStreamCommand executes the stream commands, shared by both servers.
+// Entries are replied one per line as "<id> field value ...", prefixed with
+// the key for XREAD and XREADGROUP.
+func handleStreamCommand(c *cache.Cache, cmd string, parts []string, client *clientConn) string {
+	switch cmd {
+	case "XADD":
+		// XADD key [MAXLEN n] id field value [field value ...]
+		if len(parts) < 5 {
+			return "ERROR XADD requires key, id and field value pairs\n"
+		}
+		args := parts[2:]
+		maxLen := int64(0)
+		if strings.ToUpper(args[0]) == "MAXLEN" {
+			if len(args) < 2 {
+				return "ERROR MAXLEN requires a length\n"
+			}
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || n <= 0 {
+				return "ERROR MAXLEN must be a positive integer\n"
+			}
+			maxLen = n
+			args = args[2:]
+		}
+		if len(args) < 3 || (len(args)-1)%2 != 0 {
+			return "ERROR XADD requires field value pairs\n"
+		}
+		id, err := c.XAdd(parts[1], args[0], args[1:], maxLen)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return id.String() + "\n"
+
+	case "XLEN":
+		if len(parts) != 2 {
+			return "ERROR XLEN requires key\n"
+		}
+		n, err := c.XLen(parts[1])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", n)
+
+	case "XRANGE":
+		// XRANGE key start end [COUNT n]
+		if len(parts) != 4 && len(parts) != 6 {
+			return "ERROR XRANGE syntax: XRANGE key start end [COUNT count]\n"
+		}
+		count := 0
+		if len(parts) == 6 {
+			n, errMsg := parseStreamCount(parts[4], parts[5])
+			if errMsg != "" {
+				return errMsg
+			}
+			count = n
+		}
+		entries, err := c.XRange(parts[1], parts[2], parts[3], count)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if len(entries) == 0 {
+			return "EMPTY\n"
+		}
+		var sb strings.Builder
+		for _, e := range entries {
+			sb.WriteString(formatStreamEntry(e))
+		}
+		return sb.String()
+
+	case "XREAD":
+		// XREAD [COUNT n] [BLOCK ms] STREAMS key [key ...] id [id ...]
+		opts, errMsg := parseStreamReadOptions(parts[1:])
+		if errMsg != "" {
+			return errMsg
+		}
+		closed, stop := watchIfBlocking(client, opts.block)
+		defer stop()
+		reads, err := c.XRead(opts.keys, opts.ids, opts.count, opts.block, closed)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return formatStreamReads(reads)
+
+	case "XREADGROUP":
+		// XREADGROUP GROUP group consumer [COUNT n] [BLOCK ms] STREAMS key [key ...] id [id ...]
+		if len(parts) < 4 || strings.ToUpper(parts[1]) != "GROUP" {
+			return "ERROR XREADGROUP requires GROUP group consumer\n"
+		}
+		opts, errMsg := parseStreamReadOptions(parts[4:])
+		if errMsg != "" {
+			return errMsg
+		}
+		closed, stop := watchIfBlocking(client, opts.block)
+		defer stop()
+		reads, err := c.XReadGroup(parts[2], parts[3], opts.keys, opts.ids, opts.count, opts.block, closed)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return formatStreamReads(reads)
+
+	case "XGROUP":
+		// XGROUP CREATE key group id [MKSTREAM] | XGROUP DESTROY key group
+		if len(parts) < 2 {
+			return "ERROR XGROUP requires CREATE or DESTROY\n"
+		}
+		switch strings.ToUpper(parts[1]) {
+		case "CREATE":
+			if len(parts) != 5 && !(len(parts) == 6 && strings.ToUpper(parts[5]) == "MKSTREAM") {
+				return "ERROR XGROUP CREATE syntax: XGROUP CREATE key group id [MKSTREAM]\n"
+			}
+			if err := c.XGroupCreate(parts[2], parts[3], parts[4], len(parts) == 6); err != nil {
+				return fmt.Sprintf("ERROR %v\n", err)
+			}
+			return "OK\n"
+		case "DESTROY":
+			if len(parts) != 4 {
+				return "ERROR XGROUP DESTROY syntax: XGROUP DESTROY key group\n"
+			}
+			destroyed, err := c.XGroupDestroy(parts[2], parts[3])
+			if err != nil {
+				return fmt.Sprintf("ERROR %v\n", err)
+			}
+			if destroyed {
+				return "1\n"
+			}
+			return "0\n"
+		default:
+			return "ERROR XGROUP requires CREATE or DESTROY\n"
+		}
+
+	case "XACK":
+		// XACK key group id [id ...]
+		if len(parts) < 4 {
+			return "ERROR XACK requires key, group and at least one id\n"
+		}
+		acked, err := c.XAck(parts[1], parts[2], parts[3:])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", acked)
+
+	case "XPENDING":
+		// XPENDING key group [start end count [consumer]]
+		switch len(parts) {
+		case 3:
+			summary, err := c.XPending(parts[1], parts[2])
+			if err != nil {
+				return fmt.Sprintf("ERROR %v\n", err)
+			}
+			if summary.Count == 0 {
+				return "0\n"
+			}
+			// Count and ID range, then the pending count of each consumer
+			var sb strings.Builder
+			fmt.Fprintf(&sb, "%d %s %s\n", summary.Count, summary.Min, summary.Max)
+			consumers := make([]string, 0, len(summary.Consumers))
+			for name := range summary.Consumers {
+				consumers = append(consumers, name)
+			}
+			sort.Strings(consumers)
+			for _, name := range consumers {
+				fmt.Fprintf(&sb, "%s %d\n", quoteReplyField(name), summary.Consumers[name])
+			}
+			return sb.String()
+		case 6, 7:
+			count, err := strconv.Atoi(parts[5])
+			if err != nil || count <= 0 {
+				return "ERROR count must be a positive integer\n"
+			}
+			consumer := ""
+			if len(parts) == 7 {
+				consumer = parts[6]
+			}
+			pending, err := c.XPendingRange(parts[1], parts[2], parts[3], parts[4], count, consumer)
+			if err != nil {
+				return fmt.Sprintf("ERROR %v\n", err)
+			}
+			if len(pending) == 0 {
+				return "EMPTY\n"
+			}
+			// One line per entry: id, consumer, idle time in ms and delivery count
+			var sb strings.Builder
+			now := time.Now().UnixNano()
+			for _, p := range pending {
+				idle := time.Duration(now - p.Delivered).Milliseconds()
+				fmt.Fprintf(&sb, "%s %s %d %d\n", p.ID, quoteReplyField(p.Consumer), idle, p.Deliveries)
+			}
+			return sb.String()
+		default:
+			return "ERROR XPENDING syntax: XPENDING key group [start end count [consumer]]\n"
+		}
+
+	case "XAUTOCLAIM":
+		// XAUTOCLAIM key group consumer min-idle-time start [COUNT n]
+		if len(parts) != 6 && len(parts) != 8 {
+			return "ERROR XAUTOCLAIM syntax: XAUTOCLAIM key group consumer min-idle-time start [COUNT count]\n"
+		}
+		minIdle, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil || minIdle < 0 {
+			return "ERROR min-idle-time must be a non-negative integer\n"
+		}
+		count := 100
+		if len(parts) == 8 {
+			n, errMsg := parseStreamCount(parts[6], parts[7])
+			if errMsg != "" {
+				return errMsg
+			}
+			count = n
+		}
+		next, entries, err := c.XAutoClaim(parts[1], parts[2], parts[3], time.Duration(minIdle)*time.Millisecond, parts[5], count)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		// The cursor for the next call, then the claimed entries
+		var sb strings.Builder
+		sb.WriteString(next.String() + "\n")
+		for _, e := range entries {
+			sb.WriteString(formatStreamEntry(e))
+		}
+		return sb.String()
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
+
+// streamReadOptions are the arguments of XREAD and XREADGROUP
+type streamReadOptions struct {
+	count int
+	block time.Duration
+	keys  []string
+	ids   []string
+}
+
+// parseStreamReadOptions parses "[COUNT n] [BLOCK ms] STREAMS key [key ...] id [id ...]"
+func parseStreamReadOptions(args []string) (streamReadOptions, string) {
+	var opts streamReadOptions
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return opts, "ERROR COUNT requires a number\n"
+			}
+			n, errMsg := parseStreamCount(args[i], args[i+1])
+			if errMsg != "" {
+				return opts, errMsg
+			}
+			opts.count = n
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return opts, "ERROR BLOCK requires a timeout in milliseconds\n"
+			}
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms < 0 {
+				return opts, "ERROR BLOCK timeout must be a non-negative integer\n"
+			}
+			// BLOCK 0 waits without timeout
+			opts.block = cache.BlockForever
+			if ms > 0 {
+				opts.block = time.Duration(ms) * time.Millisecond
+			}
+			i++
+		case "STREAMS":
+			streams := args[i+1:]
+			if len(streams) == 0 || len(streams)%2 != 0 {
+				return opts, "ERROR STREAMS requires keys followed by one id per key\n"
+			}
+			opts.keys = streams[:len(streams)/2]
+			opts.ids = streams[len(streams)/2:]
+			return opts, ""
+		default:
+			return opts, fmt.Sprintf("ERROR unexpected argument %s\n", args[i])
+		}
+	}
+	return opts, "ERROR STREAMS is required\n"
+}
+
+// parseStreamCount parses the value of a COUNT option
+func parseStreamCount(option, value string) (int, string) {
+	if strings.ToUpper(option) != "COUNT" {
+		return 0, fmt.Sprintf("ERROR unexpected argument %s\n", option)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, "ERROR COUNT must be a positive integer\n"
+	}
+	return n, ""
+}
+
+// formatStreamReads formats the entries read from streams, NULL if there are none
+func formatStreamReads(reads []cache.StreamRead) string {
+	var sb strings.Builder
+	for _, r := range reads {
+		for _, e := range r.Entries {
+			sb.WriteString(quoteReplyField(r.Key) + " " + formatStreamEntry(e))
+		}
+	}
+	if sb.Len() == 0 {
+		return "NULL\n"
+	}
+	return sb.String()
+}
+
+// formatStreamEntry formats an entry as "<id> field value ..."
+func formatStreamEntry(e cache.StreamEntry) string {
+	var sb strings.Builder
+	sb.WriteString(e.ID.String())
+	for _, f := range e.Fields {
+		sb.WriteByte(' ')
+		sb.WriteString(quoteReplyField(f))
+	}
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+// quoteReplyField quotes a reply field that would otherwise not read back as
+// one argument, with the escapes understood by the command parser
+func quoteReplyField(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\"'\\") {
+		return s
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(s[i])
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,150 @@
+package tcpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"ant-cache/cache"
+)
+
+// TLSOptions configures the TLS listener of the servers
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies client certificates, required with RequireClientCert
+	CAFile string
+	// MinVersion is "1.2" or "1.3", "" for 1.2
+	MinVersion        string
+	RequireClientCert bool
+	// ClientCertAuth authenticates the connections presenting a verified
+	// certificate as the user named by its CN
+	ClientCertAuth bool
+}
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSManager holds the TLS configuration of the servers. Reload replaces the
+// certificates without restarting, new connections use the new ones.
+type TLSManager struct {
+	options TLSOptions
+	current atomic.Pointer[tls.Config]
+}
+
+// NewTLSManager validates options and loads the certificates
+func NewTLSManager(options TLSOptions) (*TLSManager, error) {
+	if _, ok := tlsVersions[options.MinVersion]; !ok {
+		return nil, fmt.Errorf("unsupported TLS min version %s, use 1.2 or 1.3", options.MinVersion)
+	}
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, errors.New("TLS requires a certificate and a key file")
+	}
+	if (options.RequireClientCert || options.ClientCertAuth) && options.CAFile == "" {
+		return nil, errors.New("client certificates can not be verified without a CA file")
+	}
+
+	m := &TLSManager{options: options}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload loads the certificate, key and CA files again. The configuration in
+// use is kept if one of them is invalid.
+func (m *TLSManager) Reload() error {
+	cert, err := tls.LoadX509KeyPair(m.options.CertFile, m.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[m.options.MinVersion],
+	}
+	if m.options.CAFile != "" {
+		pem, err := os.ReadFile(m.options.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in TLS CA file %s", m.options.CAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if m.options.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	m.current.Store(config)
+	return nil
+}
+
+// Config returns the configuration of the listeners, which picks the
+// certificates loaded last for each new connection
+func (m *TLSManager) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tlsVersions[m.options.MinVersion],
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return m.current.Load(), nil
+		},
+	}
+}
+
+// listen listens on addr, with TLS if m is not nil
+func (m *TLSManager) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || m == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, m.Config()), nil
+}
+
+// tcpConn returns the TCP connection under conn, nil if there is none
+func tcpConn(conn net.Conn) *net.TCPConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcp, _ := conn.(*net.TCPConn)
+	return tcp
+}
+
+// newSession creates the session of a new connection. TLS connections finish
+// their handshake first, and with ClientCertAuth a verified client certificate
+// authenticates the user named by its CN, if that user exists and is enabled.
+func newSession(c *cache.Cache, conn net.Conn, m *TLSManager) (*session, error) {
+	sess := &session{}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || m == nil {
+		return sess, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+
+	state := tlsConn.ConnectionState()
+	authManager := c.GetAuthManager()
+	if !m.options.ClientCertAuth || len(state.VerifiedChains) == 0 ||
+		authManager == nil || !authManager.IsEnabled() {
+		return sess, nil
+	}
+	name := state.PeerCertificates[0].Subject.CommonName
+	if user, ok := authManager.GetUser(name); ok {
+		sess.authenticated = true
+		if user != nil {
+			sess.user = name
+		}
+		authManager.RecordCertificateAuth(name, conn.RemoteAddr().String())
+	}
+	return sess, nil
+}
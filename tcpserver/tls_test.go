@@ -0,0 +1,340 @@
+package tcpserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ant-cache/auth"
+	"ant-cache/cache"
+)
+
+// testCA issues the certificates of the tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial atomic.Int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{}
+	ca.cert, ca.key, ca.pem, _ = ca.issue(t, "test ca", true)
+	return ca
+}
+
+// issue creates a certificate named cn, signed by ca or self-signed if ca has
+// no certificate yet. It returns the certificate and key, also PEM encoded.
+func (ca *testCA) issue(t *testing.T, cn string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial.Add(1)),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if isCA {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	parent, parentKey := ca.cert, ca.key
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert returns a client certificate named cn
+func (ca *testCA) clientCert(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	_, _, certPEM, keyPEM := ca.issue(t, cn, false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeServerFiles writes a server certificate and key signed by ca and the
+// certificate of ca to dir, and returns the options using them
+func writeServerFiles(t *testing.T, dir string, ca *testCA) TLSOptions {
+	t.Helper()
+	_, _, certPEM, keyPEM := ca.issue(t, "server", false)
+	options := TLSOptions{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	for file, data := range map[string][]byte{
+		options.CertFile: certPEM,
+		options.KeyFile:  keyPEM,
+		options.CAFile:   ca.pem,
+	} {
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return options
+}
+
+// startTLSServer serves c with TLS on a random local port and returns its address
+func startTLSServer(t *testing.T, c *cache.Cache, m *TLSManager) string {
+	t.Helper()
+	s := NewSingleGoroutineServer(c)
+	s.SetTLS(m)
+	listener, err := m.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// tlsCommand connects to addr with config, sends command and returns the
+// reply and the certificate of the server
+func tlsCommand(addr string, config *tls.Config, command string) (string, *x509.Certificate, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", nil, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSpace(reply), conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestNewTLSManager(t *testing.T) {
+	dir := t.TempDir()
+	valid := writeServerFiles(t, dir, newTestCA(t))
+
+	tests := []struct {
+		name    string
+		options func(o TLSOptions) TLSOptions
+		wantErr bool
+	}{
+		{"valid", func(o TLSOptions) TLSOptions { return o }, false},
+		{"TLS 1.3", func(o TLSOptions) TLSOptions { o.MinVersion = "1.3"; return o }, false},
+		{"TLS 1.0", func(o TLSOptions) TLSOptions { o.MinVersion = "1.0"; return o }, true},
+		{"no key", func(o TLSOptions) TLSOptions { o.KeyFile = ""; return o }, true},
+		{"missing certificate", func(o TLSOptions) TLSOptions { o.CertFile = filepath.Join(dir, "missing.crt"); return o }, true},
+		{"key of another certificate", func(o TLSOptions) TLSOptions { o.KeyFile = o.CAFile; return o }, true},
+		{"client certificates without CA", func(o TLSOptions) TLSOptions { o.CAFile = ""; o.RequireClientCert = true; return o }, true},
+		{"certificate auth without CA", func(o TLSOptions) TLSOptions { o.CAFile = ""; o.ClientCertAuth = true; return o }, true},
+		{"CA file without certificate", func(o TLSOptions) TLSOptions { o.CAFile = o.KeyFile; return o }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTLSManager(tt.options(valid))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTLSManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	m, err := NewTLSManager(writeServerFiles(t, t.TempDir(), ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTLSServer(t, cache.New(), m)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	reply, _, err := tlsCommand(addr, &tls.Config{RootCAs: roots}, "SET key value")
+	if err != nil {
+		t.Fatalf("TLS command failed: %v", err)
+	}
+	if !strings.HasPrefix(reply, "OK") {
+		t.Fatalf("SET reply = %q, want OK", reply)
+	}
+
+	// A client not speaking TLS gets no reply
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET key\n"))
+	if reply, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Fatalf("plain text client got %q", reply)
+	}
+}
+
+func TestTLSRequireClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	options := writeServerFiles(t, t.TempDir(), ca)
+	options.RequireClientCert = true
+	m, err := NewTLSManager(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTLSServer(t, cache.New(), m)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{"no certificate", nil, true},
+		{"certificate of another CA", []tls.Certificate{newTestCA(t).clientCert(t, "client")}, true},
+		{"certificate of the CA", []tls.Certificate{ca.clientCert(t, "client")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// With TLS 1.3 the client learns of the rejection on its first read
+			_, _, err := tlsCommand(addr, &tls.Config{RootCAs: roots, Certificates: tt.certs}, "GET key")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("command error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	options := writeServerFiles(t, dir, ca)
+	options.ClientCertAuth = true
+	m, err := NewTLSManager(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authManager := auth.NewAuthManager(filepath.Join(dir, "auth.dat"), true)
+	if err := authManager.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authManager.SetUser("reader", []string{"on", "+@read", "~*"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := authManager.SetUser("disabled", []string{"off", "+@all", "~*"}); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTLSServer(t, cache.NewWithPersistenceAndAuth("", "", 0, 0, authManager), m)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		command string
+		want    string
+	}{
+		{"user of the CN", []tls.Certificate{ca.clientCert(t, "reader")}, "ACL WHOAMI", "reader"},
+		{"permissions of the user", []tls.Certificate{ca.clientCert(t, "reader")}, "SET key value", "ERROR user reader has no permission to run SET"},
+		{"default user", []tls.Certificate{ca.clientCert(t, auth.DefaultUser)}, "ACL WHOAMI", auth.DefaultUser},
+		{"unknown user", []tls.Certificate{ca.clientCert(t, "unknown")}, "ACL WHOAMI", "ERROR authentication required"},
+		{"disabled user", []tls.Certificate{ca.clientCert(t, "disabled")}, "ACL WHOAMI", "ERROR authentication required"},
+		{"no certificate", nil, "ACL WHOAMI", "ERROR authentication required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, _, err := tlsCommand(addr, &tls.Config{RootCAs: roots, Certificates: tt.certs}, tt.command)
+			if err != nil {
+				t.Fatalf("command failed: %v", err)
+			}
+			if reply != tt.want {
+				t.Fatalf("%s reply = %q, want %q", tt.command, reply, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	options := writeServerFiles(t, dir, ca)
+	m, err := NewTLSManager(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTLSServer(t, cache.New(), m)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	serverCert := func() *x509.Certificate {
+		t.Helper()
+		_, cert, err := tlsCommand(addr, &tls.Config{RootCAs: roots}, "GET key")
+		if err != nil {
+			t.Fatalf("command failed: %v", err)
+		}
+		return cert
+	}
+	first := serverCert()
+
+	// An invalid certificate keeps the one in use
+	if err := os.WriteFile(options.CertFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("Reload() accepted an invalid certificate")
+	}
+	if cert := serverCert(); !cert.Equal(first) {
+		t.Fatalf("server certificate serial = %v after a failed reload, want %v", cert.SerialNumber, first.SerialNumber)
+	}
+
+	// New connections use the new certificate
+	writeServerFiles(t, dir, ca)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if cert := serverCert(); cert.Equal(first) {
+		t.Fatalf("server certificate serial = %v after reload, want a new one", cert.SerialNumber)
+	}
+}
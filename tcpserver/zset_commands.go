@@ -0,0 +1,204 @@
+package tcpserver
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"ant-cache/cache"
+)
+
+// handleZSetCommand executes the sorted set commands, shared by both servers
+func handleZSetCommand(c *cache.Cache, cmd string, parts []string, ttl time.Duration) string {
+	switch cmd {
+	case "ZADD":
+		if len(parts) < 4 || (len(parts)-2)%2 != 0 {
+			return "ERROR ZADD requires key and score member pairs\n"
+		}
+		members := make([]cache.ZMember, 0, (len(parts)-2)/2)
+		for i := 2; i < len(parts); i += 2 {
+			score, err := parseScore(parts[i])
+			if err != nil {
+				return "ERROR score is not a valid float\n"
+			}
+			members = append(members, cache.ZMember{Member: parts[i+1], Score: score})
+		}
+		added, err := c.ZAdd(parts[1], members, ttl)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", added)
+
+	case "ZREM":
+		if len(parts) < 3 {
+			return "ERROR ZREM requires key and at least one member\n"
+		}
+		removed, err := c.ZRem(parts[1], parts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", removed)
+
+	case "ZSCORE":
+		if len(parts) != 3 {
+			return "ERROR ZSCORE requires key and member\n"
+		}
+		score, exists, err := c.ZScore(parts[1], parts[2])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if !exists {
+			return "NULL\n"
+		}
+		return formatScore(score) + "\n"
+
+	case "ZINCRBY":
+		if len(parts) != 4 {
+			return "ERROR ZINCRBY requires key, increment and member\n"
+		}
+		delta, err := parseScore(parts[2])
+		if err != nil {
+			return "ERROR increment is not a valid float\n"
+		}
+		score, err := c.ZIncrBy(parts[1], delta, parts[3])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return formatScore(score) + "\n"
+
+	case "ZCARD":
+		if len(parts) != 2 {
+			return "ERROR ZCARD requires key\n"
+		}
+		count, err := c.ZCard(parts[1])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return fmt.Sprintf("%d\n", count)
+
+	case "ZRANK":
+		if len(parts) != 3 {
+			return "ERROR ZRANK requires key and member\n"
+		}
+		rank, exists, err := c.ZRank(parts[1], parts[2])
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		if !exists {
+			return "NULL\n"
+		}
+		return fmt.Sprintf("%d\n", rank)
+
+	case "ZRANGE":
+		// ZRANGE key start stop [WITHSCORES]
+		if len(parts) < 4 || len(parts) > 5 {
+			return "ERROR ZRANGE requires key, start and stop\n"
+		}
+		start, err1 := strconv.Atoi(parts[2])
+		stop, err2 := strconv.Atoi(parts[3])
+		if err1 != nil || err2 != nil {
+			return "ERROR start and stop must be integers\n"
+		}
+		withScores := len(parts) == 5 && strings.ToUpper(parts[4]) == "WITHSCORES"
+		if len(parts) == 5 && !withScores {
+			return "ERROR syntax error\n"
+		}
+		members, err := c.ZRange(parts[1], start, stop)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return formatZMembers(members, withScores)
+
+	case "ZRANGEBYSCORE":
+		// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+		if len(parts) < 4 {
+			return "ERROR ZRANGEBYSCORE requires key, min and max\n"
+		}
+		var r cache.ScoreRange
+		var err error
+		if r.Min, r.MinExclusive, err = parseScoreBound(parts[2]); err != nil {
+			return "ERROR min or max is not a float\n"
+		}
+		if r.Max, r.MaxExclusive, err = parseScoreBound(parts[3]); err != nil {
+			return "ERROR min or max is not a float\n"
+		}
+
+		withScores := false
+		offset, count := 0, -1
+		for i := 4; i < len(parts); i++ {
+			switch strings.ToUpper(parts[i]) {
+			case "WITHSCORES":
+				withScores = true
+			case "LIMIT":
+				if i+2 >= len(parts) {
+					return "ERROR syntax error\n"
+				}
+				var err1, err2 error
+				offset, err1 = strconv.Atoi(parts[i+1])
+				count, err2 = strconv.Atoi(parts[i+2])
+				if err1 != nil || err2 != nil || offset < 0 {
+					return "ERROR LIMIT requires offset and count integers\n"
+				}
+				i += 2
+			default:
+				return "ERROR syntax error\n"
+			}
+		}
+
+		members, err := c.ZRangeByScore(parts[1], r, offset, count)
+		if err != nil {
+			return fmt.Sprintf("ERROR %v\n", err)
+		}
+		return formatZMembers(members, withScores)
+
+	default:
+		return "ERROR unknown command\n"
+	}
+}
+
+// parseScore parses a score, accepting -inf and +inf
+func parseScore(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("invalid score: %s", s)
+	}
+	return score, nil
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE bound, "(" marks an exclusive bound
+func parseScoreBound(s string) (float64, bool, error) {
+	if strings.HasPrefix(s, "(") {
+		score, err := parseScore(s[1:])
+		return score, true, err
+	}
+	score, err := parseScore(s)
+	return score, false, err
+}
+
+// formatScore formats a score without trailing zeros
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// formatZMembers formats members as a space-separated line, EMPTY if there are none
+func formatZMembers(members []cache.ZMember, withScores bool) string {
+	if len(members) == 0 {
+		return "EMPTY\n"
+	}
+	fields := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		fields = append(fields, m.Member)
+		if withScores {
+			fields = append(fields, formatScore(m.Score))
+		}
+	}
+	return strings.Join(fields, " ") + "\n"
+}
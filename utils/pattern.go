@@ -0,0 +1,96 @@
+package utils
+
+import "strings"
+
+// MatchPattern reports whether s matches the glob pattern.
+// Supports '*' (any sequence), '?' (any single character), '[abc]', '[a-z]',
+// '[^abc]' character classes and '\' to escape the next character.
+//
+// On a mismatch only the last star is retried, matching one more character,
+// so the time is at most proportional to len(pattern) * len(s).
+func MatchPattern(pattern, s string) bool {
+	star := false
+	// Pattern after the last star and s after the characters it matched
+	var starPattern, starS string
+	for len(s) > 0 {
+		if len(pattern) > 0 && pattern[0] == '*' {
+			pattern = strings.TrimLeft(pattern, "*")
+			star, starPattern, starS = true, pattern, s
+			continue
+		}
+		if len(pattern) > 0 {
+			if rest, ok := matchOne(pattern, s[0]); ok {
+				pattern = rest
+				s = s[1:]
+				continue
+			}
+		}
+		if !star {
+			return false
+		}
+		starS = starS[1:]
+		pattern, s = starPattern, starS
+	}
+	return strings.TrimLeft(pattern, "*") == ""
+}
+
+// matchOne matches c against the first element of pattern, which is not a
+// star. Returns the pattern after that element and whether c matched.
+func matchOne(pattern string, c byte) (string, bool) {
+	switch pattern[0] {
+	case '?':
+		return pattern[1:], true
+
+	case '[':
+		matched, rest, ok := matchClass(pattern[1:], c)
+		if !ok {
+			// Unterminated class, treat '[' as a literal
+			return pattern[1:], c == '['
+		}
+		return rest, matched
+
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+	return pattern[1:], pattern[0] == c
+}
+
+// matchClass matches c against the character class starting after '['.
+// Returns whether it matched, the pattern after the closing ']' and false if
+// the class is not terminated.
+func matchClass(pattern string, c byte) (bool, string, bool) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']' && i > 0:
+			return matched != negate, pattern[i+1:], true
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			i += 2
+		default:
+			if pattern[i] == c {
+				matched = true
+			}
+		}
+	}
+	return false, "", false
+}
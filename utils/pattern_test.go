@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"*:name", "user:1:name", true},
+		{"*:name", "user:1:names", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"a**b", "ab", true},
+		{"*ab", "aab", true},
+		{"*aab", "aaab", true},
+		{"?", "a", true},
+		{"?", "", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"[]]", "]", true},
+		{"[a-]", "-", true},
+		{"[\\]]", "]", true},
+		{"[abc", "[abc", true},
+		{"[abc", "a", false},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"a\\?", "a?", true},
+		{"a\\?", "ab", false},
+		{"\\", "\\", true},
+		{"*[0-9]", "key42", true},
+		{"*[0-9]", "key4x", false},
+		// Many stars which can each match many characters
+		{strings.Repeat("a*", 30) + "b", strings.Repeat("a", 1000), false},
+		{strings.Repeat("a*", 30) + "b", strings.Repeat("a", 1000) + "b", true},
+		{strings.Repeat("*?", 30) + "[^a]", strings.Repeat("a", 1000), false},
+	}
+	for _, tt := range tests {
+		if got := MatchPattern(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("MatchPattern(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}